@@ -0,0 +1,40 @@
+// The fake-openai command serves the fake OpenAI API of the openaitest package, so the bot can be run locally
+// without an API key and without paying for requests:
+//
+//	go run ./cmd/fake-openai --listen :8081
+//	go run . --openai-base-url http://localhost:8081/v1
+//
+// Chat completions echo the last message, images are placeholders, and moderation flags everything
+// containing "[flagged]". Every request is logged.
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/openaitest"
+)
+
+func main() {
+	listen := flag.String("listen", ":8081", "address to listen on")
+	latency := flag.Duration("latency", 0, "delay every response, e.g. 2s to see the pending messages of the bot")
+	flag.Parse()
+
+	server := openaitest.New()
+	server.SetLatency(*latency)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("Request", "method", r.Method, "path", r.URL.Path)
+		server.ServeHTTP(w, r)
+	})
+
+	slog.Info("Fake OpenAI API listening", "address", *listen)
+	httpServer := &http.Server{Addr: *listen, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	if err := httpServer.ListenAndServe(); err != nil {
+		slog.Error("Fake OpenAI API failed", "error", err)
+		os.Exit(1)
+	}
+}
@@ -1,127 +1,410 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/admin"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/audit"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/commands"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/commands/dalle"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/commands/gpt"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/config"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/constants"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/logging"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/metrics"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/preferences"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/ratelimit"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/tracing"
+	discord "github.com/bwmarrin/discordgo"
 	"github.com/sashabaranov/go-openai"
-	"gopkg.in/yaml.v2"
 )
 
-// creating a struct to work with the discord and open ai keys
-type Config struct {
-	//there are 2 sub structs in this, one is for discord
-	Discord struct {
-		//discord bot requires a token, which is present in the yaml file with the name "token"
-		//when we write yaml:token, we're specifying the name of the field in the yaml field
-		//that field will correspond to this particular field, which is Token and will be binded in runtime
-		Token string `yaml:"token"`
-		//guild is basically the particular server you want the bot to be present in
-		//in our case, we invited the bot to a particular workspace, but you can also
-		//specify it from the code itself so we will keep this field so that if we want
-		//to put our app into production, we have this capability
-		Guild string `yaml:"guild"`
-		//when our project shuts down, we either want to remove all the commands that we set
-		//for the bot or we want to keep them, this is a boolean value, either true or false
-		//and we can set it in our credentials file
-		RemoveCommands bool `yaml:"removeCommands"`
-	} `yaml:"discord"`
-	//this is the other sub struct, for open AI, in the previous one, we mentioned, yaml discord
-	//because all of the above values will be under the heading, discord
-	OpenAI struct {
-		APIKey           string   `yaml:"apiKey"`
-		CompletionModels []string `yaml:"completionModels"`
-	} `yaml:"openAI"`
-	//all of the above values will be under the openAI heading
-}
-
-// with this function, you can read config values from the yaml file
-// we pass the name of the file in it
-func (c *Config) ReadFromFile(file string) error {
-	data, err := os.ReadFile(file)
-	if err != nil {
-		return err
-	}
-	//unmarshalling function enables us to convert values from yaml to a higher level
-	//object such as a golang struct, we need the struct to be able to work in golangf
-	//since yaml and json aren't supported by default
-	err = yaml.Unmarshal(data, c)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func init() {
-	log.SetOutput(os.Stdout)
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-}
-
 // defining some variables in a group since we need to be able to work with
 // the discord bot, open ai client, we will be creating a cache for the messages and need to name it
 // also need an ignored channels cache
 var (
-	discordBot   *bot.Bot
-	openaiClient *openai.Client
+	discordBot *bot.Bot
 
 	gptMessagesCache     *gpt.MessagesCache
-	ignoredChannelsCache = make(gpt.IgnoredChannelsCache)
+	ignoredChannelsCache *gpt.IgnoredChannelsCache
+	openaiRequests       *queue.Pool
+	rateLimiter          *ratelimit.Limiter
+	accessRules          *acl.Store
+	userPreferences      *preferences.Store
+	auditLog             *audit.Logger
+
+	// openaiBaseURL overrides openAI.baseURL of the configuration, it is set with --openai-base-url
+	openaiBaseURL string
 )
 
+// knownConfig holds the models and rate limits of the commands, the configuration is validated against them
+var knownConfig = config.Known{
+	CompletionModels: gpt.KnownModels(),
+	ImageModels:      []string{dalle.Model},
+	RateLimits:       []string{commands.GPTRateLimit, commands.GPTMessagesRateLimit, commands.DALLERateLimit},
+}
+
 func main() {
-	// initialize config variable which is of type Config, a struct we have defined above
-	config := &Config{}
+	configFile := flag.String("config", "credentials.yaml", "path to the configuration file")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration, print it with secrets redacted and exit")
+	flag.StringVar(&openaiBaseURL, "openai-base-url", "", "OpenAI-compatible API to use instead of OpenAI, e.g. http://localhost:8081/v1 (overrides openAI.baseURL)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [sync [--dry-run]]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Without a subcommand the bot is started. The sync subcommand only syncs the commands with Discord and exits.")
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// initialize config variable which is of type Config, a struct defined in the config package
+	cfg := &config.Config{}
 	//earlier we defined readfromfile as a struct method that's available to belonging to the struct
 	//type config and we're now able to access that function with a dot operator placed on config
 	//and are able to run that function by passing in the name of the file, we know that that particular
 	//function accepts the name of the file as a string
-	err := config.ReadFromFile("credentials.yaml")
+	err := cfg.ReadFromFile(*configFile)
 	//if there's an error reading the credentials file, we will handle that error
 	if err != nil {
-		log.Fatalf("Error reading credentials.yaml: %v", err)
+		fatal("Error reading the configuration", "file", *configFile, "error", err)
+	}
+	if openaiBaseURL != "" {
+		cfg.OpenAI.BaseURL = openaiBaseURL
+	}
+
+	// with --check-config we only validate the configuration and print the effective values,
+	// without ever connecting to Discord
+	if *checkConfig {
+		fmt.Print(cfg)
+		if err := cfg.Validate(knownConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration in %s:\n%v\n", *configFile, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Configuration in %s is valid\n", *configFile)
+		return
+	}
+	if err := cfg.Validate(knownConfig); err != nil {
+		fatal("Invalid configuration", "file", *configFile, "error", err)
+	}
+	// the logger is set up as soon as the configuration is known, everything logged before goes to the default logger
+	if err := logging.Setup(cfg.Log); err != nil {
+		fatal("Error setting up logging", "error", err)
 	}
 
 	// we defined the variable gptmessagescache earlier, we will initiate it with
 	//NewMessagesCache function in the gpt package
 	gptMessagesCache, err = gpt.NewMessagesCache(constants.DiscordThreadsCacheSize)
 	if err != nil {
-		log.Fatalf("Error initializing GPTMessagesCache: %v", err)
+		fatal("Error initializing GPTMessagesCache", "error", err)
+	}
+	ignoredChannelsCache, err = gpt.NewIgnoredChannelsCache(constants.DiscordIgnoredChannelsCacheSize, constants.DiscordIgnoredChannelsCacheTTL)
+	if err != nil {
+		fatal("Error initializing IgnoredChannelsCache", "error", err)
 	}
 
 	// Initialize discord bot by calling the NewBot function from the bot package, that we have created(bot folder)
 	//we pass the token from config file, under discord topic
-	discordBot, err = bot.NewBot(config.Discord.Token)
+	discordBot, err = bot.NewBot(cfg.Discord.Token)
 	//handle the error if the parameters are invalid
 	if err != nil {
-		log.Fatalf("Invalid bot parameters: %v", err)
+		fatal("Invalid bot parameters", "error", err)
+	}
+	// failed Discord REST requests are counted in the metrics, and traced along with the interaction they were made for
+	discordBot.Client.Transport = tracing.Transport(metrics.DiscordTransport(discordBot.Client.Transport))
+
+	// spans are exported until everything else is shut down, the ones still buffered are flushed on exit
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("Error setting up tracing", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+	// every OpenAI request goes through the queue, which outlives configuration reloads
+	openaiRequests = queue.New(cfg.OpenAI.Queue.Workers, cfg.OpenAI.Queue.Size, cfg.OpenAI.Queue.ModelConcurrency)
+	defer openaiRequests.Close()
+	// requests answering in a deleted thread are not needed anymore
+	discordBot.AddHandler(func(s *discord.Session, e *discord.ThreadDelete) {
+		openaiRequests.Cancel(e.ID)
+	})
+
+	// the rate limiter keeps the buckets across reloads, only the limits themselves are taken from the configuration
+	rateLimiter = ratelimit.NewLimiter()
+
+	// the access control rules are managed with the /acl command and kept in their own file
+	accessRules, err = acl.Open(cfg.ACL.File)
+	if err != nil {
+		fatal("Error loading access control rules", "error", err)
+	}
+
+	// the preferences are chosen by users with /chat settings and kept in their own file
+	userPreferences, err = preferences.Open(cfg.Preferences.File)
+	if err != nil {
+		fatal("Error loading user preferences", "error", err)
+	}
+
+	// audit events are recorded from the first command on, until everything else is shut down
+	auditLog, err = newAuditLogger(cfg)
+	if err != nil {
+		fatal("Error initializing audit log", "error", err)
+	}
+	defer auditLog.Close()
+
+	// keep the ignored channels cache in line with thread and channel changes
+	discordBot.AddHandler(ignoredChannelsCache.HandleThreadCreate)
+	discordBot.AddHandler(ignoredChannelsCache.HandleThreadUpdate)
+	discordBot.AddHandler(ignoredChannelsCache.HandleThreadDelete)
+	discordBot.AddHandler(ignoredChannelsCache.HandleChannelDelete)
+
+	//we want to register the commands on the discord bot, the commands depend on the configuration
+	//so we build them in a separate function that is called again every time the configuration is reloaded
+	discordBot.Router.Replace(commandsFromConfig(cfg))
+
+	switch flag.Arg(0) {
+	case "":
+	case "sync":
+		syncCommands(cfg, flag.Args()[1:])
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// watch the configuration file and SIGHUP, so the model list and the API key can be
+	// changed without restarting the bot and dropping in-flight conversations
+	current := cfg
+	watcher, err := config.NewWatcher(*configFile, func() {
+		current = reloadConfig(*configFile, current)
+	})
+	if err != nil {
+		slog.Warn("Cannot watch the configuration file for changes, hot reload is disabled", "file", *configFile, "error", err)
+	} else {
+		defer watcher.Close()
+	}
+
+	// the admin server is optional, it serves the metrics and the health checks for the monitoring
+	if cfg.Admin.Listen != "" {
+		adminServer := admin.New(cfg.Admin.Listen)
+		adminServer.HandleHealth(discordBot, cfg.Admin.MaxHeartbeatLatency)
+		adminServer.Start()
+		defer adminServer.Shutdown(context.Background())
 	}
 
+	// Run the bot by passing in values from the config file for guilds and remove commands
+	//in our case guilds are empty, so the commands are registered globally, but you can set specific values if required
+	discordBot.Run(cfg.SyncGuilds(), cfg.Discord.RemoveCommands)
+}
+
+// commandsFromConfig builds all the bot commands for the given configuration.
+func commandsFromConfig(cfg *config.Config) []*bot.Command {
+	var cmds []*bot.Command
 	//first we will check that in the config file, under the open ai topic, the api key is not empty
-	if config.OpenAI.APIKey != "" {
-		//if it's not empty, we start a new open ai client by passing the APIKey and assign it
-		//to the variable called openaiClient to get the ball rolling
-		openaiClient = openai.NewClient(config.OpenAI.APIKey) // initialize OpenAI client first
-		//we want to register the commands on the discord bot
-		//so we call the register function and assign the parameters to the differnet fields
-		//we have 3 commands, so the first thing we register is the chat command, then we register
-		//the image command and then the info command
+	if cfg.OpenAI.APIKey != "" {
+		//if it's not empty, we start a new open ai client by passing the APIKey
+		openaiClient := newOpenAIClient(cfg) // initialize OpenAI client first
+		//prompts, messages and answers are checked with the moderation policies of the guilds
+		moderator := moderation.New(openaiClient, cfg.Moderation, auditLog)
+		//the first thing we register is the chat command and the fork action for its threads, then we register the image command,
+		//the acl command to manage who can use them and then the info command
 		//commands package is something that we have created (commands folder)
-		discordBot.Router.Register(commands.ChatCommand(&commands.ChatCommandParams{
+		chatParams := &commands.ChatCommandParams{
 			OpenAIClient:           openaiClient,
-			OpenAICompletionModels: config.OpenAI.CompletionModels,
+			OpenAICompletionModels: cfg.OpenAI.CompletionModels,
 			GPTMessagesCache:       gptMessagesCache,
-			IgnoredChannelsCache:   &ignoredChannelsCache,
+			IgnoredChannelsCache:   ignoredChannelsCache,
+			OpenAIRequests:         openaiRequests,
+			RateLimiter:            rateLimiter,
+			RateLimits:             cfg.RateLimits,
+			ACL:                    accessRules,
+			Moderation:             moderator,
+			Audit:                  auditLog,
+			Answers:                cfg.Answers,
+			Preferences:            userPreferences,
+		}
+		cmds = append(cmds, commands.ChatCommand(chatParams), commands.ForkCommand(chatParams))
+
+		cmds = append(cmds, commands.ImageCommand(&commands.ImageCommandParams{
+			OpenAIClient:   openaiClient,
+			OpenAIRequests: openaiRequests,
+			RateLimiter:    rateLimiter,
+			RateLimits:     cfg.RateLimits,
+			ACL:            accessRules,
+			Moderation:     moderator,
+			Audit:          auditLog,
 		}))
+		//rules can only be set for the commands that check them
+		cmds = append(cmds, commands.ACLCommand(accessRules, acl.EnforcedCommands(cmds)))
+	}
+	cmds = append(cmds, commands.InfoCommand())
 
-		discordBot.Router.Register(commands.ImageCommand(openaiClient))
+	// restrict the commands to the guilds they are enabled in and record every invocation in the audit log
+	for _, cmd := range cmds {
+		cmd.Guilds = cfg.Discord.Commands[cmd.Name].Guilds
+		cmd.Middlewares = append([]bot.Handler{audit.Middleware(auditLog)}, cmd.Middlewares...)
+	}
+	return cmds
+}
+
+// newOpenAIClient creates the OpenAI client, talking to openAI.baseURL instead of OpenAI if it is set.
+func newOpenAIClient(cfg *config.Config) *openai.Client {
+	clientConfig := openai.DefaultConfig(cfg.OpenAI.APIKey)
+	if cfg.OpenAI.BaseURL != "" {
+		clientConfig.BaseURL = cfg.OpenAI.BaseURL
+	}
+	return openai.NewClientWithConfig(clientConfig)
+}
+
+// newAuditLogger creates the audit log with the sinks enabled in the configuration.
+func newAuditLogger(cfg *config.Config) (*audit.Logger, error) {
+	auditLog := audit.NewLogger()
+	if path := cfg.Audit.File.Path; path != "" {
+		sink, err := audit.NewFileSink(path)
+		if err != nil {
+			return nil, err
+		}
+		auditLog.AddSink(sink, cfg.Audit.File.Events)
+	}
+	if channels := cfg.Audit.Discord.Channels; len(channels) > 0 {
+		auditLog.AddSink(audit.NewDiscordSink(discordBot.Session, channels), cfg.Audit.Discord.Events)
+	}
+	return auditLog, nil
+}
+
+// syncCommands implements the sync subcommand: it compares the commands registered in Discord with the ones
+// built from the configuration, prints the plan and applies it, unless --dry-run is given.
+// The gateway connection is never opened, so it can be run next to a running bot.
+func syncCommands(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only print the changes, do not apply them")
+	flags.Parse(args)
+
+	failed := false
+	for _, guild := range cfg.SyncGuilds() {
+		plan, err := discordBot.Router.Plan(discordBot.Session, guild)
+		if err != nil {
+			fatal("Cannot plan commands sync", "guild_id", guild, "error", err)
+		}
+		fmt.Print(plan)
+
+		if *dryRun || plan.Empty() {
+			continue
+		}
+		if err := discordBot.Router.Apply(discordBot.Session, plan); err != nil {
+			slog.Error("Failed to sync commands", "guild_id", guild, "error", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	if !*dryRun {
+		fmt.Println("Commands synced")
 	}
-	discordBot.Router.Register(commands.InfoCommand())
+}
+
+// reloadConfig reads and validates the configuration file again and swaps the bot commands
+// (and with them the OpenAI client, model list and per-feature settings) for the new ones.
+// Commands are synced with Discord only if their definitions changed.
+// If the new configuration is invalid, the current one is kept and returned.
+func reloadConfig(file string, current *config.Config) *config.Config {
+	cfg := &config.Config{}
+	if err := cfg.ReadFromFile(file); err != nil {
+		slog.Error("Failed to reload configuration, keeping the current one", "file", file, "error", err)
+		return current
+	}
+	if openaiBaseURL != "" {
+		cfg.OpenAI.BaseURL = openaiBaseURL
+	}
+	if err := cfg.Validate(knownConfig); err != nil {
+		slog.Error("Reloaded configuration is invalid, keeping the current one", "file", file, "error", err)
+		return current
+	}
+
+	// per command settings can be reloaded, everything else in the discord section is bound to the session
+	// and the guilds the commands were registered in
+	newDiscord, currentDiscord := cfg.Discord, current.Discord
+	newDiscord.Commands, currentDiscord.Commands = nil, nil
+	if !reflect.DeepEqual(newDiscord, currentDiscord) {
+		slog.Warn("Changes to the discord section of the configuration require a restart, ignoring them")
+		commandSettings := cfg.Discord.Commands
+		cfg.Discord = current.Discord
+		cfg.Discord.Commands = commandSettings
+	}
+	// the rules are loaded once, changes to where they are stored would be lost
+	if cfg.ACL != current.ACL {
+		slog.Warn("Changes to acl require a restart, ignoring them")
+		cfg.ACL = current.ACL
+	}
+	// the audit sinks stay open across reloads
+	if !reflect.DeepEqual(cfg.Audit, current.Audit) {
+		slog.Warn("Changes to audit require a restart, ignoring them")
+		cfg.Audit = current.Audit
+	}
+	// the queue keeps running across reloads, so jobs waiting in it are not lost
+	if !reflect.DeepEqual(cfg.OpenAI.Queue, current.OpenAI.Queue) {
+		slog.Warn("Changes to openAI.queue require a restart, ignoring them")
+		cfg.OpenAI.Queue = current.OpenAI.Queue
+	}
+	// the exporter is set up once on startup
+	if !reflect.DeepEqual(cfg.Tracing, current.Tracing) {
+		slog.Warn("Changes to tracing require a restart, ignoring them")
+		cfg.Tracing = current.Tracing
+	}
+	// the admin server keeps listening on the address it was started with
+	if cfg.Admin != current.Admin {
+		slog.Warn("Changes to admin require a restart, ignoring them")
+		cfg.Admin = current.Admin
+	}
+	// the level can be changed on the fly, the handler writing the logs stays the same
+	if cfg.Log.Format != current.Log.Format {
+		slog.Warn("Changes to log.format require a restart, ignoring them")
+		cfg.Log.Format = current.Log.Format
+	}
+	logging.SetLevel(cfg.Log.Level)
+
+	changed := discordBot.Router.Replace(commandsFromConfig(cfg))
+	auditLog.Emit(audit.Event{
+		Type: audit.EventConfigChanged,
+		Details: map[string]string{
+			"sections":         strings.Join(changedSections(current, cfg), ", "),
+			"commandsResynced": strconv.FormatBool(changed),
+		},
+	})
+	if changed {
+		slog.Info("Command definitions changed, syncing commands")
+		for _, guild := range cfg.SyncGuilds() {
+			if err := discordBot.Router.Sync(discordBot.Session, guild); err != nil {
+				slog.Error("Failed to sync commands after configuration reload", "guild_id", guild, "error", err)
+			}
+		}
+	}
+
+	slog.Info("Configuration reloaded")
+	return cfg
+}
+
+// changedSections returns the names of the top level sections of the configuration that differ.
+func changedSections(before *config.Config, after *config.Config) (sections []string) {
+	b, a := reflect.ValueOf(before).Elem(), reflect.ValueOf(after).Elem()
+	for i := 0; i < b.NumField(); i++ {
+		if !reflect.DeepEqual(b.Field(i).Interface(), a.Field(i).Interface()) {
+			name, _, _ := strings.Cut(b.Type().Field(i).Tag.Get("yaml"), ",")
+			sections = append(sections, name)
+		}
+	}
+	return sections
+}
 
-	// Run the bot by passing in values from the config file for guild and remove commands
-	//in our case guild is empty but you can set a specific value if required
-	discordBot.Run(config.Discord.Guild, config.Discord.RemoveCommands)
+// fatal logs the error and exits, the structured replacement for log.Fatalf.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,253 @@
+// Package acl lets guild admins allow or deny bot features per role, user and channel.
+// Rules are kept per guild and persisted in a JSON file, so they survive restarts.
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Resources the rules apply to. Commands, models and image sizes are followed by a name, e.g. "model:gpt-4".
+const (
+	ResourceCommand    = "command"
+	ResourceModel      = "model"
+	ResourceImageSize  = "image-size"
+	ResourceThreadChat = "thread-chat"
+)
+
+// CommandResource returns the resource of the command with the given name. Resources are lower case, while the
+// names of message commands like "Fork conversation" are not.
+func CommandResource(name string) string { return ResourceCommand + ":" + strings.ToLower(name) }
+
+// ModelResource returns the resource of the given model.
+func ModelResource(model string) string { return ResourceModel + ":" + model }
+
+// ImageSizeResource returns the resource of the given image size.
+func ImageSizeResource(size string) string { return ResourceImageSize + ":" + size }
+
+// ParseResource normalizes the resource and checks that it is one the rules can apply to. Commands must be one of
+// the given command resources, the ones EnforcedCommands returns, as rules for other commands are never checked.
+func ParseResource(resource string, commands []string) (string, error) {
+	resource = strings.ToLower(strings.TrimSpace(resource))
+	if resource == ResourceThreadChat {
+		return resource, nil
+	}
+	kind, name, ok := strings.Cut(resource, ":")
+	if !ok || name == "" {
+		return "", fmt.Errorf("unknown resource %q, expected %s, %s:<name>, %s:<name> or %s:<size>", resource, ResourceThreadChat, ResourceCommand, ResourceModel, ResourceImageSize)
+	}
+	switch kind {
+	case ResourceCommand:
+		for _, command := range commands {
+			if resource == command {
+				return resource, nil
+			}
+		}
+		return "", fmt.Errorf("`%s` doesn't check the access rules, rules can be set for: %s", resource, strings.Join(commands, ", "))
+	case ResourceModel, ResourceImageSize:
+		return resource, nil
+	}
+	return "", fmt.Errorf("unknown resource kind %q, expected %s, %s or %s", kind, ResourceCommand, ResourceModel, ResourceImageSize)
+}
+
+// SubjectType is the kind of Discord entity a rule applies to.
+type SubjectType string
+
+const (
+	SubjectRole    SubjectType = "role"
+	SubjectUser    SubjectType = "user"
+	SubjectChannel SubjectType = "channel"
+)
+
+// Effect decides whether a matching rule allows or denies the resource.
+type Effect string
+
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// Rule allows or denies a resource to a role, user or channel.
+type Rule struct {
+	Resource    string      `json:"resource"`
+	SubjectType SubjectType `json:"subjectType"`
+	SubjectID   string      `json:"subjectID"`
+	Effect      Effect      `json:"effect"`
+}
+
+// Subject describes who is using a feature and where.
+type Subject struct {
+	UserID string
+	Roles  []string
+	// Channels are the channel the feature is used in and, for threads, its parent channel
+	Channels []string
+	// Admin members (Administrator or Manage Server permission) bypass the rules, so they can't lock themselves out
+	Admin bool
+}
+
+// Store holds the rules of all guilds. It is safe for concurrent use.
+type Store struct {
+	mu     sync.RWMutex
+	file   string
+	guilds map[string][]Rule
+}
+
+// Open loads the rules from the given file. A missing file means no rules, it is created on the first change.
+func Open(file string) (*Store, error) {
+	s := &Store{file: file, guilds: make(map[string][]Rule)}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.guilds); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	return s, nil
+}
+
+// Rules returns the rules of the guild, sorted by resource.
+func (s *Store) Rules(guildID string) []Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rules := append([]Rule(nil), s.guilds[guildID]...)
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Resource < rules[j].Resource })
+	return rules
+}
+
+// Set adds the rule to the guild, replacing the rule for the same resource and subject if there is one.
+func (s *Store) Set(guildID string, rule Rule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rules := s.guilds[guildID]
+	for i, r := range rules {
+		if r.sameTarget(rule) {
+			rules[i] = rule
+			return s.saveLocked()
+		}
+	}
+	s.guilds[guildID] = append(rules, rule)
+	return s.saveLocked()
+}
+
+// Remove deletes the rule for the resource and subject from the guild and reports whether there was one.
+func (s *Store) Remove(guildID string, rule Rule) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rules := s.guilds[guildID]
+	for i, r := range rules {
+		if r.sameTarget(rule) {
+			s.guilds[guildID] = append(rules[:i:i], rules[i+1:]...)
+			if len(s.guilds[guildID]) == 0 {
+				delete(s.guilds, guildID)
+			}
+			return true, s.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+func (r Rule) sameTarget(other Rule) bool {
+	return r.Resource == other.Resource && r.SubjectType == other.SubjectType && r.SubjectID == other.SubjectID
+}
+
+// saveLocked writes the rules to a temporary file and renames it over the store file, so a crash
+// never leaves a half written file behind. The caller must hold s.mu.
+func (s *Store) saveLocked() error {
+	data, err := json.MarshalIndent(s.guilds, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), filepath.Base(s.file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
+
+// Check returns the first of the resources the subject is not allowed to use in the guild, or an empty string
+// if all of them are allowed. Resources without any matching rule are allowed.
+//
+// Rules are evaluated from the most to the least specific subject and the first tier with a matching rule decides:
+// user rules, then channel rules, then role rules and last rules for @everyone (the role with the guild's ID).
+// A deny wins within the user and channel tiers, an allow wins within the role tier, so a role can be granted
+// a resource denied to @everyone, like with Discord's permission overwrites.
+func (s *Store) Check(guildID string, subject Subject, resources ...string) (denied string) {
+	if subject.Admin {
+		return ""
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rules := s.guilds[guildID]
+	if len(rules) == 0 {
+		return ""
+	}
+	for _, resource := range resources {
+		if !s.allowed(guildID, rules, subject, resource) {
+			return resource
+		}
+	}
+	return ""
+}
+
+// allowed evaluates the rules for a single resource. The caller must hold s.mu.
+func (s *Store) allowed(guildID string, rules []Rule, subject Subject, resource string) bool {
+	var user, channel, role, everyone []Effect
+	for _, r := range rules {
+		if r.Resource != resource {
+			continue
+		}
+		switch {
+		case r.SubjectType == SubjectUser && r.SubjectID == subject.UserID:
+			user = append(user, r.Effect)
+		case r.SubjectType == SubjectChannel && contains(subject.Channels, r.SubjectID):
+			channel = append(channel, r.Effect)
+		case r.SubjectType == SubjectRole && r.SubjectID == guildID:
+			everyone = append(everyone, r.Effect)
+		case r.SubjectType == SubjectRole && contains(subject.Roles, r.SubjectID):
+			role = append(role, r.Effect)
+		}
+	}
+
+	switch {
+	case len(user) > 0:
+		return !contains(user, Deny)
+	case len(channel) > 0:
+		return !contains(channel, Deny)
+	case len(role) > 0:
+		return contains(role, Allow)
+	case len(everyone) > 0:
+		return !contains(everyone, Deny)
+	}
+	return true
+}
+
+func contains[T comparable](values []T, value T) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
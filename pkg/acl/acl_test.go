@@ -0,0 +1,145 @@
+package acl
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+)
+
+func TestCheck(t *testing.T) {
+	const (
+		guild    = "100"
+		user     = "200"
+		role     = "300"
+		channel  = "400"
+		thread   = "410"
+		resource = "model:gpt-4"
+	)
+	subject := Subject{UserID: user, Roles: []string{role}, Channels: []string{thread, channel}}
+	rule := func(subjectType SubjectType, subjectID string, effect Effect) Rule {
+		return Rule{Resource: resource, SubjectType: subjectType, SubjectID: subjectID, Effect: effect}
+	}
+
+	tests := []struct {
+		name    string
+		rules   []Rule
+		subject Subject
+		want    bool
+	}{
+		{name: "no rules", want: true},
+		{name: "rule for another resource", rules: []Rule{{Resource: "model:gpt-3.5-turbo", SubjectType: SubjectRole, SubjectID: guild, Effect: Deny}}, want: true},
+		{name: "rule for another user", rules: []Rule{rule(SubjectUser, "201", Deny)}, want: true},
+		{name: "everyone denied", rules: []Rule{rule(SubjectRole, guild, Deny)}, want: false},
+		{name: "everyone allowed", rules: []Rule{rule(SubjectRole, guild, Allow)}, want: true},
+		{name: "role allowed over everyone denied", rules: []Rule{rule(SubjectRole, guild, Deny), rule(SubjectRole, role, Allow)}, want: true},
+		{name: "role denied over everyone allowed", rules: []Rule{rule(SubjectRole, guild, Allow), rule(SubjectRole, role, Deny)}, want: false},
+		{
+			name:    "allow wins among roles",
+			rules:   []Rule{rule(SubjectRole, role, Deny), rule(SubjectRole, "301", Allow)},
+			subject: Subject{UserID: user, Roles: []string{role, "301"}},
+			want:    true,
+		},
+		{name: "channel denied over role allowed", rules: []Rule{rule(SubjectRole, role, Allow), rule(SubjectChannel, channel, Deny)}, want: false},
+		{name: "channel allowed over everyone denied", rules: []Rule{rule(SubjectRole, guild, Deny), rule(SubjectChannel, channel, Allow)}, want: true},
+		{name: "deny wins among channels", rules: []Rule{rule(SubjectChannel, thread, Allow), rule(SubjectChannel, channel, Deny)}, want: false},
+		{name: "user allowed over channel denied", rules: []Rule{rule(SubjectChannel, channel, Deny), rule(SubjectUser, user, Allow)}, want: true},
+		{name: "user denied over role allowed", rules: []Rule{rule(SubjectRole, role, Allow), rule(SubjectUser, user, Deny)}, want: false},
+		{
+			name:    "admin bypasses the rules",
+			rules:   []Rule{rule(SubjectUser, user, Deny)},
+			subject: Subject{UserID: user, Admin: true},
+			want:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := Open(filepath.Join(t.TempDir(), "acl.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range test.rules {
+				if err := s.Set(guild, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.subject.UserID == "" {
+				test.subject = subject
+			}
+
+			denied := s.Check(guild, test.subject, "command:chat", resource)
+			if allowed := denied == ""; allowed != test.want {
+				t.Errorf("Check() = %q, want allowed %v", denied, test.want)
+			}
+			if denied != "" && denied != resource {
+				t.Errorf("Check() = %q, want %q", denied, resource)
+			}
+		})
+	}
+}
+
+func TestCheckOtherGuild(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("100", Rule{Resource: ResourceThreadChat, SubjectType: SubjectRole, SubjectID: "100", Effect: Deny}); err != nil {
+		t.Fatal(err)
+	}
+	if denied := s.Check("101", Subject{UserID: "200"}, ResourceThreadChat); denied != "" {
+		t.Errorf("Check() = %q, want the rules of another guild to be ignored", denied)
+	}
+}
+
+func TestParseResource(t *testing.T) {
+	commands := []string{"command:dalle", "command:gpt"}
+	tests := []struct {
+		resource string
+		want     string
+		wantErr  bool
+	}{
+		{resource: "thread-chat", want: "thread-chat"},
+		{resource: " Command:GPT ", want: "command:gpt"},
+		{resource: "model:gpt-4", want: "model:gpt-4"},
+		{resource: "image-size:256x256", want: "image-size:256x256"},
+		{resource: "command:info", wantErr: true},
+		{resource: "command:", wantErr: true},
+		{resource: "model", wantErr: true},
+		{resource: "channel:100", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseResource(test.resource, commands)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("ParseResource(%q) = %q, %v, want %q, error %v", test.resource, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestEnforcedCommands(t *testing.T) {
+	handler := bot.HandlerFunc(func(ctx *bot.Context) {})
+	cmds := []*bot.Command{
+		{
+			Name: "chat",
+			SubCommands: bot.NewRouter([]*bot.Command{
+				{Name: "gpt", Middlewares: []bot.Handler{Middleware(nil, nil)}, Handler: handler},
+				{Name: "settings", Handler: handler},
+			}),
+		},
+		{
+			// the middleware of the parent command runs for all its subcommands
+			Name:        "image",
+			Middlewares: []bot.Handler{Middleware(nil, nil)},
+			SubCommands: bot.NewRouter([]*bot.Command{{Name: "dalle", Handler: handler}}),
+		},
+		{Name: "Fork conversation", Middlewares: []bot.Handler{handler, Middleware(nil, nil)}, Handler: handler},
+		{Name: "info", Middlewares: []bot.Handler{handler}, Handler: handler},
+	}
+
+	want := []string{"command:dalle", "command:fork conversation", "command:gpt"}
+	if got := EnforcedCommands(cmds); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("EnforcedCommands() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,116 @@
+package acl
+
+import (
+	"sort"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/session"
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// adminPermissions bypass the rules
+const adminPermissions = discord.PermissionAdministrator | discord.PermissionManageServer
+
+// Middleware returns a command middleware that checks the command itself and the resources returned by the
+// resources function (e.g. the model picked in the options) against the rules of the guild.
+// Denied users get an ephemeral error, so it must run before the interaction is responded to.
+// A nil store allows everything.
+func Middleware(store *Store, resources func(ctx *bot.Context) []string) bot.Handler {
+	return middleware{store: store, resources: resources}
+}
+
+// middleware is the handler returned by Middleware, its type tells the commands that check the rules apart from the others.
+type middleware struct {
+	store     *Store
+	resources func(ctx *bot.Context) []string
+}
+
+func (m middleware) HandleCommand(ctx *bot.Context) {
+	member := ctx.Interaction.Member
+	if m.store == nil || member == nil || member.User == nil {
+		// rules are per guild, DMs are not restricted
+		ctx.Next()
+		return
+	}
+
+	checked := []string{CommandResource(ctx.Caller.Name)}
+	if m.resources != nil {
+		checked = append(checked, m.resources(ctx)...)
+	}
+	subject := Subject{
+		UserID:   member.User.ID,
+		Roles:    member.Roles,
+		Channels: channels(ctx.Session, ctx.Interaction.ChannelID),
+		Admin:    member.Permissions&adminPermissions != 0,
+	}
+	if denied := m.store.Check(ctx.Interaction.GuildID, subject, checked...); denied != "" {
+		ctx.Logger.Info("User is not allowed to use the resource", "resource", denied)
+		ctx.Respond(&discord.InteractionResponse{
+			Type: discord.InteractionResponseChannelMessageWithSource,
+			Data: &discord.InteractionResponseData{
+				Flags:  discord.MessageFlagsEphemeral,
+				Embeds: []*discord.MessageEmbed{DeniedEmbed(denied)},
+			},
+		})
+		return
+	}
+
+	ctx.Next()
+}
+
+// EnforcedCommands returns the resources of the commands that run the access middleware, their own or one of a parent
+// command. Rules for other commands would never be checked, so only these can be given to ParseResource.
+func EnforcedCommands(cmds []*bot.Command) []string {
+	var resources []string
+	var walk func(cmds []*bot.Command, inherited bool)
+	walk = func(cmds []*bot.Command, inherited bool) {
+		for _, cmd := range cmds {
+			enforced := inherited
+			for _, h := range cmd.Middlewares {
+				if _, ok := h.(middleware); ok {
+					enforced = true
+				}
+			}
+			if cmd.SubCommands.Count() > 0 {
+				walk(cmd.SubCommands.List(), enforced)
+			} else if enforced {
+				resources = append(resources, CommandResource(cmd.Name))
+			}
+		}
+	}
+	walk(cmds, false)
+	sort.Strings(resources)
+	return resources
+}
+
+// MessageSubject returns the subject of a guild message, for checks outside of the command middlewares.
+func MessageSubject(s session.StateReader, m *discord.Message) Subject {
+	subject := Subject{Channels: channels(s, m.ChannelID)}
+	if m.Author != nil {
+		subject.UserID = m.Author.ID
+	}
+	if m.Member != nil {
+		subject.Roles = m.Member.Roles
+	}
+	if permissions, err := s.MessagePermissions(m); err == nil {
+		subject.Admin = permissions&adminPermissions != 0
+	}
+	return subject
+}
+
+// DeniedEmbed tells the user they are not allowed to use the resource.
+func DeniedEmbed(resource string) *discord.MessageEmbed {
+	return &discord.MessageEmbed{
+		Title:       "❌ Error",
+		Description: "You are not allowed to use `" + resource + "` here, ask the server admins for access",
+		Color:       0xff0000,
+	}
+}
+
+// channels returns the channel and, for threads, its parent, so channel rules set on a channel apply to its threads too.
+func channels(s session.StateReader, channelID string) []string {
+	if ch, err := s.CachedChannel(channelID); err == nil && ch.IsThread() && ch.ParentID != "" {
+		return []string{channelID, ch.ParentID}
+	}
+	return []string{channelID}
+}
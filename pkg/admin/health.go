@@ -0,0 +1,96 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/metrics"
+	"github.com/sashabaranov/go-openai"
+)
+
+// check is the outcome of a single readiness check.
+type check struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HandleHealth registers /healthz, which answers as long as the process is alive, and /readyz, which answers
+// with 503 Service Unavailable when the gateway is disconnected, the heartbeat latency reaches maxHeartbeatLatency,
+// the commands are not synced yet or the last OpenAI request was rejected for the API key.
+// Both return the outcome of the checks as JSON.
+func (s *Server) HandleHealth(b *bot.Bot, maxHeartbeatLatency time.Duration) {
+	s.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeChecks(w, map[string]check{"process": {OK: true}})
+	}))
+	s.Handle("/readyz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		at, err := metrics.LastOpenAIRequest()
+		writeChecks(w, readinessChecks(b.Health(), maxHeartbeatLatency, at, err))
+	}))
+}
+
+// The readinessChecks function runs the readiness checks on the state of the bot and the outcome of the last OpenAI
+// request, which finished at the given time (zero if there was none yet) with the given error.
+func readinessChecks(h bot.Health, maxHeartbeatLatency time.Duration, at time.Time, err error) map[string]check {
+	checks := make(map[string]check)
+
+	if h.Connected {
+		checks["gateway"] = check{OK: true, Detail: "connected since " + h.ConnectionChanged.UTC().Format(time.RFC3339)}
+	} else if h.ConnectionChanged.IsZero() {
+		checks["gateway"] = check{Detail: "not connected yet"}
+	} else {
+		checks["gateway"] = check{Detail: "disconnected since " + h.ConnectionChanged.UTC().Format(time.RFC3339)}
+	}
+
+	checks["heartbeat"] = check{
+		OK:     h.Connected && h.HeartbeatLatency < maxHeartbeatLatency,
+		Detail: h.HeartbeatLatency.String(),
+	}
+
+	if h.CommandsSynced {
+		checks["commands"] = check{OK: true, Detail: "synced"}
+	} else {
+		checks["commands"] = check{Detail: "not synced yet"}
+	}
+
+	// a failed request is not a reason to take the bot out of service, a rejected API key is
+	switch {
+	case at.IsZero():
+		checks["openAI"] = check{OK: true, Detail: "no requests yet"}
+	case err == nil:
+		checks["openAI"] = check{OK: true, Detail: "last request succeeded at " + at.UTC().Format(time.RFC3339)}
+	default:
+		checks["openAI"] = check{OK: !isAuthError(err), Detail: "last request failed at " + at.UTC().Format(time.RFC3339) + ": " + err.Error()}
+	}
+
+	return checks
+}
+
+// The isAuthError function reports whether OpenAI rejected the request because of the API key.
+func isAuthError(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusUnauthorized || apiErr.HTTPStatusCode == http.StatusForbidden
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode == http.StatusUnauthorized || reqErr.HTTPStatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// The writeChecks function writes the checks as JSON, with 200 OK if all of them passed and 503 Service Unavailable otherwise.
+func writeChecks(w http.ResponseWriter, checks map[string]check) {
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(checks)
+}
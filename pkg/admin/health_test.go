@@ -0,0 +1,86 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestReadinessChecks(t *testing.T) {
+	since := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	ready := bot.Health{Connected: true, ConnectionChanged: since, HeartbeatLatency: 50 * time.Millisecond, CommandsSynced: true}
+
+	tests := []struct {
+		name   string
+		health bot.Health
+		at     time.Time
+		err    error
+		// failed are the checks that must fail, all others must pass
+		failed []string
+	}{
+		{name: "ready", health: ready},
+		{
+			name:   "not connected yet",
+			health: bot.Health{CommandsSynced: true},
+			failed: []string{"gateway", "heartbeat"},
+		},
+		{
+			name:   "disconnected",
+			health: bot.Health{ConnectionChanged: since, HeartbeatLatency: 50 * time.Millisecond, CommandsSynced: true},
+			failed: []string{"gateway", "heartbeat"},
+		},
+		{
+			name:   "heartbeat over threshold",
+			health: bot.Health{Connected: true, ConnectionChanged: since, HeartbeatLatency: 10 * time.Second, CommandsSynced: true},
+			failed: []string{"heartbeat"},
+		},
+		{
+			name:   "not synced",
+			health: bot.Health{Connected: true, ConnectionChanged: since, HeartbeatLatency: 50 * time.Millisecond},
+			failed: []string{"commands"},
+		},
+		{name: "last request succeeded", health: ready, at: since},
+		{
+			name:   "last request failed",
+			health: ready,
+			at:     since,
+			err:    &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Message: "Rate limit reached"},
+		},
+		{name: "network error", health: ready, at: since, err: errors.New("connection refused")},
+		{
+			name:   "invalid API key",
+			health: ready,
+			at:     since,
+			err:    &openai.APIError{HTTPStatusCode: http.StatusUnauthorized, Message: "Incorrect API key provided"},
+			failed: []string{"openAI"},
+		},
+		{
+			name:   "forbidden request",
+			health: ready,
+			at:     since,
+			err:    &openai.RequestError{HTTPStatusCode: http.StatusForbidden, Err: errors.New("forbidden")},
+			failed: []string{"openAI"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checks := readinessChecks(test.health, 10*time.Second, test.at, test.err)
+			for _, name := range []string{"gateway", "heartbeat", "commands", "openAI"} {
+				want := true
+				for _, failed := range test.failed {
+					if name == failed {
+						want = false
+					}
+				}
+				if checks[name].OK != want {
+					t.Errorf("%s check = %+v, want ok %v", name, checks[name], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Package admin runs the optional HTTP server for operators, serving the Prometheus metrics on /metrics
+// and the health checks on /healthz and /readyz. It is meant to be reachable from the monitoring only, not from the internet.
+package admin
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// readHeaderTimeout keeps slow clients from holding connections open forever
+const readHeaderTimeout = 10 * time.Second
+
+// Server is the admin HTTP server.
+type Server struct {
+	server *http.Server
+	mux    *http.ServeMux
+}
+
+// New creates an admin server listening on addr, with the metrics handler already registered.
+func New(addr string) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return &Server{
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: readHeaderTimeout,
+		},
+		mux: mux,
+	}
+}
+
+// Handle registers an additional handler for the given pattern. It must be called before Start.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start serves the requests in the background. If the server cannot listen on its address,
+// the error is logged and the bot keeps running without it.
+func (s *Server) Start() {
+	go func() {
+		slog.Info("Admin server listening", "address", s.server.Addr)
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Admin server failed", "address", s.server.Addr, "error", err)
+		}
+	}()
+}
+
+// Shutdown stops the server, waiting for the requests being served until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
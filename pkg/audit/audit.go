@@ -0,0 +1,171 @@
+// Package audit records what happens in the bot as structured events: commands invoked, flagged content,
+// exceeded limits, configuration changes and new threads. Events are appended to a local JSONL file and
+// posted to a log channel of the guild they happened in, each sink with its own filter of event types.
+package audit
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of an audit event.
+type EventType string
+
+const (
+	// EventCommandInvoked is emitted for every slash command invocation
+	EventCommandInvoked EventType = "command_invoked"
+	// EventModerationFlagged is emitted when a prompt, message or answer is flagged by the moderation
+	EventModerationFlagged EventType = "moderation_flagged"
+	// EventModerationFailed is emitted when content could not be moderated, it is let through then
+	EventModerationFailed EventType = "moderation_failed"
+	// EventBudgetExceeded is emitted when a user used up their rate limit budget
+	EventBudgetExceeded EventType = "budget_exceeded"
+	// EventConfigChanged is emitted when the configuration file is reloaded
+	EventConfigChanged EventType = "config_changed"
+	// EventThreadCreated is emitted when a conversation thread is created
+	EventThreadCreated EventType = "thread_created"
+)
+
+// EventTypes are all the event types, in the order they are documented.
+var EventTypes = []EventType{EventCommandInvoked, EventModerationFlagged, EventModerationFailed, EventBudgetExceeded, EventConfigChanged, EventThreadCreated}
+
+// Event is a single audit record. Events that don't belong to a guild (like configuration changes) have an empty GuildID.
+type Event struct {
+	Time      time.Time         `json:"time"`
+	Type      EventType         `json:"type"`
+	GuildID   string            `json:"guildID,omitempty"`
+	ChannelID string            `json:"channelID,omitempty"`
+	UserID    string            `json:"userID,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// Sink receives the audit events.
+type Sink interface {
+	Write(e Event) error
+	Close() error
+}
+
+// Filter is a set of event types to forward, an empty filter forwards every event.
+type Filter []EventType
+
+// Match reports whether the event type passes the filter.
+func (f Filter) Match(t EventType) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, allowed := range f {
+		if allowed == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the filter for unknown event types.
+func (f Filter) Validate() error {
+	for _, t := range f {
+		known := false
+		for _, k := range EventTypes {
+			known = known || k == t
+		}
+		if !known {
+			return fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	return nil
+}
+
+type filteredSink struct {
+	Sink
+	filter Filter
+}
+
+// eventsBufferSize is the number of events waiting to be written, further events are dropped,
+// so a slow Discord channel never holds up the handlers.
+const eventsBufferSize = 256
+
+// Logger writes the events to the sinks in the background. A nil *Logger discards every event,
+// so the callers don't have to check whether auditing is enabled.
+type Logger struct {
+	sinks  []filteredSink
+	events chan Event
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewLogger starts a logger without any sinks, they are added with AddSink.
+func NewLogger() *Logger {
+	l := &Logger{
+		events: make(chan Event, eventsBufferSize),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// AddSink adds a sink receiving the events passing the filter. It must be called before the first event is emitted.
+func (l *Logger) AddSink(sink Sink, filter Filter) {
+	l.sinks = append(l.sinks, filteredSink{Sink: sink, filter: filter})
+}
+
+// Emit queues the event to be written, Time is set if it is empty.
+func (l *Logger) Emit(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.events <- e:
+	default:
+		slog.Warn("Audit events buffer is full, dropping event", "guild_id", e.GuildID, "event", e.Type)
+	}
+}
+
+// Close writes the queued events and closes the sinks. Events emitted afterwards are discarded.
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.events)
+	l.mu.Unlock()
+
+	<-l.done
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil {
+			slog.Error("Failed to close audit sink", "error", err)
+		}
+	}
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	for e := range l.events {
+		for _, sink := range l.sinks {
+			if !sink.filter.Match(e.Type) {
+				continue
+			}
+			if err := sink.Write(e); err != nil {
+				slog.Error("Failed to write audit event", "guild_id", e.GuildID, "event", e.Type, "error", err)
+			}
+		}
+	}
+}
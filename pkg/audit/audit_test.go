@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		event  EventType
+		want   bool
+	}{
+		{name: "empty", filter: nil, event: EventConfigChanged, want: true},
+		{name: "listed", filter: Filter{EventModerationFlagged, EventBudgetExceeded}, event: EventBudgetExceeded, want: true},
+		{name: "not listed", filter: Filter{EventModerationFlagged}, event: EventCommandInvoked, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.filter.Match(test.event); got != test.want {
+				t.Errorf("Match(%s) = %t, want %t", test.event, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  Filter
+		wantErr string
+	}{
+		{name: "empty"},
+		{name: "all", filter: Filter(EventTypes)},
+		{name: "unknown", filter: Filter{EventThreadCreated, "thread_deleted"}, wantErr: `unknown event type "thread_deleted"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.filter.Validate()
+			if test.wantErr == "" && err != nil {
+				t.Errorf("Validate() error = %v, want none", err)
+			}
+			if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+				t.Errorf("Validate() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// recordingSink keeps the events written to it. It writes slowly, so the events pile up in the buffer of the logger.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []Event
+	closed bool
+}
+
+func (s *recordingSink) Write(e Event) error {
+	time.Sleep(time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		panic("event written to a closed sink")
+	}
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestLoggerClose(t *testing.T) {
+	all := &recordingSink{}
+	flagged := &recordingSink{}
+	l := NewLogger()
+	l.AddSink(all, nil)
+	l.AddSink(flagged, Filter{EventModerationFlagged})
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		e := Event{Type: EventCommandInvoked, GuildID: strconv.Itoa(i)}
+		if i%10 == 0 {
+			e.Type = EventModerationFlagged
+		}
+		l.Emit(e)
+	}
+	// Close returns once every queued event is written
+	l.Close()
+	l.Emit(Event{Type: EventModerationFlagged, GuildID: "after close"})
+	l.Close()
+
+	if !all.closed || !flagged.closed {
+		t.Errorf("sinks closed = %t and %t, want both closed", all.closed, flagged.closed)
+	}
+	if len(all.events) != n {
+		t.Fatalf("%d events written, want %d", len(all.events), n)
+	}
+	for i, e := range all.events {
+		if e.GuildID != strconv.Itoa(i) {
+			t.Errorf("event %d is for guild %s, want the events in order", i, e.GuildID)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("event %d has no time", i)
+		}
+	}
+	if len(flagged.events) != n/10 {
+		t.Errorf("%d events passed the filter, want %d", len(flagged.events), n/10)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	// a nil logger discards everything, callers don't check whether auditing is enabled
+	l.Emit(Event{Type: EventCommandInvoked})
+	l.Close()
+}
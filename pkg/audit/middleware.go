@@ -0,0 +1,39 @@
+package audit
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+)
+
+// Middleware returns a command middleware emitting EventCommandInvoked for every invocation.
+// Only the names of the options given are recorded, not their values, which may hold prompts.
+func Middleware(l *Logger) bot.Handler {
+	return bot.HandlerFunc(func(ctx *bot.Context) {
+		e := Event{
+			Type:      EventCommandInvoked,
+			GuildID:   ctx.Interaction.GuildID,
+			ChannelID: ctx.Interaction.ChannelID,
+			Details: map[string]string{
+				"command": bot.CommandPath(ctx.Interaction),
+			},
+		}
+		if ctx.Interaction.Member != nil && ctx.Interaction.Member.User != nil {
+			e.UserID = ctx.Interaction.Member.User.ID
+		} else if ctx.Interaction.User != nil {
+			e.UserID = ctx.Interaction.User.ID
+		}
+		if len(ctx.Options) > 0 {
+			names := make([]string, 0, len(ctx.Options))
+			for name := range ctx.Options {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			e.Details["options"] = strings.Join(names, ", ")
+		}
+		l.Emit(e)
+
+		ctx.Next()
+	})
+}
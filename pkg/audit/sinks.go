@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// FileSink appends the events to a file, one JSON object per line.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink opens the file for appending, creating it if needed.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+// Write appends the event to the file.
+func (s *FileSink) Write(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// DiscordSink posts the events as embeds to the log channel of the guild they happened in.
+// Events without a guild are posted to every log channel.
+type DiscordSink struct {
+	session  *discord.Session
+	channels map[string]string // guild ID -> channel ID
+}
+
+// NewDiscordSink creates a sink posting to the given log channels, keyed by guild ID.
+func NewDiscordSink(s *discord.Session, channels map[string]string) *DiscordSink {
+	return &DiscordSink{session: s, channels: channels}
+}
+
+// Write posts the event to the log channel of its guild.
+func (s *DiscordSink) Write(e Event) error {
+	embed := eventEmbed(e)
+	if e.GuildID != "" {
+		channel, ok := s.channels[e.GuildID]
+		if !ok {
+			return nil
+		}
+		_, err := s.session.ChannelMessageSendEmbed(channel, embed)
+		return err
+	}
+
+	var firstErr error
+	for _, channel := range s.channels {
+		if _, err := s.session.ChannelMessageSendEmbed(channel, embed); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close does nothing, the session is owned by the bot.
+func (s *DiscordSink) Close() error {
+	return nil
+}
+
+// eventColors are the embed colors of the event types, events that need attention are red or orange
+var eventColors = map[EventType]int{
+	EventCommandInvoked:    0x00bfff,
+	EventModerationFlagged: 0xff0000,
+	EventModerationFailed:  0xffa500,
+	EventBudgetExceeded:    0xffa500,
+	EventConfigChanged:     0x00bfff,
+	EventThreadCreated:     0x00bfff,
+}
+
+// eventEmbed formats the event as a Discord embed.
+func eventEmbed(e Event) *discord.MessageEmbed {
+	embed := &discord.MessageEmbed{
+		Title:     string(e.Type),
+		Color:     eventColors[e.Type],
+		Timestamp: e.Time.Format("2006-01-02T15:04:05Z07:00"),
+	}
+	if e.UserID != "" {
+		embed.Fields = append(embed.Fields, &discord.MessageEmbedField{Name: "User", Value: "<@" + e.UserID + ">", Inline: true})
+	}
+	if e.ChannelID != "" {
+		embed.Fields = append(embed.Fields, &discord.MessageEmbedField{Name: "Channel", Value: "<#" + e.ChannelID + ">", Inline: true})
+	}
+
+	keys := make([]string, 0, len(e.Details))
+	for key := range e.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := e.Details[key]
+		if runes := []rune(value); len(runes) > 1024 {
+			value = string(runes[:1021]) + "..."
+		}
+		if value == "" {
+			continue
+		}
+		embed.Fields = append(embed.Fields, &discord.MessageEmbedField{Name: key, Value: value})
+	}
+	return embed
+}
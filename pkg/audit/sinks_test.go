@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventEmbed(t *testing.T) {
+	long := strings.Repeat("é", 1100)
+
+	tests := []struct {
+		name       string
+		event      Event
+		wantFields []string
+	}{
+		{
+			name: "all fields",
+			event: Event{
+				Type:      EventBudgetExceeded,
+				UserID:    "1",
+				ChannelID: "2",
+				Details:   map[string]string{"retryAfter": "5s", "limit": "gpt"},
+			},
+			// user and channel come first, the details are sorted by name
+			wantFields: []string{"User=<@1>", "Channel=<#2>", "limit=gpt", "retryAfter=5s"},
+		},
+		{
+			name:       "without guild members",
+			event:      Event{Type: EventConfigChanged, Details: map[string]string{"file": "credentials.yaml"}},
+			wantFields: []string{"file=credentials.yaml"},
+		},
+		{
+			name:       "empty values",
+			event:      Event{Type: EventCommandInvoked, UserID: "1", Details: map[string]string{"command": "chat gpt", "options": ""}},
+			wantFields: []string{"User=<@1>", "command=chat gpt"},
+		},
+		{
+			name:       "long value",
+			event:      Event{Type: EventModerationFlagged, Details: map[string]string{"categories": long}},
+			wantFields: []string{"categories=" + long[:2*1021] + "..."},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.event.Time = time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+			embed := eventEmbed(test.event)
+			if embed.Title != string(test.event.Type) || embed.Color != eventColors[test.event.Type] {
+				t.Errorf("embed title = %q and color = %x, want the ones of %s", embed.Title, embed.Color, test.event.Type)
+			}
+			if embed.Timestamp != "2023-06-01T12:00:00Z" {
+				t.Errorf("embed timestamp = %q", embed.Timestamp)
+			}
+
+			var fields []string
+			for _, f := range embed.Fields {
+				if n := len([]rune(f.Value)); n > 1024 {
+					t.Errorf("field %s has %d runes, Discord allows 1024", f.Name, n)
+				}
+				fields = append(fields, f.Name+"="+f.Value)
+			}
+			if !reflect.DeepEqual(fields, test.wantFields) {
+				t.Errorf("embed fields = %q, want %q", fields, test.wantFields)
+			}
+		})
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	events := []Event{
+		{Time: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC), Type: EventConfigChanged},
+		{Time: time.Date(2023, 6, 1, 12, 0, 1, 0, time.UTC), Type: EventThreadCreated, GuildID: "1", ChannelID: "2", UserID: "3", Details: map[string]string{"model": "gpt-4"}},
+	}
+
+	// the file is appended to, events of earlier runs stay
+	for _, e := range events {
+		sink, err := NewFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Write(e); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	want := []string{
+		`{"time":"2023-06-01T12:00:00Z","type":"config_changed"}`,
+		`{"time":"2023-06-01T12:00:01Z","type":"thread_created","guildID":"1","channelID":"2","userID":"3","details":{"model":"gpt-4"}}`,
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("file lines = %q, want %q", lines, want)
+	}
+	for i, line := range lines {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(e, events[i]) {
+			t.Errorf("line %d = %+v, want %+v", i+1, e, events[i])
+		}
+	}
+}
@@ -1,20 +1,29 @@
 package bot
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/utils"
 	discord "github.com/bwmarrin/discordgo"
 )
 
+// defaultShutdownTimeout is how long the bot waits for in-flight requests on shutdown
+const defaultShutdownTimeout = 30 * time.Second
+
 //defining the struct for a bot, it'll have a session and a router
 
 type Bot struct {
 	*discord.Session
 
 	Router *Router
+	// ShutdownTimeout is how long to wait for in-flight handlers before shutting down anyway
+	ShutdownTimeout time.Duration
+
+	health health
 }
 
 // the new bot function that we use in main.go, takes in the API token
@@ -29,13 +38,15 @@ func NewBot(token string) (*Bot, error) {
 	return &Bot{
 		Session: session,
 		//NewRouter function is in the router.go file in this package
-		Router: NewRouter(nil),
+		Router:          NewRouter(nil),
+		ShutdownTimeout: defaultShutdownTimeout,
 	}, nil
 }
 
-// the run function is called in the main.go file, takes in guildID and the remove commands
+// the run function is called in the main.go file, takes in the guilds to register the commands in
+// (an empty guild ID means global registration) and the remove commands
 // b is of type Bot struct which means this is a struct method
-func (b *Bot) Run(guildID string, removeCommands bool) {
+func (b *Bot) Run(guilds []string, removeCommands bool) {
 	// IntentMessageContent is required for us to have a conversation in threads without typing any commands
 	//this will enable conversations for us in threads without typing any commands
 	b.Identify.Intents = discord.MakeIntent(discord.IntentsAllWithoutPrivileged | discord.IntentMessageContent)
@@ -43,32 +54,36 @@ func (b *Bot) Run(guildID string, removeCommands bool) {
 	// Add handler takes in a function and that particular function is supposed to
 	//take in session and ready handler that logs in as the bot user
 	b.AddHandler(func(s *discord.Session, r *discord.Ready) {
-		log.Printf("Logged in as: %v#%v", s.State.User.Username, s.State.User.Discriminator)
+		slog.Info("Logged in", "user", s.State.User.Username+"#"+s.State.User.Discriminator)
 	})
 	//handle interaction and handle message are two functions in the router.go file
 	//when we say router.HandleInteraction, we're saying that router is actually a struct and
 	//Handle interaction is a struct method available to us
 	b.AddHandler(b.Router.HandleInteraction)
 	b.AddHandler(b.Router.HandleMessage)
+	b.AddHandler(b.Router.HandleMessageUpdate)
+	b.AddHandler(b.Router.HandleMessageDelete)
+	//the gateway events also tell whether the bot is connected, for the readiness check
+	b.addHealthHandlers()
 
 	// Run the bot
 	err := b.Open()
 	if err != nil {
-		log.Fatalf("Cannot open the session: %v", err)
+		slog.Error("Cannot open the session", "error", err)
+		os.Exit(1)
 	}
 
-	// Sync command opens the bot's session and syncs the command with the given GuildID
+	// Sync command opens the bot's session and syncs the command with every given guild
 	// we will write the logic for sync in router file
 	//we need to call the sync struct method for router
-	err = b.Router.Sync(b.Session, guildID)
-	if err != nil {
-		panic(err)
+	for _, guildID := range guilds {
+		err = b.Router.Sync(b.Session, guildID)
+		if err != nil {
+			panic(err)
+		}
 	}
+	b.health.setCommandsSynced()
 
-	//closes the bot at the end, when this particular function exits.
-	//this means we will close the bot session after our interaction and
-	//the next time, a different bot session will start
-	defer b.Close()
 	//now we want to handle graceful shutdown, we will create a channel using the os package
 	stop := make(chan os.Signal, 1)
 	//signal.Notify is used to send this to the stop channel, we're essentially listening
@@ -80,15 +95,39 @@ func (b *Bot) Run(guildID string, removeCommands bool) {
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	<-stop
 
+	b.shutdown(guilds, removeCommands)
+}
+
+// shutdown stops the bot gracefully: it stops accepting new interactions, waits (up to ShutdownTimeout)
+// for the in-flight handlers, unlocks the threads the bot locked, removes the commands if asked to
+// and finally closes the session.
+func (b *Bot) shutdown(guilds []string, removeCommands bool) {
+	slog.Info("Shutting down, waiting for in-flight requests to finish")
+	if !b.Router.Shutdown(b.ShutdownTimeout) {
+		slog.Warn("In-flight requests did not finish in time, shutting down anyway", "timeout", b.ShutdownTimeout)
+	}
+
+	// handlers that did not finish in time may have left their threads locked
+	utils.UnlockDiscordThreads(b.Session)
+
 	//in our case, we have selected true for remove commands, this means when the bot is stopped
 	// the commands will be unregistered
 	if removeCommands {
-		log.Println("Removing commands...")
+		slog.Info("Removing commands")
 		//essentially calling the clearCommands function in the router file
 		//takes in the particular session received when creating the bot
 		//and the particular guild or the server
-		b.Router.ClearCommands(b.Session, guildID)
+		for _, guildID := range guilds {
+			for _, err := range b.Router.ClearCommands(b.Session, guildID) {
+				slog.Error("Failed to remove command", "guild_id", guildID, "error", err)
+			}
+		}
+	}
+
+	//closes the bot session at the end, the next time, a different bot session will start
+	if err := b.Close(); err != nil {
+		slog.Error("Failed to close the session", "error", err)
 	}
 
-	log.Println("Gracefully shutting down.")
+	slog.Info("Gracefully shutting down")
 }
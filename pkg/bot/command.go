@@ -1,6 +1,8 @@
 package bot
 
 import (
+	"strings"
+
 	discord "github.com/bwmarrin/discordgo"
 )
 
@@ -37,10 +39,18 @@ type Command struct {
 	DefaultMemberPermissions int64
 	Options                  []*discord.ApplicationCommandOption
 	Type                     discord.ApplicationCommandType
+	// Guilds restricts a top level command to the given guilds, it is not registered globally then.
+	// Empty means the command is registered everywhere the router is synced to.
+	Guilds []string
 
 	Handler        Handler			// Command handler
 	Middlewares    []Handler		// Middleware handlers for the command
 	MessageHandler MessageHandler   // Message command handler (for message-based interactions).
+	MessageMiddlewares []MessageHandler // Middleware handlers run before the message handler
+	// Handlers of edited and deleted messages, the message of a deleted one only has its IDs
+	MessageUpdateMiddlewares []MessageHandler // Middleware handlers run before the update handler
+	MessageUpdateHandler MessageHandler
+	MessageDeleteHandler MessageHandler
 	
 	//the subcommands is of type router, which can be used to handle subcommands
 	SubCommands *Router
@@ -66,6 +76,19 @@ func (cmd Command) ApplicationCommand() *discord.ApplicationCommand {
 
 
 
+// EnabledIn reports whether the command is registered in the given guild (empty guild means global registration).
+func (cmd Command) EnabledIn(guild string) bool {
+	if len(cmd.Guilds) == 0 {
+		return true
+	}
+	for _, g := range cmd.Guilds {
+		if g == guild {
+			return true
+		}
+	}
+	return false
+}
+
 // ApplicationCommandOption method is called on the Command to get an ApplicationCommandOption struct. 
 // ApplicationCommandOption converts the Command struct into a discord.ApplicationCommandOption which is used to register the command with discord.
 func (cmd Command) ApplicationCommandOption() *discord.ApplicationCommandOption {
@@ -90,3 +113,19 @@ func (cmd Command) ApplicationCommandOption() *discord.ApplicationCommandOption
 		Type:        typ,
 	}
 }
+
+// CommandPath returns the full name of the invoked command, including subcommand groups and subcommands, e.g. "chat gpt".
+func CommandPath(i *discord.Interaction) string {
+	data := i.ApplicationCommandData()
+	path := []string{data.Name}
+	options := data.Options
+	for len(options) > 0 {
+		option := options[0]
+		if option.Type != discord.ApplicationCommandOptionSubCommand && option.Type != discord.ApplicationCommandOptionSubCommandGroup {
+			break
+		}
+		path = append(path, option.Name)
+		options = option.Options
+	}
+	return strings.Join(path, " ")
+}
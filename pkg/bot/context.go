@@ -1,7 +1,17 @@
 package bot
 
 import (
+	"context"
+	"log/slog"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/logging"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/session"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/tracing"
 	discord "github.com/bwmarrin/discordgo"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // OptionsMap is an alias for a map that stores interaction options.
@@ -10,16 +20,21 @@ type OptionsMap = map[string]*discord.ApplicationCommandInteractionDataOption
 
 
 // Context represents the context of a Discord bot command or interaction.
-// The Context struct contains several fields, including a Session field, which is a pointer to a discord.Session struct, 
+// The Context struct contains several fields, including a Session field, which is the session.Session the handlers talk to Discord through, 
 // a Caller field, which is a pointer to a Command struct, an Interaction field, which is a pointer to a discord.Interaction struct, 
-// an Options field, which is an OptionsMap, and a handlers field, which is a slice of Handler interfaces.
+// an Options field, which is an OptionsMap, a Logger field, which already carries the IDs of the interaction and a correlation ID,
+// and a handlers field, which is a slice of Handler interfaces. The context.Context returned by the Context method
+// carries the span of the running handler, so the work done for the interaction shows up in its trace.
 type Context struct {
-	*discord.Session
+	session.Session
 	Caller      *Command
 	Interaction *discord.Interaction
 	Options     OptionsMap
+	Logger      *slog.Logger
 
+	ctx      context.Context
 	handlers []Handler
+	tasks
 }
 
 // makeOptionMap function is defined to create an OptionsMap from a slice of discord.ApplicationCommandInteractionDataOption structs.
@@ -36,9 +51,9 @@ func makeOptionMap(options []*discord.ApplicationCommandInteractionDataOption) (
 }
 
 // NewContext creates a new context for a command invocation.
-// It takes in a discord session, the command caller, the interaction data, the parent option data,
-// and a slice of handlers. It returns a pointer to a new context.
-func NewContext(s *discord.Session, caller *Command, i *discord.Interaction, parent *discord.ApplicationCommandInteractionDataOption, handlers []Handler) *Context {
+// It takes in a context.Context (carrying the root span of the interaction), the session, the command caller,
+// the interaction data, the parent option data, and a slice of handlers. It returns a pointer to a new context.
+func NewContext(c context.Context, s session.Session, caller *Command, i *discord.Interaction, parent *discord.ApplicationCommandInteractionDataOption, handlers []Handler) *Context {
 	options := i.ApplicationCommandData().Options
 	if parent != nil {
 		options = parent.Options
@@ -48,15 +63,51 @@ func NewContext(s *discord.Session, caller *Command, i *discord.Interaction, par
 		Caller:      caller,
 		Interaction: i,
 		Options:     makeOptionMap(options),
+		Logger:      interactionLogger(c, caller, i),
 
+		ctx:      c,
 		handlers: handlers,
 	}
 }
 
+// interactionLogger returns the logger of an interaction, every line it logs has the IDs of the interaction
+// and a correlation ID tying together all the lines logged while handling it.
+func interactionLogger(c context.Context, caller *Command, i *discord.Interaction) *slog.Logger {
+	var userID string
+	if i.Member != nil && i.Member.User != nil {
+		userID = i.Member.User.ID
+	} else if i.User != nil {
+		userID = i.User.ID
+	}
+	return withTraceID(c, slog.Default().With(
+		"correlation_id", logging.NewCorrelationID(),
+		"guild_id", i.GuildID,
+		"channel_id", i.ChannelID,
+		"user_id", userID,
+		"interaction_id", i.ID,
+		"command", caller.Name,
+	))
+}
+
+// withTraceID adds the ID of the trace to the logger, if the interaction or message is traced.
+func withTraceID(c context.Context, logger *slog.Logger) *slog.Logger {
+	if traceID := tracing.TraceID(c); traceID != "" {
+		return logger.With("trace_id", traceID)
+	}
+	return logger
+}
+
+// Context returns the context.Context of the running handler, to be passed to OpenAI requests
+// and (with discord.WithContext) Discord REST calls, so they show up in the trace of the interaction.
+// Goroutines started with Go must get it before they start, as it changes with every handler.
+func (ctx *Context) Context() context.Context {
+	return ctx.ctx
+}
+
 
 // Respond sends a response to the interaction.
 func (ctx *Context) Respond(response *discord.InteractionResponse) error {
-	return ctx.Session.InteractionRespond(ctx.Interaction, response)
+	return ctx.Session.InteractionRespond(ctx.Interaction, response, discord.WithContext(ctx.ctx))
 }
 
 
@@ -64,14 +115,34 @@ func (ctx *Context) Respond(response *discord.InteractionResponse) error {
 func (ctx *Context) Edit(content string) error {
 	_, err := ctx.Session.InteractionResponseEdit(ctx.Interaction, &discord.WebhookEdit{
 		Content: &content,
-	})
+	}, discord.WithContext(ctx.ctx))
 	return err
 }
 
 
 // Response retrieves the original interaction response.
 func (ctx *Context) Response() (*discord.Message, error) {
-	return ctx.Session.InteractionResponse(ctx.Interaction)
+	return ctx.Session.InteractionResponse(ctx.Interaction, discord.WithContext(ctx.ctx))
+}
+
+
+// PrivateFollowup sends an embed only the user sees. The first followup of a deferred response takes the place of the
+// deferred message and keeps its visibility, Discord ignores the ephemeral flag on it. So a public deferred message is
+// deleted first and the embed is sent as an ephemeral message of its own, the next followups are new messages too.
+func (ctx *Context) PrivateFollowup(embed *discord.MessageEmbed) {
+	original, err := ctx.Response()
+	if err == nil && original.Flags&discord.MessageFlagsLoading != 0 && original.Flags&discord.MessageFlagsEphemeral == 0 {
+		if err := ctx.Session.InteractionResponseDelete(ctx.Interaction, discord.WithContext(ctx.ctx)); err != nil {
+			ctx.Logger.Warn("Failed to delete the deferred response", "error", err)
+		}
+	}
+	_, err = ctx.Session.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
+		Flags:  discord.MessageFlagsEphemeral,
+		Embeds: []*discord.MessageEmbed{embed},
+	}, discord.WithContext(ctx.ctx))
+	if err != nil {
+		ctx.Logger.Error("Failed to send followup message", "error", err)
+	}
 }
 
 
@@ -84,37 +155,65 @@ func (ctx *Context) Next() {
 	handler := ctx.handlers[0]
 	ctx.handlers = ctx.handlers[1:]
 
+	// every handler gets a span, the handlers it calls with Next become its children
+	parent := ctx.ctx
+	var span trace.Span
+	ctx.ctx, span = tracing.Start(parent, handlerName(handler))
+	defer func() {
+		span.End()
+		ctx.ctx = parent
+	}()
+
 	handler.HandleCommand(ctx)
 }
 
 // MessageContext represents the context in which a message-related command is executed.
+// Its Logger already carries the IDs of the message and a correlation ID.
 type MessageContext struct {
-	*discord.Session
+	session.Session
 	Caller  *Command
 	Message *discord.Message
+	Logger  *slog.Logger
 
+	ctx      context.Context
 	handlers []MessageHandler
+	tasks
 }
 
 
-// NewMessageContext creates a new MessageContext instance.
-func NewMessageContext(s *discord.Session, caller *Command, m *discord.Message, handlers []MessageHandler) *MessageContext {
+// NewMessageContext creates a new MessageContext instance, c carries the root span of the message.
+func NewMessageContext(c context.Context, s session.Session, caller *Command, m *discord.Message, handlers []MessageHandler) *MessageContext {
+	var userID string
+	if m.Author != nil {
+		userID = m.Author.ID
+	}
 	return &MessageContext{
 		Session: s,
 		Caller:  caller,
 		Message: m,
-
+		Logger: withTraceID(c, slog.Default().With(
+			"correlation_id", logging.NewCorrelationID(),
+			"guild_id", m.GuildID,
+			"channel_id", m.ChannelID,
+			"user_id", userID,
+			"message_id", m.ID,
+			"command", caller.Name,
+		)),
+
+		ctx:      c,
 		handlers: handlers,
 	}
 }
 
 // Reply sends a reply message in the same channel as the original message.
 func (ctx *MessageContext) Reply(content string) (m *discord.Message, err error) {
-	m, err = ctx.Session.ChannelMessageSendReply(
-		ctx.Message.ChannelID,
-		content,
-		ctx.Message.Reference(),
-	)
+	return ctx.ReplyComplex(&discord.MessageSend{Content: content})
+}
+
+// ReplyComplex sends the message, e.g. with embeds and files, as a reply in the same channel as the original message.
+func (ctx *MessageContext) ReplyComplex(data *discord.MessageSend) (m *discord.Message, err error) {
+	data.Reference = ctx.Message.Reference()
+	m, err = ctx.Session.ChannelMessageSendComplex(ctx.Message.ChannelID, data, discord.WithContext(ctx.ctx))
 	return
 }
 
@@ -122,29 +221,29 @@ func (ctx *MessageContext) Reply(content string) (m *discord.Message, err error)
 
 // EmbedReply sends a reply message with an embed in the same channel as the original message.
 func (ctx *MessageContext) EmbedReply(embed *discord.MessageEmbed) (m *discord.Message, err error) {
-	m, err = ctx.Session.ChannelMessageSendEmbedReply(
+	m, err = ctx.Session.ChannelMessageSendComplex(
 		ctx.Message.ChannelID,
-		embed,
-		ctx.Message.Reference(),
+		&discord.MessageSend{Embeds: []*discord.MessageEmbed{embed}, Reference: ctx.Message.Reference()},
+		discord.WithContext(ctx.ctx),
 	)
 	return
 }
 
 // AddReaction adds a reaction to the original message.
 func (ctx *MessageContext) AddReaction(emojiID string) error {
-	return ctx.Session.MessageReactionAdd(ctx.Message.ChannelID, ctx.Message.ID, emojiID)
+	return ctx.Session.MessageReactionAdd(ctx.Message.ChannelID, ctx.Message.ID, emojiID, discord.WithContext(ctx.ctx))
 }
 
 
 // RemoveReaction removes a reaction from the original message.
 func (ctx *MessageContext) RemoveReaction(emojiID string) error {
-	return ctx.Session.MessageReactionsRemoveEmoji(ctx.Message.ChannelID, ctx.Message.ID, emojiID)
+	return ctx.Session.MessageReactionsRemoveEmoji(ctx.Message.ChannelID, ctx.Message.ID, emojiID, discord.WithContext(ctx.ctx))
 }
 
 
 // ChannelTyping indicates that the bot is typing in the channel.
 func (ctx *MessageContext) ChannelTyping() error {
-	return ctx.Session.ChannelTyping(ctx.Message.ChannelID)
+	return ctx.Session.ChannelTyping(ctx.Message.ChannelID, discord.WithContext(ctx.ctx))
 }
 
 
@@ -157,5 +256,31 @@ func (ctx *MessageContext) Next() {
 	handler := ctx.handlers[0]
 	ctx.handlers = ctx.handlers[1:]
 
+	parent := ctx.ctx
+	var span trace.Span
+	ctx.ctx, span = tracing.Start(parent, handlerName(handler))
+	defer func() {
+		span.End()
+		ctx.ctx = parent
+	}()
+
 	handler.HandleMessageCommand(ctx)
 }
+
+// Context returns the context.Context of the running handler, see Context.Context.
+func (ctx *MessageContext) Context() context.Context {
+	return ctx.ctx
+}
+
+// handlerName returns the name of the handler function, e.g. "gpt.Command.func1", used as the name of its span.
+func handlerName(handler any) string {
+	v := reflect.ValueOf(handler)
+	if v.Kind() != reflect.Func {
+		return reflect.TypeOf(handler).String()
+	}
+	name := runtime.FuncForPC(v.Pointer()).Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
@@ -0,0 +1,80 @@
+package bot
+
+import (
+	"sync"
+	"time"
+
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// health keeps track of the gateway connection and the commands sync, driven by the gateway events.
+type health struct {
+	mu             sync.RWMutex
+	connected      bool
+	changed        time.Time
+	commandsSynced bool
+}
+
+// Health is a snapshot of the state of the bot, used by the readiness check.
+type Health struct {
+	// Connected is true while the gateway connection is open
+	Connected bool
+	// ConnectionChanged is when the bot connected or disconnected the last time
+	ConnectionChanged time.Time
+	// HeartbeatLatency is the time Discord took to acknowledge the last heartbeat. While an acknowledgement
+	// is outstanding, it is the time since the heartbeat was sent, so a dead connection shows up as a growing latency.
+	HeartbeatLatency time.Duration
+	// CommandsSynced is true once the commands were synced with every guild on startup
+	CommandsSynced bool
+}
+
+// The setConnected function records a change of the gateway connection.
+func (h *health) setConnected(connected bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = connected
+	h.changed = time.Now()
+}
+
+// The setCommandsSynced function records that the commands were synced.
+func (h *health) setCommandsSynced() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commandsSynced = true
+}
+
+// The addHealthHandlers function registers the gateway event handlers keeping the health up to date.
+func (b *Bot) addHealthHandlers() {
+	b.AddHandler(func(s *discord.Session, e *discord.Connect) {
+		b.health.setConnected(true)
+	})
+	b.AddHandler(func(s *discord.Session, e *discord.Resumed) {
+		b.health.setConnected(true)
+	})
+	b.AddHandler(func(s *discord.Session, e *discord.Disconnect) {
+		b.health.setConnected(false)
+	})
+}
+
+// Health returns the current state of the gateway connection and the commands sync.
+func (b *Bot) Health() Health {
+	b.health.mu.RLock()
+	h := Health{
+		Connected:         b.health.connected,
+		ConnectionChanged: b.health.changed,
+		CommandsSynced:    b.health.commandsSynced,
+	}
+	b.health.mu.RUnlock()
+
+	if h.Connected {
+		b.RLock()
+		sent, ack := b.LastHeartbeatSent, b.LastHeartbeatAck
+		b.RUnlock()
+		if ack.Before(sent) {
+			h.HeartbeatLatency = time.Since(sent)
+		} else {
+			h.HeartbeatLatency = ack.Sub(sent)
+		}
+	}
+	return h
+}
@@ -1,22 +1,36 @@
 package bot
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"reflect"
+	"sort"
+	"sync"
 
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/metrics"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/session"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/tracing"
 	"github.com/bwmarrin/discordgo"
 	discord "github.com/bwmarrin/discordgo"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Router manages application commands and their handlers.
 type Router struct {
+	mu                 sync.RWMutex
 	commands           map[string]*Command
-	registeredCommands []*discord.ApplicationCommand
+	registeredCommands map[string][]*discord.ApplicationCommand // keyed by guild ID, empty for global commands
+
+	inflight inflight
 }
 
 // The NewRouter function creates a new Router struct with an initial set of commands.
 func NewRouter(initial []*Command) (r *Router) {
-	r = &Router{commands: make(map[string]*Command, len(initial))}
+	r = &Router{
+		commands:           make(map[string]*Command, len(initial)),
+		registeredCommands: make(map[string][]*discord.ApplicationCommand),
+	}
 	for _, cmd := range initial {
 		r.Register(cmd)
 	}
@@ -26,28 +40,83 @@ func NewRouter(initial []*Command) (r *Router) {
 
 // The Register function adds a command to the commands map.
 func (r *Router) Register(cmd *Command) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if _, ok := r.commands[cmd.Name]; !ok {
 		r.commands[cmd.Name] = cmd
 	}
 }
 
+// The Replace function atomically swaps the whole set of commands with the given ones.
+// It is used on configuration reload, so in-flight interactions keep running with the old commands
+// while new interactions are routed to the new ones.
+// It reports whether the application command definitions changed, which means the commands have to be synced again.
+func (r *Router) Replace(cmds []*Command) (changed bool) {
+	before := r.definitions()
+
+	commands := make(map[string]*Command, len(cmds))
+	for _, cmd := range cmds {
+		if _, ok := commands[cmd.Name]; !ok {
+			commands[cmd.Name] = cmd
+		}
+	}
+
+	r.mu.Lock()
+	r.commands = commands
+	r.mu.Unlock()
+
+	return !reflect.DeepEqual(before, r.definitions())
+}
+
+// commandDefinition is what decides how a command is registered in Discord.
+type commandDefinition struct {
+	command *discord.ApplicationCommand
+	guilds  []string
+}
+
+// The definitions function returns the registration definitions of all commands, sorted by name.
+func (r *Router) definitions() (definitions []commandDefinition) {
+	for _, c := range r.List() {
+		definitions = append(definitions, commandDefinition{command: c.ApplicationCommand(), guilds: c.Guilds})
+	}
+	return
+}
+
+// The ApplicationCommands function returns the discord application commands that are enabled in the given guild,
+// sorted by name. An empty guild returns the commands that are registered globally.
+func (r *Router) ApplicationCommands(guild string) (commands []*discord.ApplicationCommand) {
+	for _, c := range r.List() {
+		if c.EnabledIn(guild) {
+			commands = append(commands, c.ApplicationCommand())
+		}
+	}
+	return
+}
+
 // The Get function retrieves a command from the commands map by name.
 func (r *Router) Get(name string) *Command {
 	if r == nil {
 		return nil
 	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.commands[name]
 }
 
-// The List function returns a slice of all commands in the commands map.
+// The List function returns a slice of all commands in the commands map, sorted by name.
 func (r *Router) List() (list []*Command) {
 	if r == nil {
 		return nil
 	}
 
+	r.mu.RLock()
 	for _, c := range r.commands {
 		list = append(list, c)
 	}
+	r.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
 	return
 }
 
@@ -56,6 +125,8 @@ func (r *Router) Count() (c int) {
 	if r == nil {
 		return 0
 	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return len(r.commands)
 }
 
@@ -81,6 +152,7 @@ func (r *Router) getMessageHandlers(cmd *Command) []MessageHandler {
 	var handlers []MessageHandler
 
 	if cmd.MessageHandler != nil {
+		handlers = append(handlers, cmd.MessageMiddlewares...)
 		handlers = append(handlers, cmd.MessageHandler)
 	}
 
@@ -93,6 +165,26 @@ func (r *Router) getMessageHandlers(cmd *Command) []MessageHandler {
 	return handlers
 }
 
+// The getMessageEventHandlers function is used to retrieve the handlers a command and its subcommands have for edited or
+// deleted messages, which middlewares and handler are picked by the handler function. These handlers run without the
+// message middlewares, the middlewares of the event only run when there is a handler.
+func (r *Router) getMessageEventHandlers(cmd *Command, handler func(cmd *Command) ([]MessageHandler, MessageHandler)) []MessageHandler {
+	var handlers []MessageHandler
+
+	if middlewares, h := handler(cmd); h != nil {
+		handlers = append(handlers, middlewares...)
+		handlers = append(handlers, h)
+	}
+
+	if cmd.SubCommands != nil {
+		for _, cmd := range cmd.SubCommands.List() {
+			handlers = append(handlers, r.getMessageEventHandlers(cmd, handler)...)
+		}
+	}
+
+	return handlers
+}
+
 // The HandleInteraction function is used to handle interaction events in the Discord bot.
 // It retrieves the command from the commands map based on the interaction data, and then retrieves the appropriate subcommand based on the interaction options.
 func (r *Router) HandleInteraction(s *discord.Session, i *discord.InteractionCreate) {
@@ -105,6 +197,10 @@ func (r *Router) HandleInteraction(s *discord.Session, i *discord.InteractionCre
 	if cmd == nil {
 		return
 	}
+	if len(cmd.Guilds) > 0 && !cmd.EnabledIn(i.GuildID) {
+		// the command may still be registered in a guild it was disabled in afterwards
+		return
+	}
 
 	var parent *discord.ApplicationCommandInteractionDataOption
 	handlers := append(cmd.Middlewares, cmd.Handler)
@@ -114,7 +210,27 @@ func (r *Router) HandleInteraction(s *discord.Session, i *discord.InteractionCre
 
 	// It then creates a new Context struct and calls the Next method to execute the command's handlers.
 	if cmd != nil {
-		ctx := NewContext(s, cmd, i.Interaction, parent, handlers)
+		if !r.inflight.begin() {
+			// the bot is shutting down, don't start anything new, but let the user know to try again
+			respondRestarting(s, i.Interaction)
+			return
+		}
+		defer r.inflight.done()
+
+		// only interactions that are handled are counted
+		path := CommandPath(i.Interaction)
+		metrics.Interactions.WithLabelValues(path).Inc()
+
+		// the root span of the interaction, the handlers add their spans below it
+		c, span := tracing.Start(context.Background(), "interaction "+path,
+			attribute.String("discord.guild_id", i.GuildID),
+			attribute.String("discord.channel_id", i.ChannelID),
+			attribute.String("discord.interaction_id", i.ID),
+		)
+		defer span.End()
+
+		ctx := NewContext(c, session.New(s), cmd, i.Interaction, parent, handlers)
+		ctx.tasks = tasks{wg: &r.inflight.wg}
 		ctx.Next()
 	}
 }
@@ -123,60 +239,112 @@ func (r *Router) HandleInteraction(s *discord.Session, i *discord.InteractionCre
 // It retrieves all message handlers for each command in the commands map and creates a new MessageContext struct for each handler.
 // It then calls the Next method to execute the message handlers.
 func (r *Router) HandleMessage(s *discord.Session, m *discord.MessageCreate) {
-	for _, cmd := range r.commands {
+	if !r.inflight.begin() {
+		// the bot is shutting down, don't start anything new
+		return
+	}
+	defer r.inflight.done()
+
+	for _, cmd := range r.List() {
 		handlers := r.getMessageHandlers(cmd)
 		if len(handlers) > 0 {
-			ctx := NewMessageContext(s, cmd, m.Message, handlers)
-			ctx.Next()
+			r.handleMessage(s, "message "+cmd.Name, cmd, m.Message, handlers)
+		}
+	}
+}
+
+// The HandleMessageUpdate function is used to handle edited messages, like HandleMessage it runs the update handlers of every command.
+// The message of the event holds the edited content, updates that don't change the content (e.g. embeds of links) come without an author.
+func (r *Router) HandleMessageUpdate(s *discord.Session, m *discord.MessageUpdate) {
+	if !r.inflight.begin() {
+		return
+	}
+	defer r.inflight.done()
+
+	for _, cmd := range r.List() {
+		handlers := r.getMessageEventHandlers(cmd, func(cmd *Command) ([]MessageHandler, MessageHandler) {
+			return cmd.MessageUpdateMiddlewares, cmd.MessageUpdateHandler
+		})
+		if len(handlers) > 0 {
+			r.handleMessage(s, "message update "+cmd.Name, cmd, m.Message, handlers)
 		}
 	}
 }
 
+// The HandleMessageDelete function is used to handle deleted messages, like HandleMessage it runs the delete handlers of every command.
+// Discord only sends the IDs of a deleted message, its content and author are gone.
+func (r *Router) HandleMessageDelete(s *discord.Session, m *discord.MessageDelete) {
+	if !r.inflight.begin() {
+		return
+	}
+	defer r.inflight.done()
+
+	for _, cmd := range r.List() {
+		handlers := r.getMessageEventHandlers(cmd, func(cmd *Command) ([]MessageHandler, MessageHandler) { return nil, cmd.MessageDeleteHandler })
+		if len(handlers) > 0 {
+			r.handleMessage(s, "message delete "+cmd.Name, cmd, m.Message, handlers)
+		}
+	}
+}
+
+// The handleMessage function runs the message handlers of a single command, under a root span of its own.
+func (r *Router) handleMessage(s *discord.Session, spanName string, cmd *Command, m *discord.Message, handlers []MessageHandler) {
+	c, span := tracing.Start(context.Background(), spanName,
+		attribute.String("discord.guild_id", m.GuildID),
+		attribute.String("discord.channel_id", m.ChannelID),
+		attribute.String("discord.message_id", m.ID),
+	)
+	defer span.End()
+
+	ctx := NewMessageContext(c, session.New(s), cmd, m, handlers)
+	ctx.tasks = tasks{wg: &r.inflight.wg}
+	ctx.Next()
+}
+
 // this is called in the bot.go file, takes in the particular discord session and the guildID
 // syncs the commands to the bot
 
 // Sync registers all the application commands in the router to the given guild using the provided session.
-// It returns an error if the session's user is nil or if there is an error in registering the commands.
-func (r *Router) Sync(s *discord.Session, guild string) (err error) {
-	//first we will check the user state in the session
-	//if it is nil, we will print out an error
-	if s.State.User == nil {
-		return fmt.Errorf("cannot determine application id")
-	}
-
-	//then we create a variable called commands which is of type ApplicationCommand struct
-	//this struct is mentioned in the command.go file
-	var commands []*discord.ApplicationCommand
-	//we will first range over all the commands one by one and each command is captured in c
-	//we will append all these specific application commands to the commands variable
-	for _, c := range r.commands {
-		commands = append(commands, c.ApplicationCommand())
+// Instead of overwriting every command, it fetches the currently registered commands and only creates,
+// edits or deletes the ones that changed, so commands never disappear for users during a deploy.
+// It returns an error if the application id cannot be determined or if there is an error in registering the commands.
+func (r *Router) Sync(s *discord.Session, guild string) error {
+	//first we compare the commands registered in discord with the commands in the router
+	plan, err := r.Plan(s, guild)
+	if err != nil {
+		return err
 	}
-	//the applicationcommandbulkoverwrite function helps us to register the commands that are
-	//now present in the commands variable, we just need to pass the user's id, guild and the list of commands
+	slog.Info("Syncing commands", "guild_id", guild, "plan", plan.String())
 
-	r.registeredCommands, err = s.ApplicationCommandBulkOverwrite(s.State.User.ID, guild, commands)
-	return
+	//then we apply only the changes, the unchanged commands are left alone
+	return r.Apply(s, plan)
 }
 
 // The ClearCommands function takes a discord.Session pointer and a string representing a guild ID as arguments.
 // The function is used to delete all registered commands for the bot from the Discord API.
+// A failed delete does not stop the function, it tries to remove every command and returns all the errors.
 func (r *Router) ClearCommands(s *discord.Session, guild string) (errors []error) { // The function first checks if the user associated with the session is not nil.
 	if s.State.User == nil { // If it is nil, it returns an error.
 		return []error{fmt.Errorf("cannot determine application id")}
 	}
 
 	// The function then iterates over all registered commands in the registeredCommands slice of the Router struct.
-	for _, v := range r.registeredCommands {
+	r.mu.Lock()
+	registered := r.registeredCommands[guild]
+	r.mu.Unlock()
+
+	var remaining []*discord.ApplicationCommand
+	for _, v := range registered {
 		err := s.ApplicationCommandDelete(s.State.User.ID, guild, v.ID)
 		if err != nil {
-			log.Panicf("Cannot delete '%v' command: %v", v.Name, err)
+			errors = append(errors, fmt.Errorf("cannot delete '%v' command: %w", v.Name, err))
+			remaining = append(remaining, v)
 		}
 	}
 
-	if len(errors) == 0 {
-		return nil
-	}
+	r.mu.Lock()
+	r.registeredCommands[guild] = remaining
+	r.mu.Unlock()
 
 	return errors
 }
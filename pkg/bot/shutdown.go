@@ -0,0 +1,96 @@
+package bot
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// inflight keeps track of the handlers that are currently running, including the goroutines they started
+// with Context.Go, so the bot can wait for them before shutting down.
+type inflight struct {
+	mu      sync.Mutex
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// begin registers a new handler. It returns false once the router is shutting down,
+// in which case the handler must not run.
+func (f *inflight) begin() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closing {
+		return false
+	}
+	f.wg.Add(1)
+	return true
+}
+
+// done marks a handler registered with begin as finished.
+func (f *inflight) done() {
+	f.wg.Done()
+}
+
+// The Shutdown function stops the router from accepting new interactions and messages and waits
+// for the in-flight handlers (and the goroutines they started) to finish.
+// It returns false if they did not finish before the timeout.
+func (r *Router) Shutdown(timeout time.Duration) bool {
+	r.inflight.mu.Lock()
+	r.inflight.closing = true
+	r.inflight.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		r.inflight.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// respondRestarting answers an interaction that came in while the bot is shutting down with an ephemeral notice,
+// so the user doesn't wait for an answer that never comes.
+func respondRestarting(s *discord.Session, i *discord.Interaction) {
+	err := s.InteractionRespond(i, &discord.InteractionResponse{
+		Type: discord.InteractionResponseChannelMessageWithSource,
+		Data: &discord.InteractionResponseData{
+			Flags: discord.MessageFlagsEphemeral,
+			Embeds: []*discord.MessageEmbed{{
+				Title:       "🔄 Restarting",
+				Description: "The bot is restarting, try again in a moment",
+				Color:       0xffa500,
+			}},
+		},
+	})
+	if err != nil {
+		slog.Warn("Failed to tell the user the bot is restarting", "interaction_id", i.ID, "error", err)
+	}
+}
+
+// tasks is passed to the contexts, so handlers can start goroutines that are waited for on shutdown.
+type tasks struct {
+	wg *sync.WaitGroup
+}
+
+// Go runs f in a new goroutine. If the goroutine was started by a handler, the router waits for it on shutdown.
+// It must only be called while the handler is running.
+func (t tasks) Go(f func()) {
+	if t.wg == nil {
+		go f()
+		return
+	}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		f()
+	}()
+}
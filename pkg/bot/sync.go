@@ -0,0 +1,250 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// SyncPlan describes the changes needed to bring the application commands registered
+// in Discord in line with the commands of the router.
+type SyncPlan struct {
+	Guild string
+
+	Create    []*discord.ApplicationCommand
+	Update    []*SyncUpdate
+	Delete    []*discord.ApplicationCommand
+	Unchanged []*discord.ApplicationCommand
+}
+
+// SyncUpdate is a registered command whose definition differs from the router one.
+type SyncUpdate struct {
+	// Current is the command registered in Discord
+	Current *discord.ApplicationCommand
+	// Desired is the command as defined in the router
+	Desired *discord.ApplicationCommand
+	// Changes lists the names of the fields that differ
+	Changes []string
+}
+
+// Empty reports whether the plan has nothing to create, update or delete.
+func (p *SyncPlan) Empty() bool {
+	return len(p.Create) == 0 && len(p.Update) == 0 && len(p.Delete) == 0
+}
+
+// String returns a human readable representation of the plan, one command per line.
+func (p *SyncPlan) String() string {
+	var b strings.Builder
+	guild := p.Guild
+	if guild == "" {
+		guild = "global"
+	}
+	fmt.Fprintf(&b, "Commands sync plan for guild %s: %d to create, %d to update, %d to delete, %d unchanged\n", guild, len(p.Create), len(p.Update), len(p.Delete), len(p.Unchanged))
+	for _, c := range p.Create {
+		fmt.Fprintf(&b, "  + %s\n", c.Name)
+	}
+	for _, u := range p.Update {
+		fmt.Fprintf(&b, "  ~ %s (%s)\n", u.Desired.Name, strings.Join(u.Changes, ", "))
+	}
+	for _, c := range p.Delete {
+		fmt.Fprintf(&b, "  - %s\n", c.Name)
+	}
+	for _, c := range p.Unchanged {
+		fmt.Fprintf(&b, "  = %s\n", c.Name)
+	}
+	return b.String()
+}
+
+// applicationID returns the application ID of the bot. It prefers the session state, which is populated
+// once the gateway connection is ready, and falls back to the REST API so commands can be synced without
+// opening the gateway connection.
+func applicationID(s *discord.Session) (string, error) {
+	if s.State != nil && s.State.User != nil {
+		return s.State.User.ID, nil
+	}
+	user, err := s.User("@me")
+	if err != nil {
+		return "", fmt.Errorf("cannot determine application id: %w", err)
+	}
+	return user.ID, nil
+}
+
+// The Plan function fetches the commands currently registered in the given guild (or globally, if the guild is empty)
+// and compares them against the commands of the router.
+func (r *Router) Plan(s *discord.Session, guild string) (*SyncPlan, error) {
+	appID, err := applicationID(s)
+	if err != nil {
+		return nil, err
+	}
+
+	registered, err := s.ApplicationCommands(appID, guild)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch registered commands: %w", err)
+	}
+
+	return diffCommands(guild, registered, r.ApplicationCommands(guild)), nil
+}
+
+// The Apply function creates, edits and deletes the commands as described in the plan.
+// It keeps going when a single command fails and returns all the errors joined together.
+func (r *Router) Apply(s *discord.Session, plan *SyncPlan) error {
+	appID, err := applicationID(s)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	registered := append([]*discord.ApplicationCommand(nil), plan.Unchanged...)
+	for _, c := range plan.Create {
+		created, err := s.ApplicationCommandCreate(appID, plan.Guild, c)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot create '%v' command: %w", c.Name, err))
+			continue
+		}
+		registered = append(registered, created)
+	}
+	for _, u := range plan.Update {
+		updated, err := s.ApplicationCommandEdit(appID, plan.Guild, u.Current.ID, u.Desired)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot update '%v' command: %w", u.Desired.Name, err))
+			registered = append(registered, u.Current)
+			continue
+		}
+		registered = append(registered, updated)
+	}
+	for _, c := range plan.Delete {
+		err := s.ApplicationCommandDelete(appID, plan.Guild, c.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot delete '%v' command: %w", c.Name, err))
+			registered = append(registered, c)
+		}
+	}
+
+	r.mu.Lock()
+	r.registeredCommands[plan.Guild] = registered
+	r.mu.Unlock()
+
+	return errors.Join(errs...)
+}
+
+// commandKey identifies a command, names are only unique per command type.
+func commandKey(c *discord.ApplicationCommand) string {
+	return fmt.Sprintf("%d/%s", normalizeCommandType(c.Type), c.Name)
+}
+
+// diffCommands compares the registered commands against the desired ones.
+func diffCommands(guild string, registered []*discord.ApplicationCommand, desired []*discord.ApplicationCommand) *SyncPlan {
+	plan := &SyncPlan{Guild: guild}
+
+	current := make(map[string]*discord.ApplicationCommand, len(registered))
+	for _, c := range registered {
+		current[commandKey(c)] = c
+	}
+
+	for _, c := range desired {
+		key := commandKey(c)
+		existing, ok := current[key]
+		if !ok {
+			plan.Create = append(plan.Create, c)
+			continue
+		}
+		delete(current, key)
+
+		if changes := commandChanges(existing, c, guild != ""); len(changes) > 0 {
+			plan.Update = append(plan.Update, &SyncUpdate{Current: existing, Desired: c, Changes: changes})
+		} else {
+			plan.Unchanged = append(plan.Unchanged, existing)
+		}
+	}
+
+	for _, c := range current {
+		plan.Delete = append(plan.Delete, c)
+	}
+	sort.Slice(plan.Delete, func(i, j int) bool { return plan.Delete[i].Name < plan.Delete[j].Name })
+
+	return plan
+}
+
+// commandChanges returns the names of the fields that differ between the registered and the desired command.
+// DM permission is ignored for guild commands, since it only applies to global ones.
+func commandChanges(current, desired *discord.ApplicationCommand, isGuild bool) (changes []string) {
+	if current.Description != desired.Description {
+		changes = append(changes, "description")
+	}
+	if !isGuild && boolOrDefault(current.DMPermission, true) != boolOrDefault(desired.DMPermission, true) {
+		changes = append(changes, "dm_permission")
+	}
+	if !reflect.DeepEqual(current.DefaultMemberPermissions, desired.DefaultMemberPermissions) {
+		changes = append(changes, "default_member_permissions")
+	}
+	if !reflect.DeepEqual(normalizeOptions(current.Options), normalizeOptions(desired.Options)) {
+		changes = append(changes, "options")
+	}
+	return
+}
+
+// normalizeCommandType treats an unset command type as a chat command, which is what Discord does.
+func normalizeCommandType(t discord.ApplicationCommandType) discord.ApplicationCommandType {
+	if t == 0 {
+		return discord.ChatApplicationCommand
+	}
+	return t
+}
+
+func boolOrDefault(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+// normalizedOption is the comparable subset of an application command option.
+type normalizedOption struct {
+	Type         discord.ApplicationCommandOptionType
+	Name         string
+	Description  string
+	ChannelTypes []discord.ChannelType
+	Required     bool
+	Autocomplete bool
+	Choices      []string
+	MinValue     *float64
+	MaxValue     float64
+	MinLength    *int
+	MaxLength    int
+	Options      []normalizedOption
+}
+
+// normalizeOptions converts the options into a form where values that Discord treats as equal compare equal
+// (e.g. empty and nil slices, or choice values that come back from the API as a different numeric type).
+func normalizeOptions(options []*discord.ApplicationCommandOption) []normalizedOption {
+	if len(options) == 0 {
+		return nil
+	}
+	normalized := make([]normalizedOption, 0, len(options))
+	for _, o := range options {
+		n := normalizedOption{
+			Type:         o.Type,
+			Name:         o.Name,
+			Description:  o.Description,
+			Required:     o.Required,
+			Autocomplete: o.Autocomplete,
+			MinValue:     o.MinValue,
+			MaxValue:     o.MaxValue,
+			MinLength:    o.MinLength,
+			MaxLength:    o.MaxLength,
+			Options:      normalizeOptions(o.Options),
+		}
+		if len(o.ChannelTypes) > 0 {
+			n.ChannelTypes = o.ChannelTypes
+		}
+		for _, c := range o.Choices {
+			n.Choices = append(n.Choices, fmt.Sprintf("%s=%v", c.Name, c.Value))
+		}
+		normalized = append(normalized, n)
+	}
+	return normalized
+}
@@ -0,0 +1,239 @@
+package bot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// planSummary is the part of a sync plan the tests compare, commands are identified by name.
+type planSummary struct {
+	Create    []string
+	Update    []string
+	Delete    []string
+	Unchanged []string
+}
+
+func summarizePlan(plan *SyncPlan) planSummary {
+	var s planSummary
+	for _, c := range plan.Create {
+		s.Create = append(s.Create, c.Name)
+	}
+	for _, u := range plan.Update {
+		s.Update = append(s.Update, u.Desired.Name+" ("+strings.Join(u.Changes, ", ")+")")
+	}
+	for _, c := range plan.Delete {
+		s.Delete = append(s.Delete, c.Name)
+	}
+	for _, c := range plan.Unchanged {
+		s.Unchanged = append(s.Unchanged, c.Name)
+	}
+	return s
+}
+
+func TestDiffCommands(t *testing.T) {
+	no := false
+	manageServer := int64(discord.PermissionManageServer)
+	administrator := int64(discord.PermissionAdministrator)
+
+	tests := []struct {
+		name       string
+		guild      string
+		registered []*discord.ApplicationCommand
+		desired    []*discord.ApplicationCommand
+		want       planSummary
+	}{
+		{
+			name:    "create",
+			desired: []*discord.ApplicationCommand{{Name: "chat", Description: "Start a chat"}},
+			want:    planSummary{Create: []string{"chat"}},
+		},
+		{
+			name: "delete",
+			registered: []*discord.ApplicationCommand{
+				{ID: "2", Name: "image", Description: "Generate an image"},
+				{ID: "1", Name: "chat", Description: "Start a chat"},
+			},
+			// deleted commands are sorted by name
+			want: planSummary{Delete: []string{"chat", "image"}},
+		},
+		{
+			name:       "unchanged",
+			registered: []*discord.ApplicationCommand{{ID: "1", Name: "chat", Type: discord.ChatApplicationCommand, Description: "Start a chat"}},
+			// an unset type is a chat command
+			desired: []*discord.ApplicationCommand{{Name: "chat", Description: "Start a chat"}},
+			want:    planSummary{Unchanged: []string{"chat"}},
+		},
+		{
+			name:       "update description",
+			registered: []*discord.ApplicationCommand{{ID: "1", Name: "chat", Description: "Chat"}},
+			desired:    []*discord.ApplicationCommand{{Name: "chat", Description: "Start a chat"}},
+			want:       planSummary{Update: []string{"chat (description)"}},
+		},
+		{
+			name:       "update options",
+			registered: []*discord.ApplicationCommand{{ID: "1", Name: "chat", Description: "Start a chat"}},
+			desired: []*discord.ApplicationCommand{{Name: "chat", Description: "Start a chat", Options: []*discord.ApplicationCommandOption{
+				{Type: discord.ApplicationCommandOptionString, Name: "prompt", Description: "The prompt"},
+			}}},
+			want: planSummary{Update: []string{"chat (options)"}},
+		},
+		{
+			name:       "same name different type",
+			registered: []*discord.ApplicationCommand{{ID: "1", Name: "chat", Type: discord.MessageApplicationCommand}},
+			desired:    []*discord.ApplicationCommand{{Name: "chat", Description: "Start a chat"}},
+			want:       planSummary{Create: []string{"chat"}, Delete: []string{"chat"}},
+		},
+		{
+			name:       "global dm permission",
+			registered: []*discord.ApplicationCommand{{ID: "1", Name: "chat", Description: "Start a chat"}},
+			desired:    []*discord.ApplicationCommand{{Name: "chat", Description: "Start a chat", DMPermission: &no}},
+			want:       planSummary{Update: []string{"chat (dm_permission)"}},
+		},
+		{
+			name:       "guild dm permission",
+			guild:      "guild",
+			registered: []*discord.ApplicationCommand{{ID: "1", Name: "chat", Description: "Start a chat"}},
+			// DM permission only applies to global commands
+			desired: []*discord.ApplicationCommand{{Name: "chat", Description: "Start a chat", DMPermission: &no}},
+			want:    planSummary{Unchanged: []string{"chat"}},
+		},
+		{
+			name:       "default member permissions set",
+			guild:      "guild",
+			registered: []*discord.ApplicationCommand{{ID: "1", Name: "acl", Description: "Access rules"}},
+			desired:    []*discord.ApplicationCommand{{Name: "acl", Description: "Access rules", DefaultMemberPermissions: &manageServer}},
+			want:       planSummary{Update: []string{"acl (default_member_permissions)"}},
+		},
+		{
+			name:       "default member permissions changed",
+			guild:      "guild",
+			registered: []*discord.ApplicationCommand{{ID: "1", Name: "acl", Description: "Access rules", DefaultMemberPermissions: &administrator}},
+			desired:    []*discord.ApplicationCommand{{Name: "acl", Description: "Access rules", DefaultMemberPermissions: &manageServer}},
+			want:       planSummary{Update: []string{"acl (default_member_permissions)"}},
+		},
+		{
+			name:  "mixed",
+			guild: "guild",
+			registered: []*discord.ApplicationCommand{
+				{ID: "1", Name: "chat", Description: "Start a chat"},
+				{ID: "2", Name: "image", Description: "Image"},
+				{ID: "3", Name: "old", Description: "Removed command"},
+			},
+			desired: []*discord.ApplicationCommand{
+				{Name: "chat", Description: "Start a chat"},
+				{Name: "image", Description: "Generate an image"},
+				{Name: "acl", Description: "Access rules"},
+			},
+			want: planSummary{
+				Create:    []string{"acl"},
+				Update:    []string{"image (description)"},
+				Delete:    []string{"old"},
+				Unchanged: []string{"chat"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := diffCommands(test.guild, test.registered, test.desired)
+			if plan.Guild != test.guild {
+				t.Errorf("plan guild = %q, want %q", plan.Guild, test.guild)
+			}
+			if got := summarizePlan(plan); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("plan = %+v, want %+v", got, test.want)
+			}
+			if plan.Empty() != (len(test.want.Create)+len(test.want.Update)+len(test.want.Delete) == 0) {
+				t.Errorf("plan.Empty() = %t for %+v", plan.Empty(), test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeOptions(t *testing.T) {
+	zero := 0.0
+	one := 1
+
+	tests := []struct {
+		name      string
+		current   []*discord.ApplicationCommandOption
+		desired   []*discord.ApplicationCommandOption
+		wantEqual bool
+	}{
+		{
+			name:      "nil and empty",
+			current:   nil,
+			desired:   []*discord.ApplicationCommandOption{},
+			wantEqual: true,
+		},
+		{
+			name:      "nil and empty channel types",
+			current:   []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionChannel, Name: "channel"}},
+			desired:   []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionChannel, Name: "channel", ChannelTypes: []discord.ChannelType{}}},
+			wantEqual: true,
+		},
+		{
+			// the API returns numbers as float64, the router defines them as int
+			name: "choice value types",
+			current: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionInteger, Name: "n", Choices: []*discord.ApplicationCommandOptionChoice{
+				{Name: "one", Value: float64(1)},
+				{Name: "two", Value: float64(2)},
+			}}},
+			desired: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionInteger, Name: "n", Choices: []*discord.ApplicationCommandOptionChoice{
+				{Name: "one", Value: 1},
+				{Name: "two", Value: 2},
+			}}},
+			wantEqual: true,
+		},
+		{
+			name: "choice value changed",
+			current: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionInteger, Name: "n", Choices: []*discord.ApplicationCommandOptionChoice{
+				{Name: "one", Value: float64(1)},
+			}}},
+			desired: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionInteger, Name: "n", Choices: []*discord.ApplicationCommandOptionChoice{
+				{Name: "one", Value: 2},
+			}}},
+		},
+		{
+			name:    "choices reordered",
+			current: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionString, Name: "model", Choices: []*discord.ApplicationCommandOptionChoice{{Name: "a", Value: "a"}, {Name: "b", Value: "b"}}}},
+			desired: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionString, Name: "model", Choices: []*discord.ApplicationCommandOptionChoice{{Name: "b", Value: "b"}, {Name: "a", Value: "a"}}}},
+		},
+		{
+			name:    "required",
+			current: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionString, Name: "prompt"}},
+			desired: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionString, Name: "prompt", Required: true}},
+		},
+		{
+			name:      "min value",
+			current:   []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionNumber, Name: "temperature", MinValue: &zero, MaxValue: 2}},
+			desired:   []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionNumber, Name: "temperature", MinValue: new(float64), MaxValue: 2}},
+			wantEqual: true,
+		},
+		{
+			name:    "min length",
+			current: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionString, Name: "prompt"}},
+			desired: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionString, Name: "prompt", MinLength: &one}},
+		},
+		{
+			name: "subcommand options",
+			current: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionSubCommand, Name: "gpt", Options: []*discord.ApplicationCommandOption{
+				{Type: discord.ApplicationCommandOptionString, Name: "prompt", Description: "The prompt"},
+			}}},
+			desired: []*discord.ApplicationCommandOption{{Type: discord.ApplicationCommandOptionSubCommand, Name: "gpt", Options: []*discord.ApplicationCommandOption{
+				{Type: discord.ApplicationCommandOptionString, Name: "prompt", Description: "Your question"},
+			}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			equal := reflect.DeepEqual(normalizeOptions(test.current), normalizeOptions(test.desired))
+			if equal != test.wantEqual {
+				t.Errorf("normalized options equal = %t, want %t", equal, test.wantEqual)
+			}
+		})
+	}
+}
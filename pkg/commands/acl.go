@@ -0,0 +1,263 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/commands/gpt"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+const aclCommandName = "acl"
+
+// aclListMaxLength keeps the list of rules within the embed description limit
+const aclListMaxLength = 4000
+
+// aclEffectDone describes the effect of a saved rule
+var aclEffectDone = map[acl.Effect]string{acl.Allow: "allowed", acl.Deny: "denied"}
+
+// aclManagePermissions are needed to change the rules. The command is only shown to members with the Manage Server
+// permission by default, but guild admins can change who sees it in the integration settings.
+const aclManagePermissions = discord.PermissionAdministrator | discord.PermissionManageServer
+
+// This file defines the acl command, which lets guild admins manage the access control rules of the bot.
+// Rules allow or deny a resource (a command, a model, an image size or chatting in threads) to a role, a user or a channel.
+
+// The aclSubjectOptions function returns the options shared by the allow, deny and remove subcommands:
+// the resource and the role, user or channel the rule applies to.
+func aclSubjectOptions() []*discord.ApplicationCommandOption {
+	return []*discord.ApplicationCommandOption{
+		{
+			Type:        discord.ApplicationCommandOptionString,
+			Name:        "resource",
+			Description: "command:<name>, model:<name>, image-size:<size> or thread-chat",
+			Required:    true,
+		},
+		{
+			Type:        discord.ApplicationCommandOptionRole,
+			Name:        "role",
+			Description: "Role the rule applies to (@everyone for all members)",
+		},
+		{
+			Type:        discord.ApplicationCommandOptionUser,
+			Name:        "user",
+			Description: "User the rule applies to",
+		},
+		{
+			Type:        discord.ApplicationCommandOptionChannel,
+			Name:        "channel",
+			Description: "Channel the rule applies to, including its threads",
+		},
+	}
+}
+
+// The parseACLRule function builds a rule from the options of the allow, deny and remove subcommands.
+// Exactly one of the role, user and channel options has to be set, and commands must be among the ones that check the rules.
+func parseACLRule(ctx *bot.Context, effect acl.Effect, commands []string) (acl.Rule, error) {
+	rule := acl.Rule{Effect: effect}
+
+	resource, err := acl.ParseResource(ctx.Options["resource"].StringValue(), commands)
+	if err != nil {
+		return rule, err
+	}
+	if kind, name, _ := strings.Cut(resource, ":"); kind == acl.ResourceModel && !gpt.IsKnownModel(name) {
+		return rule, fmt.Errorf("unknown model %q, known models are: %s", name, strings.Join(gpt.KnownModels(), ", "))
+	} else if kind == acl.ResourceImageSize && name != openai.CreateImageSize256x256 && name != openai.CreateImageSize512x512 && name != openai.CreateImageSize1024x1024 {
+		return rule, fmt.Errorf("unknown image size %q", name)
+	}
+	rule.Resource = resource
+
+	subjects := 0
+	if option, ok := ctx.Options["role"]; ok {
+		rule.SubjectType, rule.SubjectID = acl.SubjectRole, option.RoleValue(nil, "").ID
+		subjects++
+	}
+	if option, ok := ctx.Options["user"]; ok {
+		rule.SubjectType, rule.SubjectID = acl.SubjectUser, option.UserValue(nil).ID
+		subjects++
+	}
+	if option, ok := ctx.Options["channel"]; ok {
+		rule.SubjectType, rule.SubjectID = acl.SubjectChannel, option.ChannelValue(nil).ID
+		subjects++
+	}
+	if subjects != 1 {
+		return rule, fmt.Errorf("exactly one of role, user or channel has to be given")
+	}
+	return rule, nil
+}
+
+// The aclSubjectMention function formats the subject of the rule as a Discord mention.
+func aclSubjectMention(guildID string, rule acl.Rule) string {
+	switch rule.SubjectType {
+	case acl.SubjectRole:
+		if rule.SubjectID == guildID {
+			return "@everyone"
+		}
+		return "<@&" + rule.SubjectID + ">"
+	case acl.SubjectUser:
+		return "<@" + rule.SubjectID + ">"
+	case acl.SubjectChannel:
+		return "<#" + rule.SubjectID + ">"
+	}
+	return rule.SubjectID
+}
+
+// The aclRespond function sends an ephemeral embed, only the admin managing the rules needs to see it.
+func aclRespond(ctx *bot.Context, embed *discord.MessageEmbed) {
+	err := ctx.Respond(&discord.InteractionResponse{
+		Type: discord.InteractionResponseChannelMessageWithSource,
+		Data: &discord.InteractionResponseData{
+			Flags:  discord.MessageFlagsEphemeral,
+			Embeds: []*discord.MessageEmbed{embed},
+		},
+	})
+	if err != nil {
+		ctx.Logger.Error("Failed to respond to interaction", "error", err)
+	}
+}
+
+// The aclErrorEmbed function returns the red error embed used across the bot.
+func aclErrorEmbed(err error) *discord.MessageEmbed {
+	return &discord.MessageEmbed{
+		Title:       "❌ Error",
+		Description: err.Error(),
+		Color:       0xff0000,
+	}
+}
+
+// The aclCanManage function checks that the member using the command may change the rules, and tells them otherwise.
+func aclCanManage(ctx *bot.Context) bool {
+	if member := ctx.Interaction.Member; member != nil && member.Permissions&aclManagePermissions != 0 {
+		return true
+	}
+	ctx.Logger.Info("User is not allowed to change the access rules")
+	aclRespond(ctx, aclErrorEmbed(fmt.Errorf("you need the Manage Server permission to change the access rules")))
+	return false
+}
+
+// The aclSetHandler function handles the allow and deny subcommands, which add a rule or change the effect of an existing one.
+func aclSetHandler(ctx *bot.Context, store *acl.Store, effect acl.Effect, commands []string) {
+	if !aclCanManage(ctx) {
+		return
+	}
+	rule, err := parseACLRule(ctx, effect, commands)
+	if err == nil {
+		err = store.Set(ctx.Interaction.GuildID, rule)
+	}
+	if err != nil {
+		ctx.Logger.Error("Failed to set access rule", "effect", effect, "error", err)
+		aclRespond(ctx, aclErrorEmbed(err))
+		return
+	}
+
+	ctx.Logger.Info("Access rule set", "effect", rule.Effect, "resource", rule.Resource, "subject_type", rule.SubjectType, "subject_id", rule.SubjectID)
+	aclRespond(ctx, &discord.MessageEmbed{
+		Title:       "✅ Rule saved",
+		Description: fmt.Sprintf("`%s` is now %s for %s", rule.Resource, aclEffectDone[rule.Effect], aclSubjectMention(ctx.Interaction.GuildID, rule)),
+		Color:       0x00bfff,
+	})
+}
+
+// The aclRemoveHandler function handles the remove subcommand, which deletes the rule for a resource and subject.
+func aclRemoveHandler(ctx *bot.Context, store *acl.Store, commands []string) {
+	if !aclCanManage(ctx) {
+		return
+	}
+	rule, err := parseACLRule(ctx, "", commands)
+	var removed bool
+	if err == nil {
+		removed, err = store.Remove(ctx.Interaction.GuildID, rule)
+	}
+	if err == nil && !removed {
+		err = fmt.Errorf("there is no rule for `%s` and %s", rule.Resource, aclSubjectMention(ctx.Interaction.GuildID, rule))
+	}
+	if err != nil {
+		ctx.Logger.Error("Failed to remove access rule", "error", err)
+		aclRespond(ctx, aclErrorEmbed(err))
+		return
+	}
+
+	ctx.Logger.Info("Access rule removed", "resource", rule.Resource, "subject_type", rule.SubjectType, "subject_id", rule.SubjectID)
+	aclRespond(ctx, &discord.MessageEmbed{
+		Title:       "✅ Rule removed",
+		Description: fmt.Sprintf("Rule for `%s` and %s was removed", rule.Resource, aclSubjectMention(ctx.Interaction.GuildID, rule)),
+		Color:       0x00bfff,
+	})
+}
+
+// The aclListHandler function handles the list subcommand, which shows all the rules of the guild.
+func aclListHandler(ctx *bot.Context, store *acl.Store) {
+	rules := store.Rules(ctx.Interaction.GuildID)
+	if len(rules) == 0 {
+		aclRespond(ctx, &discord.MessageEmbed{
+			Title:       "Access rules",
+			Description: "There are no rules, everybody can use every feature",
+			Color:       0x00bfff,
+		})
+		return
+	}
+
+	var list strings.Builder
+	for i, rule := range rules {
+		line := fmt.Sprintf("`%s` %s %s\n", rule.Resource, rule.Effect, aclSubjectMention(ctx.Interaction.GuildID, rule))
+		if list.Len()+len(line) > aclListMaxLength {
+			fmt.Fprintf(&list, "... and %d more", len(rules)-i)
+			break
+		}
+		list.WriteString(line)
+	}
+	aclRespond(ctx, &discord.MessageEmbed{
+		Title:       "Access rules",
+		Description: list.String(),
+		Color:       0x00bfff,
+	})
+}
+
+// The ACLCommand function returns a bot.Command struct that represents the acl command for the Discord bot.
+// The command is named acl and is used by guild admins to allow or deny bot features per role, user and channel.
+// DefaultMemberPermissions field is set to discord.PermissionManageServer, which means only members that can manage the server see the command.
+// Rules can be set for the commands given in commands, the resources of the commands that check them (see acl.EnforcedCommands).
+func ACLCommand(store *acl.Store, commands []string) *bot.Command {
+	return &bot.Command{
+		Name:                     aclCommandName,
+		Description:              "Manage who can use the bot features",
+		DMPermission:             false,
+		DefaultMemberPermissions: discord.PermissionManageServer,
+		SubCommands: bot.NewRouter([]*bot.Command{
+			{
+				Name:        string(acl.Allow),
+				Description: "Allow a resource to a role, user or channel",
+				Options:     aclSubjectOptions(),
+				Handler: bot.HandlerFunc(func(ctx *bot.Context) {
+					aclSetHandler(ctx, store, acl.Allow, commands)
+				}),
+			},
+			{
+				Name:        string(acl.Deny),
+				Description: "Deny a resource to a role, user or channel",
+				Options:     aclSubjectOptions(),
+				Handler: bot.HandlerFunc(func(ctx *bot.Context) {
+					aclSetHandler(ctx, store, acl.Deny, commands)
+				}),
+			},
+			{
+				Name:        "remove",
+				Description: "Remove the rule for a resource and a role, user or channel",
+				Options:     aclSubjectOptions(),
+				Handler: bot.HandlerFunc(func(ctx *bot.Context) {
+					aclRemoveHandler(ctx, store, commands)
+				}),
+			},
+			{
+				Name:        "list",
+				Description: "List the access rules of the server",
+				Handler: bot.HandlerFunc(func(ctx *bot.Context) {
+					aclListHandler(ctx, store)
+				}),
+			},
+		}),
+	}
+}
@@ -1,27 +1,65 @@
 package commands
 
 import (
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/audit"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/commands/gpt"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/preferences"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/ratelimit"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
 	discord "github.com/bwmarrin/discordgo"
 	"github.com/sashabaranov/go-openai"
 )
 
 const chatCommandName = "chat"
 
+// Names of the rate limits that can be configured for the chat command
+const (
+	// GPTRateLimit limits how often a user can start a conversation with /chat gpt
+	GPTRateLimit = "gpt"
+	// GPTMessagesRateLimit limits how often a user can send messages in GPT threads
+	GPTMessagesRateLimit = "gptMessages"
+)
+
 // The ChatCommandParams struct defines parameters for the ChatCommand function. 
-// These parameters include an OpenAI client, a slice of OpenAI completion models, a cache for GPT messages, and a cache for ignored channels.
+// These parameters include an OpenAI client, a slice of OpenAI completion models, a cache for GPT messages, a cache for ignored channels,
+// the queue all OpenAI requests go through, the rate limiter with the configured rate limits, keyed by their names,
+// the access control rules, the moderation service for prompts and answers, the audit log, the policies for posting answers and the preferences of the users.
 type ChatCommandParams struct {
 	OpenAIClient           *openai.Client
 	OpenAICompletionModels []string
 	GPTMessagesCache       *gpt.MessagesCache
 	IgnoredChannelsCache   *gpt.IgnoredChannelsCache
+	OpenAIRequests         *queue.Pool
+	RateLimiter            *ratelimit.Limiter
+	RateLimits             map[string]ratelimit.Rule
+	ACL                    *acl.Store
+	Moderation             *moderation.Service
+	Audit                  *audit.Logger
+	Answers                render.Config
+	Preferences            *preferences.Store
 }
 
 
 // The ChatCommand function returns a bot.Command struct that represents a chat command for the Discord bot. 
 // The command is named chat and is used to start a conversation with an AI language model. 
 func ChatCommand(params *ChatCommandParams) *bot.Command {      // The ChatCommand function is used to define a chat command for the bot that starts a conversation with an AI language model.
+	gptCommand := gpt.Command(params.OpenAIClient, params.OpenAICompletionModels, params.GPTMessagesCache, params.IgnoredChannelsCache, params.OpenAIRequests, params.ACL, params.Moderation, params.Audit, params.Answers, params.Preferences)
+	// The rate limit middlewares go in front of the command middlewares, so throttled users are answered before anything else happens.
+	// Thread messages are limited after the GPT thread filter, so messages that are not meant for the bot don't use up the budget.
+	if rule, ok := params.RateLimits[GPTRateLimit]; ok {
+		gptCommand.Middlewares = append([]bot.Handler{ratelimit.Middleware(params.RateLimiter, GPTRateLimit, rule, params.Audit)}, gptCommand.Middlewares...)
+	}
+	if rule, ok := params.RateLimits[GPTMessagesRateLimit]; ok {
+		// answers generated again for edited messages use up the same budget as new messages
+		messagesRateLimit := ratelimit.MessageMiddleware(params.RateLimiter, GPTMessagesRateLimit, rule, params.Audit)
+		gptCommand.MessageMiddlewares = append(gptCommand.MessageMiddlewares, messagesRateLimit)
+		gptCommand.MessageUpdateMiddlewares = append(gptCommand.MessageUpdateMiddlewares, messagesRateLimit)
+	}
+
 	return &bot.Command{				     					
 		Name:                     chatCommandName,
 		Description:              "Start conversation with LLM",
@@ -30,11 +68,20 @@ func ChatCommand(params *ChatCommandParams) *bot.Command {      // The ChatComma
 		Type:                     discord.ChatApplicationCommand, // The Type field is set to discord.ChatApplicationCommand, which means that the command is a chat command.
 
 
-		// The SubCommands field is set to a bot.Router struct that contains a single subcommand, which is defined by the gpt.Command function. 
+		// The SubCommands field is set to a bot.Router struct that contains the gpt subcommand, which is defined by the gpt.Command function, the settings subcommand and the export and import subcommands. 
 		// The gpt.Command function takes the OpenAI client, the OpenAI completion models, the GPT messages cache, and the ignored channels cache as arguments, and returns a bot.
 		SubCommands: bot.NewRouter([]*bot.Command{
-			gpt.Command(params.OpenAIClient, params.OpenAICompletionModels, params.GPTMessagesCache, params.IgnoredChannelsCache), // Command struct that represents a GPT command for the Discord bot.
+			gptCommand, // Command struct that represents a GPT command for the Discord bot.
+			settingsCommand(params.Preferences, params.ACL, params.Answers), // lets users choose how the answers for them are posted
+			gpt.ExportCommand(params.GPTMessagesCache, params.ACL, params.OpenAICompletionModels), // sends the conversation of a GPT thread as a file
+			gpt.ImportCommand(params.GPTMessagesCache, params.OpenAICompletionModels, params.ACL, params.Moderation, params.Audit), // starts a GPT thread from a conversation file
 
 		}),				//  The gpt.Command function is used to define a subcommand for the chat command that uses the GPT language model.
 	}
 }
+
+// The ForkCommand function returns the message command that forks the conversation of a GPT thread at a message into a new thread.
+// It is a command of its own, because message commands show up in the apps menu of messages and can't be subcommands.
+func ForkCommand(params *ChatCommandParams) *bot.Command {
+	return gpt.ForkCommand(params.GPTMessagesCache, params.OpenAICompletionModels, params.ACL, params.Audit)
+}
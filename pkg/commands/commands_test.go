@@ -0,0 +1,941 @@
+package commands_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/commands"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/commands/gpt"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/discordtest"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/golden"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/metrics"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/openaitest"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/preferences"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/ratelimit"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sashabaranov/go-openai"
+)
+
+// testBot is the bot with the chat and image commands, connected to a fake Discord and a fake OpenAI.
+type testBot struct {
+	discord *discordtest.Server
+	session *discord.Session
+	openAI  *openaitest.Server
+	guild   *discord.Guild
+	channel *discord.Channel
+	user    *discord.User
+	access  *acl.Store
+	router  *bot.Router
+}
+
+// newTestBot starts the bot with the moderation policies of moderationConfig, the options change the parameters of the chat command.
+func newTestBot(t *testing.T, moderationConfig moderation.Config, options ...func(params *commands.ChatCommandParams)) *testBot {
+	b := &testBot{discord: discordtest.NewServer(t), openAI: openaitest.NewServer(t)}
+	client := b.openAI.Client()
+
+	messagesCache, err := gpt.NewMessagesCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignoredChannelsCache, err := gpt.NewIgnoredChannelsCache(16, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := queue.New(2, 16, nil)
+	t.Cleanup(requests.Close)
+	access, err := acl.Open(filepath.Join(t.TempDir(), "acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.access = access
+	moderator := moderation.New(client, moderationConfig, nil)
+	prefs, err := preferences.Open(filepath.Join(t.TempDir(), "preferences.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chatParams := &commands.ChatCommandParams{
+		OpenAIClient:         client,
+		GPTMessagesCache:     messagesCache,
+		IgnoredChannelsCache: ignoredChannelsCache,
+		OpenAIRequests:       requests,
+		ACL:                  access,
+		Moderation:           moderator,
+		Preferences:          prefs,
+	}
+	for _, option := range options {
+		option(chatParams)
+	}
+	cmds := []*bot.Command{
+		commands.ChatCommand(chatParams),
+		commands.ForkCommand(chatParams),
+		commands.ImageCommand(&commands.ImageCommandParams{
+			OpenAIClient:   client,
+			OpenAIRequests: requests,
+			ACL:            access,
+			Moderation:     moderator,
+		}),
+	}
+	router := bot.NewRouter(append(cmds, commands.ACLCommand(access, acl.EnforcedCommands(cmds))))
+	b.router = router
+
+	b.session = b.discord.Session()
+	b.session.AddHandler(router.HandleInteraction)
+	b.session.AddHandler(router.HandleMessage)
+	b.session.AddHandler(router.HandleMessageUpdate)
+	b.session.AddHandler(router.HandleMessageDelete)
+
+	b.channel = &discord.Channel{ID: b.discord.NewID(), Name: "general", Type: discord.ChannelTypeGuildText}
+	b.guild = &discord.Guild{ID: b.discord.NewID(), Name: "test", Channels: []*discord.Channel{b.channel}}
+	b.user = &discord.User{ID: b.discord.NewID(), Username: "alice"}
+	b.discord.AddGuild(b.guild)
+	b.discord.WaitFor("the guild to be in the state", func() bool {
+		_, err := b.session.State.Channel(b.channel.ID)
+		return err == nil
+	})
+	return b
+}
+
+// command invokes a slash command with a single subcommand in the test channel.
+func (b *testBot) command(name string, subcommand string, options ...*discord.ApplicationCommandInteractionDataOption) *discord.Interaction {
+	return b.commandIn(b.channel.ID, name, subcommand, options...)
+}
+
+// commandIn invokes a slash command with a single subcommand in the channel or thread.
+func (b *testBot) commandIn(channelID string, name string, subcommand string, options ...*discord.ApplicationCommandInteractionDataOption) *discord.Interaction {
+	return b.discord.Interact(&discord.Interaction{
+		Type:      discord.InteractionApplicationCommand,
+		GuildID:   b.guild.ID,
+		ChannelID: channelID,
+		Member:    &discord.Member{User: b.user, GuildID: b.guild.ID},
+		Data: discord.ApplicationCommandInteractionData{
+			ID:   b.discord.NewID(),
+			Name: name,
+			Options: []*discord.ApplicationCommandInteractionDataOption{{
+				Name:    subcommand,
+				Type:    discord.ApplicationCommandOptionSubCommand,
+				Options: options,
+			}},
+		},
+	})
+}
+
+func stringOption(name string, value string) *discord.ApplicationCommandInteractionDataOption {
+	return &discord.ApplicationCommandInteractionDataOption{Name: name, Type: discord.ApplicationCommandOptionString, Value: value}
+}
+
+func boolOption(name string, value bool) *discord.ApplicationCommandInteractionDataOption {
+	return &discord.ApplicationCommandInteractionDataOption{Name: name, Type: discord.ApplicationCommandOptionBoolean, Value: value}
+}
+
+// startChat runs /chat gpt and waits until the answer is posted in the new thread and the thread is unlocked.
+func (b *testBot) startChat(t *testing.T, prompt string) *discord.Channel {
+	t.Helper()
+	b.command("chat", "gpt", stringOption("prompt", prompt))
+
+	var thread *discord.Channel
+	b.discord.WaitFor("the thread to be created", func() bool {
+		threads := b.discord.Threads()
+		if len(threads) == 0 {
+			return false
+		}
+		thread = threads[0]
+		return true
+	})
+	b.discord.WaitFor("the answer and the usage", func() bool {
+		messages := b.discord.Messages(thread.ID)
+		return len(messages) == 1 && len(messages[0].Embeds) == 1
+	})
+	// the update is dispatched before the next event the test sends, the session sees the thread unlocked then
+	b.discord.WaitFor("the thread to be unlocked", func() bool {
+		return !b.discord.Channel(thread.ID).ThreadMetadata.Locked
+	})
+	return thread
+}
+
+func TestChatGPTCommand(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+	b.openAI.Respond(openaitest.EndpointCompletions, openaitest.Completion("Greetings", openai.Usage{}))
+	thread := b.startChat(t, "Hello there")
+
+	if thread.ParentID != b.channel.ID {
+		t.Errorf("thread parent = %s, want %s", thread.ParentID, b.channel.ID)
+	}
+
+	// the interaction reply holds the prompt, the thread is started from it
+	reply := b.discord.Message(b.channel.ID, thread.ID)
+	if reply == nil || len(reply.Embeds) != 1 || reply.Embeds[0].Description != "Hello there" {
+		t.Fatalf("interaction reply = %+v, want an embed with the prompt", reply)
+	}
+
+	answer := b.discord.Messages(thread.ID)[0]
+	if answer.Content != "You said: Hello there" {
+		t.Errorf("answer = %q, want %q", answer.Content, "You said: Hello there")
+	}
+	if footer := answer.Embeds[0].Footer; footer == nil || !strings.Contains(footer.Text, "Completion Tokens: 4") {
+		t.Errorf("usage footer = %+v, want the completion tokens", footer)
+	}
+
+	b.discord.WaitFor("the thread title", func() bool {
+		return b.discord.Channel(thread.ID).Name == "Greetings"
+	})
+
+	var locks []bool
+	for _, r := range b.discord.Requests() {
+		if r.Method == http.MethodPatch && r.Path == "channels/"+thread.ID && strings.Contains(string(r.Body), "locked") {
+			var edit discord.ChannelEdit
+			json.Unmarshal(r.Body, &edit)
+			locks = append(locks, *edit.Locked)
+		}
+	}
+	if len(locks) != 2 || !locks[0] || locks[1] {
+		t.Errorf("thread locks = %v, want locked while answering and unlocked afterwards", locks)
+	}
+}
+
+func TestChatGPTModeration(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy moderation.Policy
+		// thread reports whether the bot starts a chat after the notice
+		thread bool
+	}{
+		{name: "blocked"},
+		{name: "warned", policy: moderation.Policy{Action: moderation.ActionWarn}, thread: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBot(t, moderation.Config{Policy: test.policy})
+			i := b.command("chat", "gpt", stringOption("prompt", "Hello there "+openaitest.FlaggedMarker))
+
+			b.discord.WaitFor("the moderation notice", func() bool {
+				return len(b.discord.Followups(i)) > 0
+			})
+			// the notice is only shown to the user, the public deferred response is deleted for it
+			notice := b.discord.Followups(i)[0]
+			if notice.Flags&discord.MessageFlagsEphemeral == 0 {
+				t.Errorf("notice flags = %d, want ephemeral", notice.Flags)
+			}
+			if !test.thread {
+				if original := b.discord.Original(i); original != nil {
+					t.Errorf("original = %+v, want it deleted", original)
+				}
+				return
+			}
+
+			b.discord.WaitFor("the thread to be created", func() bool {
+				return len(b.discord.Threads()) == 1
+			})
+			// the thread is started from the public request embed, not from the notice
+			thread := b.discord.Threads()[0]
+			request := b.discord.Message(b.channel.ID, thread.ID)
+			if request == nil || request.Flags&discord.MessageFlagsEphemeral != 0 || len(request.Embeds) != 1 {
+				t.Errorf("thread starter = %+v, want the public request embed", request)
+			}
+		})
+	}
+}
+
+func TestChatGPTFailedRequestUnlocksThread(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+	b.openAI.Respond(openaitest.EndpointChatCompletions, openaitest.Error(http.StatusInternalServerError, "server_error", "The server had an error"))
+	b.command("chat", "gpt", stringOption("prompt", "Hello there"))
+
+	var thread *discord.Channel
+	b.discord.WaitFor("the thread to be created", func() bool {
+		threads := b.discord.Threads()
+		if len(threads) == 0 {
+			return false
+		}
+		thread = threads[0]
+		return true
+	})
+	b.discord.WaitFor("the error", func() bool {
+		messages := b.discord.Messages(thread.ID)
+		return len(messages) == 1 && len(messages[0].Embeds) == 1 && messages[0].Embeds[0].Title == "❌ OpenAI API failed"
+	})
+	b.discord.WaitFor("the thread to be unlocked", func() bool {
+		return !b.discord.Channel(thread.ID).ThreadMetadata.Locked
+	})
+}
+
+func TestChatGPTCodeAttachment(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+	var code strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&code, "\tfmt.Println(%d)\n", i)
+	}
+	b.openAI.Respond(openaitest.EndpointChatCompletions, openaitest.ChatCompletion("Here you go:\n```go\n"+code.String()+"```\nRun it with go run.", openai.Usage{}))
+	thread := b.startChat(t, "Print 40 numbers in Go")
+
+	answer := b.discord.Messages(thread.ID)[0]
+	want := "Here you go:\n📎 `main.go` (40 lines)\nRun it with go run."
+	if answer.Content != want {
+		t.Errorf("answer = %q, want %q", answer.Content, want)
+	}
+	files := b.discord.Files(answer.ID)
+	if len(files) != 1 || files[0].Name != "main.go" {
+		t.Fatalf("files = %+v, want main.go", files)
+	}
+	content, err := io.ReadAll(files[0].Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != code.String() {
+		t.Errorf("main.go = %q, want the code block", content)
+	}
+}
+
+func TestChatSettings(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+	i := b.command("chat", "settings", stringOption("render", "embed"))
+
+	var responses []*discord.InteractionResponse
+	b.discord.WaitFor("the settings", func() bool {
+		responses = b.discord.InteractionResponses(i)
+		return len(responses) == 1
+	})
+	if data := responses[0].Data; data.Flags&discord.MessageFlagsEphemeral == 0 || data.Embeds[0].Description != "Answers are posted in `embed` mode" {
+		t.Errorf("settings response = %+v, want the mode in an ephemeral message", data)
+	}
+
+	// the answers for the user are posted in embeds from now on
+	thread := b.startChat(t, "Hello there")
+	answer := b.discord.Messages(thread.ID)[0]
+	if answer.Content != "" || answer.Embeds[0].Description != "You said: Hello there" {
+		t.Errorf("answer = %q with embeds %+v, want the answer in an embed", answer.Content, answer.Embeds)
+	}
+	if footer := answer.Embeds[0].Footer; footer == nil || !strings.HasPrefix(footer.Text, "gpt-3.5-turbo • Completion Tokens: 4") {
+		t.Errorf("footer = %+v, want the model and the usage", footer)
+	}
+}
+
+func TestChatExport(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+	thread := b.startChat(t, "Hello there")
+
+	i := b.commandIn(thread.ID, "chat", "export", stringOption("format", "json"))
+	var export *discord.Message
+	b.discord.WaitFor("the export", func() bool {
+		followups := b.discord.Followups(i)
+		if len(followups) == 0 {
+			return false
+		}
+		export = followups[0]
+		return true
+	})
+	if export.Flags&discord.MessageFlagsEphemeral == 0 {
+		t.Errorf("export flags = %d, want an ephemeral message", export.Flags)
+	}
+	files := b.discord.Files(export.ID)
+	if len(files) != 1 || files[0].Name != "conversation-"+thread.ID+".json" {
+		t.Fatalf("files = %+v, want the conversation as JSON", files)
+	}
+	var conversation struct {
+		Model    string `json:"model"`
+		Messages []struct {
+			Role    string        `json:"role"`
+			Content string        `json:"content"`
+			Time    time.Time     `json:"time"`
+			Usage   *openai.Usage `json:"usage"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(files[0].Reader).Decode(&conversation); err != nil {
+		t.Fatal(err)
+	}
+	if conversation.Model != openai.GPT3Dot5Turbo || len(conversation.Messages) != 2 {
+		t.Fatalf("conversation = %+v, want the prompt and the answer", conversation)
+	}
+	prompt, answer := conversation.Messages[0], conversation.Messages[1]
+	if prompt.Role != openai.ChatMessageRoleUser || prompt.Content != "Hello there" || prompt.Time.IsZero() {
+		t.Errorf("prompt = %+v, want the prompt with its time", prompt)
+	}
+	if answer.Role != openai.ChatMessageRoleAssistant || answer.Usage == nil || answer.Usage.CompletionTokens != 4 {
+		t.Errorf("answer = %+v, want the answer with its usage", answer)
+	}
+
+	// the file can be sent as a direct message instead
+	i = b.commandIn(thread.ID, "chat", "export", boolOption("dm", true))
+	b.discord.WaitFor("the direct message", func() bool {
+		return len(b.discord.Followups(i)) == 1
+	})
+	dm := b.discord.DMChannel(b.user.ID)
+	if dm == nil {
+		t.Fatal("no direct message channel was opened")
+	}
+	messages := b.discord.Messages(dm.ID)
+	if len(messages) != 1 || len(b.discord.Files(messages[0].ID)) != 1 || b.discord.Files(messages[0].ID)[0].Name != "conversation-"+thread.ID+".md" {
+		t.Errorf("direct messages = %+v, want the conversation as Markdown", messages)
+	}
+	if reply := b.discord.Followups(i)[0]; reply.Content != "📬 Sent you the conversation as a direct message" {
+		t.Errorf("reply = %q, want a note about the direct message", reply.Content)
+	}
+
+	// there is nothing to export outside of GPT threads
+	i = b.command("chat", "export")
+	b.discord.WaitFor("the error", func() bool {
+		return len(b.discord.Followups(i)) == 1
+	})
+	if reply := b.discord.Followups(i)[0]; len(reply.Embeds) != 1 || reply.Embeds[0].Description != "This command can only be used in a GPT thread" {
+		t.Errorf("reply = %+v, want an error", reply.Embeds)
+	}
+}
+
+// TestChatDeniedSubcommands checks that the subcommands of chat that only read or change what is stored check the rules too.
+func TestChatDeniedSubcommands(t *testing.T) {
+	for _, subcommand := range []string{"export", "settings"} {
+		t.Run(subcommand, func(t *testing.T) {
+			b := newTestBot(t, moderation.Config{})
+			thread := b.startChat(t, "Hello there")
+			rule := acl.Rule{Resource: acl.CommandResource(subcommand), SubjectType: acl.SubjectUser, SubjectID: b.user.ID, Effect: acl.Deny}
+			if err := b.access.Set(b.guild.ID, rule); err != nil {
+				t.Fatal(err)
+			}
+
+			i := b.commandIn(thread.ID, "chat", subcommand)
+			var responses []*discord.InteractionResponse
+			b.discord.WaitFor("the response", func() bool {
+				responses = b.discord.InteractionResponses(i)
+				return len(responses) == 1
+			})
+			data := responses[0].Data
+			if data.Flags&discord.MessageFlagsEphemeral == 0 || len(data.Embeds) != 1 || data.Embeds[0].Description != acl.DeniedEmbed(rule.Resource).Description {
+				t.Errorf("response = %+v, want the denied error", data)
+			}
+			if followups := b.discord.Followups(i); len(followups) != 0 {
+				t.Errorf("followups = %+v, want nothing else to be sent", followups)
+			}
+		})
+	}
+}
+
+func TestACLManagePermission(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions int64
+		want        string
+		wantRules   int
+	}{
+		{name: "member", permissions: discord.PermissionViewChannel, want: "you need the Manage Server permission to change the access rules"},
+		{name: "manage server", permissions: discord.PermissionManageServer, want: "`command:dalle` is now denied for <@&ROLE>", wantRules: 1},
+		{name: "administrator", permissions: discord.PermissionAdministrator, want: "`command:dalle` is now denied for <@&ROLE>", wantRules: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBot(t, moderation.Config{})
+			role := &discord.Role{ID: b.discord.NewID(), Name: "guests"}
+			// the command is shown to everyone, as guild admins can do in the integration settings
+			i := b.discord.Interact(&discord.Interaction{
+				Type:      discord.InteractionApplicationCommand,
+				GuildID:   b.guild.ID,
+				ChannelID: b.channel.ID,
+				Member:    &discord.Member{User: b.user, GuildID: b.guild.ID, Permissions: test.permissions},
+				Data: discord.ApplicationCommandInteractionData{
+					ID:   b.discord.NewID(),
+					Name: "acl",
+					Options: []*discord.ApplicationCommandInteractionDataOption{{
+						Name: "deny",
+						Type: discord.ApplicationCommandOptionSubCommand,
+						Options: []*discord.ApplicationCommandInteractionDataOption{
+							stringOption("resource", "command:dalle"),
+							{Name: "role", Type: discord.ApplicationCommandOptionRole, Value: role.ID},
+						},
+					}},
+				},
+			})
+
+			var responses []*discord.InteractionResponse
+			b.discord.WaitFor("the response", func() bool {
+				responses = b.discord.InteractionResponses(i)
+				return len(responses) == 1
+			})
+			want := strings.ReplaceAll(test.want, "ROLE", role.ID)
+			if data := responses[0].Data; len(data.Embeds) != 1 || data.Embeds[0].Description != want {
+				t.Errorf("response = %+v, want %q", data, want)
+			}
+			if rules := b.access.Rules(b.guild.ID); len(rules) != test.wantRules {
+				t.Errorf("rules = %+v, want %d", rules, test.wantRules)
+			}
+		})
+	}
+}
+
+// conversation returns the messages of the last chat completion request as "role: content".
+func (b *testBot) conversation(t *testing.T) []string {
+	t.Helper()
+	requests := b.openAI.ChatCompletionRequests()
+	if len(requests) == 0 {
+		t.Fatal("no chat completion request was sent")
+	}
+	var conversation []string
+	for _, m := range requests[len(requests)-1].Messages {
+		conversation = append(conversation, m.Role+": "+m.Content)
+	}
+	return conversation
+}
+
+// askInThread posts a message in the thread and waits until it is answered.
+func (b *testBot) askInThread(t *testing.T, threadID string, content string) {
+	t.Helper()
+	before := len(b.discord.Messages(threadID))
+	b.discord.SendMessage(&discord.Message{ChannelID: threadID, Author: b.user, Content: content, Type: discord.MessageTypeDefault})
+	b.discord.WaitFor("the answer", func() bool {
+		messages := b.discord.Messages(threadID)
+		return len(messages) == before+2 && len(messages[before+1].Embeds) == 1
+	})
+}
+
+func TestChatImport(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+	file := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"role": "system", "content": "You are a pirate."},
+			{"role": "user", "content": "Hello"},
+			{"role": "assistant", "content": "Ahoy!"}
+		]`)
+	}))
+	t.Cleanup(file.Close)
+
+	attachmentID := b.discord.NewID()
+	i := b.discord.Interact(&discord.Interaction{
+		Type:      discord.InteractionApplicationCommand,
+		GuildID:   b.guild.ID,
+		ChannelID: b.channel.ID,
+		Member:    &discord.Member{User: b.user, GuildID: b.guild.ID},
+		Data: discord.ApplicationCommandInteractionData{
+			ID:   b.discord.NewID(),
+			Name: "chat",
+			Options: []*discord.ApplicationCommandInteractionDataOption{{
+				Name: "import",
+				Type: discord.ApplicationCommandOptionSubCommand,
+				Options: []*discord.ApplicationCommandInteractionDataOption{
+					{Name: "file", Type: discord.ApplicationCommandOptionAttachment, Value: attachmentID},
+				},
+			}},
+			Resolved: &discord.ApplicationCommandInteractionDataResolved{
+				Attachments: map[string]*discord.MessageAttachment{
+					attachmentID: {ID: attachmentID, Filename: "conversation.json", URL: file.URL, Size: 100},
+				},
+			},
+		},
+	})
+
+	var reply *discord.Message
+	b.discord.WaitFor("the import", func() bool {
+		followups := b.discord.Followups(i)
+		if len(followups) == 0 {
+			return false
+		}
+		reply = followups[0]
+		return true
+	})
+	threads := b.discord.Threads()
+	if len(threads) != 1 {
+		t.Fatalf("got %d threads, want the imported one (reply %q %+v)", len(threads), reply.Content, reply.Embeds)
+	}
+	thread := threads[0]
+	if want := "📥 Imported 2 messages into <#" + thread.ID + ">"; reply.Content != want {
+		t.Errorf("reply = %q, want %q", reply.Content, want)
+	}
+	starter := b.discord.Message(b.channel.ID, thread.ID)
+	if starter == nil || len(starter.Attachments) != 1 || starter.Attachments[0].Filename != "conversation.json" {
+		t.Fatalf("thread starter = %+v, want the conversation attached", starter)
+	}
+
+	// the conversation goes on in the thread
+	b.askInThread(t, thread.ID, "Where is the treasure?")
+	want := []string{"system: You are a pirate.", "user: Hello", "assistant: Ahoy!", "user: Where is the treasure?"}
+	if conversation := b.conversation(t); strings.Join(conversation, "\n") != strings.Join(want, "\n") {
+		t.Errorf("conversation = %q, want %q", conversation, want)
+	}
+}
+
+func TestChatFork(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+	thread := b.startChat(t, "Hello there")
+	b.askInThread(t, thread.ID, "How are you?")
+	firstAnswer := b.discord.Messages(thread.ID)[0]
+
+	i := b.discord.Interact(&discord.Interaction{
+		Type:      discord.InteractionApplicationCommand,
+		GuildID:   b.guild.ID,
+		ChannelID: thread.ID,
+		Member:    &discord.Member{User: b.user, GuildID: b.guild.ID},
+		Data: discord.ApplicationCommandInteractionData{
+			ID:       b.discord.NewID(),
+			Name:     gpt.ForkCommandName,
+			TargetID: firstAnswer.ID,
+		},
+	})
+	var reply *discord.Message
+	b.discord.WaitFor("the fork", func() bool {
+		followups := b.discord.Followups(i)
+		if len(followups) == 0 {
+			return false
+		}
+		reply = followups[0]
+		return true
+	})
+	threads := b.discord.Threads()
+	if len(threads) != 2 {
+		t.Fatalf("got %d threads, want the original and the fork (reply %q %+v)", len(threads), reply.Content, reply.Embeds)
+	}
+	fork := threads[1]
+	if fork.ParentID != b.channel.ID || !strings.HasPrefix(fork.Name, "Fork of ") {
+		t.Errorf("fork = %+v, want a thread named after the original in the same channel", fork)
+	}
+	if want := "🍴 Forked 2 messages into <#" + fork.ID + ">"; reply.Content != want {
+		t.Errorf("reply = %q, want %q", reply.Content, want)
+	}
+
+	// the fork continues from the first answer, without the second question
+	b.askInThread(t, fork.ID, "Tell me a joke")
+	want := []string{"user: Hello there", "assistant: You said: Hello there", "user: Tell me a joke"}
+	if conversation := b.conversation(t); strings.Join(conversation, "\n") != strings.Join(want, "\n") {
+		t.Errorf("conversation = %q, want %q", conversation, want)
+	}
+}
+
+func TestChatGPTRegenerateOnEdit(t *testing.T) {
+	b := newTestBot(t, moderation.Config{}, func(params *commands.ChatCommandParams) {
+		params.Answers = render.Config{Policy: render.Policy{RegenerateOnEdit: true}}
+	})
+	thread := b.startChat(t, "Hello there")
+	b.askInThread(t, thread.ID, "How are you?")
+	question := b.discord.Messages(thread.ID)[1]
+
+	b.discord.EditMessage(thread.ID, question.ID, "How old are you?")
+	b.discord.WaitFor("the new answer", func() bool {
+		messages := b.discord.Messages(thread.ID)
+		return len(messages) == 3 && messages[2].Content == "You said: How old are you?" && len(messages[2].Embeds) == 1
+	})
+	answer := b.discord.Messages(thread.ID)[2]
+	if answer.MessageReference == nil || answer.MessageReference.MessageID != question.ID {
+		t.Errorf("answer reference = %+v, want a reply to %s", answer.MessageReference, question.ID)
+	}
+	want := []string{"user: Hello there", "assistant: You said: Hello there", "user: How old are you?"}
+	if conversation := b.conversation(t); strings.Join(conversation, "\n") != strings.Join(want, "\n") {
+		t.Errorf("conversation = %q, want %q", conversation, want)
+	}
+	b.discord.WaitFor("the thread to be unlocked", func() bool {
+		return !b.discord.Channel(thread.ID).ThreadMetadata.Locked
+	})
+
+	// the next question goes on from the new answer
+	b.askInThread(t, thread.ID, "Tell me a joke")
+	want = append(want, "assistant: You said: How old are you?", "user: Tell me a joke")
+	if conversation := b.conversation(t); strings.Join(conversation, "\n") != strings.Join(want, "\n") {
+		t.Errorf("conversation = %q, want %q", conversation, want)
+	}
+}
+
+func TestChatGPTRegenerateOnEditDeletesOnlyTheAnswer(t *testing.T) {
+	b := newTestBot(t, moderation.Config{}, func(params *commands.ChatCommandParams) {
+		params.Answers = render.Config{Policy: render.Policy{RegenerateOnEdit: true}}
+	})
+	thread := b.startChat(t, "Hello there")
+
+	// the echoed answer is too long for one message
+	question := b.discord.SendMessage(&discord.Message{ChannelID: thread.ID, Author: b.user, Content: strings.Repeat("How are you? ", 200), Type: discord.MessageTypeDefault})
+	b.discord.WaitFor("the split answer", func() bool {
+		messages := b.discord.Messages(thread.ID)
+		return len(messages) == 4 && len(messages[3].Embeds) == 1
+	})
+
+	// a member who may not chat in the thread is told so, the notice is not part of the answer
+	other := &discord.User{ID: b.discord.NewID(), Username: "bob"}
+	rule := acl.Rule{Resource: acl.ResourceThreadChat, SubjectType: acl.SubjectUser, SubjectID: other.ID, Effect: acl.Deny}
+	if err := b.access.Set(b.guild.ID, rule); err != nil {
+		t.Fatal(err)
+	}
+	b.discord.SendMessage(&discord.Message{ChannelID: thread.ID, Author: other, Content: "Hi", Type: discord.MessageTypeDefault})
+	var notice *discord.Message
+	b.discord.WaitFor("the access notice", func() bool {
+		messages := b.discord.Messages(thread.ID)
+		if len(messages) != 6 {
+			return false
+		}
+		notice = messages[5]
+		return true
+	})
+
+	b.discord.EditMessage(thread.ID, question.ID, "How old are you?")
+	b.discord.WaitFor("the new answer", func() bool {
+		messages := b.discord.Messages(thread.ID)
+		return len(messages) == 5 && messages[4].Content == "You said: How old are you?" && len(messages[4].Embeds) == 1
+	})
+	// both parts of the old answer are gone, the notice stays
+	if m := b.discord.Message(thread.ID, notice.ID); m == nil {
+		t.Errorf("notice %s was deleted with the old answer", notice.ID)
+	}
+}
+
+func TestChatGPTRegenerateOnEditRateLimited(t *testing.T) {
+	b := newTestBot(t, moderation.Config{}, func(params *commands.ChatCommandParams) {
+		params.Answers = render.Config{Policy: render.Policy{RegenerateOnEdit: true}}
+		params.RateLimiter = ratelimit.NewLimiter()
+		params.RateLimits = map[string]ratelimit.Rule{commands.GPTMessagesRateLimit: {Limit: ratelimit.Limit{Requests: 1, Per: time.Hour}}}
+	})
+	thread := b.startChat(t, "Hello there")
+	b.askInThread(t, thread.ID, "How are you?")
+	question := b.discord.Messages(thread.ID)[1]
+	answer := b.discord.Messages(thread.ID)[2]
+
+	// the question used up the budget, so the edit is not answered again
+	b.discord.EditMessage(thread.ID, question.ID, "How old are you?")
+	b.discord.WaitFor("the rate limit reply", func() bool {
+		messages := b.discord.Messages(thread.ID)
+		return len(messages) == 4 && len(messages[3].Embeds) == 1 && messages[3].Embeds[0].Title == "⏳ Slow down"
+	})
+	if messages := b.discord.Messages(thread.ID); messages[2].ID != answer.ID {
+		t.Errorf("message after the question = %s, want the old answer %s to stay", messages[2].ID, answer.ID)
+	}
+	if n := len(b.openAI.ChatCompletionRequests()); n != 2 {
+		t.Errorf("%d chat completion requests, want 2", n)
+	}
+}
+
+func TestChatGPTThreadMessage(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+	thread := b.startChat(t, "Hello there")
+
+	question := b.discord.SendMessage(&discord.Message{
+		ChannelID: thread.ID,
+		Author:    b.user,
+		Content:   "How are you?",
+		Type:      discord.MessageTypeDefault,
+	})
+
+	b.discord.WaitFor("the second answer", func() bool {
+		messages := b.discord.Messages(thread.ID)
+		return len(messages) == 3 && len(messages[2].Embeds) == 1
+	})
+	answer := b.discord.Messages(thread.ID)[2]
+	if answer.Content != "You said: How are you?" {
+		t.Errorf("answer = %q, want %q", answer.Content, "You said: How are you?")
+	}
+	if answer.MessageReference == nil || answer.MessageReference.MessageID != question.ID {
+		t.Errorf("answer reference = %+v, want a reply to %s", answer.MessageReference, question.ID)
+	}
+
+	// the whole conversation is sent to the model
+	requests := b.openAI.ChatCompletionRequests()
+	if len(requests) != 2 {
+		t.Fatalf("got %d chat completion requests, want 2", len(requests))
+	}
+	var conversation []string
+	for _, m := range requests[1].Messages {
+		conversation = append(conversation, m.Role+": "+m.Content)
+	}
+	want := []string{"user: Hello there", "assistant: You said: Hello there", "user: How are you?"}
+	if strings.Join(conversation, "\n") != strings.Join(want, "\n") {
+		t.Errorf("conversation = %q, want %q", conversation, want)
+	}
+
+	// the question is marked while it is being answered
+	b.discord.WaitFor("the reaction to be removed", func() bool {
+		return len(b.discord.Reactions()) == 2
+	})
+	reactions := b.discord.Reactions()
+	if len(reactions) != 2 || reactions[0].MessageID != question.ID || reactions[0].Removed || !reactions[1].Removed {
+		t.Errorf("reactions = %+v, want one added and removed on the question", reactions)
+	}
+}
+
+func TestChatGPTIgnoresOtherThreads(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+
+	starter := b.discord.AddMessage(&discord.Message{ChannelID: b.channel.ID, Author: b.user, Content: "Let's talk"})
+	thread := &discord.Channel{
+		ID:             starter.ID,
+		GuildID:        b.guild.ID,
+		ParentID:       b.channel.ID,
+		Name:           "Not a GPT thread",
+		Type:           discord.ChannelTypeGuildPublicThread,
+		ThreadMetadata: &discord.ThreadMetadata{},
+	}
+	b.discord.AddChannel(thread)
+	b.discord.SendMessage(&discord.Message{ChannelID: thread.ID, Author: b.user, Content: "Hi", Type: discord.MessageTypeDefault})
+
+	// the bot reads the starter message to find out it's not a GPT thread
+	b.discord.WaitFor("the starter message lookup", func() bool {
+		for _, r := range b.discord.Requests() {
+			if r.Method == http.MethodGet && r.Path == "channels/"+b.channel.ID+"/messages/"+starter.ID {
+				return true
+			}
+		}
+		return false
+	})
+	time.Sleep(100 * time.Millisecond)
+	if messages := b.discord.Messages(thread.ID); len(messages) != 1 {
+		t.Errorf("got %d messages in the thread, want only the user's", len(messages))
+	}
+	if requests := b.openAI.ChatCompletionRequests(); len(requests) != 0 {
+		t.Errorf("got %d chat completion requests, want none", len(requests))
+	}
+}
+
+func TestImageDALLECommand(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+	i := b.command("image", "dalle", stringOption("prompt", "A cat in space"))
+
+	b.discord.WaitFor("the images", func() bool {
+		for _, m := range b.discord.Followups(i) {
+			if len(m.Embeds) > 1 {
+				return true
+			}
+		}
+		return false
+	})
+
+	responses := b.discord.InteractionResponses(i)
+	if len(responses) != 1 {
+		t.Fatalf("got %d interaction responses, want 1", len(responses))
+	}
+	var images *discord.Message
+	for _, m := range b.discord.Followups(i) {
+		if len(m.Embeds) > 1 {
+			images = m
+		}
+	}
+	if images.Embeds[0].Author == nil || images.Embeds[0].Author.Name != "A cat in space" {
+		t.Errorf("first embed author = %+v, want the prompt", images.Embeds[0].Author)
+	}
+	if image := images.Embeds[1].Image; image == nil || image.URL != "https://images.openaitest.invalid/1.png" {
+		t.Errorf("image = %+v, want the generated image", image)
+	}
+}
+
+// imageReplies summarizes what the user got to see for an image command, for the golden files.
+type imageReplies struct {
+	Original      *imageReply   `json:"original"`
+	Followups     []*imageReply `json:"followups"`
+	ImageRequests int           `json:"imageRequests"`
+}
+
+type imageReply struct {
+	Content string                  `json:"content,omitempty"`
+	Flags   discord.MessageFlags    `json:"flags,omitempty"`
+	Embeds  []*discord.MessageEmbed `json:"embeds,omitempty"`
+}
+
+func newImageReply(m *discord.Message) *imageReply {
+	if m == nil {
+		return nil
+	}
+	return &imageReply{Content: m.Content, Flags: m.Flags, Embeds: m.Embeds}
+}
+
+func TestImageDALLEModeration(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy moderation.Policy
+		prompt string
+		// moderationError makes the Moderation API fail
+		moderationError bool
+		// done reports whether the bot finished answering
+		done func(followups []*discord.Message) bool
+	}{
+		{
+			name:   "blocked",
+			prompt: "A cat in space " + openaitest.FlaggedMarker,
+			done: func(followups []*discord.Message) bool {
+				return len(followups) == 1
+			},
+		},
+		{
+			name:   "warned",
+			policy: moderation.Policy{Action: moderation.ActionWarn},
+			prompt: "A cat in space " + openaitest.FlaggedMarker,
+		},
+		{
+			name:            "moderation_failed",
+			prompt:          "A cat in space",
+			moderationError: true,
+		},
+		{
+			name:   "allowed",
+			prompt: "A cat in space",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBot(t, moderation.Config{Policy: test.policy})
+			if test.moderationError {
+				b.openAI.Respond(openaitest.EndpointModerations, openaitest.Error(http.StatusInternalServerError, "server_error", "The server had an error"))
+			}
+			i := b.command("image", "dalle", stringOption("prompt", test.prompt))
+
+			replies := func() *imageReplies {
+				r := &imageReplies{
+					Original:      newImageReply(b.discord.Original(i)),
+					ImageRequests: len(b.openAI.Requests(openaitest.EndpointImages)),
+				}
+				for _, m := range b.discord.Followups(i) {
+					r.Followups = append(r.Followups, newImageReply(m))
+				}
+				return r
+			}
+			b.discord.WaitFor("the bot to answer", func() bool {
+				if test.done != nil {
+					return test.done(b.discord.Followups(i))
+				}
+				// the images are the last thing the bot sends
+				for _, m := range append(b.discord.Followups(i), b.discord.Original(i)) {
+					if m != nil && len(m.Embeds) > 1 {
+						return true
+					}
+				}
+				return false
+			})
+
+			golden.AssertJSON(t, "image_dalle_moderation_"+test.name, replies())
+		})
+	}
+}
+
+func TestShutdownRejectsInteractions(t *testing.T) {
+	b := newTestBot(t, moderation.Config{})
+	interactions := metrics.Interactions.WithLabelValues("chat gpt")
+	before := testutil.ToFloat64(interactions)
+
+	if !b.router.Shutdown(time.Second) {
+		t.Fatal("the router didn't shut down")
+	}
+	i := b.command("chat", "gpt", stringOption("prompt", "Hello there"))
+	b.discord.WaitFor("the restart notice", func() bool {
+		return len(b.discord.InteractionResponses(i)) == 1
+	})
+
+	response := b.discord.InteractionResponses(i)[0]
+	if response.Type != discord.InteractionResponseChannelMessageWithSource || response.Data.Flags&discord.MessageFlagsEphemeral == 0 {
+		t.Errorf("response = %+v, want an ephemeral message", response)
+	}
+	if len(response.Data.Embeds) != 1 || response.Data.Embeds[0].Title != "🔄 Restarting" {
+		t.Errorf("response embeds = %+v, want the restart notice", response.Data.Embeds)
+	}
+	if threads := b.discord.Threads(); len(threads) != 0 {
+		t.Errorf("%d threads were started during shutdown", len(threads))
+	}
+	// rejected interactions are not counted
+	if after := testutil.ToFloat64(interactions); after != before {
+		t.Errorf("interactions counter = %v, want %v", after, before)
+	}
+}
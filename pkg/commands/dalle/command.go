@@ -1,7 +1,10 @@
 package dalle
 
 import (
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
 	discord "github.com/bwmarrin/discordgo"
 	"github.com/sashabaranov/go-openai"
 )
@@ -12,7 +15,7 @@ const commandName = "dalle"
 // The Command function is defined in this code block, which returns a bot.Command object. 
 // The bot.Command object represents a command that can be executed by a Discord bot. 
 // The Command function takes an openai.Client object as input, which is used to interact with the DALL-E API.
-func Command(client *openai.Client) *bot.Command {
+func Command(client *openai.Client, requests *queue.Pool, access *acl.Store, moderator *moderation.Service) *bot.Command {
 	numberOptionMinValue := 1.0
 	return &bot.Command{
 
@@ -60,17 +63,25 @@ func Command(client *openai.Client) *bot.Command {
 		// The Handler field of the bot.Command object is set to a bot.HandlerFunc object, which is a function that handles the execution of the command.
 		// The Handler function calls the imageHandler function, passing in the bot.Context object and the openai.Client object as arguments.
 		Handler: bot.HandlerFunc(func(ctx *bot.Context) {
-			imageHandler(ctx, client)
+			imageHandler(ctx, client, requests)
 		}),
 
 		// The Middlewares field of the bot.Command object is set to an array of bot.Handler objects,
 		// which represent middleware functions that are executed before the command is executed. 
-		// The first middleware function is imageInteractionResponseMiddleware, which handles the response to the user's interaction with the command. 
-		// The second middleware function is imageModerationMiddleware, which moderates the generated images to ensure they are appropriate.
+		// The first middleware function is acl.Middleware, which checks if the user is allowed to use the command and the requested size.
+		// The second middleware function is imageInteractionResponseMiddleware, which handles the response to the user's interaction with the command. 
+		// The third middleware function is imageModerationMiddleware, which moderates the prompt with the moderation policy of the guild.
 		Middlewares: []bot.Handler{
+			acl.Middleware(access, func(ctx *bot.Context) []string {	// The access middleware checks the command and the requested size 
+				size := imageDefaultSize									// against the rules of the guild, before the interaction is responded to.
+				if option, ok := ctx.Options[imageCommandOptionSize.String()]; ok {
+					size = option.StringValue()
+				}
+				return []string{acl.ImageSizeResource(size)}
+			}),
 			bot.HandlerFunc(imageInteractionResponseMiddleware),   	// When a user interacts with the command, the imageInteractionResponseMiddleware 
 			bot.HandlerFunc(func(ctx *bot.Context) {				// function is executed before the command is executed. The function takes a 
-				imageModerationMiddleware(ctx, client)				// bot.HandlerFunc object as input, which represents the function that handles 
+				imageModerationMiddleware(ctx, moderator)			// bot.HandlerFunc object as input, which represents the function that handles 
 			}),														// the execution of the command.
 		},
 	}
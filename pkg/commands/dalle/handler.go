@@ -3,24 +3,29 @@ package dalle
 import (
 	"context"
 	"fmt"
-	"log"
+	"time"
 
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/constants"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/logging"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/metrics"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/tracing"
 	discord "github.com/bwmarrin/discordgo"
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // The imageHandler function is defined in this code block, which takes a bot.Context object and an openai.Client object as input. 
 // The purpose of this function is to handle the execution of the dalle command, which generates images based on user input.
-func imageHandler(ctx *bot.Context, client *openai.Client) {			// The function first extracts the prompt, size, and number of images to be generated 
+func imageHandler(ctx *bot.Context, client *openai.Client, requests *queue.Pool) {			// The function first extracts the prompt, size, and number of images to be generated 
 	var prompt string													// from the bot.Context object. If the prompt is empty, the function sends an error
 	if option, ok := ctx.Options[imageCommandOptionPrompt.String()]; ok {	// message to the user indicating that an error occurred.
 		prompt = option.StringValue()
 	} else {
 		// We can't have empty prompt, unfortunately
 		// this should not happen, discord prevents empty required options
-		log.Printf("[GID: %s, i.ID: %s] Failed to parse prompt option\n", ctx.Interaction.GuildID, ctx.Interaction.ID)
+		ctx.Logger.Error("Failed to parse prompt option")
 		ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
 			Embeds: []*discord.MessageEmbed{
 				{
@@ -36,30 +41,61 @@ func imageHandler(ctx *bot.Context, client *openai.Client) {			// The function f
 	size := imageDefaultSize
 	if option, ok := ctx.Options[imageCommandOptionSize.String()]; ok {
 		size = option.StringValue()
-		log.Printf("[GID: %s, i.ID: %s] Image size provided: %s\n", ctx.Interaction.GuildID, ctx.Interaction.ID, size)
+		ctx.Logger.Debug("Image size provided", "size", size)
 	}
 
 	number := 1
 	if option, ok := ctx.Options[imageCommandOptionNumber.String()]; ok {
 		number = int(option.IntValue())
-		log.Printf("[GID: %s, i.ID: %s] Image number provided: %d\n", ctx.Interaction.GuildID, ctx.Interaction.ID, number)
+		ctx.Logger.Debug("Image number provided", "number", number)
 	}
 
-	log.Printf("[GID: %s, CHID: %s] Dalle Request [Size: %s, Number: %d] invoked", ctx.Interaction.GuildID, ctx.Interaction.ID, size, number)
-	resp, err := client.CreateImage(
-		context.Background(),
-		openai.ImageRequest{
-			Prompt:         prompt,
-			N:              number,
-			Size:           size,
-			ResponseFormat: openai.CreateImageResponseFormatURL,
-			User:           ctx.Interaction.Member.User.ID,
-		},
+	ctx.Logger.Info("Dalle request invoked", "size", size, "number", number, logging.Content("prompt", prompt))
+	// Image generation goes through the request queue like every other OpenAI request
+	var (
+		resp openai.ImageResponse
+		err  error
 	)
+	queueErr := requests.Do(ctx.Context(), &queue.Job{
+		Priority: queue.PriorityHigh,
+		Model:    Model,
+		Run: func(jobCtx context.Context) {
+			jobCtx, span := tracing.Start(jobCtx, "openai.createImage",
+				attribute.String("openai.model", Model),
+				attribute.String("openai.image_size", size),
+				attribute.Int("openai.images", number),
+			)
+			start := time.Now()
+			defer func() {
+				metrics.ObserveOpenAIRequest(metrics.EndpointImage, Model, start, err)
+				tracing.End(span, err)
+			}()
+			resp, err = client.CreateImage(
+				jobCtx,
+				openai.ImageRequest{
+					Prompt:         prompt,
+					N:              number,
+					Size:           size,
+					ResponseFormat: openai.CreateImageResponseFormatURL,
+					User:           ctx.Interaction.Member.User.ID,
+				},
+			)
+		},
+		Queued: func(position int) {
+			// let the user know the request is waiting in line
+			ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
+				Content: fmt.Sprintf(imageQueuedMessage, position),
+				Flags:   discord.MessageFlagsEphemeral,
+			})
+		},
+	})
+	if queueErr != nil {
+		err = queueErr
+	}
 
 	// If the API request is successful, the function creates an array of discord.MessageEmbed objects, which represent the images generated by the API. 
 	if err != nil {
-		log.Printf("[GID: %s, i.ID: %s] OpenAI request CreateImage failed with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Error("OpenAI request CreateImage failed", "size", size, "error", err)
 		ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
 			Embeds: []*discord.MessageEmbed{
 				{
@@ -75,7 +111,8 @@ func imageHandler(ctx *bot.Context, client *openai.Client) {			// The function f
 	// The function then creates an array of discord.MessageEmbed objects, which represent the images generated by the DALL-E API. 
 	// First discord.MessageEmbed object in the array contains information about the prompt, author, and footer of the message and 
 	// remaining discord.MessageEmbed objects in the array contain the images generated by the API.
-	log.Printf("[GID: %s, i.ID: %s] Dalle Request [Size: %s, Number: %d] responded with a data array size %d\n", ctx.Interaction.GuildID, ctx.Interaction.ID, size, number, len(resp.Data))
+	ctx.Logger.Info("Dalle request responded", "size", size, "number", number, "images", len(resp.Data))
+	metrics.ImageGenerations.WithLabelValues(size).Add(float64(len(resp.Data)))
 
 	var embeds = []*discord.MessageEmbed{
 		{
@@ -111,7 +148,7 @@ func imageHandler(ctx *bot.Context, client *openai.Client) {			// The function f
 		Components: []discord.MessageComponent{discord.ActionsRow{Components: buttonComponents}},
 	})
 	if err != nil {
-		log.Printf("[GID: %s, i.ID: %s] Failed to send a follow up message with images with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Error("Failed to send a follow up message with images", "error", err)
 		ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
 			Embeds: []*discord.MessageEmbed{
 				{
@@ -128,7 +165,7 @@ func imageHandler(ctx *bot.Context, client *openai.Client) {			// The function f
 	// The function then sends a message to the user containing the images and buttons using the FollowupMessageCreate method of the bot.Context object. 
 	// If an error occurs during the sending of the message, the function sends an error message to the user indicating that the message failed to send.
 	if err != nil {
-		log.Printf("[GID: %s, i.ID: %s] Discord API failed with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Error("Discord API failed", "error", err)
 		ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
 			Content: fmt.Sprintf("> %s", prompt),
 			Embeds: []*discord.MessageEmbed{
@@ -0,0 +1,87 @@
+package dalle
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/openaitest"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/sessiontest"
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// runImageHandler runs the interaction response middleware and the handler with the prompt, like the command does without
+// the access checks and moderation.
+func runImageHandler(t *testing.T, server *openaitest.Server, prompt string) (*sessiontest.Session, *discord.Interaction) {
+	t.Helper()
+	requests := queue.New(1, 4, nil)
+	t.Cleanup(requests.Close)
+
+	s := sessiontest.New()
+	s.AddChannel(&discord.Channel{ID: "100", Type: discord.ChannelTypeGuildText})
+	i := &discord.Interaction{
+		ID:        s.NewID(),
+		Type:      discord.InteractionApplicationCommand,
+		ChannelID: "100",
+		Member:    &discord.Member{User: &discord.User{ID: "1", Username: "alice"}},
+		Data: discord.ApplicationCommandInteractionData{
+			Name: commandName,
+			Options: []*discord.ApplicationCommandInteractionDataOption{
+				{Name: imageCommandOptionPrompt.String(), Type: discord.ApplicationCommandOptionString, Value: prompt},
+			},
+		},
+	}
+
+	ctx := bot.NewContext(context.Background(), s, &bot.Command{Name: commandName}, i, nil, []bot.Handler{
+		bot.HandlerFunc(imageInteractionResponseMiddleware),
+		bot.HandlerFunc(func(ctx *bot.Context) {
+			imageHandler(ctx, server.Client(), requests)
+		}),
+	})
+	ctx.Next()
+	return s, i
+}
+
+func TestImageHandler(t *testing.T) {
+	server := openaitest.NewServer(t)
+	s, i := runImageHandler(t, server, "A cat in space")
+
+	if responses := s.InteractionResponses(i); len(responses) != 1 || responses[0].Type != discord.InteractionResponseDeferredChannelMessageWithSource {
+		t.Fatalf("interaction responses = %+v, want a deferred response", responses)
+	}
+	images := lastFollowup(t, s, i)
+	if len(images.Embeds) != 2 {
+		t.Fatalf("last followup = %+v, want the prompt and an image", images)
+	}
+	if author := images.Embeds[0].Author; author == nil || author.Name != "A cat in space" {
+		t.Errorf("prompt embed author = %+v, want the prompt", author)
+	}
+	if image := images.Embeds[1].Image; image == nil || image.URL != "https://images.openaitest.invalid/1.png" {
+		t.Errorf("image = %+v, want the generated image", image)
+	}
+}
+
+func TestImageHandlerAPIError(t *testing.T) {
+	server := openaitest.NewServer(t)
+	server.Respond(openaitest.EndpointImages, openaitest.Error(http.StatusBadRequest, "invalid_request_error", "Your request was rejected"))
+	s, i := runImageHandler(t, server, "A cat in space")
+
+	if failed := lastFollowup(t, s, i); len(failed.Embeds) != 1 || failed.Embeds[0].Title != "❌ OpenAI API failed" {
+		t.Fatalf("last followup = %+v, want the error", failed)
+	}
+	if original := s.Original(i); original.Flags&discord.MessageFlagsLoading != 0 {
+		t.Error("the original response is still loading")
+	}
+}
+
+// lastFollowup returns what the handler sent last.
+func lastFollowup(t *testing.T, s *sessiontest.Session, i *discord.Interaction) *discord.Message {
+	t.Helper()
+	followups := s.Followups(i)
+	if len(followups) == 0 {
+		t.Fatal("no followup was sent")
+	}
+	return followups[len(followups)-1]
+}
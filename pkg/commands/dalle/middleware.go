@@ -1,12 +1,10 @@
 package dalle
 
 import (
-	"context"
-	"log"
 
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
 	discord "github.com/bwmarrin/discordgo"
-	"github.com/sashabaranov/go-openai"
 )
 
 
@@ -18,26 +16,26 @@ import (
 // The function logs a message indicating that the interaction has been invoked and sends a response to the user indicating that the interaction is being processed.
 // If an error occurs during the sending of the response, the function sends an error message to the user indicating that the response failed to send.
 func imageInteractionResponseMiddleware(ctx *bot.Context) {
-	log.Printf("[GID: %s, i.ID: %s] Image interaction invoked by UserID: %s\n", ctx.Interaction.GuildID, ctx.Interaction.ID, ctx.Interaction.Member.User.ID)
+	ctx.Logger.Info("Image interaction invoked")
 
 	err := ctx.Respond(&discord.InteractionResponse{
 		Type: discord.InteractionResponseDeferredChannelMessageWithSource,
 	})
 	if err != nil {
-		log.Printf("[GID: %s, i.ID: %s] Failed to respond to interactrion with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Error("Failed to respond to interaction", "error", err)
 		return
 	}
 
 	ctx.Next()
 }
 
-// The imageModerationMiddleware function is used to moderate the generated images to ensure they are appropriate. 
+// The imageModerationMiddleware function is used to moderate the prompt before any image is generated. 
 // The function logs a message indicating that the moderation middleware is being performed and extracts the prompt from the bot.Context object. 
-// The function then sends a request to the DALL-E API to moderate the prompt. If the prompt violates the usage policies of the DALL-E API, 
-// the function sends an error message to the user indicating that the prompt is not allowed. If the prompt is allowed, the function proceeds 
-// to the next middleware or the main function.
-func imageModerationMiddleware(ctx *bot.Context, client *openai.Client) {
-	log.Printf("[GID: %s, i.ID: %s] Performing interaction moderation middleware\n", ctx.Interaction.GuildID, ctx.Interaction.ID)
+// The function then checks the prompt with the moderation service, which applies the moderation policy of the guild and reports flagged prompts.
+// Blocked prompts get an error message, flagged prompts that are let through get a warning.
+// If the prompt is allowed, the function proceeds to the next middleware or the main function.
+func imageModerationMiddleware(ctx *bot.Context, moderator *moderation.Service) {
+	ctx.Logger.Debug("Performing interaction moderation middleware")
 
 	var prompt string
 	if option, ok := ctx.Options[imageCommandOptionPrompt.String()]; ok {
@@ -45,7 +43,7 @@ func imageModerationMiddleware(ctx *bot.Context, client *openai.Client) {
 	} else {
 		// We can't have empty prompt, unfortunately
 		// this should not happen, discord prevents empty required options
-		log.Printf("[GID: %s, i.ID: %s] Failed to parse prompt option\n", ctx.Interaction.GuildID, ctx.Interaction.ID)
+		ctx.Logger.Error("Failed to parse prompt option")
 		ctx.Respond(&discord.InteractionResponse{
 			Type: discord.InteractionResponseChannelMessageWithSource,
 			Data: &discord.InteractionResponseData{
@@ -55,32 +53,30 @@ func imageModerationMiddleware(ctx *bot.Context, client *openai.Client) {
 		return
 	}
 
-	resp, err := client.Moderations(
-		context.Background(),
-		openai.ModerationRequest{
-			Input: prompt,
-		},
-	)
+	result, err := moderator.Moderate(ctx.Context(), ctx.Session, moderation.Item{
+		GuildID:   ctx.Interaction.GuildID,
+		ChannelID: ctx.Interaction.ChannelID,
+		UserID:    ctx.Interaction.Member.User.ID,
+		Source:    moderation.SourceImagePrompt,
+		Content:   prompt,
+	})
 	if err != nil {
 		// do not block request if moderation api failed
-		log.Printf("[GID: %s, i.ID: %s] OpenAI Moderation API request failed with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Warn("OpenAI Moderation API request failed, letting the prompt through", "error", err)
 		ctx.Next()
 		return
 	}
 
-	if resp.Results[0].Flagged {
-		// response was flagged, send error
-		log.Printf("[GID: %s, i.ID: %s] Interaction was flagged by Moderation API, prompt: \"%s\"\n", ctx.Interaction.GuildID, ctx.Interaction.ID, prompt)
-		ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
-			Embeds: []*discord.MessageEmbed{
-				{
-					Title:       "❌ Error",
-					Description: "The provided prompt contains text that violates OpenAI's usage policies and is not allowed by their safety system",
-					Color:       0xff0000,
-				},
-			},
-		})
-		return
+	if result.Flagged {
+		ctx.Logger.Info("Image prompt was flagged by Moderation API", "categories", result.FlaggedCategories(), "action", result.Action)
+		switch result.Action {
+		case moderation.ActionBlock:
+			// response was flagged, send error only the user sees
+			ctx.PrivateFollowup(moderation.BlockedEmbed("The provided prompt"))
+			return
+		case moderation.ActionWarn:
+			ctx.PrivateFollowup(moderation.WarningEmbed("The provided prompt"))
+		}
 	}
 
 	ctx.Next()
@@ -8,8 +8,12 @@ import (
 	"github.com/sashabaranov/go-openai"
 )
 
+// Model is the name image generation requests are queued under, so its concurrency can be limited like for chat models
+const Model = "dall-e-2"
+
 const (
-	imageDefaultSize = openai.CreateImageSize256x256
+	imageDefaultSize   = openai.CreateImageSize256x256
+	imageQueuedMessage = "⌛ You are #%d in line, wait a moment, please..."
 
 	imagePriceSize256x256   = 0.016
 	imagePriceSize512x512   = 0.018
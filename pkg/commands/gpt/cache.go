@@ -1,30 +1,149 @@
 package gpt
 
 import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/metrics"
+	discord "github.com/bwmarrin/discordgo"
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/sashabaranov/go-openai"
 )
 
-// The IgnoredChannelsCache struct is a map that is used to store ignored channels for the bot. The keys of the map are strings representing channel IDs, 
-// and the values are empty structs. This struct is  used to keep track of channels that the bot should ignore when processing messages.
-type IgnoredChannelsCache map[string]struct{}
+// The IgnoredChannelsCache struct is used to store ignored channels for the bot. This struct is used to keep track of
+// channels that the bot should ignore when processing messages (non-thread channels and threads that are not GPT threads),
+// so we don't have to ask Discord about them over and over again.
+// It is safe for concurrent use, holds at most a fixed number of channels (least recently used ones are evicted first),
+// and forgets a channel after a while, so a channel is never ignored forever by mistake.
+type IgnoredChannelsCache struct {
+	channels *lru.Cache[string, time.Time] // channel ID -> time the entry expires
+	ttl      time.Duration
+}
+
+// The NewIgnoredChannelsCache function creates a new IgnoredChannelsCache that holds at most size channels,
+// each of them for the given ttl.
+func NewIgnoredChannelsCache(size int, ttl time.Duration) (*IgnoredChannelsCache, error) {
+	lruCache, err := lru.New[string, time.Time](size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IgnoredChannelsCache{
+		channels: lruCache,
+		ttl:      ttl,
+	}, nil
+}
+
+// Contains reports whether the channel is ignored.
+func (c *IgnoredChannelsCache) Contains(channelID string) bool {
+	expires, ok := c.channels.Get(channelID)
+	if ok && time.Now().After(expires) {
+		c.channels.Remove(channelID)
+		ok = false
+	}
+
+	// the hit rate is tracked in the metrics
+	metrics.CacheLookup(metrics.CacheIgnoredChannels, ok)
+	return ok
+}
+
+// Add marks the channel as ignored.
+func (c *IgnoredChannelsCache) Add(channelID string) {
+	c.channels.Add(channelID, time.Now().Add(c.ttl))
+}
+
+// Invalidate stops ignoring the channel.
+func (c *IgnoredChannelsCache) Invalidate(channelID string) {
+	c.channels.Remove(channelID)
+}
+
+// HandleThreadCreate is a discord event handler that invalidates newly created threads. A message can arrive
+// before the thread makes it into the state cache, which would get the thread ignored as a regular channel.
+func (c *IgnoredChannelsCache) HandleThreadCreate(s *discord.Session, e *discord.ThreadCreate) {
+	c.Invalidate(e.ID)
+}
+
+// HandleThreadUpdate is a discord event handler that invalidates updated threads, so they are checked again.
+func (c *IgnoredChannelsCache) HandleThreadUpdate(s *discord.Session, e *discord.ThreadUpdate) {
+	c.Invalidate(e.ID)
+}
+
+// HandleThreadDelete is a discord event handler that forgets deleted threads.
+func (c *IgnoredChannelsCache) HandleThreadDelete(s *discord.Session, e *discord.ThreadDelete) {
+	c.Invalidate(e.ID)
+}
+
+// HandleChannelDelete is a discord event handler that forgets deleted channels.
+func (c *IgnoredChannelsCache) HandleChannelDelete(s *discord.Session, e *discord.ChannelDelete) {
+	c.Invalidate(e.ID)
+}
 
 // The MessagesCache struct is a cache that is used to store messages generated by the OpenAI API. The cache is implemented using the golang-lru library. 
 // The cache is a map that maps strings to *MessagesCacheData pointers. 
 type MessagesCache struct {
 	*lru.Cache[string, *MessagesCacheData]
+
+	locks conversationLocks
 }
 
 // The MessagesCacheData struct contains information about the messages generated by the OpenAI API, 
 // including the messages themselves, the model used to generate the messages, and the number of tokens used to generate the messages.
 type MessagesCacheData struct {
-	Messages      []openai.ChatCompletionMessage
+	Messages      []Message
 	SystemMessage *openai.ChatCompletionMessage
 	Model         string
 	Temperature   *float32
 	TokenCount    int
+	// TruncatedMessages is the number of messages removed from the beginning of the conversation to stay within the token limit of the model
+	TruncatedMessages int
+}
+
+
+// The Message struct is a message of a conversation, the message sent to the model along with what else is known about it.
+type Message struct {
+	openai.ChatCompletionMessage
+	// Time the message was sent, zero if it is not known
+	Time time.Time `json:"time"`
+	// Usage of the request the message was the answer to, only set for answers of the model
+	Usage *openai.Usage `json:"usage,omitempty"`
+	// DiscordID is the ID of the Discord message the message was posted in, the first one for answers that were split.
+	// It is empty for messages that are not in the thread, like the messages of imported conversations.
+	DiscordID string `json:"-"`
+	// AnswerIDs are the IDs of all the Discord messages an answer was posted in: the parts of a split answer and the
+	// notices posted along with it. Answers read back from the thread only have DiscordID.
+	AnswerIDs []string `json:"-"`
+}
+
+// MarshalJSON writes the message like the encoding/json package does, but leaves out the time if it is not known.
+func (m Message) MarshalJSON() ([]byte, error) {
+	// message has the fields of Message without this method, so encoding it doesn't end up here again. The time
+	// and the usage are written after it, in the order of the fields of Message.
+	type message Message
+	var t *time.Time
+	if !m.Time.IsZero() {
+		t = &m.Time
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	// the encoder of the export keeps HTML as it is, which only works if the message doesn't escape it first
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(struct {
+		message
+		Time  *time.Time    `json:"time,omitempty"`
+		Usage *openai.Usage `json:"usage,omitempty"`
+	}{message(m), t, m.Usage})
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), err
 }
 
+// The chatCompletionMessages function returns the messages as they are sent to the model.
+func chatCompletionMessages(messages []Message) []openai.ChatCompletionMessage {
+	chatMessages := make([]openai.ChatCompletionMessage, 0, len(messages))
+	for _, m := range messages {
+		chatMessages = append(chatMessages, m.ChatCompletionMessage)
+	}
+	return chatMessages
+}
 
 // The NewMessagesCache function is used to create a new MessagesCache struct with a specified size. The function takes an int representing the 
 // size of the cache as an argument and returns a pointer to a new MessagesCache struct. The function uses the lru.New function from the golang-lru 
@@ -39,3 +158,22 @@ func NewMessagesCache(size int) (*MessagesCache, error) {
 		Cache: lruCache,
 	}, nil
 }
+
+// Lock waits until the conversation in the given thread is free and takes it over. All reads and writes of the
+// thread's *MessagesCacheData must happen while holding the lock, so messages in a thread are processed one
+// at a time and in the order they arrived. It returns the number of messages that were queued ahead.
+func (c *MessagesCache) Lock(threadID string) int {
+	return c.locks.lock(threadID)
+}
+
+// Unlock releases the conversation in the given thread, letting the next queued message in.
+func (c *MessagesCache) Unlock(threadID string) {
+	c.locks.unlock(threadID)
+}
+
+// Get looks up the conversation of the given thread, counting the hits and misses in the metrics.
+func (c *MessagesCache) Get(threadID string) (*MessagesCacheData, bool) {
+	data, ok := c.Cache.Get(threadID)
+	metrics.CacheLookup(metrics.CacheMessages, ok)
+	return data, ok
+}
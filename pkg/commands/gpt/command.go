@@ -1,20 +1,27 @@
 package gpt
 
 import (
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/audit"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/preferences"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
 	discord "github.com/bwmarrin/discordgo"
 	"github.com/sashabaranov/go-openai"
 )
 
-var gptDefaultModel = openai.GPT3Dot5Turbo
+// gptDefaultModel is used when no completion models are configured
+const gptDefaultModel = openai.GPT3Dot5Turbo
 
 const commandName = "gpt"
 
 // The Command function is used to define a command for the Discord bot. The function takes several arguments, including a *openai.Client pointer, 
 
 // he function takes several arguments, including a *openai.Client pointer, a slice of strings representing completion models, a *MessagesCache pointer,
-// and an *IgnoredChannelsCache pointer. The function creates a new bot.Command struct and sets its Name and Description fields to "gpt" and "Start conversation with ChatGPT", respectively.
-func Command(client *openai.Client, completionModels []string, messagesCache *MessagesCache, ignoredChannelsCache *IgnoredChannelsCache) *bot.Command {
+// an *IgnoredChannelsCache pointer, the request queue, the access control rules, the moderation service, the audit log, the policies for posting answers and the preferences of the users. The function creates a new bot.Command struct and sets its Name and Description fields to "gpt" and "Start conversation with ChatGPT", respectively.
+func Command(client *openai.Client, completionModels []string, messagesCache *MessagesCache, ignoredChannelsCache *IgnoredChannelsCache, requests *queue.Pool, access *acl.Store, moderator *moderation.Service, auditLog *audit.Logger, answers render.Config, prefs *preferences.Store) *bot.Command {
 	temperatureOptionMinValue := 0.0
 	opts := []*discord.ApplicationCommandOption{		// The function then creates a slice of *discord.ApplicationCommandOptions representing the different options 
 		{												// that can be used with the command. The options include a prompt, context, context file, model, and temperature. 
@@ -36,9 +43,10 @@ func Command(client *openai.Client, completionModels []string, messagesCache *Me
 			Required:    false,
 		},
 	}
+	defaultModel := gptDefaultModel
 	numberOfModels := len(completionModels)
 	if numberOfModels > 0 {
-		gptDefaultModel = completionModels[0] // set first model as default one
+		defaultModel = completionModels[0] // set first model as default one
 	}
 	if numberOfModels > 1 {
 		var modelChoices []*discord.ApplicationCommandOptionChoice		// If there is more than one completion model, the function creates a slice of *discord.ApplicationCommandOptionChoices
@@ -75,13 +83,44 @@ func Command(client *openai.Client, completionModels []string, messagesCache *Me
 		Name:        commandName,
 		Description: "Start conversation with ChatGPT", /// Command struct and sets its Name and Description fields to "gpt" and "Start conversation with ChatGPT", respectively.
 		Options:     opts,
+		// The access middleware checks the command and the requested model against the rules of the guild
+		Middlewares: []bot.Handler{
+			acl.Middleware(access, func(ctx *bot.Context) []string {
+				model := defaultModel
+				if option, ok := ctx.Options[gptCommandOptionModel.string()]; ok {
+					model = option.StringValue()
+				}
+				return []string{acl.ModelResource(model)}
+			}),
+		},
 		Handler: bot.HandlerFunc(func(ctx *bot.Context) {
-			chatGPTHandler(ctx, client, messagesCache)  
+			chatGPTHandler(ctx, client, messagesCache, requests, moderator, auditLog, answers, prefs, defaultModel)
 		}),
+		MessageMiddlewares: []bot.MessageHandler{
+			// The chatGPTThreadMiddleware function lets only messages in GPT threads through, so the middlewares
+			// added after it (like rate limiting) only apply to conversations with the bot
+			bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+				chatGPTThreadMiddleware(ctx, messagesCache, ignoredChannelsCache)
+			}),
+		},
 		MessageHandler: bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
-			chatGPTMessageHandler(ctx, client, messagesCache, ignoredChannelsCache) 
+			chatGPTMessageHandler(ctx, client, messagesCache, ignoredChannelsCache, requests, access, moderator, answers, prefs, defaultModel)
 			// The chatGPTHandler function is used to handle the gpt command for the Discord bot.
 			// The function takes a bot.Context pointer, a *openai.Client pointer, and a *MessagesCache pointer as arguments.
 		}),
+		// Edited and deleted messages are changed in the cached conversation too, so the model answers from what the thread says now
+		MessageUpdateMiddlewares: []bot.MessageHandler{
+			// The chatGPTMessageUpdateMiddleware function lets only edits that are answered again through, so the
+			// middlewares added after it (like rate limiting) don't apply to edits that only change the conversation
+			bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+				chatGPTMessageUpdateMiddleware(ctx, messagesCache, access, moderator, answers)
+			}),
+		},
+		MessageUpdateHandler: bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+			chatGPTRegenerateHandler(ctx, client, messagesCache, requests, moderator, answers, prefs)
+		}),
+		MessageDeleteHandler: bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+			chatGPTMessageDeleteHandler(ctx, messagesCache)
+		}),
 	}
 }
@@ -0,0 +1,176 @@
+package gpt
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/session"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+// The loadConversation function reads the conversation of a thread back from its messages, e.g. when the thread is not
+// in the cache anymore after a restart. It returns nil if the thread is not a GPT thread, and an error if the messages
+// could not be fetched.
+func loadConversation(c context.Context, s session.Session, logger *slog.Logger, threadID string, defaultModel string) (*MessagesCacheData, error) {
+	cacheItem := &MessagesCacheData{}
+	botID := s.CurrentUser().ID
+
+	var lastID string
+	retries := 0
+	// files are the code blocks attached to the answer being read, the messages are read from the newest one and the
+	// files come with the last message of an answer
+	var files []render.File
+	for {
+		if retries >= gptDiscordChannelMessagesRequestMaxRetries {
+			// max retries reached on fetching messages
+			return nil, fmt.Errorf("reached %d retries", retries)
+		}
+		// Get messages in batches of 100 (maximum allowed by Discord API)
+		batch, err := s.ChannelMessages(threadID, 100, lastID, "", "", discord.WithContext(c))
+		if err != nil {
+			// Since we cannot fetch messages, that means we cannot determine whether this a GPT thread,
+			// and if it was, we cannot get the full context to provide a better user experience. Do retries
+			// and print the error in the log
+			logger.Warn("Failed to get channel messages", "error", err, "retries_left", gptDiscordChannelMessagesRequestMaxRetries-retries)
+			retries++
+			continue
+		}
+
+		transformed := make([]Message, 0, len(batch))
+		for _, value := range batch {
+			role := openai.ChatMessageRoleUser
+			content := value.Content
+			if value.Author.ID == botID {
+				role = openai.ChatMessageRoleAssistant
+				content = answerContent(value)
+				if len(value.Attachments) > 0 && value.Type != discord.MessageTypeThreadStarterMessage {
+					files = attachedFiles(logger, value)
+				}
+				// put the attached code back, it is part of what the model answered
+				content = render.Restore(content, files)
+			} else {
+				// the answers before the question have files of their own
+				files = nil
+			}
+			// First message is always a referenced message
+			// Check if it is, and then modify to get the original prompt
+			if value.Type == discord.MessageTypeThreadStarterMessage {
+				if value.Author.ID != botID || value.ReferencedMessage == nil {
+					// this is not gpt thread
+					return nil, nil
+				}
+				role = openai.ChatMessageRoleUser
+
+				prompt, context, model, temperature := parseInteractionReply(value.ReferencedMessage)
+				if prompt == "" {
+					return nil, nil
+				}
+				if model == "" {
+					model = defaultModel
+				}
+				if url := seedURL(value.ReferencedMessage); url != "" {
+					// imported and forked threads start with the conversation they were seeded with
+					seed, err := loadSeed(url)
+					if err != nil {
+						return nil, err
+					}
+					cacheItem.SystemMessage = seed.SystemMessage
+					cacheItem.Model = model
+					cacheItem.Temperature = temperature
+					// the messages of the batch are reversed below
+					for i := len(seed.Messages) - 1; i >= 0; i-- {
+						transformed = append(transformed, seed.Messages[i])
+					}
+					continue
+				}
+				content = prompt
+				var systemMessage *openai.ChatCompletionMessage
+				if context != "" {
+					context, _ = getContentOrURLData(attachmentClient, context)
+					systemMessage = &openai.ChatCompletionMessage{
+						Role:    openai.ChatMessageRoleSystem,
+						Content: context,
+					}
+				}
+				if temperature != nil {
+					cacheItem.Temperature = temperature
+				}
+
+				cacheItem.SystemMessage = systemMessage
+				cacheItem.Model = model
+			} else if !shouldHandleMessageType(value.Type) {
+				// ignore message types that are
+				// not related to conversation
+				continue
+			} else if isExcludedMessage(value) {
+				// the bot didn't answer the message, e.g. because its author may not chat with the model
+				continue
+			} else if content == "" {
+				// ignore messages without text, like the footer of an answer that did not fit into its last message
+				continue
+			}
+			transformed = append(transformed, Message{
+				ChatCompletionMessage: openai.ChatCompletionMessage{
+					Role:    role,
+					Content: content,
+				},
+				Time:      value.Timestamp,
+				DiscordID: value.ID,
+			})
+		}
+
+		reverseMessages(&transformed)
+
+		// Add the messages to the beginning of the main list
+		cacheItem.Messages = append(transformed, cacheItem.Messages...)
+
+		// If there are no more messages in the thread, we are done
+		if len(batch) == 0 {
+			return cacheItem, nil
+		}
+
+		// Set the lastID to the last message's ID to get the next batch of messages
+		lastID = batch[len(batch)-1].ID
+	}
+}
+
+// The attachedFiles function downloads the code blocks attached to an answer. Files that cannot be downloaded are left out,
+// their references stay in the answer.
+func attachedFiles(logger *slog.Logger, m *discord.Message) []render.File {
+	var files []render.File
+	for _, attachment := range m.Attachments {
+		content, err := getUrlData(attachmentClient, attachment.URL)
+		if err != nil {
+			logger.Warn("Failed to download the attached code", "message_id", m.ID, "file", attachment.Filename, "error", err)
+			continue
+		}
+		files = append(files, render.File{Name: attachment.Filename, Content: content})
+	}
+	return files
+}
+
+// The isExcludedMessage function reports whether the bot marked the message as not part of the conversation.
+func isExcludedMessage(m *discord.Message) bool {
+	for _, r := range m.Reactions {
+		if r.Me && r.Emoji != nil && r.Emoji.Name == gptEmojiExcluded {
+			return true
+		}
+	}
+	return false
+}
+
+// The loadSeed function fetches the conversation a thread was seeded with.
+func loadSeed(url string) (*MessagesCacheData, error) {
+	data, err := getUrlData(attachmentClient, url)
+	if err != nil {
+		return nil, fmt.Errorf("fetching the conversation the thread was seeded with: %w", err)
+	}
+	seed, _, err := parseSeed([]byte(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading the conversation the thread was seeded with: %w", err)
+	}
+	return seed, nil
+}
@@ -0,0 +1,104 @@
+package gpt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/sessiontest"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestLoadConversationAttachedCode(t *testing.T) {
+	code := "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"Hello\")\n}\n"
+	answers := []string{
+		"Here is the program:\n```go\n" + code + "```\nRun it with `go run main.go`.",
+		"Sure, in Python:\n```python\nprint(\"Hello\")\nprint(\"again\")\n```\nAnd in Go:\n```go\n" + code + "```",
+		// the answer is split, the files come with its last message
+		"Once more:\n```go\n" + code + "```\n" + strings.Repeat("It prints Hello. ", 300),
+	}
+
+	// the attached files are served like Discord serves attachments
+	files := make(map[string]string)
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, content)
+	}))
+	t.Cleanup(cdn.Close)
+
+	for _, mode := range []render.Mode{render.ModePlain, render.ModeEmbed, render.ModeHybrid} {
+		t.Run(string(mode), func(t *testing.T) {
+			s := sessiontest.New()
+			user := &discord.User{ID: "1", Username: "alice"}
+			starter := s.AddMessage(&discord.Message{
+				ChannelID: "10",
+				Author:    s.User,
+				Embeds:    []*discord.MessageEmbed{{Description: "Write a program"}},
+			})
+			addThread(s, "10", starter.ID, false)
+			s.AddMessage(&discord.Message{ChannelID: starter.ID, Author: s.User, Type: discord.MessageTypeThreadStarterMessage, ReferencedMessage: starter})
+
+			for i, content := range answers {
+				if i > 0 {
+					s.AddMessage(&discord.Message{ChannelID: starter.ID, Author: user, Content: "Another one", Type: discord.MessageTypeDefault})
+				}
+				// post the answer the way the handlers do
+				text, attached := render.Attach(content, render.Attachments{MinLines: 2, MaxLength: 4000})
+				for _, m := range renderAnswer(mode, &answer{content: text, files: attached, model: openai.GPT3Dot5Turbo}) {
+					posted := &discord.Message{ChannelID: starter.ID, Author: s.User, Content: m.Content, Embeds: m.Embeds, Type: discord.MessageTypeReply}
+					for _, f := range m.Files {
+						data, _ := io.ReadAll(f.Reader)
+						path := fmt.Sprintf("/%s/%d/%s", starter.ID, len(files), f.Name)
+						files[path] = string(data)
+						posted.Attachments = append(posted.Attachments, &discord.MessageAttachment{Filename: f.Name, URL: cdn.URL + path})
+					}
+					s.AddMessage(posted)
+				}
+			}
+
+			cacheItem, err := loadConversation(context.Background(), s, slog.Default(), starter.ID, openai.GPT3Dot5Turbo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cacheItem == nil {
+				t.Fatal("loadConversation() = nil, want the conversation")
+			}
+
+			// the parts of a split answer are read back as messages of their own
+			var got []string
+			previous := ""
+			for _, m := range cacheItem.Messages {
+				if m.Role == openai.ChatMessageRoleAssistant {
+					if previous == openai.ChatMessageRoleAssistant {
+						got[len(got)-1] += m.Content
+					} else {
+						got = append(got, m.Content)
+					}
+				}
+				previous = m.Role
+			}
+			if len(got) != len(answers) {
+				t.Fatalf("answers = %q, want %d", got, len(answers))
+			}
+			for i, answer := range got {
+				if strings.Contains(answer, "📎") || !strings.Contains(answer, code) {
+					t.Errorf("answer %d = %q, want the attached code restored", i+1, answer)
+				}
+			}
+			if !strings.Contains(got[1], "```python\nprint(\"Hello\")\nprint(\"again\")\n```") {
+				t.Errorf("answer 2 = %q, want the Python code restored", got[1])
+			}
+		})
+	}
+}
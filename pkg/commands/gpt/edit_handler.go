@@ -0,0 +1,134 @@
+package gpt
+
+import (
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/preferences"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+	"github.com/sashabaranov/go-openai"
+)
+
+// This file keeps cached conversations in line with their threads when messages are edited or deleted. The messages
+// of a conversation are found by the Discord message they were posted in, conversations that are not cached don't
+// need any of this, they are read from the thread as it is now when the next message comes in.
+
+// The chatGPTMessageUpdateMiddleware function puts the edited content of a user message into the cached conversation. If the
+// answers policy of the guild says so and the message is the last one that was answered, it calls the next handlers to
+// generate the answer again, so the middlewares added after it (like rate limiting) only apply to edits that are answered.
+// The conversation stays locked until the next handlers are done.
+func chatGPTMessageUpdateMiddleware(ctx *bot.MessageContext, messagesCache *MessagesCache, access *acl.Store, moderator *moderation.Service, answers render.Config) {
+	if ctx.Message.Author == nil || ctx.Message.Content == "" {
+		// updates without an author don't change the content, e.g. when Discord adds the embeds of links
+		return
+	}
+	if ctx.Message.Author.ID == ctx.CurrentUser().ID || !messagesCache.Contains(ctx.Message.ChannelID) {
+		// the bot edits its own answers while posting them, and only cached conversations can be out of date
+		return
+	}
+
+	messagesCache.Lock(ctx.Message.ChannelID)
+	defer messagesCache.Unlock(ctx.Message.ChannelID)
+
+	cacheItem, ok := messagesCache.Get(ctx.Message.ChannelID)
+	if !ok {
+		return
+	}
+	i := cachedMessageIndex(cacheItem, ctx.Message.ID)
+	if i < 0 || cacheItem.Messages[i].Role != openai.ChatMessageRoleUser || cacheItem.Messages[i].Content == ctx.Message.Content {
+		return
+	}
+
+	ctx.Logger.Info("Message of the conversation was edited", "position", i)
+	if moderateMessageInput(ctx, moderator) {
+		// the blocked content must not reach the model, so the message leaves the conversation like a deleted one,
+		// and it is marked, so it stays out when the conversation is read back from the thread
+		removeCachedMessage(cacheItem, i)
+		return
+	}
+	cacheItem.Messages[i].Content = ctx.Message.Content
+
+	answered := i == len(cacheItem.Messages)-2 && cacheItem.Messages[i+1].Role == openai.ChatMessageRoleAssistant
+	if !answered || !answers.PolicyFor(ctx.Message.GuildID).RegenerateOnEdit {
+		return
+	}
+	if !chatGPTMessageAllowed(ctx, access, cacheItem.Model) {
+		return
+	}
+
+	ctx.Next()
+}
+
+// The chatGPTRegenerateHandler function answers the edited message again, after chatGPTMessageUpdateMiddleware has put
+// the edit into the conversation and left it locked. The old answer goes away in the thread and in the conversation,
+// the new one is posted as a reply to the edited message.
+func chatGPTRegenerateHandler(ctx *bot.MessageContext, client *openai.Client, messagesCache *MessagesCache, requests *queue.Pool, moderator *moderation.Service, answers render.Config, prefs *preferences.Store) {
+	cacheItem, ok := messagesCache.Get(ctx.Message.ChannelID)
+	if !ok {
+		return
+	}
+	i := cachedMessageIndex(cacheItem, ctx.Message.ID)
+	if i < 0 {
+		return
+	}
+
+	deleteAnswerMessages(ctx, cacheItem.Messages[i+1:])
+	cacheItem.Messages = cacheItem.Messages[:i+1]
+	ctx.Logger.Info("Regenerating the answer of the edited message")
+	answerThreadMessage(ctx, client, cacheItem, requests, moderator, answers, prefs)
+}
+
+// The chatGPTMessageDeleteHandler function removes a deleted message from the cached conversation, so the model
+// doesn't answer based on it anymore. The answers to a deleted prompt stay, they are still part of the thread.
+func chatGPTMessageDeleteHandler(ctx *bot.MessageContext, messagesCache *MessagesCache) {
+	if !messagesCache.Contains(ctx.Message.ChannelID) {
+		return
+	}
+
+	messagesCache.Lock(ctx.Message.ChannelID)
+	defer messagesCache.Unlock(ctx.Message.ChannelID)
+
+	cacheItem, ok := messagesCache.Get(ctx.Message.ChannelID)
+	if !ok {
+		return
+	}
+	if i := cachedMessageIndex(cacheItem, ctx.Message.ID); i >= 0 {
+		ctx.Logger.Info("Message of the conversation was deleted", "position", i, "role", cacheItem.Messages[i].Role)
+		removeCachedMessage(cacheItem, i)
+	}
+}
+
+// The cachedMessageIndex function returns the position of the message posted in the Discord message, or -1 if the
+// Discord message is not the first message of a prompt or an answer of the conversation.
+func cachedMessageIndex(cacheItem *MessagesCacheData, discordID string) int {
+	for i, m := range cacheItem.Messages {
+		if m.DiscordID != "" && m.DiscordID == discordID {
+			return i
+		}
+	}
+	return -1
+}
+
+// The removeCachedMessage function removes the message at the position from the conversation. The token count is
+// counted again before the next request, so it is left as it is.
+func removeCachedMessage(cacheItem *MessagesCacheData, i int) {
+	cacheItem.Messages = append(cacheItem.Messages[:i:i], cacheItem.Messages[i+1:]...)
+}
+
+// The deleteAnswerMessages function deletes the Discord messages the answers were posted in, including the parts of
+// split answers and the warnings about them. Messages of the thread that are not part of the answers stay.
+func deleteAnswerMessages(ctx *bot.MessageContext, answers []Message) {
+	for _, answer := range answers {
+		ids := answer.AnswerIDs
+		if len(ids) == 0 && answer.DiscordID != "" {
+			// the answer was read back from the thread, every part of it is a message of the conversation
+			ids = []string{answer.DiscordID}
+		}
+		for _, id := range ids {
+			if err := ctx.ChannelMessageDelete(ctx.Message.ChannelID, id); err != nil {
+				ctx.Logger.Warn("Failed to delete the old answer", "message_id", id, "error", err)
+			}
+		}
+	}
+}
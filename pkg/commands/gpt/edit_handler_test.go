@@ -0,0 +1,171 @@
+package gpt
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/openaitest"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/sessiontest"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestChatGPTMessageEvents(t *testing.T) {
+	user := &discord.User{ID: "1", Username: "alice"}
+
+	tests := []struct {
+		name    string
+		deleted bool
+		message func(s *sessiontest.Session) *discord.Message
+		want    []string
+	}{
+		{
+			name: "edited question",
+			message: func(*sessiontest.Session) *discord.Message {
+				return &discord.Message{ID: "300", Author: user, Content: "How old are you?"}
+			},
+			want: []string{"user: Hello there", "assistant: Hi!", "user: How old are you?", "assistant: Fine."},
+		},
+		{
+			name: "same content",
+			message: func(*sessiontest.Session) *discord.Message {
+				return &discord.Message{ID: "300", Author: user, Content: "How are you?"}
+			},
+			want: []string{"user: Hello there", "assistant: Hi!", "user: How are you?", "assistant: Fine."},
+		},
+		{
+			name:    "update without author",
+			message: func(*sessiontest.Session) *discord.Message { return &discord.Message{ID: "300"} },
+			want:    []string{"user: Hello there", "assistant: Hi!", "user: How are you?", "assistant: Fine."},
+		},
+		{
+			name: "edited answer of the bot",
+			message: func(s *sessiontest.Session) *discord.Message {
+				return &discord.Message{ID: "310", Author: s.User, Content: "Great."}
+			},
+			want: []string{"user: Hello there", "assistant: Hi!", "user: How are you?", "assistant: Fine."},
+		},
+		{
+			name: "message not in the conversation",
+			message: func(*sessiontest.Session) *discord.Message {
+				return &discord.Message{ID: "305", Author: user, Content: "Never mind"}
+			},
+			want: []string{"user: Hello there", "assistant: Hi!", "user: How are you?", "assistant: Fine."},
+		},
+		{
+			name:    "deleted question",
+			deleted: true,
+			message: func(*sessiontest.Session) *discord.Message { return &discord.Message{ID: "300"} },
+			want:    []string{"user: Hello there", "assistant: Hi!", "assistant: Fine."},
+		},
+		{
+			name:    "deleted answer",
+			deleted: true,
+			message: func(*sessiontest.Session) *discord.Message { return &discord.Message{ID: "210"} },
+			want:    []string{"user: Hello there", "user: How are you?", "assistant: Fine."},
+		},
+		{
+			name:    "deleted message not in the conversation",
+			deleted: true,
+			message: func(*sessiontest.Session) *discord.Message { return &discord.Message{ID: "305"} },
+			want:    []string{"user: Hello there", "assistant: Hi!", "user: How are you?", "assistant: Fine."},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := sessiontest.New()
+			thread := addThread(s, "100", "200", false)
+			messagesCache, err := NewMessagesCache(16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messagesCache.Add(thread.ID, &MessagesCacheData{
+				Model: openai.GPT3Dot5Turbo,
+				Messages: []Message{
+					{ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "Hello there"}, DiscordID: "200"},
+					{ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "Hi!"}, DiscordID: "210"},
+					{ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "How are you?"}, DiscordID: "300"},
+					{ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "Fine."}, DiscordID: "310"},
+				},
+			})
+
+			m := test.message(s)
+			m.ChannelID = thread.ID
+			handler := bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+				if test.deleted {
+					chatGPTMessageDeleteHandler(ctx, messagesCache)
+				} else {
+					// regenerating is off, so the edit is not answered again
+					chatGPTMessageUpdateMiddleware(ctx, messagesCache, nil, nil, render.Config{})
+				}
+			})
+			bot.NewMessageContext(context.Background(), s, &bot.Command{Name: "chat"}, m, []bot.MessageHandler{handler}).Next()
+
+			cacheItem, _ := messagesCache.Get(thread.ID)
+			var got []string
+			for _, m := range cacheItem.Messages {
+				got = append(got, m.Role+": "+m.Content)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("conversation = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChatGPTMessageUpdateHandlerBlocked(t *testing.T) {
+	s := sessiontest.New()
+	thread := addGPTThread(s)
+	user := &discord.User{ID: "1", Username: "alice"}
+	question := s.AddMessage(&discord.Message{ChannelID: thread.ID, GuildID: "10", Author: user, Content: "How are you?", Type: discord.MessageTypeDefault})
+	s.AddMessage(&discord.Message{ChannelID: thread.ID, Author: s.User, Content: "Fine.", Type: discord.MessageTypeReply})
+
+	messagesCache, err := NewMessagesCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheItem, err := loadConversation(context.Background(), s, slog.Default(), thread.ID, openai.GPT3Dot5Turbo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messagesCache.Add(thread.ID, cacheItem)
+
+	// the question is edited to content the moderation blocks
+	content := "How are you? " + openaitest.FlaggedMarker
+	if _, err := s.ChannelMessageEditComplex(&discord.MessageEdit{Channel: thread.ID, ID: question.ID, Content: &content}); err != nil {
+		t.Fatal(err)
+	}
+	edited := &discord.Message{ID: question.ID, ChannelID: thread.ID, GuildID: "10", Author: user, Content: content}
+	openAI := openaitest.NewServer(t)
+	moderator := moderation.New(openAI.Client(), moderation.Config{}, nil)
+	handler := bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+		// regenerating is off, so the edit is not answered again
+		chatGPTMessageUpdateMiddleware(ctx, messagesCache, nil, moderator, render.Config{})
+	})
+	bot.NewMessageContext(context.Background(), s, &bot.Command{Name: "chat"}, edited, []bot.MessageHandler{handler}).Next()
+
+	want := []string{"user: Hello there", "assistant: Hi!", "assistant: Fine."}
+	cacheItem, _ = messagesCache.Get(thread.ID)
+	if got := conversationOf(cacheItem); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("cached conversation = %q, want %q", got, want)
+	}
+
+	// the mark keeps the edited message out when the conversation is read from the thread again
+	reactions := s.Reactions()
+	if len(reactions) != 1 || reactions[0].MessageID != question.ID || reactions[0].Emoji != gptEmojiExcluded {
+		t.Errorf("reactions = %+v, want %s on the edited message", reactions, gptEmojiExcluded)
+	}
+	cacheItem, err = loadConversation(context.Background(), s, slog.Default(), thread.ID, openai.GPT3Dot5Turbo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conversationOf(cacheItem); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("loaded conversation = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,344 @@
+package gpt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+// This file defines the export subcommand of the chat command, which sends the conversation of a GPT thread as a file.
+
+const (
+	exportCommandName = "export"
+
+	exportCommandOptionFormat = "format"
+	exportCommandOptionDM     = "dm"
+
+	// exportTimeLayout is how the times of the messages are written in the Markdown and HTML exports
+	exportTimeLayout = "2006-01-02 15:04:05 MST"
+)
+
+// conversationExport is the conversation of a thread as it is exported. It is written as is by the JSON format,
+// its messages are in the OpenAI chat message format with the time and the usage of each message added.
+type conversationExport struct {
+	Thread      exportThread `json:"thread"`
+	ExportedAt  time.Time    `json:"exportedAt"`
+	Model       string       `json:"model"`
+	Temperature *float32     `json:"temperature,omitempty"`
+	// Messages start with the system prompt, if the conversation has one
+	Messages []Message `json:"messages"`
+}
+
+type exportThread struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// exportFormat writes a conversation in a file format.
+type exportFormat struct {
+	name        string
+	extension   string
+	contentType string
+	write       func(e *conversationExport) ([]byte, error)
+}
+
+// exportFormats are the formats a conversation can be exported in, the first one is the default.
+var exportFormats = []exportFormat{
+	{name: "markdown", extension: "md", contentType: "text/markdown; charset=utf-8", write: exportMarkdown},
+	{name: "json", extension: "json", contentType: "application/json", write: exportJSON},
+	{name: "html", extension: "html", contentType: "text/html; charset=utf-8", write: exportHTML},
+}
+
+// The ExportCommand function returns the export subcommand. It is used inside a GPT thread and sends the conversation
+// as a Markdown, JSON or HTML file, either in an ephemeral message or in a direct message to the user.
+func ExportCommand(messagesCache *MessagesCache, access *acl.Store, completionModels []string) *bot.Command {
+	defaultModel := gptDefaultModel
+	if len(completionModels) > 0 {
+		defaultModel = completionModels[0]
+	}
+
+	choices := make([]*discord.ApplicationCommandOptionChoice, 0, len(exportFormats))
+	for _, format := range exportFormats {
+		choices = append(choices, &discord.ApplicationCommandOptionChoice{Name: format.name, Value: format.name})
+	}
+
+	return &bot.Command{
+		Name:        exportCommandName,
+		Description: "Export the conversation of this GPT thread",
+		Options: []*discord.ApplicationCommandOption{
+			{
+				Type:        discord.ApplicationCommandOptionString,
+				Name:        exportCommandOptionFormat,
+				Description: "File format, Markdown by default",
+				Choices:     choices,
+			},
+			{
+				Type:        discord.ApplicationCommandOptionBoolean,
+				Name:        exportCommandOptionDM,
+				Description: "Send the file as a direct message",
+			},
+		},
+		// The access middleware checks the command, so the export of conversations can be denied like the other features
+		Middlewares: []bot.Handler{
+			acl.Middleware(access, nil),
+		},
+		Handler: bot.HandlerFunc(func(ctx *bot.Context) {
+			exportHandler(ctx, messagesCache, defaultModel)
+		}),
+	}
+}
+
+// The exportHandler function exports the conversation of the thread the command was used in. The response is deferred,
+// because the conversation may have to be read from the thread, or wait for an answer that is being generated.
+func exportHandler(ctx *bot.Context, messagesCache *MessagesCache, defaultModel string) {
+	err := ctx.Respond(&discord.InteractionResponse{
+		Type: discord.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discord.InteractionResponseData{Flags: discord.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		ctx.Logger.Error("Failed to respond to interaction", "error", err)
+		return
+	}
+
+	format := exportFormats[0]
+	if option, ok := ctx.Options[exportCommandOptionFormat]; ok {
+		for _, f := range exportFormats {
+			if f.name == option.StringValue() {
+				format = f
+			}
+		}
+	}
+
+	ch, err := ctx.CachedChannel(ctx.Interaction.ChannelID)
+	if err != nil || !ch.IsThread() {
+		followupError(ctx, "This command can only be used in a GPT thread")
+		return
+	}
+
+	export, err := exportConversation(ctx, messagesCache, ch, defaultModel)
+	if err != nil {
+		ctx.Logger.Error("Failed to get the conversation", "error", err)
+		followupError(ctx, "Failed to get the conversation of this thread")
+		return
+	}
+	if export == nil {
+		followupError(ctx, "This command can only be used in a GPT thread")
+		return
+	}
+
+	data, err := format.write(export)
+	if err != nil {
+		ctx.Logger.Error("Failed to export the conversation", "format", format.name, "error", err)
+		followupError(ctx, err.Error())
+		return
+	}
+	file := &discord.File{
+		Name:        fmt.Sprintf("conversation-%s.%s", ch.ID, format.extension),
+		ContentType: format.contentType,
+		Reader:      bytes.NewReader(data),
+	}
+
+	content := fmt.Sprintf("📄 Conversation of **%s**", ch.Name)
+	if option, ok := ctx.Options[exportCommandOptionDM]; ok && option.BoolValue() {
+		dm, err := ctx.UserChannelCreate(ctx.Interaction.Member.User.ID, discord.WithContext(ctx.Context()))
+		if err == nil {
+			_, err = ctx.ChannelMessageSendComplex(dm.ID, &discord.MessageSend{
+				Content: content,
+				Files:   []*discord.File{file},
+			}, discord.WithContext(ctx.Context()))
+		}
+		if err != nil {
+			// most likely the user does not allow direct messages from members of the server
+			ctx.Logger.Warn("Failed to send the conversation as a direct message", "error", err)
+			followupError(ctx, "Failed to send you a direct message, check that you allow direct messages from members of this server")
+			return
+		}
+		content = "📬 Sent you the conversation as a direct message"
+		file = nil
+	}
+
+	params := &discord.WebhookParams{Content: content, Flags: discord.MessageFlagsEphemeral}
+	if file != nil {
+		params.Files = []*discord.File{file}
+	}
+	if _, err := ctx.FollowupMessageCreate(ctx.Interaction, true, params, discord.WithContext(ctx.Context())); err != nil {
+		ctx.Logger.Error("Failed to send the export", "error", err)
+		return
+	}
+	ctx.Logger.Info("Conversation exported", "format", format.name, "messages", len(export.Messages))
+}
+
+// The exportConversation function returns the conversation of the thread, nil if it is not a GPT thread. The cache has the
+// usage of the answers, but it drops the first messages of long conversations, those are read from the thread then.
+func exportConversation(ctx *bot.Context, messagesCache *MessagesCache, ch *discord.Channel, defaultModel string) (*conversationExport, error) {
+	// wait for an answer that is being generated, so it is part of the export
+	messagesCache.Lock(ch.ID)
+	var cacheItem MessagesCacheData
+	cached, ok := messagesCache.Get(ch.ID)
+	if ok {
+		cacheItem = *cached
+		cacheItem.Messages = append([]Message(nil), cached.Messages...)
+	}
+	messagesCache.Unlock(ch.ID)
+
+	if !ok || cacheItem.TruncatedMessages > 0 {
+		thread, err := loadConversation(ctx.Context(), ctx.Session, ctx.Logger, ch.ID, defaultModel)
+		if err != nil || thread == nil {
+			return nil, err
+		}
+		if !ok {
+			cacheItem = *thread
+		} else {
+			cacheItem.Messages = append(messagesBefore(thread.Messages, cacheItem.Messages), cacheItem.Messages...)
+		}
+	}
+
+	export := &conversationExport{
+		Thread:      exportThread{ID: ch.ID, Name: ch.Name},
+		ExportedAt:  time.Now().UTC(),
+		Model:       cacheItem.Model,
+		Temperature: cacheItem.Temperature,
+	}
+	if cacheItem.SystemMessage != nil {
+		export.Messages = append(export.Messages, Message{ChatCompletionMessage: *cacheItem.SystemMessage})
+	}
+	export.Messages = append(export.Messages, cacheItem.Messages...)
+	return export, nil
+}
+
+// The messagesBefore function returns the messages of the thread that were sent before the first cached message,
+// which are the ones dropped from the cache.
+func messagesBefore(thread []Message, cached []Message) []Message {
+	if len(cached) == 0 || cached[0].Time.IsZero() {
+		return nil
+	}
+	var before []Message
+	for _, m := range thread {
+		if m.Time.Before(cached[0].Time) {
+			before = append(before, m)
+		}
+	}
+	return before
+}
+
+// The exportJSON function writes the conversation as JSON. The messages are in the OpenAI chat message format with their
+// time and usage added, /chat import reads them back as they are, but the chat completion API only takes them without those.
+func exportJSON(e *conversationExport) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	// the messages are read by people too, keep code like <b>bold</b> as it is
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(e); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// The exportMarkdown function writes the conversation as a Markdown document, with a section for each message.
+func exportMarkdown(e *conversationExport) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", e.Thread.Name)
+	fmt.Fprintf(&b, "- **Model:** `%s`\n", e.Model)
+	fmt.Fprintf(&b, "- **Temperature:** %s\n", exportTemperature(e.Temperature))
+	fmt.Fprintf(&b, "- **Exported:** %s\n", e.ExportedAt.Format(exportTimeLayout))
+
+	for _, m := range e.Messages {
+		b.WriteString("\n## " + exportRole(m.Role))
+		if !m.Time.IsZero() {
+			b.WriteString(" · " + m.Time.UTC().Format(exportTimeLayout))
+		}
+		b.WriteString("\n\n" + strings.TrimRight(m.Content, "\n") + "\n")
+		if m.Usage != nil {
+			fmt.Fprintf(&b, "\n*%s*\n", exportUsage(m.Usage))
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+// exportHTMLTemplate is a standalone page, the styles are inlined so the file can be opened anywhere
+var exportHTMLTemplate = template.Must(template.New("export").Funcs(template.FuncMap{
+	"role":        exportRole,
+	"temperature": exportTemperature,
+	"usage":       exportUsage,
+	"time": func(t time.Time) string {
+		return t.UTC().Format(exportTimeLayout)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Thread.Name}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 50rem; margin: 2rem auto; padding: 0 1rem; color: #1f2328; }
+dl { display: grid; grid-template-columns: max-content auto; gap: .25rem 1rem; }
+dt { font-weight: bold; }
+dd { margin: 0; }
+section { border-left: 4px solid #d0d7de; margin: 1.5rem 0; padding: .25rem 1rem; }
+section.system { border-color: #bf8700; }
+section.assistant { border-color: #10a37f; }
+h2 { font-size: 1rem; margin: .5rem 0; }
+time, .usage { color: #656d76; font-size: .875rem; font-weight: normal; }
+.content { white-space: pre-wrap; overflow-wrap: anywhere; }
+</style>
+</head>
+<body>
+<h1>{{.Thread.Name}}</h1>
+<dl>
+<dt>Model</dt><dd><code>{{.Model}}</code></dd>
+<dt>Temperature</dt><dd>{{temperature .Temperature}}</dd>
+<dt>Exported</dt><dd>{{time .ExportedAt}}</dd>
+</dl>
+{{- range .Messages}}
+<section class="{{.Role}}">
+<h2>{{role .Role}}{{if not .Time.IsZero}} <time datetime="{{.Time.UTC.Format "2006-01-02T15:04:05Z07:00"}}">{{time .Time}}</time>{{end}}</h2>
+<div class="content">{{.Content}}</div>
+{{- if .Usage}}
+<p class="usage">{{usage .Usage}}</p>
+{{- end}}
+</section>
+{{- end}}
+</body>
+</html>
+`))
+
+// The exportHTML function writes the conversation as a standalone HTML page, the content of the messages is escaped.
+func exportHTML(e *conversationExport) ([]byte, error) {
+	var b bytes.Buffer
+	if err := exportHTMLTemplate.Execute(&b, e); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// The exportRole function returns the heading of the messages of the role.
+func exportRole(role string) string {
+	switch role {
+	case openai.ChatMessageRoleSystem:
+		return "System prompt"
+	case openai.ChatMessageRoleUser:
+		return "User"
+	case openai.ChatMessageRoleAssistant:
+		return "Assistant"
+	}
+	return role
+}
+
+func exportTemperature(temperature *float32) string {
+	if temperature == nil {
+		return "default"
+	}
+	return fmt.Sprintf("%g", *temperature)
+}
+
+func exportUsage(usage *openai.Usage) string {
+	return fmt.Sprintf("Prompt Tokens: %d, Completion Tokens: %d, Total: %d", usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens)
+}
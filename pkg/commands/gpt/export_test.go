@@ -0,0 +1,61 @@
+package gpt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/golden"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestExportFormats(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	temperature := float32(0.5)
+	export := &conversationExport{
+		Thread:      exportThread{ID: "1100000000000000001", Name: "Escaping <html> & friends"},
+		ExportedAt:  start.Add(time.Hour),
+		Model:       openai.GPT4,
+		Temperature: &temperature,
+		Messages: []Message{
+			{ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: "You are a helpful assistant."}},
+			{
+				ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "How do I write <b>bold</b> text?"},
+				Time:                  start,
+			},
+			{
+				ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "Use the b element:\n```html\n<b>bold</b>\n```\n"},
+				Time:                  start.Add(3 * time.Second),
+				Usage:                 &openai.Usage{PromptTokens: 25, CompletionTokens: 12, TotalTokens: 37},
+			},
+		},
+	}
+
+	for _, format := range exportFormats {
+		t.Run(format.name, func(t *testing.T) {
+			data, err := format.write(export)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden.Assert(t, "export_"+format.name, data)
+		})
+	}
+}
+
+func TestMessagesBefore(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	message := func(content string, seconds int) Message {
+		return Message{
+			ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: content},
+			Time:                  start.Add(time.Duration(seconds) * time.Second),
+		}
+	}
+	thread := []Message{message("first", 0), message("second", 10), message("third", 20)}
+
+	before := messagesBefore(thread, []Message{message("third", 20)})
+	if len(before) != 2 || before[0].Content != "first" || before[1].Content != "second" {
+		t.Errorf("messagesBefore() = %+v, want the first two messages", before)
+	}
+	if before := messagesBefore(thread, []Message{chatMessage(openai.ChatMessageRoleUser, "third")}); before != nil {
+		t.Errorf("messagesBefore() without a time = %+v, want nothing", before)
+	}
+}
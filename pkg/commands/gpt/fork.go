@@ -0,0 +1,131 @@
+package gpt
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/audit"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+// This file defines the fork action, a message command that copies the conversation of a GPT thread up to the chosen
+// message into a new thread, so a different direction can be explored without changing the original conversation.
+
+// ForkCommandName is the name of the fork action in the apps menu of messages
+const ForkCommandName = "Fork conversation"
+
+// The ForkCommand function returns the fork action. It is used on a message of a GPT thread and starts a new thread
+// in the parent channel with the conversation up to and including that message.
+func ForkCommand(messagesCache *MessagesCache, completionModels []string, access *acl.Store, auditLog *audit.Logger) *bot.Command {
+	defaultModel := gptDefaultModel
+	if len(completionModels) > 0 {
+		defaultModel = completionModels[0]
+	}
+
+	return &bot.Command{
+		Name:                     ForkCommandName,
+		Type:                     discord.MessageApplicationCommand,
+		DMPermission:             false,
+		DefaultMemberPermissions: discord.PermissionViewChannel,
+		Middlewares: []bot.Handler{
+			acl.Middleware(access, nil),
+		},
+		Handler: bot.HandlerFunc(func(ctx *bot.Context) {
+			forkHandler(ctx, messagesCache, auditLog, defaultModel)
+		}),
+	}
+}
+
+// The forkHandler function forks the conversation of the thread at the message the action was used on.
+func forkHandler(ctx *bot.Context, messagesCache *MessagesCache, auditLog *audit.Logger, defaultModel string) {
+	err := ctx.Respond(&discord.InteractionResponse{
+		Type: discord.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discord.InteractionResponseData{Flags: discord.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		ctx.Logger.Error("Failed to respond to interaction", "error", err)
+		return
+	}
+
+	ch, err := ctx.CachedChannel(ctx.Interaction.ChannelID)
+	if err != nil || !ch.IsThread() {
+		followupError(ctx, "Only messages of GPT threads can be forked")
+		return
+	}
+
+	// the conversation is read like for an export, so the fork has the usage and times of the messages too
+	export, err := exportConversation(ctx, messagesCache, ch, defaultModel)
+	if err != nil {
+		ctx.Logger.Error("Failed to get the conversation", "error", err)
+		followupError(ctx, "Failed to get the conversation of this thread")
+		return
+	}
+	if export == nil {
+		followupError(ctx, "Only messages of GPT threads can be forked")
+		return
+	}
+
+	cacheItem := &MessagesCacheData{
+		Model:       export.Model,
+		Temperature: export.Temperature,
+	}
+	messages := export.Messages
+	if len(messages) > 0 && messages[0].Role == openai.ChatMessageRoleSystem {
+		cacheItem.SystemMessage = &messages[0].ChatCompletionMessage
+		messages = messages[1:]
+	}
+	cacheItem.Messages = messagesUpTo(messages, ctx.Interaction.ApplicationCommandData().TargetID)
+	if len(cacheItem.Messages) == 0 {
+		followupError(ctx, "The message is not part of the conversation, choose a prompt or an answer")
+		return
+	}
+
+	thread, err := startSeededThread(ctx, messagesCache, ch.ParentID, "🍴 Forked conversation", "Fork of "+ch.Name, cacheItem)
+	if err != nil {
+		ctx.Logger.Error("Failed to start the thread", "error", err)
+		followupError(ctx, "Failed to start the thread: "+err.Error())
+		return
+	}
+
+	auditLog.Emit(audit.Event{
+		Type:      audit.EventThreadCreated,
+		GuildID:   ctx.Interaction.GuildID,
+		ChannelID: thread.ID,
+		UserID:    ctx.Interaction.Member.User.ID,
+		Details:   map[string]string{"model": cacheItem.Model, "source": "fork", "forked_from": ch.ID},
+	})
+	ctx.Logger.Info("Conversation forked", "thread_id", thread.ID, "messages", len(cacheItem.Messages))
+
+	_, err = ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
+		Content: fmt.Sprintf("🍴 Forked %d messages into <#%s>", len(cacheItem.Messages), thread.ID),
+		Flags:   discord.MessageFlagsEphemeral,
+	})
+	if err != nil {
+		ctx.Logger.Error("Failed to respond to interaction", "error", err)
+	}
+}
+
+// The messagesUpTo function returns the messages up to and including the one posted in the Discord message. Snowflakes grow
+// over time, so the last message posted at or before the Discord message is the one it belongs to, also for the later parts
+// of a split answer. Messages without a Discord message, like the seed of an imported thread, go with the messages after them.
+func messagesUpTo(messages []Message, discordID string) []Message {
+	target, err := strconv.ParseUint(discordID, 10, 64)
+	if err != nil {
+		return nil
+	}
+	last := -1
+	for i, m := range messages {
+		id, err := strconv.ParseUint(m.DiscordID, 10, 64)
+		if err != nil {
+			continue
+		}
+		if id > target {
+			break
+		}
+		last = i
+	}
+	return append([]Message(nil), messages[:last+1]...)
+}
@@ -2,10 +2,15 @@ package gpt
 
 import (
 	"fmt"
-	"log"
 
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/audit"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/constants"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/logging"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/preferences"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/utils"
 	discord "github.com/bwmarrin/discordgo"
 	"github.com/sashabaranov/go-openai"
@@ -19,6 +24,7 @@ const (
 
 	gptInteractionEmbedColor  = 0x000000
 	gptPendingMessage         = "⌛ Wait a moment, please..."
+	gptQueuedMessage          = "⌛ You are #%d in line, wait a moment, please..."
 	gptContextOptionMaxLength = 1024 // due to discord embed field value limitation
 )
 
@@ -34,21 +40,21 @@ const (
 	// code block from the selection goes here
 
 
-func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *MessagesCache) {
-	ch, err := ctx.Session.State.Channel(ctx.Interaction.ChannelID)
+func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *MessagesCache, requests *queue.Pool, moderator *moderation.Service, auditLog *audit.Logger, answers render.Config, prefs *preferences.Store, defaultModel string) {
+	ch, err := ctx.CachedChannel(ctx.Interaction.ChannelID)
 	if err == nil && ch.IsThread() {
 		// ignore interactions invoked in threads
-		log.Printf("[GID: %s, i.ID: %s] Interaction was invoked in the existing thread, ignoring\n", ctx.Interaction.GuildID, ctx.Interaction.ID)
+		ctx.Logger.Debug("Interaction was invoked in the existing thread, ignoring")
 		return
 	}
 
-	log.Printf("[GID: %s, i.ID: %s] ChatGPT interaction invoked by UserID: %s\n", ctx.Interaction.GuildID, ctx.Interaction.ID, ctx.Interaction.Member.User.ID)
+	ctx.Logger.Info("ChatGPT interaction invoked")
 
 	err = ctx.Respond(&discord.InteractionResponse{
 		Type: discord.InteractionResponseDeferredChannelMessageWithSource,
 	})
 	if err != nil {
-		log.Printf("[GID: %s, i.ID: %s] Failed to respond to interactrion with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Error("Failed to respond to interaction", "error", err)
 		return
 	}
 
@@ -58,7 +64,7 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 	} else {
 		// We can't have empty prompt, unfortunately
 		// this should not happen, discord prevents empty required options
-		log.Printf("[GID: %s, i.ID: %s] Failed to parse prompt option\n", ctx.Interaction.GuildID, ctx.Interaction.ID)
+		ctx.Logger.Error("Failed to parse prompt option")
 		ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
 			Embeds: []*discord.MessageEmbed{
 				{
@@ -77,18 +83,21 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 	})
 
 	// Determine model
-	model := gptDefaultModel
+	model := defaultModel
 	if option, ok := ctx.Options[gptCommandOptionModel.string()]; ok {
 		model = option.StringValue()
-		log.Printf("[GID: %s, i.ID: %s] Model provided: %s\n", ctx.Interaction.GuildID, ctx.Interaction.ID, model)
+		ctx.Logger.Debug("Model provided", "model", model)
 	}
 
 	// Prepare cache item
 	cacheItem := &MessagesCacheData{
-		Messages: []openai.ChatCompletionMessage{
+		Messages: []Message{
 			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: prompt,
+				ChatCompletionMessage: openai.ChatCompletionMessage{
+					Role:    openai.ChatMessageRoleUser,
+					Content: prompt,
+				},
+				Time: interactionTime(ctx.Interaction),
 			},
 		},
 		Model: model,
@@ -104,9 +113,9 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 		// If an error occurs during the retrieval of the attachment data, the function logs an error message and sends a follow-up message to the Discord API 
 		// indicating that the attachment data could not be retrieved.
 		
-		context, err := getContentOrURLData(ctx.Client, attachmentURL)
+		context, err := getContentOrURLData(attachmentClient, attachmentURL)
 		if err != nil {
-			log.Printf("[GID: %s, i.ID: %s] Failed to get context file data with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+			ctx.Logger.Error("Failed to get context file data", "error", err)
 			ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
 				Embeds: []*discord.MessageEmbed{
 					{
@@ -127,7 +136,7 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 			Content: context,
 		}
 
-		if ok, count := isCacheItemWithinTruncateLimit(cacheItem); !ok {
+		if ok, count := isCacheItemWithinTruncateLimit(ctx.Context(), cacheItem); !ok {
 			// Message exceeds allowed token input from the user
 			truncateLimit := count
 			if limit := modelTruncateLimit(model); limit != nil {
@@ -144,21 +153,25 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 					},
 				},
 			})
-			log.Printf("[GID: %s, i.ID: %s] User provided context file has %d tokens, which exceeds allowed token limit of `%d` for model `%s`.\n", ctx.Interaction.GuildID, ctx.Interaction.ID, count, truncateLimit, model)
+			ctx.Logger.Warn("User provided context file exceeds allowed token limit", "tokens", count, "limit", truncateLimit, "model", model)
 			return
 		}
 		
+		if moderateInteractionInput(ctx, moderator, moderation.SourceContextFile, context) {
+			return
+		}
+
 		// The name of the field is set to the human-readable string of the gptCommandOptionContextFile option, and the value is set to the attachment URL.
 		fields = append(fields, &discord.MessageEmbedField{
 			Name:  gptCommandOptionContextFile.humanReadableString(),
 			Value: attachmentURL,
 		})
 
-		log.Printf("[GID: %s, i.ID: %s] Context file provided: [AID: %s]\n", ctx.Interaction.GuildID, ctx.Interaction.ID, attachmentID)
+		ctx.Logger.Debug("Context file provided", "attachment_id", attachmentID)
 	} else if option, ok := ctx.Options[gptCommandOptionContext.string()]; ok {
 		context := option.StringValue()
 		if len(context) >= gptContextOptionMaxLength {
-			log.Printf("[GID: %s, i.ID: %s] User-provided context is above limit of %d characters\n", ctx.Interaction.GuildID, ctx.Interaction.ID, gptContextOptionMaxLength)
+			ctx.Logger.Warn("User provided context is above the characters limit", "limit", gptContextOptionMaxLength)
 			ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
 				Embeds: []*discord.MessageEmbed{
 					{
@@ -170,6 +183,9 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 			})
 			return
 		}
+		if moderateInteractionInput(ctx, moderator, moderation.SourceContext, context) {
+			return
+		}
 		cacheItem.SystemMessage = &openai.ChatCompletionMessage{
 			Role:    openai.ChatMessageRoleSystem,
 			Content: context,
@@ -178,7 +194,12 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 			Name:  gptCommandOptionContext.humanReadableString(),
 			Value: context,
 		})
-		log.Printf("[GID: %s, i.ID: %s] Context provided: %s\n", ctx.Interaction.GuildID, ctx.Interaction.ID, context)
+		ctx.Logger.Debug("Context provided", logging.Content("context", context))
+	}
+
+	// Check the prompt before anything is posted or sent to the model
+	if moderateInteractionInput(ctx, moderator, moderation.SourcePrompt, prompt) {
+		return
 	}
 
 	// Add model info field after context
@@ -199,12 +220,13 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 			Name:  gptCommandOptionTemperature.humanReadableString(),
 			Value: fmt.Sprintf("%g", temp),
 		})
-		log.Printf("[GID: %s, i.ID: %s] Temperature provided: %g\n", ctx.Interaction.GuildID, ctx.Interaction.ID, temp)
+		ctx.Logger.Debug("Temperature provided", "temperature", temp)
 	}
 	// The function then responds to the interaction with a reference and user ping. The response includes a message embed with a description of the prompt,
 	// an author field indicating the user who made the request, and a list of fields that includes the selected temperature value.
 	// Respond to interaction with a reference and user ping
-	_, err = ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
+	// The followup is the deferred response, or a message of its own if a moderation warning took its place
+	m, err := ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
 		Embeds: []*discord.MessageEmbed{
 			{
 				Description: prompt,
@@ -220,7 +242,7 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 	}) 
 	// The function then logs a message indicating that the temperature was provided and includes the guild ID and interaction ID.
 	if err != nil {
-		log.Printf("[GID: %s, i.ID: %s] Failed to respond to interactrion with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Error("Failed to respond to interaction", "error", err)
 		ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
 			Embeds: []*discord.MessageEmbed{
 				{
@@ -233,19 +255,12 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 		return
 	}
 
-	// Get interaction ID so we can create a thread on top of it
-	m, err := ctx.Response()
-	if err != nil {
-		// Without interaction reference we cannot create a thread with the response of ChatGPT
-		// Maybe in the future just try to post a new message instead, but for now just cancel
-		log.Printf("[GID: %s, i.ID: %s] Failed to get interaction reference with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
-		ctx.Edit(fmt.Sprintf("Failed to get interaction reference with error: %v", err))
-		return
-	}
+	// the prompt is posted in the interaction reply
+	cacheItem.Messages[0].DiscordID = m.ID
 
-	ch, err = ctx.Session.State.Channel(m.ChannelID)
+	ch, err = ctx.CachedChannel(m.ChannelID)
 	if err != nil || ch.IsThread() {
-		log.Printf("[GID: %s, i.ID: %s] Interaction reply was in a thread, or there was an error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Warn("Interaction reply was in a thread, or there was an error", "error", err)
 		return
 	}
 
@@ -253,16 +268,30 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 		Name:                "New chat",
 		AutoArchiveDuration: gptDiscordThreadAutoArchivewDurationMinutes,
 		Invitable:           false,
-	})
+	}, discord.WithContext(ctx.Context()))
 
 	if err != nil {
 		// Without thread we cannot reply our answer
-		log.Printf("[GID: %s, i.ID: %s] Failed to create a thread with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Error("Failed to create a thread", "error", err)
 		return
 	}
 
+	auditLog.Emit(audit.Event{
+		Type:      audit.EventThreadCreated,
+		GuildID:   ctx.Interaction.GuildID,
+		ChannelID: thread.ID,
+		UserID:    ctx.Interaction.Member.User.ID,
+		Details:   map[string]string{"model": model},
+	})
+
+	// Messages posted in the thread before the first answer is ready wait for it
+	messagesCache.Lock(thread.ID)
+	defer messagesCache.Unlock(thread.ID)
+
 	// Lock the thread while we are generating ChatGPT answser
 	utils.ToggleDiscordThreadLock(ctx.Session, thread.ID, true)
+	// Unlock the thread at the end, also when the request fails or never gets out of the queue
+	defer utils.ToggleDiscordThreadLock(ctx.Session, thread.ID, false)
 
 	// add user to the thread
 	ctx.ThreadMemberAdd(thread.ID, ctx.Interaction.Member.User.ID)
@@ -271,17 +300,21 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 	if err != nil {
 		// Without reply  we cannot edit message with the response of ChatGPT
 		// Maybe in the future just try to post a new message instead, but for now just cancel
-		log.Printf("[GID: %s, i.ID: %s] Failed to reply in the thread with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Error("Failed to reply in the thread", "thread_id", thread.ID, "error", err)
 		return
 	}
 
 	messagesCache.Add(thread.ID, cacheItem)
 
-	log.Printf("[GID: %s, i.ID: %s] ChatGPT Request invoked with [Model: %s]. Current cache size: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, cacheItem.Model, len(cacheItem.Messages))
-	resp, err := sendChatGPTRequest(client, cacheItem)
+	ctx.Logger.Info("ChatGPT request invoked", "thread_id", thread.ID, "model", cacheItem.Model, "messages", len(cacheItem.Messages), logging.Content("prompt", prompt))
+	resp, err := queueChatGPTRequest(ctx.Context(), requests, queue.PriorityHigh, thread.ID, client, cacheItem, func(position int) {
+		// let the user know the request is waiting in line
+		queuedMessage := fmt.Sprintf(gptQueuedMessage, position)
+		utils.DiscordChannelMessageEdit(ctx.Session, channelMessage.ID, channelMessage.ChannelID, &queuedMessage, nil)
+	})
 	if err != nil {
 		// ChatGPT failed for whatever reason, tell users about it
-		log.Printf("[GID: %s, i.ID: %s] OpenAI request ChatCompletion failed with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Error("OpenAI request ChatCompletion failed", "thread_id", thread.ID, "model", cacheItem.Model, "error", err)
 		emptyString := ""
 		utils.DiscordChannelMessageEdit(ctx.Session, channelMessage.ID, channelMessage.ChannelID, &emptyString, []*discord.MessageEmbed{
 			{
@@ -295,15 +328,22 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 
 
 
+	// the answer replaces the pending message, the other messages it is posted in are recorded on it as well
+	cached := &cacheItem.Messages[len(cacheItem.Messages)-1]
+	cached.DiscordID = channelMessage.ID
+	cached.AnswerIDs = []string{channelMessage.ID}
+
 	//The code block is used to edit a message in a Discord channel with the response generated by the OpenAI API. 
-	// The function first defers a call to the ToggleDiscordThreadLock function to release the thread lock. 
 	// The function then calls the generateThreadTitleBasedOnInitialPrompt function to generate a thread title based on the initial prompt.
-	// Unlock the thread at the end
-	defer utils.ToggleDiscordThreadLock(ctx.Session, thread.ID, false)
 
-	go generateThreadTitleBasedOnInitialPrompt(ctx, client, thread.ID, cacheItem.Messages)
+	// the title is generated in the background, while the conversation may already go on
+	initialMessages := chatCompletionMessages(cacheItem.Messages)
+	traceCtx := ctx.Context()
+	ctx.Go(func() {
+		generateThreadTitleBasedOnInitialPrompt(traceCtx, ctx, client, thread.ID, initialMessages)
+	})
 
-	log.Printf("[GID: %s, i.ID: %s] ChatGPT Request [Model: %s] responded with a usage: [PromptTokens: %d, CompletionTokens: %d, TotalTokens: %d]\n", ctx.Interaction.GuildID, ctx.Interaction.ID, cacheItem.Model, resp.usage.PromptTokens, resp.usage.CompletionTokens, resp.usage.TotalTokens)
+	ctx.Logger.Info("ChatGPT request responded", "thread_id", thread.ID, "model", cacheItem.Model, "prompt_tokens", resp.usage.PromptTokens, "completion_tokens", resp.usage.CompletionTokens, "total_tokens", resp.usage.TotalTokens)
 
 	// The function logs a message indicating the details of the ChatGPT request, including the guild ID, interaction ID, model, and usage statistics. 
 	// The function then splits the response content into multiple messages using the splitMessage function.
@@ -311,11 +351,42 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 	// The function then calls the DiscordChannelMessageEdit function to edit the original message in the Discord channel with the first message in the messages slice. 
 	// If an error occurs during the editing of the message, the function logs an error message and sends a follow-up message to the Discord API indicating that an error occurred.
 
-	// Split message into multiple messages
-	messages := splitMessage(resp.content)
-	err = utils.DiscordChannelMessageEdit(ctx.Session, channelMessage.ID, channelMessage.ChannelID, &messages[0], nil)
+	// Check the answer before it is posted, blocked answers never reach the thread
+	if result := moderateOutput(ctx.Context(), ctx.Session, ctx.Logger.With("thread_id", thread.ID), moderator, ctx.Interaction.GuildID, thread.ID, ctx.Interaction.Member.User.ID, resp.content); result != nil {
+		switch result.Action {
+		case moderation.ActionBlock:
+			dropBlockedAnswer(cacheItem)
+			emptyString := ""
+			utils.DiscordChannelMessageEdit(ctx.Session, channelMessage.ID, channelMessage.ChannelID, &emptyString, []*discord.MessageEmbed{moderation.BlockedEmbed("The answer")})
+			return
+		case moderation.ActionWarn:
+			defer func() {
+				m, err := ctx.ChannelMessageSendComplex(thread.ID, &discord.MessageSend{Embeds: []*discord.MessageEmbed{moderation.WarningEmbed("The answer")}})
+				if err == nil {
+					cached.AnswerIDs = append(cached.AnswerIDs, m.ID)
+				}
+			}()
+		}
+	}
+
+	// Attach long code blocks as files and render the rest in the mode the user chose, the first message replaces the pending one
+	content, files := render.Attach(resp.content, answers.PolicyFor(ctx.Interaction.GuildID).Attachments)
+	messages := renderAnswer(renderMode(answers, prefs, ctx.Interaction.GuildID, ctx.Interaction.Member.User.ID), &answer{
+		content: content,
+		files:   files,
+		model:   cacheItem.Model,
+		usage:   resp.usage,
+		latency: resp.latency,
+	})
+	_, err = ctx.ChannelMessageEditComplex(&discord.MessageEdit{
+		Content: &messages[0].Content,
+		Embeds:  messages[0].Embeds,
+		Files:   messages[0].Files,
+		ID:      channelMessage.ID,
+		Channel: channelMessage.ChannelID,
+	})
 	if err != nil {
-		log.Printf("[GID: %s, i.ID: %s] Discord API failed with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
+		ctx.Logger.Error("Discord API failed", "thread_id", thread.ID, "error", err)
 		emptyString := ""
 		utils.DiscordChannelMessageEdit(ctx.Session, channelMessage.ID, channelMessage.ChannelID, &emptyString, []*discord.MessageEmbed{
 			{
@@ -327,15 +398,13 @@ func chatGPTHandler(ctx *bot.Context, client *openai.Client, messagesCache *Mess
 		return
 	}
 
-	if len(messages) > 1 {
-		// if there are more messages, send them as a thread reply
-		for _, message := range messages[1:] {
-			channelMessage, err = utils.DiscordChannelMessageSend(ctx.Session, thread.ID, message, nil)
-			if err != nil {
-				log.Printf("[GID: %s, i.ID: %s] Discord API failed with the error: %v\n", ctx.Interaction.GuildID, ctx.Interaction.ID, err)
-			}
+	// if there are more messages, send them as a thread reply
+	for _, message := range messages[1:] {
+		m, err := ctx.ChannelMessageSendComplex(thread.ID, message)
+		if err != nil {
+			ctx.Logger.Error("Discord API failed", "thread_id", thread.ID, "error", err)
+			continue
 		}
+		cached.AnswerIDs = append(cached.AnswerIDs, m.ID)
 	}
-
-	attachUsageInfo(ctx.Session, channelMessage, resp.usage, cacheItem.Model)
 }
@@ -0,0 +1,28 @@
+package gpt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/golden"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/markdown"
+)
+
+func TestSplitMessage(t *testing.T) {
+	answer, err := os.ReadFile(filepath.Join("testdata", "long_code_answer.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got strings.Builder
+	for i, message := range splitMessage(string(answer)) {
+		if length := markdown.Length(message); length > discordMaxMessageLength {
+			t.Errorf("message %d is %d characters long", i+1, length)
+		}
+		fmt.Fprintf(&got, "----- message %d (%d characters) -----\n%s\n", i+1, markdown.Length(message), message)
+	}
+	golden.Assert(t, "split_message_long_code_answer", []byte(got.String()))
+}
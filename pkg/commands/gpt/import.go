@@ -0,0 +1,176 @@
+package gpt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/audit"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// This file defines the import subcommand of the chat command, which starts a GPT thread with the messages of a JSON file.
+
+const (
+	importCommandName = "import"
+
+	importCommandOptionFile = "file"
+)
+
+// The ImportCommand function returns the import subcommand. It takes a JSON file with messages in the OpenAI chat message
+// format, e.g. an export of another thread, and starts a new GPT thread that continues the conversation. The model is
+// picked with the model option like with /chat gpt, the temperature of the file is used unless one is given.
+func ImportCommand(messagesCache *MessagesCache, completionModels []string, access *acl.Store, moderator *moderation.Service, auditLog *audit.Logger) *bot.Command {
+	temperatureOptionMinValue := 0.0
+	opts := []*discord.ApplicationCommandOption{
+		{
+			Type:        discord.ApplicationCommandOptionAttachment,
+			Name:        importCommandOptionFile,
+			Description: "JSON file with the messages of the conversation",
+			Required:    true,
+		},
+	}
+	defaultModel := gptDefaultModel
+	if len(completionModels) > 0 {
+		defaultModel = completionModels[0]
+	}
+	if len(completionModels) > 1 {
+		var modelChoices []*discord.ApplicationCommandOptionChoice
+		for i, model := range completionModels {
+			name := model
+			if i == 0 {
+				name += " (Default)"
+			}
+			modelChoices = append(modelChoices, &discord.ApplicationCommandOptionChoice{
+				Name:  name,
+				Value: model,
+			})
+		}
+		opts = append(opts, &discord.ApplicationCommandOption{
+			Type:        discord.ApplicationCommandOptionString,
+			Name:        gptCommandOptionModel.string(),
+			Description: "GPT model",
+			Choices:     modelChoices,
+		})
+	}
+	opts = append(opts, &discord.ApplicationCommandOption{
+		Type:        discord.ApplicationCommandOptionNumber,
+		Name:        gptCommandOptionTemperature.string(),
+		Description: "What sampling temperature to use, between 0.0 and 2.0. Lower - more focused and deterministic",
+		MinValue:    &temperatureOptionMinValue,
+		MaxValue:    2.0,
+	})
+
+	return &bot.Command{
+		Name:        importCommandName,
+		Description: "Continue a conversation from a JSON file in a new thread",
+		Options:     opts,
+		// The access middleware checks the command and the model the conversation continues with, like for /chat gpt
+		Middlewares: []bot.Handler{
+			acl.Middleware(access, func(ctx *bot.Context) []string {
+				return []string{acl.ModelResource(importModel(ctx, defaultModel))}
+			}),
+		},
+		Handler: bot.HandlerFunc(func(ctx *bot.Context) {
+			importHandler(ctx, messagesCache, moderator, auditLog, defaultModel)
+		}),
+	}
+}
+
+// The importModel function returns the model picked in the options, or the default one.
+func importModel(ctx *bot.Context, defaultModel string) string {
+	if option, ok := ctx.Options[gptCommandOptionModel.string()]; ok {
+		return option.StringValue()
+	}
+	return defaultModel
+}
+
+// The importHandler function reads the attached conversation and starts a thread with it in the channel.
+func importHandler(ctx *bot.Context, messagesCache *MessagesCache, moderator *moderation.Service, auditLog *audit.Logger, defaultModel string) {
+	err := ctx.Respond(&discord.InteractionResponse{
+		Type: discord.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discord.InteractionResponseData{Flags: discord.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		ctx.Logger.Error("Failed to respond to interaction", "error", err)
+		return
+	}
+
+	ch, err := ctx.CachedChannel(ctx.Interaction.ChannelID)
+	if err == nil && ch.IsThread() {
+		// threads can't have threads
+		followupError(ctx, "Conversations can't be imported in a thread, use the command in a channel")
+		return
+	}
+
+	option, ok := ctx.Options[importCommandOptionFile]
+	if !ok {
+		// this should not happen, discord prevents empty required options
+		ctx.Logger.Error("Failed to parse file option")
+		followupError(ctx, "Failed to parse file option")
+		return
+	}
+	attachment := ctx.Interaction.ApplicationCommandData().Resolved.Attachments[option.Value.(string)]
+	if attachment.Size > seedMaxSize {
+		followupError(ctx, fmt.Sprintf("The file is larger than %d KiB", seedMaxSize/1024))
+		return
+	}
+	data, err := getUrlData(attachmentClient, attachment.URL)
+	if err != nil {
+		ctx.Logger.Error("Failed to get the file", "error", err)
+		followupError(ctx, "Failed to get the file: "+err.Error())
+		return
+	}
+	cacheItem, name, err := parseSeed([]byte(data))
+	if err != nil {
+		ctx.Logger.Info("Failed to read the imported conversation", "error", err)
+		followupError(ctx, err.Error())
+		return
+	}
+	cacheItem.Model = importModel(ctx, defaultModel)
+	if option, ok := ctx.Options[gptCommandOptionTemperature.string()]; ok {
+		temp := float32(option.FloatValue())
+		cacheItem.Temperature = &temp
+	}
+
+	// The conversation is checked like prompts are, before anything is posted or sent to the model
+	var content strings.Builder
+	if cacheItem.SystemMessage != nil {
+		content.WriteString(cacheItem.SystemMessage.Content + "\n\n")
+	}
+	for _, m := range cacheItem.Messages {
+		content.WriteString(m.Content + "\n\n")
+	}
+	if moderateInteractionInput(ctx, moderator, moderation.SourceImport, content.String()) {
+		return
+	}
+
+	if name == "" {
+		name = "Imported chat"
+	}
+	thread, err := startSeededThread(ctx, messagesCache, ctx.Interaction.ChannelID, "📥 Imported conversation", name, cacheItem)
+	if err != nil {
+		ctx.Logger.Error("Failed to start the thread", "error", err)
+		followupError(ctx, "Failed to start the thread: "+err.Error())
+		return
+	}
+
+	auditLog.Emit(audit.Event{
+		Type:      audit.EventThreadCreated,
+		GuildID:   ctx.Interaction.GuildID,
+		ChannelID: thread.ID,
+		UserID:    ctx.Interaction.Member.User.ID,
+		Details:   map[string]string{"model": cacheItem.Model, "source": importCommandName},
+	})
+	ctx.Logger.Info("Conversation imported", "thread_id", thread.ID, "model", cacheItem.Model, "messages", len(cacheItem.Messages))
+
+	_, err = ctx.FollowupMessageCreate(ctx.Interaction, true, &discord.WebhookParams{
+		Content: fmt.Sprintf("📥 Imported %d messages into <#%s>", len(cacheItem.Messages), thread.ID),
+		Flags:   discord.MessageFlagsEphemeral,
+	})
+	if err != nil {
+		ctx.Logger.Error("Failed to respond to interaction", "error", err)
+	}
+}
@@ -0,0 +1,56 @@
+package gpt
+
+import "sync"
+
+// conversationLocks serializes the work on a conversation. discordgo dispatches every event in its own goroutine,
+// so two messages posted in a thread at the same time would otherwise both mutate the same *MessagesCacheData.
+// Waiters are served in the order they arrived, so messages in a thread are answered in order,
+// and a key is forgotten as soon as nobody holds or waits for it.
+type conversationLocks struct {
+	mu      sync.Mutex
+	waiters map[string][]chan struct{}
+}
+
+// lock blocks until the caller owns the conversation identified by key.
+// It returns the number of callers that were ahead in the queue.
+func (l *conversationLocks) lock(key string) (position int) {
+	l.mu.Lock()
+	if l.waiters == nil {
+		l.waiters = make(map[string][]chan struct{})
+	}
+
+	queue, busy := l.waiters[key]
+	if !busy {
+		// nobody owns the conversation, the queue holds just the owner
+		l.waiters[key] = []chan struct{}{nil}
+		l.mu.Unlock()
+		return 0
+	}
+
+	turn := make(chan struct{})
+	l.waiters[key] = append(queue, turn)
+	position = len(queue)
+	l.mu.Unlock()
+
+	<-turn
+	return position
+}
+
+// unlock releases the conversation identified by key and hands it over to the next waiter, if any.
+func (l *conversationLocks) unlock(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	queue, busy := l.waiters[key]
+	if !busy {
+		panic("gpt: unlock of unlocked conversation " + key)
+	}
+
+	queue = queue[1:]
+	if len(queue) == 0 {
+		delete(l.waiters, key)
+		return
+	}
+	l.waiters[key] = queue
+	close(queue[0])
+}
@@ -4,10 +4,17 @@
 package gpt
 
 import (
-	"log"
+	"fmt"
 	"time"
 
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/logging"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/metrics"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/preferences"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/utils"
 	discord "github.com/bwmarrin/discordgo"
 	"github.com/sashabaranov/go-openai"
@@ -19,24 +26,27 @@ const (
 
 	gptEmojiAck = "⌛"
 	gptEmojiErr = "❌"
+	// gptEmojiExcluded marks messages that are not part of the conversation, like blocked ones or the ones of users who
+	// may not chat with the model, so they are left out when the conversation is read back from the thread
+	gptEmojiExcluded = "🚫"
 )
 
 
-// The chatGPTMessageHandler function is the main function that handles messages sent to the Discord bot.
-// Function first checks if the message type should be handled by the function and if the message is not sent by the bot itself. 
-// The function then checks if the message is in a thread and if the thread is not locked or archived.
-func chatGPTMessageHandler(ctx *bot.MessageContext, client *openai.Client, messagesCache *MessagesCache, ignoredChannelsCache *IgnoredChannelsCache) {
+// The chatGPTThreadMiddleware function filters out the messages the gpt command should not answer, before any other middleware runs.
+// Function first checks if the message type should be handled by the function and if the message is not sent by the bot itself.
+// The function then checks if the message is in a thread, if the thread is not locked or archived and if it is a GPT thread.
+func chatGPTThreadMiddleware(ctx *bot.MessageContext, messagesCache *MessagesCache, ignoredChannelsCache *IgnoredChannelsCache) {
 	if !shouldHandleMessageType(ctx.Message.Type) {
 		// ignore message types that should not be handled by this command
 		return
 	}
 
-	if ctx.Session.State.User.ID == ctx.Message.Author.ID {
+	if ctx.CurrentUser().ID == ctx.Message.Author.ID {
 		// ignore self messages
 		return
 	}
 
-	if _, exists := (*ignoredChannelsCache)[ctx.Message.ChannelID]; exists {
+	if ignoredChannelsCache.Contains(ctx.Message.ChannelID) {
 		// skip over ignored channels list
 		return
 	}
@@ -46,145 +56,111 @@ func chatGPTMessageHandler(ctx *bot.MessageContext, client *openai.Client, messa
 		return
 	}
 
-	ch, err := ctx.Session.State.Channel(ctx.Message.ChannelID)
+	ch, err := ctx.CachedChannel(ctx.Message.ChannelID)
 	if err != nil {
-		log.Printf("[GID: %s, CHID: %s, MID: %s] Failed to get channel info with the error: %v\n", ctx.Message.GuildID, ctx.Message.ChannelID, ctx.Message.ID, err)
+		ctx.Logger.Error("Failed to get channel info", "error", err)
 		return
 	}
 
 	if !ch.IsThread() {
 		// ignore non threads
-		(*ignoredChannelsCache)[ctx.Message.ChannelID] = struct{}{}
+		ignoredChannelsCache.Add(ctx.Message.ChannelID)
 		return
 	}
 
 	if ch.ThreadMetadata != nil && (ch.ThreadMetadata.Locked || ch.ThreadMetadata.Archived) {
 		// We don't want to handle messages in locked or archived threads
-		log.Printf("[GID: %s, CHID: %s, MID: %s] Ignoring new message in a potential thread as it is locked or/and archived\n", ctx.Message.GuildID, ctx.Message.ChannelID, ctx.Message.ID)
+		ctx.Logger.Debug("Ignoring new message in a potential thread as it is locked or/and archived")
 		return
 	}
 
-	log.Printf("[GID: %s, CHID: %s, MID: %s] Handling new message in a potential GPT thread\n", ctx.Message.GuildID, ctx.Message.ChannelID, ctx.Message.ID)
-
-
-	// If the message is in a thread and not locked or archived, the function retrieves the messages in the thread and checks if it is a GPT thread.
-	// If it is a GPT thread, the function adds the messages to a cache and generates a response using the OpenAI API. 
-	// The response is then split into multiple messages and sent back to the Discord channel.
-	cacheItem, ok := messagesCache.Get(ctx.Message.ChannelID)
-	if !ok {
-		isGPTThread := true
-		cacheItem = &MessagesCacheData{}
-
-		var lastID string
-		retries := 0
-		for {
-			if retries >= gptDiscordChannelMessagesRequestMaxRetries {
-				// max retries reached
-				break
-			}
-			// Get messages in batches of 100 (maximum allowed by Discord API)
-			batch, err := ctx.Session.ChannelMessages(ch.ID, 100, lastID, "", "")
-			if err != nil {
-				// Since we cannot fetch messages, that means we cannot determine whether this a GPT thread,
-				// and if it was, we cannot get the full context to provide a better user experience. Do retries
-				// and print the error in the log
-				log.Printf("[GID: %s, CHID: %s, MID: %s] Failed to get channel messages with the error: %v. Retries left: %d\n", ctx.Message.GuildID, ctx.Message.ChannelID, ctx.Message.ID, err, (gptDiscordChannelMessagesRequestMaxRetries - retries))
-				retries++
-				continue
+	if !messagesCache.Contains(ch.ID) {
+		// GPT threads are started from the bot's interaction reply, and a thread started from a message has the same ID as the message.
+		// If the starter message can't be fetched we can't tell yet, the handler goes through the whole thread history then.
+		starter, err := ctx.Session.ChannelMessage(ch.ParentID, ch.ID)
+		if err == nil {
+			if prompt, _, _, _ := parseInteractionReply(starter); starter.Author.ID != ctx.CurrentUser().ID || prompt == "" {
+				ctx.Logger.Debug("Not a GPT thread, saving to ignored cache to skip over it later")
+				ignoredChannelsCache.Add(ctx.Message.ChannelID)
+				return
 			}
+		}
+	}
 
-			transformed := make([]openai.ChatCompletionMessage, 0, len(batch))
-			for _, value := range batch {
-				role := openai.ChatMessageRoleUser
-				if value.Author.ID == ctx.Session.State.User.ID {
-					role = openai.ChatMessageRoleAssistant
-				}
-				content := value.Content
-				// First message is always a referenced message
-				// Check if it is, and then modify to get the original prompt
-				if value.Type == discord.MessageTypeThreadStarterMessage {
-					if value.Author.ID != ctx.Session.State.User.ID || value.ReferencedMessage == nil {
-						// this is not gpt thread, ignore
-						isGPTThread = false
-						break
-					}
-					role = openai.ChatMessageRoleUser
-
-					prompt, context, model, temperature := parseInteractionReply(value.ReferencedMessage)
-					if prompt == "" {
-						isGPTThread = false
-						break
-					}
-					content = prompt
-					var systemMessage *openai.ChatCompletionMessage
-					if context != "" {
-						context, _ = getContentOrURLData(ctx.Client, context)
-						systemMessage = &openai.ChatCompletionMessage{
-							Role:    openai.ChatMessageRoleSystem,
-							Content: context,
-						}
-					}
-					if model == "" {
-						model = gptDefaultModel
-					}
-					if temperature != nil {
-						cacheItem.Temperature = temperature
-					}
-
-					cacheItem.SystemMessage = systemMessage
-					cacheItem.Model = model
-				} else if !shouldHandleMessageType(value.Type) {
-					// ignore message types that are
-					// not related to conversation
-					continue
-				}
-				transformed = append(transformed, openai.ChatCompletionMessage{
-					Role:    role,
-					Content: content,
-				})
-			}
+	ctx.Next()
+}
 
-			reverseMessages(&transformed)
+// The chatGPTMessageHandler function is the main function that handles messages sent to the Discord bot in GPT threads.
+// Messages are filtered by chatGPTThreadMiddleware before they get here.
+func chatGPTMessageHandler(ctx *bot.MessageContext, client *openai.Client, messagesCache *MessagesCache, ignoredChannelsCache *IgnoredChannelsCache, requests *queue.Pool, access *acl.Store, moderator *moderation.Service, answers render.Config, prefs *preferences.Store, defaultModel string) {
+	metrics.Messages.WithLabelValues(ctx.Caller.Name).Inc()
 
-			// Add the messages to the beginning of the main list
-			cacheItem.Messages = append(transformed, cacheItem.Messages...)
+	// Process messages of a thread one at a time, later messages wait for the earlier ones to be answered
+	if queued := messagesCache.Lock(ctx.Message.ChannelID); queued > 0 {
+		ctx.Logger.Debug("Message was queued behind other messages", "queued", queued)
+	}
+	defer messagesCache.Unlock(ctx.Message.ChannelID)
 
-			// If there are no more messages in the thread, break the loop
-			if len(batch) == 0 {
-				break
-			}
+	ctx.Logger.Info("Handling new message in a potential GPT thread")
 
-			// Set the lastID to the last message's ID to get the next batch of messages
-			lastID = batch[len(batch)-1].ID
-		}
 
-		if retries >= gptDiscordChannelMessagesRequestMaxRetries {
-			// max retries reached on fetching messages
-			log.Printf("[GID: %s, CHID: %s, MID: %s] Failed to get channel messages. Reached max retries\n", ctx.Message.GuildID, ctx.Message.ChannelID, ctx.Message.ID)
+	// If the message is in a thread and not locked or archived, the function retrieves the messages in the thread and checks if it is a GPT thread.
+	// If it is a GPT thread, the function adds the messages to a cache and generates a response using the OpenAI API. 
+	// The response is then split into multiple messages and sent back to the Discord channel.
+	cacheItem, ok := messagesCache.Get(ctx.Message.ChannelID)
+	if !ok {
+		var err error
+		cacheItem, err = loadConversation(ctx.Context(), ctx.Session, ctx.Logger, ctx.Message.ChannelID, defaultModel)
+		if err != nil {
+			ctx.Logger.Error("Failed to get channel messages", "error", err)
 			return
 		}
-
-		if !isGPTThread {
+		if cacheItem == nil {
 			// this was not a GPT thread
-			log.Printf("[GID: %s, CHID: %s, MID: %s] Not a GPT thread, saving to ignored cache to skip over it later\n", ctx.Message.GuildID, ctx.Message.ChannelID, ctx.Message.ID)
+			ctx.Logger.Debug("Not a GPT thread, saving to ignored cache to skip over it later")
 			// save threadID to ignored cache, so we can always ignore it later
-			(*ignoredChannelsCache)[ctx.Message.ChannelID] = struct{}{}
+			ignoredChannelsCache.Add(ctx.Message.ChannelID)
 			return
 		}
 
+		// The history already has the message, it is checked before the conversation is cached,
+		// so a message that is not answered doesn't become part of it
+		if !chatGPTMessageAllowed(ctx, access, cacheItem.Model) || moderateMessageInput(ctx, moderator) {
+			if i := cachedMessageIndex(cacheItem, ctx.Message.ID); i >= 0 {
+				removeCachedMessage(cacheItem, i)
+			}
+			messagesCache.Add(ctx.Message.ChannelID, cacheItem)
+			return
+		}
 		messagesCache.Add(ctx.Message.ChannelID, cacheItem)
 	} else {
-		cacheItem.Messages = append(cacheItem.Messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: ctx.Message.Content,
+		// check the access and moderate the message before it becomes part of the conversation
+		if !chatGPTMessageAllowed(ctx, access, cacheItem.Model) || moderateMessageInput(ctx, moderator) {
+			return
+		}
+		cacheItem.Messages = append(cacheItem.Messages, Message{
+			ChatCompletionMessage: openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleUser,
+				Content: ctx.Message.Content,
+			},
+			Time:      ctx.Message.Timestamp,
+			DiscordID: ctx.Message.ID,
 		})
 	}
 
+
+	answerThreadMessage(ctx, client, cacheItem, requests, moderator, answers, prefs)
+}
+
+// The answerThreadMessage function asks the model for the answer to the last message of the conversation and replies with it
+// to the message of the context. It is used for new messages and for edited ones whose answer is generated again, the
+// conversation of the thread must be locked by the caller.
+func answerThreadMessage(ctx *bot.MessageContext, client *openai.Client, cacheItem *MessagesCacheData, requests *queue.Pool, moderator *moderation.Service, answers render.Config, prefs *preferences.Store) {
 	// check if current message cache is within allowed token limit
-	if ok, count := isCacheItemWithinTruncateLimit(cacheItem); !ok {
-		log.Printf("[GID: %s, CHID: %s, MID: %s] Current thread cache token count of %d exceeds truncate limit. Performing adjustments.\n", ctx.Message.GuildID, ctx.Message.ChannelID, ctx.Message.ID, count)
-		adjustMessageTokens(cacheItem)
-		log.Printf("[GID: %s, CHID: %s, MID: %s] Tokens adjustments finished. Current cache tokens: %d\n", ctx.Message.GuildID, ctx.Message.ChannelID, ctx.Message.ID, cacheItem.TokenCount)
+	if ok, count := isCacheItemWithinTruncateLimit(ctx.Context(), cacheItem); !ok {
+		ctx.Logger.Info("Thread cache token count exceeds truncate limit, performing adjustments", "tokens", count)
+		adjustMessageTokens(ctx.Context(), cacheItem)
+		ctx.Logger.Info("Tokens adjustments finished", "tokens", cacheItem.TokenCount)
 	}
 
 	// Lock the thread while we are generating ChatGPT answser
@@ -213,16 +189,23 @@ func chatGPTMessageHandler(ctx *bot.MessageContext, client *openai.Client, messa
 		}
 	}()
 
-	log.Printf("[GID: %s, CHID: %s] ChatGPT Request invoked with [Model: %s]. Current cache size: %v\n", ctx.Message.GuildID, ctx.Message.ChannelID, cacheItem.Model, len(cacheItem.Messages))
+	ctx.Logger.Info("ChatGPT request invoked", "model", cacheItem.Model, "messages", len(cacheItem.Messages), logging.Content("prompt", ctx.Message.Content))
 
-	resp, err := sendChatGPTRequest(client, cacheItem)
+	var queuedMessage *discord.Message
+	resp, err := queueChatGPTRequest(ctx.Context(), requests, queue.PriorityLow, ctx.Message.ChannelID, client, cacheItem, func(position int) {
+		// let the user know the request is waiting in line
+		queuedMessage, _ = ctx.Reply(fmt.Sprintf(gptQueuedMessage, position))
+	})
+	if queuedMessage != nil {
+		ctx.ChannelMessageDelete(queuedMessage.ChannelID, queuedMessage.ID)
+	}
 
 	// Signal the typing ticker to stop
 	done <- true
 
 	if err != nil {
 		// ChatGPT failed for whatever reason, tell users about it
-		log.Printf("[GID: %s, CHID: %s] ChatGPT request ChatCompletion failed with the error: %v\n", ctx.Message.GuildID, ctx.Message.ChannelID, err)
+		ctx.Logger.Error("OpenAI request ChatCompletion failed", "model", cacheItem.Model, "error", err)
 		ctx.AddReaction(gptEmojiErr)
 		ctx.EmbedReply(&discord.MessageEmbed{
 			Title:       "❌ OpenAI API failed",
@@ -232,17 +215,44 @@ func chatGPTMessageHandler(ctx *bot.MessageContext, client *openai.Client, messa
 		return
 	}
 
-	log.Printf("[GID: %s, CHID: %s] ChatGPT Request [Model: %s] responded with a usage: [PromptTokens: %d, CompletionTokens: %d, TotalTokens: %d]\n", ctx.Message.GuildID, ctx.Message.ChannelID, cacheItem.Model, resp.usage.PromptTokens, resp.usage.CompletionTokens, resp.usage.TotalTokens)
+	ctx.Logger.Info("ChatGPT request responded", "model", cacheItem.Model, "prompt_tokens", resp.usage.PromptTokens, "completion_tokens", resp.usage.CompletionTokens, "total_tokens", resp.usage.TotalTokens)
 	// The code block logs a message indicating the details of the ChatGPT request, including the guild ID, channel ID, model, and usage statistics. 
 	// The function then splits the response content into multiple messages using the splitMessage function.
 	// The function then iterates over the messages slice and sends each message as a reply to the original message in the Discord channel using the ctx.Reply function. 
 	// If an error occurs during the sending of the message, the function logs an error message and sends a follow-up message to the Discord API indicating that an error occurred.
-	messages := splitMessage(resp.content)
-	var replyMessage *discord.Message
-	for _, message := range messages {
-		replyMessage, err = ctx.Reply(message)
+	// the answer is the last message of the conversation, the messages it is posted in are recorded on it
+	cached := &cacheItem.Messages[len(cacheItem.Messages)-1]
+
+	// Check the answer before it is posted, blocked answers never reach the thread
+	if result := moderateOutput(ctx.Context(), ctx.Session, ctx.Logger, moderator, ctx.Message.GuildID, ctx.Message.ChannelID, ctx.Message.Author.ID, resp.content); result != nil {
+		switch result.Action {
+		case moderation.ActionBlock:
+			dropBlockedAnswer(cacheItem)
+			ctx.AddReaction(gptEmojiErr)
+			ctx.EmbedReply(moderation.BlockedEmbed("The answer"))
+			return
+		case moderation.ActionWarn:
+			defer func() {
+				if m, err := ctx.EmbedReply(moderation.WarningEmbed("The answer")); err == nil {
+					cached.AnswerIDs = append(cached.AnswerIDs, m.ID)
+				}
+			}()
+		}
+	}
+
+	// Attach long code blocks as files and render the rest in the mode the user chose
+	content, files := render.Attach(resp.content, answers.PolicyFor(ctx.Message.GuildID).Attachments)
+	messages := renderAnswer(renderMode(answers, prefs, ctx.Message.GuildID, ctx.Message.Author.ID), &answer{
+		content: content,
+		files:   files,
+		model:   cacheItem.Model,
+		usage:   resp.usage,
+		latency: resp.latency,
+	})
+	for i, message := range messages {
+		m, err := ctx.ReplyComplex(message)
 		if err != nil {
-			log.Printf("[GID: %s, CHID: %s, MID: %s] Failed to reply in the thread with the error: %v\n", ctx.Message.GuildID, ctx.Message.ChannelID, ctx.Message.ID, err)
+			ctx.Logger.Error("Failed to reply in the thread", "error", err)
 			ctx.AddReaction(gptEmojiErr)
 			ctx.EmbedReply(&discord.MessageEmbed{
 				Title:       "❌ Discord API Error",
@@ -251,9 +261,25 @@ func chatGPTMessageHandler(ctx *bot.MessageContext, client *openai.Client, messa
 			})
 			return
 		}
+		if i == 0 {
+			cached.DiscordID = m.ID
+		}
+		cached.AnswerIDs = append(cached.AnswerIDs, m.ID)
 	}
+}
 
-	// The function then calls the attachUsageInfo function to attach usage information to the response message. 
-	// The attachUsageInfo function is used to add usage information to the response message, including the number of prompt tokens, completion tokens, and total tokens used by the OpenAI API.
-	attachUsageInfo(ctx.Session, replyMessage, resp.usage, cacheItem.Model)
+// The chatGPTMessageAllowed function checks if the author of the message is allowed to chat in threads with the model of the thread.
+// If not, the message is marked as not part of the conversation, the user is told so and the function returns false.
+func chatGPTMessageAllowed(ctx *bot.MessageContext, access *acl.Store, model string) bool {
+	if access == nil {
+		return true
+	}
+	denied := access.Check(ctx.Message.GuildID, acl.MessageSubject(ctx.Session, ctx.Message), acl.ResourceThreadChat, acl.ModelResource(model))
+	if denied == "" {
+		return true
+	}
+	ctx.Logger.Info("User is not allowed to use the resource", "resource", denied)
+	ctx.AddReaction(gptEmojiExcluded)
+	ctx.EmbedReply(acl.DeniedEmbed(denied))
+	return false
 }
@@ -0,0 +1,359 @@
+package gpt
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/openaitest"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/sessiontest"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestChatGPTThreadMiddleware(t *testing.T) {
+	user := &discord.User{ID: "1", Username: "alice"}
+
+	tests := []struct {
+		name string
+		// setup adds the channels and messages and returns the message sent by the user
+		setup       func(s *sessiontest.Session, messagesCache *MessagesCache) *discord.Message
+		wantHandled bool
+		wantIgnored bool
+	}{
+		{
+			name: "own message",
+			setup: func(s *sessiontest.Session, _ *MessagesCache) *discord.Message {
+				thread := addThread(s, "100", "200", false)
+				return &discord.Message{ChannelID: thread.ID, Author: s.User, Content: "Hi"}
+			},
+		},
+		{
+			name: "not a thread",
+			setup: func(s *sessiontest.Session, _ *MessagesCache) *discord.Message {
+				s.AddChannel(&discord.Channel{ID: "100", Type: discord.ChannelTypeGuildText})
+				return &discord.Message{ChannelID: "100", Author: user, Content: "Hi"}
+			},
+			wantIgnored: true,
+		},
+		{
+			name: "locked thread",
+			setup: func(s *sessiontest.Session, _ *MessagesCache) *discord.Message {
+				thread := addThread(s, "100", "200", true)
+				return &discord.Message{ChannelID: thread.ID, Author: user, Content: "Hi"}
+			},
+		},
+		{
+			name: "cached thread",
+			setup: func(s *sessiontest.Session, messagesCache *MessagesCache) *discord.Message {
+				thread := addThread(s, "100", "200", false)
+				messagesCache.Add(thread.ID, &MessagesCacheData{})
+				return &discord.Message{ChannelID: thread.ID, Author: user, Content: "Hi"}
+			},
+			wantHandled: true,
+		},
+		{
+			name: "thread started from a prompt of the bot",
+			setup: func(s *sessiontest.Session, _ *MessagesCache) *discord.Message {
+				thread := addThread(s, "100", "200", false)
+				s.AddMessage(&discord.Message{
+					ID:        thread.ID,
+					ChannelID: thread.ParentID,
+					Author:    s.User,
+					Embeds:    []*discord.MessageEmbed{{Description: "Hello there"}},
+				})
+				return &discord.Message{ChannelID: thread.ID, Author: user, Content: "Hi"}
+			},
+			wantHandled: true,
+		},
+		{
+			name: "thread started from a message of a user",
+			setup: func(s *sessiontest.Session, _ *MessagesCache) *discord.Message {
+				thread := addThread(s, "100", "200", false)
+				s.AddMessage(&discord.Message{ID: thread.ID, ChannelID: thread.ParentID, Author: user, Content: "Let's talk"})
+				return &discord.Message{ChannelID: thread.ID, Author: user, Content: "Hi"}
+			},
+			wantIgnored: true,
+		},
+		{
+			name: "starter message unavailable",
+			setup: func(s *sessiontest.Session, _ *MessagesCache) *discord.Message {
+				thread := addThread(s, "100", "200", false)
+				return &discord.Message{ChannelID: thread.ID, Author: user, Content: "Hi"}
+			},
+			wantHandled: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := sessiontest.New()
+			messagesCache, err := NewMessagesCache(16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ignoredChannelsCache, err := NewIgnoredChannelsCache(16, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := test.setup(s, messagesCache)
+			m.Type = discord.MessageTypeDefault
+
+			handled := false
+			ctx := bot.NewMessageContext(context.Background(), s, &bot.Command{Name: "chat"}, m, []bot.MessageHandler{
+				bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+					chatGPTThreadMiddleware(ctx, messagesCache, ignoredChannelsCache)
+				}),
+				bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+					handled = true
+				}),
+			})
+			ctx.Next()
+
+			if handled != test.wantHandled {
+				t.Errorf("handled = %v, want %v", handled, test.wantHandled)
+			}
+			if ignored := ignoredChannelsCache.Contains(m.ChannelID); ignored != test.wantIgnored {
+				t.Errorf("channel ignored = %v, want %v", ignored, test.wantIgnored)
+			}
+		})
+	}
+}
+
+// addGPTThread adds a GPT thread started with the prompt "Hello there" and answered with "Hi!".
+func addGPTThread(s *sessiontest.Session) *discord.Channel {
+	starter := s.AddMessage(&discord.Message{
+		ID:        "200",
+		ChannelID: "100",
+		GuildID:   "10",
+		Author:    s.User,
+		Embeds:    []*discord.MessageEmbed{{Description: "Hello there"}},
+	})
+	thread := addThread(s, "100", starter.ID, false)
+	s.AddMessage(&discord.Message{ChannelID: thread.ID, Author: s.User, Type: discord.MessageTypeThreadStarterMessage, ReferencedMessage: starter})
+	s.AddMessage(&discord.Message{ChannelID: thread.ID, Author: s.User, Content: "Hi!", Type: discord.MessageTypeReply})
+	return thread
+}
+
+// conversationOf returns the messages of the conversation as "role: content".
+func conversationOf(cacheItem *MessagesCacheData) []string {
+	var conversation []string
+	for _, m := range cacheItem.Messages {
+		conversation = append(conversation, m.Role+": "+m.Content)
+	}
+	return conversation
+}
+
+func TestChatGPTMessageHandlerDenied(t *testing.T) {
+	s := sessiontest.New()
+	thread := addGPTThread(s)
+	user := &discord.User{ID: "1", Username: "alice"}
+	denied := s.AddMessage(&discord.Message{ChannelID: thread.ID, GuildID: "10", Author: user, Content: "How are you?", Type: discord.MessageTypeDefault})
+
+	access, err := acl.Open(filepath.Join(t.TempDir(), "acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := access.Set("10", acl.Rule{Resource: acl.ResourceThreadChat, SubjectType: acl.SubjectUser, SubjectID: user.ID, Effect: acl.Deny}); err != nil {
+		t.Fatal(err)
+	}
+	messagesCache, err := NewMessagesCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignoredChannelsCache, err := NewIgnoredChannelsCache(16, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the thread is not cached, its history already has the denied message
+	ctx := bot.NewMessageContext(context.Background(), s, &bot.Command{Name: "chat"}, denied, []bot.MessageHandler{
+		bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+			// the message is not answered, so no client and queue are needed
+			chatGPTMessageHandler(ctx, nil, messagesCache, ignoredChannelsCache, nil, access, nil, render.Config{}, nil, openai.GPT3Dot5Turbo)
+		}),
+	})
+	ctx.Next()
+
+	want := []string{"user: Hello there", "assistant: Hi!"}
+	cacheItem, ok := messagesCache.Get(thread.ID)
+	if !ok {
+		t.Fatal("the conversation was not cached")
+	}
+	if got := conversationOf(cacheItem); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("cached conversation = %q, want %q", got, want)
+	}
+
+	// the mark keeps the message out when the conversation is read from the thread again
+	reactions := s.Reactions()
+	if len(reactions) != 1 || reactions[0].MessageID != denied.ID || reactions[0].Emoji != gptEmojiExcluded {
+		t.Errorf("reactions = %+v, want %s on the denied message", reactions, gptEmojiExcluded)
+	}
+	cacheItem, err = loadConversation(context.Background(), s, slog.Default(), thread.ID, openai.GPT3Dot5Turbo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conversationOf(cacheItem); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("loaded conversation = %q, want %q", got, want)
+	}
+}
+
+func TestChatGPTMessageHandlerBlocked(t *testing.T) {
+	s := sessiontest.New()
+	thread := addGPTThread(s)
+	user := &discord.User{ID: "1", Username: "alice"}
+	blocked := s.AddMessage(&discord.Message{ChannelID: thread.ID, GuildID: "10", Author: user, Content: "How are you? " + openaitest.FlaggedMarker, Type: discord.MessageTypeDefault})
+
+	openAI := openaitest.NewServer(t)
+	moderator := moderation.New(openAI.Client(), moderation.Config{}, nil)
+	messagesCache, err := NewMessagesCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignoredChannelsCache, err := NewIgnoredChannelsCache(16, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the thread is not cached, its history already has the blocked message
+	ctx := bot.NewMessageContext(context.Background(), s, &bot.Command{Name: "chat"}, blocked, []bot.MessageHandler{
+		bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+			// the message is not answered, so no queue is needed
+			chatGPTMessageHandler(ctx, openAI.Client(), messagesCache, ignoredChannelsCache, nil, nil, moderator, render.Config{}, nil, openai.GPT3Dot5Turbo)
+		}),
+	})
+	ctx.Next()
+
+	if n := len(openAI.ChatCompletionRequests()); n != 0 {
+		t.Errorf("%d chat completion requests, want the blocked message not to be answered", n)
+	}
+	want := []string{"user: Hello there", "assistant: Hi!"}
+	cacheItem, ok := messagesCache.Get(thread.ID)
+	if !ok {
+		t.Fatal("the conversation was not cached")
+	}
+	if got := conversationOf(cacheItem); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("cached conversation = %q, want %q", got, want)
+	}
+
+	// the mark keeps the message out when the conversation is read from the thread again
+	reactions := s.Reactions()
+	if len(reactions) != 1 || reactions[0].MessageID != blocked.ID || reactions[0].Emoji != gptEmojiExcluded {
+		t.Errorf("reactions = %+v, want %s on the blocked message", reactions, gptEmojiExcluded)
+	}
+	cacheItem, err = loadConversation(context.Background(), s, slog.Default(), thread.ID, openai.GPT3Dot5Turbo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conversationOf(cacheItem); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("loaded conversation = %q, want %q", got, want)
+	}
+}
+
+// TestChatGPTMessageHandlerConcurrent sends several messages in one thread at once. They must be answered one at a time
+// in the order they came in, and the race detector must not find the handlers sharing the conversation unsynchronized.
+func TestChatGPTMessageHandlerConcurrent(t *testing.T) {
+	s := sessiontest.New()
+	thread := addGPTThread(s)
+	user := &discord.User{ID: "1", Username: "alice"}
+
+	openAI := openaitest.NewServer(t)
+	// the answers take a moment, so the next messages pile up behind the one being answered
+	openAI.SetLatency(5 * time.Millisecond)
+	requests := queue.New(4, 16, nil)
+	defer requests.Close()
+	messagesCache, err := NewMessagesCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignoredChannelsCache, err := NewIgnoredChannelsCache(16, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheItem, err := loadConversation(context.Background(), s, slog.Default(), thread.ID, openai.GPT3Dot5Turbo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messagesCache.Add(thread.ID, cacheItem)
+
+	// The conversation is held until all messages wait for it, so the order they are answered in is the order they came in
+	messagesCache.Lock(thread.ID)
+	const count = 5
+	var wg sync.WaitGroup
+	for i := 1; i <= count; i++ {
+		m := s.AddMessage(&discord.Message{ChannelID: thread.ID, GuildID: "10", Author: user, Content: fmt.Sprintf("Question %d", i), Type: discord.MessageTypeDefault})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := bot.NewMessageContext(context.Background(), s, &bot.Command{Name: "chat"}, m, []bot.MessageHandler{
+				bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+					chatGPTMessageHandler(ctx, openAI.Client(), messagesCache, ignoredChannelsCache, requests, nil, nil, render.Config{}, nil, openai.GPT3Dot5Turbo)
+				}),
+			})
+			ctx.Next()
+		}()
+		waitForWaiters(t, messagesCache, thread.ID, i)
+	}
+	messagesCache.Unlock(thread.ID)
+	wg.Wait()
+
+	want := []string{"user: Hello there", "assistant: Hi!"}
+	for i := 1; i <= count; i++ {
+		want = append(want, fmt.Sprintf("user: Question %d", i), fmt.Sprintf("assistant: You said: Question %d", i))
+	}
+	cacheItem, _ = messagesCache.Get(thread.ID)
+	if got := conversationOf(cacheItem); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("cached conversation = %q, want %q", got, want)
+	}
+
+	// every request has the answers to the earlier messages
+	chatRequests := openAI.ChatCompletionRequests()
+	if len(chatRequests) != count {
+		t.Fatalf("%d chat completion requests, want %d", len(chatRequests), count)
+	}
+	for i, req := range chatRequests {
+		if n := len(req.Messages); n != 3+2*i || req.Messages[n-1].Content != fmt.Sprintf("Question %d", i+1) {
+			t.Errorf("request %d has %d messages ending with %q, want %d ending with Question %d", i+1, n, req.Messages[n-1].Content, 3+2*i, i+1)
+		}
+	}
+}
+
+// waitForWaiters waits until n callers wait for the conversation of the thread, behind the one holding it.
+func waitForWaiters(t *testing.T, messagesCache *MessagesCache, threadID string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		messagesCache.locks.mu.Lock()
+		waiting := len(messagesCache.locks.waiters[threadID]) - 1
+		messagesCache.locks.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages wait for the conversation, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// addThread adds a text channel and a public thread in it.
+func addThread(s *sessiontest.Session, channelID string, threadID string, locked bool) *discord.Channel {
+	s.AddChannel(&discord.Channel{ID: channelID, Type: discord.ChannelTypeGuildText})
+	thread := &discord.Channel{
+		ID:             threadID,
+		ParentID:       channelID,
+		Type:           discord.ChannelTypeGuildPublicThread,
+		ThreadMetadata: &discord.ThreadMetadata{Locked: locked},
+	}
+	s.AddChannel(thread)
+	return thread
+}
@@ -0,0 +1,58 @@
+package gpt
+
+import "github.com/sashabaranov/go-openai"
+
+// modelInfo is what the bot knows about a chat completion model.
+type modelInfo struct {
+	name string
+	// promptPrice and completionPrice are the prices of a token in USD
+	promptPrice     float64
+	completionPrice float64
+	// truncateLimit is the number of tokens a conversation is cut down to before it is sent, zero if it is not cut
+	truncateLimit int
+}
+
+// models is the catalog of chat completion models the bot knows how to talk to, count tokens for and price.
+// Models outside of this list are rejected by config validation. The models without a date may change over time,
+// they are priced and truncated like the snapshot noted next to them.
+var models = []modelInfo{
+	// priced like gpt-3.5-turbo-0613, truncated like gpt-3.5-turbo-0301
+	{name: openai.GPT3Dot5Turbo, promptPrice: gptPricePerPromptTokenGPT3Dot5Turbo0613, completionPrice: gptPricePerCompletionTokenGPT3Dot5Turbo0613, truncateLimit: gptTruncateLimitGPT3Dot5Turbo0301},
+	{name: openai.GPT3Dot5Turbo0301, promptPrice: gptPricePerPromptTokenGPT3Dot5Turbo0613, completionPrice: gptPricePerCompletionTokenGPT3Dot5Turbo0613, truncateLimit: gptTruncateLimitGPT3Dot5Turbo0301},
+	{name: openai.GPT3Dot5Turbo0613, promptPrice: gptPricePerPromptTokenGPT3Dot5Turbo0613, completionPrice: gptPricePerCompletionTokenGPT3Dot5Turbo0613},
+	{name: openai.GPT3Dot5Turbo16K, promptPrice: gptPricePerPromptTokenGPT3Dot5Turbo16K0613, completionPrice: gptPricePerCompletionTokenGPT3Dot5Turbo16K0613},
+	{name: openai.GPT3Dot5Turbo16K0613, promptPrice: gptPricePerPromptTokenGPT3Dot5Turbo16K0613, completionPrice: gptPricePerCompletionTokenGPT3Dot5Turbo16K0613},
+	// priced like gpt-4-0613, truncated like gpt-4-0314
+	{name: openai.GPT4, promptPrice: gptPricePerPromptTokenGPT40613, completionPrice: gptPricePerCompletionTokenGPT40613, truncateLimit: gptTruncateLimitGPT40314},
+	{name: openai.GPT40314, promptPrice: gptPricePerPromptTokenGPT40613, completionPrice: gptPricePerCompletionTokenGPT40613, truncateLimit: gptTruncateLimitGPT40314},
+	{name: openai.GPT40613, promptPrice: gptPricePerPromptTokenGPT40613, completionPrice: gptPricePerCompletionTokenGPT40613},
+	// priced like gpt-4-32k-0613, truncated like gpt-4-32k-0314
+	{name: openai.GPT432K, promptPrice: gptPricePerPromptTokenGPT432K0613, completionPrice: gptPricePerCompletionTokenGPT432K0613, truncateLimit: gptTruncateLimitGPT432K0314},
+	{name: openai.GPT432K0314, promptPrice: gptPricePerPromptTokenGPT432K0613, completionPrice: gptPricePerCompletionTokenGPT432K0613, truncateLimit: gptTruncateLimitGPT432K0314},
+	{name: openai.GPT432K0613, promptPrice: gptPricePerPromptTokenGPT432K0613, completionPrice: gptPricePerCompletionTokenGPT432K0613},
+}
+
+// lookupModel returns what the catalog knows about the model.
+func lookupModel(name string) (modelInfo, bool) {
+	for _, m := range models {
+		if m.name == name {
+			return m, true
+		}
+	}
+	return modelInfo{}, false
+}
+
+// KnownModels returns the names of all chat completion models in the catalog.
+func KnownModels() []string {
+	names := make([]string, 0, len(models))
+	for _, m := range models {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+// IsKnownModel reports whether the given model name is present in the catalog.
+func IsKnownModel(model string) bool {
+	_, ok := lookupModel(model)
+	return ok
+}
@@ -0,0 +1,131 @@
+package gpt
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/session"
+)
+
+// The moderation.go file connects the gpt command to the moderation service. Prompts, contexts, thread messages and
+// model answers are checked with the moderation policy of the guild, the moderation service reports flagged content.
+
+// The moderateInteractionInput function checks the content of an option of the gpt command. Blocked content gets an error message,
+// flagged content that is let through gets a warning, both only the user sees. It returns true if the content is blocked.
+// If the Moderation API fails, the content is let through.
+func moderateInteractionInput(ctx *bot.Context, moderator *moderation.Service, source string, content string) (blocked bool) {
+	if moderator == nil {
+		return false
+	}
+
+	result, err := moderator.Moderate(ctx.Context(), ctx.Session, moderation.Item{
+		GuildID:   ctx.Interaction.GuildID,
+		ChannelID: ctx.Interaction.ChannelID,
+		UserID:    ctx.Interaction.Member.User.ID,
+		Source:    source,
+		Content:   content,
+	})
+	if err != nil {
+		ctx.Logger.Warn("OpenAI Moderation API request failed, letting the content through", "source", source, "error", err)
+		return false
+	}
+	if !result.Flagged {
+		return false
+	}
+	ctx.Logger.Info("Content was flagged by Moderation API", "source", source, "categories", result.FlaggedCategories(), "action", result.Action)
+
+	switch result.Action {
+	case moderation.ActionBlock:
+		ctx.PrivateFollowup(moderation.BlockedEmbed("The provided "+sourceName(source)))
+		return true
+	case moderation.ActionWarn:
+		ctx.PrivateFollowup(moderation.WarningEmbed("The provided "+sourceName(source)))
+	}
+	return false
+}
+
+// The moderateMessageInput function checks a message sent in a GPT thread. Blocked messages are marked as not part of the
+// conversation and get an error reply, flagged messages that are let through get a warning. It returns true if the message is blocked.
+func moderateMessageInput(ctx *bot.MessageContext, moderator *moderation.Service) (blocked bool) {
+	if moderator == nil {
+		return false
+	}
+
+	result, err := moderator.Moderate(ctx.Context(), ctx.Session, moderation.Item{
+		GuildID:   ctx.Message.GuildID,
+		ChannelID: ctx.Message.ChannelID,
+		UserID:    ctx.Message.Author.ID,
+		Source:    moderation.SourceThreadMessage,
+		Content:   ctx.Message.Content,
+	})
+	if err != nil {
+		ctx.Logger.Warn("OpenAI Moderation API request failed, letting the message through", "error", err)
+		return false
+	}
+	if !result.Flagged {
+		return false
+	}
+	ctx.Logger.Info("Message was flagged by Moderation API", "categories", result.FlaggedCategories(), "action", result.Action)
+
+	switch result.Action {
+	case moderation.ActionBlock:
+		// the mark keeps the message out of the conversation when it is read back from the thread
+		ctx.AddReaction(gptEmojiExcluded)
+		ctx.EmbedReply(moderation.BlockedEmbed("Your message"))
+		return true
+	case moderation.ActionWarn:
+		ctx.EmbedReply(moderation.WarningEmbed("Your message"))
+	}
+	return false
+}
+
+// The moderateOutput function checks an answer of the model before it is posted. The caller decides how to tell the users about
+// flagged answers, as the answer is posted differently for interactions and thread messages.
+// It returns nil if the answer was not flagged or the Moderation API failed.
+func moderateOutput(c context.Context, s session.MessageSender, logger *slog.Logger, moderator *moderation.Service, guildID string, channelID string, userID string, content string) *moderation.Result {
+	if moderator == nil {
+		return nil
+	}
+
+	result, err := moderator.Moderate(c, s, moderation.Item{
+		GuildID:   guildID,
+		ChannelID: channelID,
+		UserID:    userID,
+		Source:    moderation.SourceOutput,
+		Content:   content,
+	})
+	if err != nil {
+		logger.Warn("OpenAI Moderation API request failed, letting the model output through", "error", err)
+		return nil
+	}
+	if !result.Flagged {
+		return nil
+	}
+	logger.Info("Model output was flagged by Moderation API", "categories", result.FlaggedCategories(), "action", result.Action)
+	return result
+}
+
+// The dropBlockedAnswer function removes the blocked answer of the model from the conversation,
+// so it is not sent to the model again with the next message.
+func dropBlockedAnswer(cacheItem *MessagesCacheData) {
+	if n := len(cacheItem.Messages); n > 0 {
+		cacheItem.Messages = cacheItem.Messages[:n-1]
+	}
+}
+
+// The sourceName function returns the source in lower case, to be used in the middle of a sentence.
+func sourceName(source string) string {
+	switch source {
+	case moderation.SourcePrompt:
+		return "prompt"
+	case moderation.SourceContext:
+		return "context"
+	case moderation.SourceContextFile:
+		return "context file"
+	case moderation.SourceImport:
+		return "conversation"
+	}
+	return source
+}
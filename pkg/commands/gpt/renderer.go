@@ -0,0 +1,180 @@
+package gpt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/constants"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/markdown"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/preferences"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Limits Discord puts on embeds
+const (
+	discordMaxEmbedDescriptionLength = 4096
+	// discordMaxEmbedsLength is the most characters all the embeds of a message may have together
+	discordMaxEmbedsLength = 6000
+	discordMaxEmbeds       = 10
+)
+
+// usageFooterSeparator separates the parts of the footer of an answer
+const usageFooterSeparator = " • "
+
+// answer is an answer of the model with everything that is shown along with it.
+type answer struct {
+	// content is the text of the answer, with the attached code blocks replaced by references
+	content string
+	files   []render.File
+	model   string
+	usage   openai.Usage
+	latency time.Duration
+}
+
+// The renderer interface turns an answer into the messages it is posted as. Renderers differ in how they show the text,
+// but the footer with the model, the tokens, the cost and the latency is always at the end of the last message.
+type renderer interface {
+	render(a *answer) []*discord.MessageSend
+}
+
+// renderers holds the renderer of every mode, a new mode only needs a renderer added here.
+var renderers = map[render.Mode]renderer{
+	render.ModePlain:  plainRenderer{},
+	render.ModeEmbed:  embedRenderer{},
+	render.ModeHybrid: hybridRenderer{},
+}
+
+// The renderAnswer function renders the answer in the mode, the attached files go with the last message.
+func renderAnswer(mode render.Mode, a *answer) []*discord.MessageSend {
+	r, ok := renderers[mode]
+	if !ok {
+		r = renderers[render.ModeHybrid]
+	}
+	messages := r.render(a)
+	messages[len(messages)-1].Files = render.DiscordFiles(a.files)
+	return messages
+}
+
+// The renderMode function returns the mode the answers for the user are posted in: the one the user chose with
+// /chat settings, else the one of the guild.
+func renderMode(answers render.Config, prefs *preferences.Store, guildID string, userID string) render.Mode {
+	if prefs != nil {
+		if mode := prefs.Get(userID).RenderMode; mode != "" {
+			return mode
+		}
+	}
+	return answers.PolicyFor(guildID).Mode
+}
+
+// The usageFooter function returns the footer of an answer: the model, the tokens, the cost and how long the model took.
+func usageFooter(a *answer) string {
+	parts := []string{
+		a.model,
+		fmt.Sprintf("Completion Tokens: %d, Total: %d", a.usage.CompletionTokens, a.usage.TotalTokens),
+	}
+	if cost := generateCost(a.usage, a.model); cost != "" {
+		parts = append(parts, cost)
+	}
+	parts = append(parts, fmt.Sprintf("%.1fs", a.latency.Seconds()))
+	return strings.Join(parts, usageFooterSeparator)
+}
+
+// The answerContent function returns the text of a message the renderers posted, without the footer, so the conversation can be
+// read back from the thread. Embeds with a title are notices like moderation warnings and not part of the answer.
+func answerContent(m *discord.Message) string {
+	content := m.Content
+	if i := strings.LastIndex(content, "-# "); i >= 0 && (i == 0 || content[i-1] == '\n') && strings.Contains(content[i:], usageFooterSeparator+"Completion Tokens: ") {
+		content = strings.TrimRight(content[:i], "\n")
+	}
+	for _, embed := range m.Embeds {
+		if embed.Title == "" {
+			content += embed.Description
+		}
+	}
+	return content
+}
+
+// The modelColor function returns the color of the embeds of the model's answers.
+func modelColor(model string) int {
+	switch {
+	case strings.HasPrefix(model, "gpt-4"):
+		return 0xab68ff
+	case strings.HasPrefix(model, "gpt-3.5"):
+		return 0x10a37f
+	}
+	return 0x00bfff
+}
+
+// plainRenderer posts the answer as text and the footer as a small line of text below it, without any embeds.
+type plainRenderer struct{}
+
+func (plainRenderer) render(a *answer) []*discord.MessageSend {
+	var messages []*discord.MessageSend
+	for _, content := range splitMessage(a.content) {
+		messages = append(messages, &discord.MessageSend{Content: content})
+	}
+	footer := "-# " + usageFooter(a)
+	last := messages[len(messages)-1]
+	if markdown.Length(last.Content)+1+markdown.Length(footer) <= discordMaxMessageLength {
+		last.Content = strings.TrimRight(last.Content, "\n") + "\n" + footer
+	} else {
+		messages = append(messages, &discord.MessageSend{Content: footer})
+	}
+	return messages
+}
+
+// embedRenderer posts the answer in embeds colored by the model, the footer is the footer of the last embed.
+// The embeds are spread over as many messages as needed to stay within the limits of a message.
+type embedRenderer struct{}
+
+func (embedRenderer) render(a *answer) []*discord.MessageSend {
+	color := modelColor(a.model)
+	var embeds []*discord.MessageEmbed
+	for _, description := range markdown.Split(a.content, discordMaxEmbedDescriptionLength) {
+		embeds = append(embeds, &discord.MessageEmbed{Description: description, Color: color})
+	}
+	embeds[len(embeds)-1].Footer = &discord.MessageEmbedFooter{
+		Text:    usageFooter(a),
+		IconURL: constants.OpenAIBlackIconURL,
+	}
+
+	var messages []*discord.MessageSend
+	current := &discord.MessageSend{}
+	length := 0
+	for _, embed := range embeds {
+		embedLength := markdown.Length(embed.Description)
+		if embed.Footer != nil {
+			embedLength += markdown.Length(embed.Footer.Text)
+		}
+		if len(current.Embeds) > 0 && (length+embedLength > discordMaxEmbedsLength || len(current.Embeds) == discordMaxEmbeds) {
+			messages = append(messages, current)
+			current, length = &discord.MessageSend{}, 0
+		}
+		current.Embeds = append(current.Embeds, embed)
+		length += embedLength
+	}
+	return append(messages, current)
+}
+
+// hybridRenderer posts the answer as text and the footer in an embed colored by the model below it.
+type hybridRenderer struct{}
+
+func (hybridRenderer) render(a *answer) []*discord.MessageSend {
+	var messages []*discord.MessageSend
+	for _, content := range splitMessage(a.content) {
+		messages = append(messages, &discord.MessageSend{Content: content})
+	}
+	messages[len(messages)-1].Embeds = []*discord.MessageEmbed{
+		{
+			Color: modelColor(a.model),
+			Footer: &discord.MessageEmbedFooter{
+				Text:    usageFooter(a),
+				IconURL: constants.OpenAIBlackIconURL,
+			},
+		},
+	}
+	return messages
+}
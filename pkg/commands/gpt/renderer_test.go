@@ -0,0 +1,176 @@
+package gpt
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/golden"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/markdown"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/preferences"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+// renderedMessage keeps the golden files short, long texts are only shown by their length.
+type renderedMessage struct {
+	Content       string          `json:"content,omitempty"`
+	ContentLength int             `json:"contentLength,omitempty"`
+	Embeds        []renderedEmbed `json:"embeds,omitempty"`
+	Files         []string        `json:"files,omitempty"`
+}
+
+type renderedEmbed struct {
+	Description       string `json:"description,omitempty"`
+	DescriptionLength int    `json:"descriptionLength,omitempty"`
+	Color             int    `json:"color"`
+	Footer            string `json:"footer,omitempty"`
+}
+
+// shortText returns the text if it is short, else its length.
+func shortText(text string) (string, int) {
+	if markdown.Length(text) > 200 {
+		return "", markdown.Length(text)
+	}
+	return text, 0
+}
+
+func summarizeRendered(messages []*discord.MessageSend) []renderedMessage {
+	var summary []renderedMessage
+	for _, m := range messages {
+		var r renderedMessage
+		r.Content, r.ContentLength = shortText(m.Content)
+		for _, e := range m.Embeds {
+			var embed renderedEmbed
+			embed.Description, embed.DescriptionLength = shortText(e.Description)
+			embed.Color = e.Color
+			if e.Footer != nil {
+				embed.Footer = e.Footer.Text
+			}
+			r.Embeds = append(r.Embeds, embed)
+		}
+		for _, f := range m.Files {
+			r.Files = append(r.Files, f.Name)
+		}
+		summary = append(summary, r)
+	}
+	return summary
+}
+
+func TestRenderAnswer(t *testing.T) {
+	short := &answer{
+		content: "Hello there!\n\n📎 `main.go` (40 lines)",
+		files:   []render.File{{Name: "main.go", Content: "package main\n"}},
+		model:   openai.GPT3Dot5Turbo,
+		usage:   openai.Usage{PromptTokens: 10, CompletionTokens: 20, TotalTokens: 30},
+		latency: 1250 * time.Millisecond,
+	}
+	// paragraphs of 1000 characters, so the answer is split at them
+	paragraph := strings.Repeat("word ", 199) + "end.\n\n"
+	long := &answer{
+		content: strings.Repeat(paragraph, 11),
+		model:   openai.GPT4,
+		usage:   openai.Usage{PromptTokens: 100, CompletionTokens: 2000, TotalTokens: 2100},
+		latency: 42 * time.Second,
+	}
+	// the footer does not fit into the last message anymore
+	full := &answer{
+		content: strings.Repeat("a", discordMaxMessageLength-10),
+		model:   "local-model",
+		latency: time.Second,
+	}
+
+	tests := []struct {
+		name   string
+		mode   render.Mode
+		answer *answer
+	}{
+		{name: "plain", mode: render.ModePlain, answer: short},
+		{name: "embed", mode: render.ModeEmbed, answer: short},
+		{name: "hybrid", mode: render.ModeHybrid, answer: short},
+		{name: "unknown_mode", mode: "fancy", answer: short},
+		{name: "plain_long", mode: render.ModePlain, answer: long},
+		{name: "embed_long", mode: render.ModeEmbed, answer: long},
+		{name: "hybrid_long", mode: render.ModeHybrid, answer: long},
+		{name: "plain_full", mode: render.ModePlain, answer: full},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := renderAnswer(test.mode, test.answer)
+			for i, m := range messages {
+				if length := markdown.Length(m.Content); length > discordMaxMessageLength {
+					t.Errorf("message %d is %d characters long", i+1, length)
+				}
+				embedsLength := 0
+				for _, e := range m.Embeds {
+					if length := markdown.Length(e.Description); length > discordMaxEmbedDescriptionLength {
+						t.Errorf("embed description of message %d is %d characters long", i+1, length)
+					}
+					embedsLength += markdown.Length(e.Description)
+					if e.Footer != nil {
+						embedsLength += markdown.Length(e.Footer.Text)
+					}
+				}
+				if embedsLength > discordMaxEmbedsLength {
+					t.Errorf("embeds of message %d are %d characters long", i+1, embedsLength)
+				}
+			}
+			golden.AssertJSON(t, "render_answer_"+test.name, summarizeRendered(messages))
+		})
+	}
+}
+
+func TestRenderMode(t *testing.T) {
+	answers := render.Config{Guilds: map[string]render.Policy{"1": {Mode: render.ModePlain}}}
+
+	if mode := renderMode(answers, nil, "1", "10"); mode != render.ModePlain {
+		t.Errorf("mode without preferences = %q, want the mode of the guild", mode)
+	}
+	if mode := renderMode(answers, nil, "2", "10"); mode != render.ModeHybrid {
+		t.Errorf("mode without preferences = %q, want the default mode", mode)
+	}
+
+	prefs, err := preferences.Open(filepath.Join(t.TempDir(), "preferences.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prefs.Set("10", preferences.Preferences{RenderMode: render.ModeEmbed}); err != nil {
+		t.Fatal(err)
+	}
+	if mode := renderMode(answers, prefs, "1", "10"); mode != render.ModeEmbed {
+		t.Errorf("mode with preferences = %q, want the mode the user chose", mode)
+	}
+	if mode := renderMode(answers, prefs, "1", "11"); mode != render.ModePlain {
+		t.Errorf("mode of another user = %q, want the mode of the guild", mode)
+	}
+}
+
+func TestAnswerContent(t *testing.T) {
+	a := &answer{content: "Hello there!\n", model: openai.GPT4, latency: time.Second}
+	tests := []struct {
+		name string
+		mode render.Mode
+	}{
+		{name: "plain", mode: render.ModePlain},
+		{name: "embed", mode: render.ModeEmbed},
+		{name: "hybrid", mode: render.ModeHybrid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := renderAnswer(test.mode, a)[0]
+			got := answerContent(&discord.Message{Content: m.Content, Embeds: m.Embeds})
+			if strings.TrimSpace(got) != "Hello there!" {
+				t.Errorf("answerContent() = %q, want the answer without the footer", got)
+			}
+		})
+	}
+
+	warning := &discord.Message{Embeds: []*discord.MessageEmbed{{Title: "⚠️ Warning", Description: "The answer was flagged"}}}
+	if got := answerContent(warning); got != "" {
+		t.Errorf("answerContent() of a warning = %q, want nothing", got)
+	}
+}
@@ -0,0 +1,158 @@
+package gpt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+// This file has what imported and forked conversations share. Both start a new GPT thread seeded with the messages of
+// a conversation, the messages are attached to the first message of the thread as a JSON file in the export format,
+// so the conversation can be read back from the thread like the conversations started with /chat gpt.
+
+const (
+	seedFileName = "conversation.json"
+	// seedMaxSize is the largest conversation file that is read, way more than the context of any model
+	seedMaxSize = 1 << 20
+	// discordMaxThreadNameLength is the longest name a thread can have
+	discordMaxThreadNameLength = 100
+)
+
+// seedFile is the JSON a conversation is seeded from: an object with the messages, like an export or the body of a chat
+// completion request, or just the array of messages. The messages are in the OpenAI chat message format.
+type seedFile struct {
+	Thread      *exportThread `json:"thread"`
+	Temperature *float32      `json:"temperature"`
+	Messages    []Message     `json:"messages"`
+}
+
+// The parseSeed function reads a conversation from JSON. A system message may only come first, it becomes the system
+// message of the conversation. The name of the exported thread is returned too, if the file has one.
+func parseSeed(data []byte) (cacheItem *MessagesCacheData, threadName string, err error) {
+	var seed seedFile
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &seed.Messages)
+	} else {
+		err = json.Unmarshal(data, &seed)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("the file is not a JSON conversation: %w", err)
+	}
+
+	cacheItem = &MessagesCacheData{Temperature: seed.Temperature}
+	for i, m := range seed.Messages {
+		switch {
+		case m.Role == openai.ChatMessageRoleSystem && i == 0:
+			cacheItem.SystemMessage = &openai.ChatCompletionMessage{Role: m.Role, Content: m.Content}
+			continue
+		case m.Role == openai.ChatMessageRoleSystem:
+			return nil, "", fmt.Errorf("message %d is a system message, only the first message can be one", i+1)
+		case m.Role != openai.ChatMessageRoleUser && m.Role != openai.ChatMessageRoleAssistant:
+			return nil, "", fmt.Errorf("message %d has the role %q, only system, user and assistant messages can be imported", i+1, m.Role)
+		case m.Content == "":
+			return nil, "", fmt.Errorf("message %d has no content", i+1)
+		}
+		cacheItem.Messages = append(cacheItem.Messages, m)
+	}
+	if len(cacheItem.Messages) == 0 {
+		return nil, "", errors.New("the file has no user or assistant messages")
+	}
+	if seed.Thread != nil {
+		threadName = seed.Thread.Name
+	}
+	return cacheItem, threadName, nil
+}
+
+// The seedURL function returns the URL of the conversation a thread was seeded with, which is attached to the message the
+// thread was started from. It is empty for threads that were not seeded.
+func seedURL(starter *discord.Message) string {
+	for _, attachment := range starter.Attachments {
+		if attachment.Filename == seedFileName {
+			return attachment.URL
+		}
+	}
+	return ""
+}
+
+// The startSeededThread function posts the message a seeded thread is started from in the channel, an embed like the one
+// of /chat gpt that says where the conversation came from, with the conversation attached. It then starts the thread,
+// adds the user to it and caches the conversation, so the next message in the thread is answered right away.
+func startSeededThread(ctx *bot.Context, messagesCache *MessagesCache, channelID string, title string, name string, cacheItem *MessagesCacheData) (*discord.Channel, error) {
+	export := &conversationExport{
+		Thread:      exportThread{Name: name},
+		ExportedAt:  time.Now().UTC(),
+		Model:       cacheItem.Model,
+		Temperature: cacheItem.Temperature,
+	}
+	if cacheItem.SystemMessage != nil {
+		export.Messages = append(export.Messages, Message{ChatCompletionMessage: *cacheItem.SystemMessage})
+	}
+	export.Messages = append(export.Messages, cacheItem.Messages...)
+	data, err := exportJSON(export)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []*discord.MessageEmbedField{
+		{
+			Name:  gptCommandOptionModel.humanReadableString(),
+			Value: cacheItem.Model,
+		},
+	}
+	if cacheItem.Temperature != nil {
+		fields = append(fields, &discord.MessageEmbedField{
+			Name:  gptCommandOptionTemperature.humanReadableString(),
+			Value: strconv.FormatFloat(float64(*cacheItem.Temperature), 'g', -1, 32),
+		})
+	}
+	starter, err := ctx.ChannelMessageSendComplex(channelID, &discord.MessageSend{
+		Embeds: []*discord.MessageEmbed{
+			{
+				Title: title,
+				// the description is what tells a GPT thread apart from other threads, it must not be empty
+				Description: fmt.Sprintf("%d messages, continue the conversation in the thread", len(cacheItem.Messages)),
+				Color:       gptInteractionEmbedColor,
+				Author: &discord.MessageEmbedAuthor{
+					Name:    "OpenAI chat by " + ctx.Interaction.Member.User.Username,
+					IconURL: ctx.Interaction.Member.User.AvatarURL("32"),
+				},
+				Fields: fields,
+			},
+		},
+		Files: []*discord.File{
+			{
+				Name:        seedFileName,
+				ContentType: "application/json",
+				Reader:      bytes.NewReader(data),
+			},
+		},
+	}, discord.WithContext(ctx.Context()))
+	if err != nil {
+		return nil, err
+	}
+
+	if runes := []rune(name); len(runes) > discordMaxThreadNameLength {
+		name = string(runes[:discordMaxThreadNameLength-1]) + "…"
+	}
+	thread, err := ctx.Session.MessageThreadStartComplex(channelID, starter.ID, &discord.ThreadStart{
+		Name:                name,
+		AutoArchiveDuration: gptDiscordThreadAutoArchivewDurationMinutes,
+		Invitable:           false,
+	}, discord.WithContext(ctx.Context()))
+	if err != nil {
+		return nil, err
+	}
+
+	messagesCache.Add(thread.ID, cacheItem)
+	if err := ctx.ThreadMemberAdd(thread.ID, ctx.Interaction.Member.User.ID, discord.WithContext(ctx.Context())); err != nil {
+		ctx.Logger.Warn("Failed to add the user to the thread", "thread_id", thread.ID, "error", err)
+	}
+	return thread, nil
+}
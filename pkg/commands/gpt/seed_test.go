@@ -0,0 +1,137 @@
+package gpt
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/golden"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/sessiontest"
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestParseSeed(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name: "array",
+			data: `[{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Hi"}, {"role": "assistant", "content": "Hello!"}]`,
+		},
+		{
+			name: "request",
+			data: `{"model": "gpt-4", "temperature": 0.2, "messages": [{"role": "user", "content": "Hi", "name": "alice"}]}`,
+		},
+		{
+			name: "export",
+			data: `{"thread": {"id": "1", "name": "Greetings"}, "model": "gpt-4", "messages": [
+				{"role": "user", "content": "Hi", "time": "2023-06-01T12:00:00Z"},
+				{"role": "assistant", "content": "Hello!", "time": "2023-06-01T12:00:03Z", "usage": {"prompt_tokens": 8, "completion_tokens": 2, "total_tokens": 10}}
+			]}`,
+		},
+		{name: "not_json", data: `Hi`, wantErr: "the file is not a JSON conversation"},
+		{name: "empty", data: `{"messages": []}`, wantErr: "the file has no user or assistant messages"},
+		{name: "only_system", data: `[{"role": "system", "content": "Be brief."}]`, wantErr: "the file has no user or assistant messages"},
+		{name: "late_system", data: `[{"role": "user", "content": "Hi"}, {"role": "system", "content": "Be brief."}]`, wantErr: "message 2 is a system message, only the first message can be one"},
+		{name: "function", data: `[{"role": "function", "content": "{}", "name": "f"}]`, wantErr: `message 1 has the role "function", only system, user and assistant messages can be imported`},
+		{name: "no_content", data: `[{"role": "user", "content": ""}]`, wantErr: "message 1 has no content"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cacheItem, threadName, err := parseSeed([]byte(test.data))
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("parseSeed() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden.AssertJSON(t, "parse_seed_"+test.name, map[string]interface{}{
+				"threadName": threadName,
+				"cacheItem":  cacheItem,
+			})
+		})
+	}
+}
+
+func TestLoadSeededConversation(t *testing.T) {
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Hi"}, {"role": "assistant", "content": "Hello!"}]}`)
+	}))
+	t.Cleanup(seed.Close)
+
+	s := sessiontest.New()
+	user := &discord.User{ID: "1", Username: "alice"}
+	starter := s.AddMessage(&discord.Message{
+		ChannelID: "10",
+		Author:    s.User,
+		Embeds: []*discord.MessageEmbed{{
+			Title:       "📥 Imported conversation",
+			Description: "2 messages, continue the conversation in the thread",
+			Fields:      []*discord.MessageEmbedField{{Name: gptCommandOptionModel.humanReadableString(), Value: openai.GPT4}},
+		}},
+		Attachments: []*discord.MessageAttachment{{Filename: seedFileName, URL: seed.URL}},
+	})
+	addThread(s, "10", starter.ID, false)
+	s.AddMessage(&discord.Message{ChannelID: starter.ID, Author: s.User, Type: discord.MessageTypeThreadStarterMessage, ReferencedMessage: starter})
+	question := s.AddMessage(&discord.Message{ChannelID: starter.ID, Author: user, Content: "How are you?", Type: discord.MessageTypeDefault})
+	s.AddMessage(&discord.Message{ChannelID: starter.ID, Author: s.User, Content: "Fine.", Type: discord.MessageTypeReply})
+
+	cacheItem, err := loadConversation(context.Background(), s, slog.Default(), starter.ID, openai.GPT3Dot5Turbo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cacheItem == nil {
+		t.Fatal("loadConversation() = nil, want the seeded conversation")
+	}
+	if cacheItem.Model != openai.GPT4 || cacheItem.SystemMessage == nil || cacheItem.SystemMessage.Content != "Be brief." {
+		t.Errorf("conversation has model %q and system message %+v, want the ones of the seed", cacheItem.Model, cacheItem.SystemMessage)
+	}
+	var got []string
+	for _, m := range cacheItem.Messages {
+		got = append(got, m.Role+": "+m.Content)
+	}
+	want := []string{"user: Hi", "assistant: Hello!", "user: How are you?", "assistant: Fine."}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("messages = %q, want %q", got, want)
+	}
+	if cacheItem.Messages[2].DiscordID != question.ID || cacheItem.Messages[0].DiscordID != "" {
+		t.Errorf("Discord IDs = %q and %q, want the question's and none for the seed", cacheItem.Messages[2].DiscordID, cacheItem.Messages[0].DiscordID)
+	}
+}
+
+func TestMessagesUpTo(t *testing.T) {
+	messages := []Message{
+		chatMessage(openai.ChatMessageRoleUser, "seeded"),
+		{ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "question"}, DiscordID: "100"},
+		{ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "answer"}, DiscordID: "110"},
+		{ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "next question"}, DiscordID: "120"},
+	}
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{target: "100", want: 2},
+		// the second part of the answer
+		{target: "115", want: 3},
+		{target: "120", want: 4},
+		{target: "99", want: 0},
+		{target: "not a snowflake", want: 0},
+	}
+	for _, test := range tests {
+		if got := messagesUpTo(messages, test.target); len(got) != test.want {
+			t.Errorf("messagesUpTo(%s) = %d messages, want %d", test.target, len(got), test.want)
+		}
+	}
+}
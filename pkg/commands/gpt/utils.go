@@ -4,16 +4,20 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
-	"github.com/akhilsharma90/go-openai-bot-discord/pkg/constants"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/metrics"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/tracing"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/utils"
 	discord "github.com/bwmarrin/discordgo"
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
 )
 // The file imports several packages, including http, io, log, and discordgo.
 
@@ -48,14 +52,22 @@ func shouldHandleMessageType(t discord.MessageType) bool {
 type chatGPTResponse struct {
 	content string
 	usage   openai.Usage
+	// latency is how long the model took to answer
+	latency time.Duration
 }
 
 // The sendChatGPTRequest function sends a request to the OpenAI API to generate a response to a given prompt using the GPT model. 
 // The function takes a client object, which is used to make the API request, and a cacheItem object, which contains the messages that make up the conversation. 
 // The function returns a chatGPTResponse object, which contains the generated response and usage information.
-func sendChatGPTRequest(client *openai.Client, cacheItem *MessagesCacheData) (*chatGPTResponse, error) {
+func sendChatGPTRequest(ctx context.Context, client *openai.Client, cacheItem *MessagesCacheData) (resp *chatGPTResponse, err error) {
+	ctx, span := tracing.Start(ctx, "openai.chatCompletion",
+		attribute.String("openai.model", cacheItem.Model),
+		attribute.Int("openai.messages", len(cacheItem.Messages)),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	// Create message with ChatGPT
-	messages := cacheItem.Messages
+	messages := chatCompletionMessages(cacheItem.Messages)
 	if cacheItem.SystemMessage != nil {
 		messages = append([]openai.ChatCompletionMessage{*cacheItem.SystemMessage}, messages...)
 	}
@@ -69,27 +81,62 @@ func sendChatGPTRequest(client *openai.Client, cacheItem *MessagesCacheData) (*c
 		req.Temperature = *cacheItem.Temperature
 	}
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
+	start := time.Now()
+	completion, err := client.CreateChatCompletion(
+		ctx,
 		req,
 	)
+	metrics.ObserveOpenAIRequest(metrics.EndpointChatCompletion, cacheItem.Model, start, err)
 	if err != nil {
 		return nil, err
 	}
+	metrics.AddOpenAITokens(cacheItem.Model, completion.Usage)
+	span.SetAttributes(
+		attribute.Int("openai.prompt_tokens", completion.Usage.PromptTokens),
+		attribute.Int("openai.completion_tokens", completion.Usage.CompletionTokens),
+	)
 
 	// Save response to context cache
-	responseContent := resp.Choices[0].Message.Content
-	cacheItem.Messages = append(cacheItem.Messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleAssistant,
-		Content: responseContent,
+	responseContent := completion.Choices[0].Message.Content
+	usage := completion.Usage
+	cacheItem.Messages = append(cacheItem.Messages, Message{
+		ChatCompletionMessage: openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleAssistant,
+			Content: responseContent,
+		},
+		Time:  time.Now(),
+		Usage: &usage,
 	})
-	cacheItem.TokenCount = resp.Usage.TotalTokens
+	cacheItem.TokenCount = completion.Usage.TotalTokens
 	return &chatGPTResponse{
 		content: responseContent,
-		usage:   resp.Usage,
+		usage:   completion.Usage,
+		latency: time.Since(start),
 	}, nil
 }
 
+// The queueChatGPTRequest function runs sendChatGPTRequest through the request queue, so only a limited number of
+// requests talk to OpenAI at the same time. The threadID is used as the job key, so the request is cancelled
+// when the thread is deleted. If the request has to wait, queued is called with its position in the queue.
+func queueChatGPTRequest(ctx context.Context, requests *queue.Pool, priority queue.Priority, threadID string, client *openai.Client, cacheItem *MessagesCacheData, queued func(position int)) (resp *chatGPTResponse, err error) {
+	queueErr := requests.Do(ctx, &queue.Job{
+		Priority: priority,
+		Model:    cacheItem.Model,
+		Key:      threadID,
+		Run: func(ctx context.Context) {
+			resp, err = sendChatGPTRequest(ctx, client, cacheItem)
+		},
+		Queued: queued,
+	})
+	if queueErr != nil {
+		return nil, queueErr
+	}
+	return resp, err
+}
+
+// attachmentClient downloads the context files and URLs, with the same timeout discordgo uses for its requests
+var attachmentClient = &http.Client{Timeout: 20 * time.Second}
+
 // The getUrlData function sends an HTTP GET request to a given URL and returns the response body as a string.
 func getUrlData(client *http.Client, url string) (string, error) {
 	res, err := client.Get(url)
@@ -140,7 +187,7 @@ func parseInteractionReply(discordMessage *discord.Message) (prompt string, cont
 			case gptCommandOptionTemperature.humanReadableString():
 				parsedValue, err := strconv.ParseFloat(field.Value, 32)
 				if err != nil {
-					log.Printf("[GID: %s, CHID: %s, MID: %s] Failed to parse temperature value from the message with the error: %v\n", discordMessage.GuildID, discordMessage.ChannelID, discordMessage.ID, err)
+					slog.Warn("Failed to parse temperature value from the message", "guild_id", discordMessage.GuildID, "channel_id", discordMessage.ChannelID, "message_id", discordMessage.ID, "error", err)
 					continue
 				}
 				temp := float32(parsedValue)
@@ -154,36 +201,30 @@ func parseInteractionReply(discordMessage *discord.Message) (prompt string, cont
 
 // The modelTruncateLimit function takes a model name and returns the maximum number of tokens that can be used in a message for that model.
 func modelTruncateLimit(model string) *int {
-	var truncateLimit int
-	switch model {
-	case openai.GPT3Dot5Turbo, openai.GPT3Dot5Turbo0301:
-		// gpt-3.5-turbo may change over time. Assigning truncate limit assuming gpt-3.5-turbo-0301
-		truncateLimit = gptTruncateLimitGPT3Dot5Turbo0301
-	case openai.GPT4, openai.GPT40314:
-		// gpt-4 may change over time. Assigning truncate limit assuming gpt-4-0314
-		truncateLimit = gptTruncateLimitGPT40314
-	case openai.GPT432K, openai.GPT432K0314:
-		// gpt-4-32k may change over time. Assigning truncate limit assuming gpt-4-32k-0314
-		truncateLimit = gptTruncateLimitGPT432K0314
-	default:
+	m, ok := lookupModel(model)
+	if !ok || m.truncateLimit == 0 {
 		// Not implemented
 		return nil
 	}
-	return &truncateLimit
+	return &m.truncateLimit
 }
 
 
 // The adjustMessageTokens function removes messages from a conversation until the total number of tokens in the conversation is below the maximum allowed for the model.
-func adjustMessageTokens(cacheItem *MessagesCacheData) {
+func adjustMessageTokens(c context.Context, cacheItem *MessagesCacheData) {
 	truncateLimit := modelTruncateLimit(cacheItem.Model)
 	if truncateLimit == nil {
 		return
 	}
 
+	_, span := tracing.Start(c, "gpt.adjustMessageTokens", attribute.String("openai.model", cacheItem.Model))
+	defer span.End()
+
 	for cacheItem.TokenCount > *truncateLimit {
 		message := cacheItem.Messages[0]
 		cacheItem.Messages = cacheItem.Messages[1:]
-		removedTokens := countMessageTokens(message, cacheItem.Model)
+		cacheItem.TruncatedMessages++
+		removedTokens := countMessageTokens(message.ChatCompletionMessage, cacheItem.Model)
 		if removedTokens == nil {
 			return
 		}
@@ -193,16 +234,20 @@ func adjustMessageTokens(cacheItem *MessagesCacheData) {
 
 
 // The isCacheItemWithinTruncateLimit function checks whether a given conversation is within the maximum token limit for the model.
-func isCacheItemWithinTruncateLimit(cacheItem *MessagesCacheData) (ok bool, count int) {
+func isCacheItemWithinTruncateLimit(c context.Context, cacheItem *MessagesCacheData) (ok bool, count int) {
 	truncateLimit := modelTruncateLimit(cacheItem.Model)
 	if truncateLimit == nil {
 		return true, 0
 	}
 
-	tokens := countAllMessagesTokens(cacheItem.SystemMessage, cacheItem.Messages, cacheItem.Model)
+	_, span := tracing.Start(c, "gpt.countTokens", attribute.String("openai.model", cacheItem.Model))
+	tokens := countAllMessagesTokens(cacheItem.SystemMessage, chatCompletionMessages(cacheItem.Messages), cacheItem.Model)
 	if tokens == nil {
+		span.End()
 		return true, 0
 	}
+	span.SetAttributes(attribute.Int("openai.tokens", *tokens))
+	span.End()
 	cacheItem.TokenCount = *tokens
 
 	return *tokens <= *truncateLimit, *tokens
@@ -210,7 +255,7 @@ func isCacheItemWithinTruncateLimit(cacheItem *MessagesCacheData) (ok bool, coun
 
 
 // The generateThreadTitleBasedOnInitialPrompt function generates a thread title based on the initial prompt of a conversation.
-func generateThreadTitleBasedOnInitialPrompt(ctx *bot.Context, client *openai.Client, threadID string, messages []openai.ChatCompletionMessage) {
+func generateThreadTitleBasedOnInitialPrompt(c context.Context, ctx *bot.Context, client *openai.Client, threadID string, messages []openai.ChatCompletionMessage) {
 	conversation := make([]map[string]string, len(messages))
 	for i, msg := range messages {
 		conversation[i] = map[string]string{
@@ -229,61 +274,41 @@ func generateThreadTitleBasedOnInitialPrompt(ctx *bot.Context, client *openai.Cl
 	// Create a prompt that asks the model to generate a title
 	prompt := fmt.Sprintf("%s\nGenerate a short and concise title summarizing the conversation in the same language. The title must not contain any quotes. The title should be no longer than 60 characters:", conversationText)
 
-	resp, err := client.CreateCompletion(context.Background(), openai.CompletionRequest{
+	c, span := tracing.Start(c, "gpt.generateThreadTitle", attribute.String("openai.model", openai.GPT3TextDavinci003))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	resp, err := client.CreateCompletion(c, openai.CompletionRequest{
 		Model:       openai.GPT3TextDavinci003,
 		Prompt:      prompt,
 		Temperature: 0.5,
 		MaxTokens:   75,
 	})
+	metrics.ObserveOpenAIRequest(metrics.EndpointCompletion, openai.GPT3TextDavinci003, start, err)
 	if err != nil {
-		log.Printf("[GID: %s, threadID: %s] Failed to generate thread title with the error: %v\n", ctx.Interaction.GuildID, threadID, err)
+		ctx.Logger.Error("Failed to generate thread title", "thread_id", threadID, "error", err)
 		return
 	}
 
 	_, err = ctx.Session.ChannelEditComplex(threadID, &discord.ChannelEdit{
 		Name: resp.Choices[0].Text,
-	})
+	}, discord.WithContext(c))
 	if err != nil {
-		log.Printf("[GID: %s, i.ID: %s] Failed to update thread title with the error: %v\n", ctx.Interaction.GuildID, threadID, err)
+		ctx.Logger.Error("Failed to update thread title", "thread_id", threadID, "error", err)
 	}
 }
 
 
-// The attachUsageInfo function adds usage information to a Discord message.
-func attachUsageInfo(s *discord.Session, m *discord.Message, usage openai.Usage, model string) {
-	extraInfo := fmt.Sprintf("Completion Tokens: %d, Total: %d%s", usage.CompletionTokens, usage.TotalTokens, generateCost(usage, model))
-
-	utils.DiscordChannelMessageEdit(s, m.ID, m.ChannelID, nil, []*discord.MessageEmbed{
-		{
-			Footer: &discord.MessageEmbedFooter{
-				Text:    extraInfo,
-				IconURL: constants.OpenAIBlackIconURL,
-			},
-		},
-	})
-}
-
 // The generateCost function calculates the cost of using the GPT model based on the number of prompt and completion tokens used. 
 // The cost is returned as a string.
 func generateCost(usage openai.Usage, model string) string {
-	var cost float64
-
-	switch model {
-	case openai.GPT3Dot5Turbo, openai.GPT3Dot5Turbo0301, openai.GPT3Dot5Turbo0613:
-		// gpt-3.5-turbo may change over time. Calculating usage assuming gpt-3.5-turbo-0301
-		cost = float64(usage.PromptTokens)*gptPricePerPromptTokenGPT3Dot5Turbo0613 + float64(usage.CompletionTokens)*gptPricePerCompletionTokenGPT3Dot5Turbo0613
-	case openai.GPT3Dot5Turbo16K, openai.GPT3Dot5Turbo16K0613:
-		cost = float64(usage.PromptTokens)*gptPricePerPromptTokenGPT3Dot5Turbo16K0613 + float64(usage.CompletionTokens)*gptPricePerCompletionTokenGPT3Dot5Turbo16K0613
-	case openai.GPT4, openai.GPT40314, openai.GPT40613:
-		// gpt-4 may change over time. Calculating usage assuming gpt-4-0613
-		cost = float64(usage.PromptTokens)*gptPricePerPromptTokenGPT40613 + float64(usage.CompletionTokens)*gptPricePerCompletionTokenGPT40613
-	case openai.GPT432K, openai.GPT432K0314, openai.GPT432K0613:
-		// gpt-4-32k may change over time. Calculating usage assuming gpt-4-32k-0613
-		cost = float64(usage.PromptTokens)*gptPricePerPromptTokenGPT432K0613 + float64(usage.CompletionTokens)*gptPricePerCompletionTokenGPT432K0613
-	default:
+	m, ok := lookupModel(model)
+	if !ok {
 		// Not implemented
 		return ""
 	}
+	cost := float64(usage.PromptTokens)*m.promptPrice + float64(usage.CompletionTokens)*m.completionPrice
 
-	return fmt.Sprintf("\nLLM Cost: $%f", cost)
+	return fmt.Sprintf("LLM Cost: $%f", cost)
 }
@@ -0,0 +1,259 @@
+package gpt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/golden"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/openaitest"
+	"github.com/sashabaranov/go-openai"
+)
+
+// requestBody decodes the last chat completion request body, so the golden file shows exactly what was sent to the API.
+func requestBody(t *testing.T, server *openaitest.Server) map[string]interface{} {
+	t.Helper()
+	requests := server.Requests(openaitest.EndpointChatCompletions)
+	if len(requests) == 0 {
+		t.Fatal("no chat completion request was made")
+	}
+	var body map[string]interface{}
+	if err := requests[len(requests)-1].Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestSendChatGPTRequest(t *testing.T) {
+	temperature := float32(0.2)
+	tests := []struct {
+		name      string
+		cacheItem *MessagesCacheData
+	}{
+		{
+			name: "prompt_only",
+			cacheItem: &MessagesCacheData{
+				Model:    openai.GPT3Dot5Turbo,
+				Messages: []Message{chatMessage(openai.ChatMessageRoleUser, "Hello there")},
+			},
+		},
+		{
+			name: "system_message",
+			cacheItem: &MessagesCacheData{
+				Model:         openai.GPT4,
+				SystemMessage: &openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: "Answer like a pirate"},
+				Messages:      []Message{chatMessage(openai.ChatMessageRoleUser, "Where is the treasure?")},
+			},
+		},
+		{
+			name: "temperature",
+			cacheItem: &MessagesCacheData{
+				Model:       openai.GPT3Dot5Turbo,
+				Temperature: &temperature,
+				Messages:    []Message{chatMessage(openai.ChatMessageRoleUser, "Name a color")},
+			},
+		},
+		{
+			name: "conversation",
+			cacheItem: &MessagesCacheData{
+				Model:         openai.GPT3Dot5Turbo,
+				SystemMessage: &openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: "Be brief"},
+				Messages: []Message{
+					chatMessage(openai.ChatMessageRoleUser, "What is Go?"),
+					chatMessage(openai.ChatMessageRoleAssistant, "A programming language."),
+					{ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "Who made it?", Name: "alice"}},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := openaitest.NewServer(t)
+
+			resp, err := sendChatGPTRequest(context.Background(), server.Client(), test.cacheItem)
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := test.cacheItem.Messages[len(test.cacheItem.Messages)-1]
+			if last.Role != openai.ChatMessageRoleAssistant || last.Content != resp.content {
+				t.Errorf("answer %q was not appended to the conversation, last message is %+v", resp.content, last)
+			}
+			if test.cacheItem.TokenCount != resp.usage.TotalTokens {
+				t.Errorf("token count is %d, want the total tokens %d", test.cacheItem.TokenCount, resp.usage.TotalTokens)
+			}
+			if last.Time.IsZero() || last.Usage == nil || *last.Usage != resp.usage {
+				t.Errorf("answer has time %v and usage %+v, want the time it was received and the usage %+v", last.Time, last.Usage, resp.usage)
+			}
+			// the time the answer was received differs from run to run
+			test.cacheItem.Messages[len(test.cacheItem.Messages)-1].Time = time.Time{}
+
+			golden.AssertJSON(t, "send_chat_gpt_request_"+test.name, map[string]interface{}{
+				"request":   requestBody(t, server),
+				"cacheItem": test.cacheItem,
+			})
+		})
+	}
+}
+
+func TestSendChatGPTRequestError(t *testing.T) {
+	server := openaitest.NewServer(t)
+	server.Respond(openaitest.EndpointChatCompletions, openaitest.Error(http.StatusTooManyRequests, "rate_limit_exceeded", "Rate limit reached"))
+
+	cacheItem := &MessagesCacheData{
+		Model:      openai.GPT3Dot5Turbo,
+		Messages:   []Message{chatMessage(openai.ChatMessageRoleUser, "Hello")},
+		TokenCount: 8,
+	}
+	_, err := sendChatGPTRequest(context.Background(), server.Client(), cacheItem)
+
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got error %v, want an API error with status 429", err)
+	}
+	if len(cacheItem.Messages) != 1 || cacheItem.TokenCount != 8 {
+		t.Errorf("conversation changed after a failed request: %+v", cacheItem)
+	}
+}
+
+// chatMessage is a message of the conversation without a time or usage.
+func chatMessage(role string, content string) Message {
+	return Message{ChatCompletionMessage: openai.ChatCompletionMessage{Role: role, Content: content}}
+}
+
+// longMessage is a message of roughly the given number of tokens, starting with a label to tell the messages apart.
+func longMessage(role string, label string, words int) Message {
+	return chatMessage(role, label+strings.Repeat(" hello", words))
+}
+
+// summarizeMessages keeps the golden files short, the messages are only identified by their role, label and token count.
+func summarizeMessages(messages []openai.ChatCompletionMessage, model string) []string {
+	summary := make([]string, 0, len(messages))
+	for _, message := range messages {
+		label, _, _ := strings.Cut(message.Content, " ")
+		tokens := countMessageTokens(message, model)
+		summary = append(summary, fmt.Sprintf("%s %s (%d tokens)", message.Role, label, *tokens))
+	}
+	return summary
+}
+
+func TestAdjustMessageTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		messages []Message
+	}{
+		{
+			name:  "within_limit",
+			model: openai.GPT3Dot5Turbo,
+			messages: []Message{
+				longMessage(openai.ChatMessageRoleUser, "first", 100),
+				longMessage(openai.ChatMessageRoleAssistant, "second", 100),
+				longMessage(openai.ChatMessageRoleUser, "third", 100),
+			},
+		},
+		{
+			name:  "over_limit",
+			model: openai.GPT3Dot5Turbo,
+			messages: []Message{
+				longMessage(openai.ChatMessageRoleUser, "first", 1500),
+				longMessage(openai.ChatMessageRoleAssistant, "second", 1500),
+				longMessage(openai.ChatMessageRoleUser, "third", 1000),
+			},
+		},
+		{
+			name:  "over_limit_gpt4",
+			model: openai.GPT4,
+			messages: []Message{
+				longMessage(openai.ChatMessageRoleUser, "first", 3000),
+				longMessage(openai.ChatMessageRoleAssistant, "second", 3000),
+				longMessage(openai.ChatMessageRoleUser, "third", 1000),
+			},
+		},
+		{
+			name:  "unknown_model",
+			model: "fake-model",
+			messages: []Message{
+				longMessage(openai.ChatMessageRoleUser, "first", 5000),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := openaitest.NewServer(t)
+			cacheItem := &MessagesCacheData{
+				Model:         test.model,
+				SystemMessage: &openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: "system"},
+				Messages:      test.messages,
+			}
+
+			// The same steps the message handler takes before sending a conversation
+			ok, count := isCacheItemWithinTruncateLimit(context.Background(), cacheItem)
+			if !ok {
+				adjustMessageTokens(context.Background(), cacheItem)
+			}
+			if _, err := sendChatGPTRequest(context.Background(), server.Client(), cacheItem); err != nil {
+				t.Fatal(err)
+			}
+
+			var sent openai.ChatCompletionRequest
+			requests := server.Requests(openaitest.EndpointChatCompletions)
+			if err := requests[0].Decode(&sent); err != nil {
+				t.Fatal(err)
+			}
+			summaryModel := test.model
+			if modelTruncateLimit(summaryModel) == nil {
+				summaryModel = openai.GPT3Dot5Turbo
+			}
+			golden.AssertJSON(t, "adjust_message_tokens_"+test.name, map[string]interface{}{
+				"withinLimit": ok,
+				"tokens":      count,
+				"truncated":   cacheItem.TruncatedMessages,
+				"sent":        summarizeMessages(sent.Messages, summaryModel),
+			})
+		})
+	}
+}
+
+func TestModelCatalog(t *testing.T) {
+	tests := []struct {
+		model string
+		// wantCost is the cost of 1000 prompt and 1000 completion tokens, empty for models that are not priced
+		wantCost          string
+		wantTruncateLimit int
+	}{
+		{model: openai.GPT3Dot5Turbo, wantCost: "LLM Cost: $0.003500", wantTruncateLimit: gptTruncateLimitGPT3Dot5Turbo0301},
+		{model: openai.GPT3Dot5Turbo0613, wantCost: "LLM Cost: $0.003500"},
+		{model: openai.GPT3Dot5Turbo16K, wantCost: "LLM Cost: $0.007000"},
+		{model: openai.GPT4, wantCost: "LLM Cost: $0.090000", wantTruncateLimit: gptTruncateLimitGPT40314},
+		{model: openai.GPT432K0314, wantCost: "LLM Cost: $0.180000", wantTruncateLimit: gptTruncateLimitGPT432K0314},
+		{model: openai.GPT3TextDavinci003},
+	}
+	for _, test := range tests {
+		if got := generateCost(openai.Usage{PromptTokens: 1000, CompletionTokens: 1000}, test.model); got != test.wantCost {
+			t.Errorf("generateCost(%s) = %q, want %q", test.model, got, test.wantCost)
+		}
+		limit := 0
+		if l := modelTruncateLimit(test.model); l != nil {
+			limit = *l
+		}
+		if limit != test.wantTruncateLimit {
+			t.Errorf("modelTruncateLimit(%s) = %d, want %d", test.model, limit, test.wantTruncateLimit)
+		}
+		if IsKnownModel(test.model) != (test.wantCost != "") {
+			t.Errorf("IsKnownModel(%s) = %t, want %t", test.model, IsKnownModel(test.model), test.wantCost != "")
+		}
+	}
+
+	// every known model is priced, so the footer of an answer always has the cost
+	for _, model := range KnownModels() {
+		if generateCost(openai.Usage{}, model) == "" {
+			t.Errorf("known model %s has no price", model)
+		}
+	}
+}
@@ -1,30 +1,57 @@
 package commands
 
 import (
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/audit"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
 	"github.com/akhilsharma90/go-openai-bot-discord/pkg/commands/dalle"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/queue"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/ratelimit"
 	discord "github.com/bwmarrin/discordgo"
 	"github.com/sashabaranov/go-openai"
 )
 
 const imageCommandName = "image"
 
+// DALLERateLimit is the name of the rate limit that limits how often a user can generate images with /image dalle
+const DALLERateLimit = "dalle"
 
-//The ImageCommand function takes an OpenAI client as an argument and returns a bot.Command struct that represents an image command for the Discord bot. 
+
+// The ImageCommandParams struct defines parameters for the ImageCommand function.
+// These parameters include an OpenAI client, the queue all OpenAI requests go through,
+// the rate limiter with the configured rate limits, keyed by their names, the access control rules, the moderation service for prompts and the audit log.
+type ImageCommandParams struct {
+	OpenAIClient   *openai.Client
+	OpenAIRequests *queue.Pool
+	RateLimiter    *ratelimit.Limiter
+	RateLimits     map[string]ratelimit.Rule
+	ACL            *acl.Store
+	Moderation     *moderation.Service
+	Audit          *audit.Logger
+}
+
+//The ImageCommand function takes the ImageCommandParams as an argument and returns a bot.Command struct that represents an image command for the Discord bot. 
 //  Command is named image and is used to generate creative images from textual descriptions. 
 //  DMPermission field is set to false, which means the command can only be used in guild channels. 
 //  DefaultMemberPermissions field is set to discord.PermissionViewChannel, which means that all members can view the channel.
 
-func ImageCommand(client *openai.Client) *bot.Command {
+func ImageCommand(params *ImageCommandParams) *bot.Command {
+	dalleCommand := dalle.Command(params.OpenAIClient, params.OpenAIRequests, params.ACL, params.Moderation)
+	// the rate limit middleware has to run before imageInteractionResponseMiddleware responds to the interaction
+	if rule, ok := params.RateLimits[DALLERateLimit]; ok {
+		dalleCommand.Middlewares = append([]bot.Handler{ratelimit.Middleware(params.RateLimiter, DALLERateLimit, rule, params.Audit)}, dalleCommand.Middlewares...)
+	}
+
 	return &bot.Command{
 		Name:                     imageCommandName,
 		Description:              "Generate creative images from textual descriptions",
 		DMPermission:             false,
 		DefaultMemberPermissions: discord.PermissionViewChannel,
 		// The SubCommands field is set to a bot.Router struct that contains a single subcommand, which is defined by the dalle.Command function. 
-		// The dalle.Command function takes the OpenAI client as an argument and returns a bot.Command struct that represents a DALL-E command for the Discord bot.
+		// The dalle.Command function takes the OpenAI client, the request queue, the access control rules and the moderation service as arguments and returns a bot.Command struct that represents a DALL-E command for the Discord bot.
 		SubCommands: bot.NewRouter([]*bot.Command{
-			dalle.Command(client),
+			dalleCommand,
 		}),
 	}
 }
@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/acl"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/preferences"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+	discord "github.com/bwmarrin/discordgo"
+)
+
+const settingsCommandName = "settings"
+
+// This file defines the settings subcommand of the chat command, which lets users choose how the answers for them are posted.
+
+// renderModeDescriptions explain the modes in the choices of the render option.
+var renderModeDescriptions = map[render.Mode]string{
+	render.ModeHybrid: "Hybrid: text with the usage in an embed",
+	render.ModeEmbed:  "Embed: everything in colored embeds",
+	render.ModePlain:  "Plain: text only",
+}
+
+// The settingsCommand function returns the settings subcommand. Without options it shows the settings of the user,
+// the render option sets the mode answers are posted in, "server default" goes back to the mode of the guild.
+func settingsCommand(store *preferences.Store, access *acl.Store, answers render.Config) *bot.Command {
+	choices := []*discord.ApplicationCommandOptionChoice{
+		{Name: "Server default", Value: "default"},
+	}
+	for _, mode := range render.Modes {
+		choices = append(choices, &discord.ApplicationCommandOptionChoice{Name: renderModeDescriptions[mode], Value: string(mode)})
+	}
+
+	return &bot.Command{
+		Name:        settingsCommandName,
+		Description: "Choose how the answers for you are posted",
+		Options: []*discord.ApplicationCommandOption{
+			{
+				Type:        discord.ApplicationCommandOptionString,
+				Name:        "render",
+				Description: "How answers are posted",
+				Choices:     choices,
+			},
+		},
+		// The access middleware checks the command, like for the other subcommands of chat
+		Middlewares: []bot.Handler{
+			acl.Middleware(access, nil),
+		},
+		Handler: bot.HandlerFunc(func(ctx *bot.Context) {
+			settingsHandler(ctx, store, answers)
+		}),
+	}
+}
+
+// The settingsHandler function saves the options given and shows the settings of the user in an ephemeral message.
+func settingsHandler(ctx *bot.Context, store *preferences.Store, answers render.Config) {
+	userID := ctx.Interaction.Member.User.ID
+	prefs := store.Get(userID)
+
+	if option, ok := ctx.Options["render"]; ok {
+		prefs.RenderMode = render.Mode(option.StringValue())
+		if prefs.RenderMode == "default" {
+			prefs.RenderMode = ""
+		}
+		if err := store.Set(userID, prefs); err != nil {
+			ctx.Logger.Error("Failed to save preferences", "error", err)
+			settingsRespond(ctx, &discord.MessageEmbed{
+				Title:       "❌ Error",
+				Description: err.Error(),
+				Color:       0xff0000,
+			})
+			return
+		}
+		ctx.Logger.Info("Preferences saved", "render_mode", prefs.RenderMode)
+	}
+
+	mode := fmt.Sprintf("`%s`", prefs.RenderMode)
+	if prefs.RenderMode == "" {
+		mode = fmt.Sprintf("`%s` (server default)", answers.PolicyFor(ctx.Interaction.GuildID).Mode)
+	}
+	settingsRespond(ctx, &discord.MessageEmbed{
+		Title:       "⚙️ Settings",
+		Description: "Answers are posted in " + mode + " mode",
+		Color:       0x00bfff,
+	})
+}
+
+// The settingsRespond function sends an ephemeral embed, the settings are nobody else's business.
+func settingsRespond(ctx *bot.Context, embed *discord.MessageEmbed) {
+	err := ctx.Respond(&discord.InteractionResponse{
+		Type: discord.InteractionResponseChannelMessageWithSource,
+		Data: &discord.InteractionResponseData{
+			Flags:  discord.MessageFlagsEphemeral,
+			Embeds: []*discord.MessageEmbed{embed},
+		},
+	})
+	if err != nil {
+		ctx.Logger.Error("Failed to respond to interaction", "error", err)
+	}
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"os"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/audit"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/logging"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/moderation"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/ratelimit"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/tracing"
+	"gopkg.in/yaml.v2"
+)
+
+// creating a struct to work with the discord and open ai keys
+type Config struct {
+	//there are 2 sub structs in this, one is for discord
+	Discord struct {
+		//discord bot requires a token, which is present in the yaml file with the name "token"
+		//when we write yaml:token, we're specifying the name of the field in the yaml field
+		//that field will correspond to this particular field, which is Token and will be binded in runtime
+		Token string `yaml:"token"`
+		//guild is basically the particular server you want the bot to be present in
+		//in our case, we invited the bot to a particular workspace, but you can also
+		//specify it from the code itself so we will keep this field so that if we want
+		//to put our app into production, we have this capability
+		//
+		// Deprecated: use Guilds instead, a guild set here is treated as if it was listed in Guilds
+		Guild string `yaml:"guild,omitempty"`
+		//guilds are the servers to register the commands in, registering commands in a guild is instant,
+		//while global commands take a while to propagate, so this is handy during development
+		Guilds []string `yaml:"guilds"`
+		//global registers the commands globally in addition to the guilds above,
+		//when no guilds are specified, the commands are always registered globally
+		Global bool `yaml:"global"`
+		//commands holds per command settings, keyed by the command name
+		Commands map[string]CommandConfig `yaml:"commands"`
+		//when our project shuts down, we either want to remove all the commands that we set
+		//for the bot or we want to keep them, this is a boolean value, either true or false
+		//and we can set it in our credentials file
+		RemoveCommands bool `yaml:"removeCommands"`
+	} `yaml:"discord"`
+	//this is the other sub struct, for open AI, in the previous one, we mentioned, yaml discord
+	//because all of the above values will be under the heading, discord
+	OpenAI struct {
+		APIKey string `yaml:"apiKey"`
+		// BaseURL of an OpenAI-compatible API, e.g. the fake API of cmd/fake-openai. The OpenAI API is used when empty.
+		BaseURL          string   `yaml:"baseURL"`
+		CompletionModels []string `yaml:"completionModels"`
+		//queue configures the queue every OpenAI request goes through
+		Queue QueueConfig `yaml:"queue"`
+	} `yaml:"openAI"`
+	//all of the above values will be under the openAI heading
+
+	//rateLimits throttles the commands and thread messages, keyed by the name of the limit
+	//(gpt, gptMessages or dalle), everything not listed here is not limited
+	RateLimits map[string]ratelimit.Rule `yaml:"rateLimits"`
+
+	//moderation sets what happens with flagged prompts, messages and answers, per guild,
+	//by default flagged content is blocked
+	Moderation moderation.Config `yaml:"moderation"`
+
+	//answers sets how the answers of the model are posted, per guild, by default long code blocks are attached as files
+	Answers render.Config `yaml:"answers"`
+
+	//audit configures where the audit events are recorded
+	Audit AuditConfig `yaml:"audit"`
+
+	//acl configures where the access control rules managed with the /acl command are stored
+	ACL struct {
+		//file the rules are persisted in, it is created when the first rule is added
+		File string `yaml:"file"`
+	} `yaml:"acl"`
+
+	//preferences configures where the settings users choose with /chat settings are stored
+	Preferences struct {
+		//file the preferences are persisted in, it is created when the first user saves their settings
+		File string `yaml:"file"`
+	} `yaml:"preferences"`
+
+	//log sets the level and the format of the logs, prompts and other user content are only logged on the debug level
+	Log logging.Config `yaml:"log"`
+
+	//admin configures the HTTP server for operators, serving the metrics
+	Admin AdminConfig `yaml:"admin"`
+
+	//tracing configures the OTLP collector the OpenTelemetry spans are exported to
+	Tracing tracing.Config `yaml:"tracing"`
+}
+
+// CommandConfig holds the settings of a single command.
+type CommandConfig struct {
+	// Guilds restricts the command to the given guilds. The command is not registered globally then,
+	// and every guild listed here must also be one of the guilds the commands are registered in.
+	Guilds []string `yaml:"guilds"`
+}
+
+// QueueConfig holds the settings of the OpenAI request queue.
+type QueueConfig struct {
+	// Workers is the number of OpenAI requests that run at the same time
+	Workers int `yaml:"workers"`
+	// Size is the number of requests that can wait in the queue, further requests are rejected
+	Size int `yaml:"size"`
+	// ModelConcurrency limits the number of concurrent requests per model, e.g. to stay within rate limits of gpt-4
+	ModelConcurrency map[string]int `yaml:"modelConcurrency"`
+}
+
+// AuditConfig holds the settings of the audit log.
+type AuditConfig struct {
+	// File records the events in a local append-only JSONL file
+	File struct {
+		// Path of the file, the file sink is disabled when empty
+		Path string `yaml:"path"`
+		// Events to record, all events when empty
+		Events audit.Filter `yaml:"events"`
+	} `yaml:"file"`
+	// Discord posts the events to a log channel of the guild they happened in
+	Discord struct {
+		// Channels are the log channel IDs keyed by guild ID, the Discord sink is disabled when empty
+		Channels map[string]string `yaml:"channels"`
+		// Events to post, all events when empty
+		Events audit.Filter `yaml:"events"`
+	} `yaml:"discord"`
+}
+
+// AdminConfig holds the settings of the admin HTTP server.
+type AdminConfig struct {
+	// Listen is the address the server listens on, e.g. ":9090". The server is disabled when empty.
+	Listen string `yaml:"listen"`
+	// MaxHeartbeatLatency is the gateway heartbeat latency from which the bot is reported as not ready
+	MaxHeartbeatLatency time.Duration `yaml:"maxHeartbeatLatency"`
+}
+
+// AdminListenEnv is the environment variable that overrides admin.listen when it is set. The Docker image sets it,
+// so the admin server listens where the health check of the container looks for it.
+const AdminListenEnv = "ADMIN_LISTEN"
+
+// Default values of the settings that are not required in the configuration file
+const (
+	defaultQueueWorkers    = 4
+	defaultQueueSize       = 100
+	defaultACLFile         = "acl.json"
+	defaultPreferencesFile = "preferences.json"
+
+	defaultMaxHeartbeatLatency = 10 * time.Second
+	defaultTracingSampleRatio  = 1
+)
+
+// with this function, you can read config values from the yaml file
+// we pass the name of the file in it
+func (c *Config) ReadFromFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	//values missing in the file keep their defaults
+	c.OpenAI.Queue.Workers = defaultQueueWorkers
+	c.OpenAI.Queue.Size = defaultQueueSize
+	c.ACL.File = defaultACLFile
+	c.Preferences.File = defaultPreferencesFile
+	c.Admin.MaxHeartbeatLatency = defaultMaxHeartbeatLatency
+	c.Tracing.SampleRatio = defaultTracingSampleRatio
+	//unmarshalling function enables us to convert values from yaml to a higher level
+	//object such as a golang struct, we need the struct to be able to work in golangf
+	//since yaml and json aren't supported by default
+	err = yaml.Unmarshal(data, c)
+	if err != nil {
+		return err
+	}
+	//an empty variable disables the admin server, like an empty admin.listen does
+	if listen, ok := os.LookupEnv(AdminListenEnv); ok {
+		c.Admin.Listen = listen
+	}
+	return nil
+}
+
+// SyncGuilds returns the guilds the commands are registered in. An empty string stands for
+// global registration.
+func (c *Config) SyncGuilds() []string {
+	var guilds []string
+	seen := make(map[string]struct{})
+	for _, guild := range append([]string{c.Discord.Guild}, c.Discord.Guilds...) {
+		if _, ok := seen[guild]; ok || guild == "" {
+			continue
+		}
+		seen[guild] = struct{}{}
+		guilds = append(guilds, guild)
+	}
+	if len(guilds) == 0 || c.Discord.Global {
+		guilds = append(guilds, "")
+	}
+	return guilds
+}
+
+// redactedValue replaces secrets when the configuration is printed.
+const redactedValue = "<redacted>"
+
+// Redacted returns a copy of the configuration with all secrets (discord token, OpenAI API key, tracing headers)
+// replaced by a placeholder, so it can be safely printed or logged.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.Discord.Guilds = append([]string(nil), c.Discord.Guilds...)
+	redacted.OpenAI.CompletionModels = append([]string(nil), c.OpenAI.CompletionModels...)
+	if redacted.Discord.Token != "" {
+		redacted.Discord.Token = redactedValue
+	}
+	if redacted.OpenAI.APIKey != "" {
+		redacted.OpenAI.APIKey = redactedValue
+	}
+	if len(c.Tracing.Headers) > 0 {
+		redacted.Tracing.Headers = make(map[string]string, len(c.Tracing.Headers))
+		for name := range c.Tracing.Headers {
+			redacted.Tracing.Headers[name] = redactedValue
+		}
+	}
+	return &redacted
+}
+
+// String returns the YAML representation of the configuration with secrets redacted.
+func (c *Config) String() string {
+	data, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
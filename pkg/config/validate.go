@@ -0,0 +1,190 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Discord allows at most 25 choices per application command option,
+// so this is the maximum number of completion models we can offer in the `model` option.
+const maxCompletionModels = 25
+
+// maxQueueWorkers caps the number of concurrent OpenAI requests, more would only hit the rate limits
+const maxQueueWorkers = 64
+
+// Known holds the names the configuration may refer to. They are defined by the commands, which are
+// passed in by the caller, so the config package doesn't depend on the packages it configures.
+type Known struct {
+	// CompletionModels are the chat completion models the bot supports
+	CompletionModels []string
+	// ImageModels are the image models the bot uses, they can be limited in the queue too
+	ImageModels []string
+	// RateLimits are the names of the rate limits the commands look up
+	RateLimits []string
+}
+
+// Validate checks the configuration for missing required fields, unknown model names,
+// malformed guild IDs and out of range options. All problems found are returned joined
+// together, so a single run reports every mistake in the file.
+func (c *Config) Validate(known Known) error {
+	var errs []error
+
+	if strings.TrimSpace(c.Discord.Token) == "" {
+		errs = append(errs, errors.New("discord.token is required"))
+	}
+	if c.Discord.Guild != "" && !isSnowflake(c.Discord.Guild) {
+		errs = append(errs, fmt.Errorf("discord.guild %q is not a valid Discord ID", c.Discord.Guild))
+	}
+	for _, guild := range c.Discord.Guilds {
+		if !isSnowflake(guild) {
+			errs = append(errs, fmt.Errorf("discord.guilds contains %q, which is not a valid Discord ID", guild))
+		}
+	}
+	syncGuilds := make(map[string]struct{})
+	for _, guild := range c.SyncGuilds() {
+		syncGuilds[guild] = struct{}{}
+	}
+	for name, command := range c.Discord.Commands {
+		for _, guild := range command.Guilds {
+			if !isSnowflake(guild) {
+				errs = append(errs, fmt.Errorf("discord.commands.%s.guilds contains %q, which is not a valid Discord ID", name, guild))
+			} else if _, ok := syncGuilds[guild]; !ok {
+				errs = append(errs, fmt.Errorf("discord.commands.%s.guilds contains %q, which is not listed in discord.guilds", name, guild))
+			}
+		}
+	}
+
+	if c.OpenAI.APIKey == "" && len(c.OpenAI.CompletionModels) > 0 {
+		errs = append(errs, errors.New("openAI.completionModels is set, but openAI.apiKey is empty"))
+	}
+	if c.OpenAI.BaseURL != "" {
+		if u, err := url.Parse(c.OpenAI.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("openAI.baseURL %q is not a valid http or https URL", c.OpenAI.BaseURL))
+		}
+	}
+	if n := len(c.OpenAI.CompletionModels); n > maxCompletionModels {
+		errs = append(errs, fmt.Errorf("openAI.completionModels has %d entries, Discord allows at most %d", n, maxCompletionModels))
+	}
+	seen := make(map[string]struct{}, len(c.OpenAI.CompletionModels))
+	for _, model := range c.OpenAI.CompletionModels {
+		if _, ok := seen[model]; ok {
+			errs = append(errs, fmt.Errorf("openAI.completionModels contains duplicate model %q", model))
+			continue
+		}
+		seen[model] = struct{}{}
+		if !contains(known.CompletionModels, model) {
+			errs = append(errs, fmt.Errorf("openAI.completionModels contains unknown model %q, known models are: %s", model, strings.Join(known.CompletionModels, ", ")))
+		}
+	}
+
+	if w := c.OpenAI.Queue.Workers; w < 1 || w > maxQueueWorkers {
+		errs = append(errs, fmt.Errorf("openAI.queue.workers is %d, must be between 1 and %d", w, maxQueueWorkers))
+	}
+	if c.OpenAI.Queue.Size < 0 {
+		errs = append(errs, fmt.Errorf("openAI.queue.size is %d, must not be negative", c.OpenAI.Queue.Size))
+	}
+	for model, limit := range c.OpenAI.Queue.ModelConcurrency {
+		if !contains(known.CompletionModels, model) && !contains(known.ImageModels, model) {
+			errs = append(errs, fmt.Errorf("openAI.queue.modelConcurrency contains unknown model %q", model))
+		}
+		if limit < 1 {
+			errs = append(errs, fmt.Errorf("openAI.queue.modelConcurrency.%s is %d, must be at least 1", model, limit))
+		}
+	}
+
+	for name, rule := range c.RateLimits {
+		if !contains(known.RateLimits, name) {
+			errs = append(errs, fmt.Errorf("rateLimits contains unknown limit %q, known limits are: %s", name, strings.Join(known.RateLimits, ", ")))
+			continue
+		}
+		if err := rule.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rateLimits.%s: %w", name, err))
+		}
+	}
+
+	if err := c.Moderation.Validate(); err != nil {
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			errs = append(errs, fmt.Errorf("moderation.%w", err))
+		}
+	}
+	if c.Moderation.LogChannel != "" && !isSnowflake(c.Moderation.LogChannel) {
+		errs = append(errs, fmt.Errorf("moderation.logChannel %q is not a valid Discord ID", c.Moderation.LogChannel))
+	}
+	for guild, policy := range c.Moderation.Guilds {
+		if !isSnowflake(guild) {
+			errs = append(errs, fmt.Errorf("moderation.guilds contains %q, which is not a valid Discord ID", guild))
+		}
+		if policy.LogChannel != "" && !isSnowflake(policy.LogChannel) {
+			errs = append(errs, fmt.Errorf("moderation.guilds.%s.logChannel %q is not a valid Discord ID", guild, policy.LogChannel))
+		}
+	}
+	if err := c.Answers.Validate(); err != nil {
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			errs = append(errs, fmt.Errorf("answers.%w", err))
+		}
+	}
+	for guild := range c.Answers.Guilds {
+		if !isSnowflake(guild) {
+			errs = append(errs, fmt.Errorf("answers.guilds contains %q, which is not a valid Discord ID", guild))
+		}
+	}
+	if err := c.Audit.File.Events.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("audit.file.events: %w", err))
+	}
+	if err := c.Audit.Discord.Events.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("audit.discord.events: %w", err))
+	}
+	for guild, channel := range c.Audit.Discord.Channels {
+		if !isSnowflake(guild) {
+			errs = append(errs, fmt.Errorf("audit.discord.channels contains guild %q, which is not a valid Discord ID", guild))
+		}
+		if !isSnowflake(channel) {
+			errs = append(errs, fmt.Errorf("audit.discord.channels.%s %q is not a valid Discord ID", guild, channel))
+		}
+	}
+	if strings.TrimSpace(c.ACL.File) == "" {
+		errs = append(errs, errors.New("acl.file must not be empty"))
+	}
+	if strings.TrimSpace(c.Preferences.File) == "" {
+		errs = append(errs, errors.New("preferences.file must not be empty"))
+	}
+	if err := c.Log.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("log: %w", err))
+	}
+	if c.Admin.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("admin.listen %q is not a valid address: %w", c.Admin.Listen, err))
+		}
+	}
+	if c.Admin.MaxHeartbeatLatency <= 0 {
+		errs = append(errs, fmt.Errorf("admin.maxHeartbeatLatency must be positive, got %v", c.Admin.MaxHeartbeatLatency))
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tracing.%w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// contains reports whether name is one of the known names.
+func contains(known []string, name string) bool {
+	for _, k := range known {
+		if name == k {
+			return true
+		}
+	}
+	return false
+}
+
+// isSnowflake reports whether s looks like a Discord snowflake ID.
+func isSnowflake(s string) bool {
+	if len(s) < 17 || len(s) > 20 {
+		return false
+	}
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
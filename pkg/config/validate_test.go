@@ -0,0 +1,151 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testKnown are the names the configurations of the tests may refer to.
+var testKnown = Known{
+	CompletionModels: []string{"gpt-3.5-turbo", "gpt-4"},
+	ImageModels:      []string{"dall-e"},
+	RateLimits:       []string{"gpt", "gptMessages", "dalle"},
+}
+
+// readTestConfig reads the configuration from a file with the given content, so the defaults apply like they do
+// for the real file.
+func readTestConfig(t *testing.T, content string) (*Config, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "credentials.yaml")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{}
+	return cfg, cfg.ReadFromFile(file)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// wantReadErr is part of the error reading the file fails with
+		wantReadErr string
+		// wantErrs are the errors joined together by Validate
+		wantErrs []string
+	}{
+		{
+			name:   "valid",
+			config: "discord:\n  token: token\n",
+		},
+		{
+			name:   "unknown model",
+			config: "discord:\n  token: token\nopenAI:\n  apiKey: key\n  completionModels: [gpt-4, gpt-5]\n",
+			wantErrs: []string{
+				`openAI.completionModels contains unknown model "gpt-5", known models are: gpt-3.5-turbo, gpt-4`,
+			},
+		},
+		{
+			name:   "unknown queue model",
+			config: "discord:\n  token: token\nopenAI:\n  queue:\n    modelConcurrency:\n      dall-e: 1\n      gpt-5: 0\n",
+			wantErrs: []string{
+				`openAI.queue.modelConcurrency contains unknown model "gpt-5"`,
+				`openAI.queue.modelConcurrency.gpt-5 is 0, must be at least 1`,
+			},
+		},
+		{
+			name:   "negative duration",
+			config: "discord:\n  token: token\nrateLimits:\n  gpt:\n    requests: 1\n    per: -1m\n",
+			wantErrs: []string{
+				`rateLimits.gpt: per is -1m0s, must be positive`,
+			},
+		},
+		{
+			name:   "zero duration",
+			config: "discord:\n  token: token\nadmin:\n  maxHeartbeatLatency: 0s\n",
+			wantErrs: []string{
+				`admin.maxHeartbeatLatency must be positive, got 0s`,
+			},
+		},
+		{
+			name:        "malformed duration",
+			config:      "discord:\n  token: token\nrateLimits:\n  gpt:\n    requests: 1\n    per: soon\n",
+			wantReadErr: "time.Duration",
+		},
+		{
+			name: "moderation and answers",
+			config: "discord:\n  token: token\n" +
+				"moderation:\n  action: ban\n  thresholds:\n    violence: 2\n" +
+				"answers:\n  mode: fancy\n  guilds:\n    \"123456789012345678\":\n      attachments:\n        minLines: -1\n",
+			// every error of the nested configurations is reported on its own, with the prefix of its section
+			wantErrs: []string{
+				`answers.guilds.123456789012345678.attachments.minLines is -1, must not be negative`,
+				`answers.mode "fancy" is unknown, expected hybrid, embed or plain`,
+				`moderation.action "ban" is unknown, expected block, warn or log`,
+				`moderation.thresholds.violence is 2, must be between 0 and 1`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := readTestConfig(t, test.config)
+			if test.wantReadErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantReadErr) {
+					t.Fatalf("ReadFromFile() error = %v, want one containing %q", err, test.wantReadErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = cfg.Validate(testKnown)
+			var got []string
+			if err != nil {
+				joined, ok := err.(interface{ Unwrap() []error })
+				if !ok {
+					t.Fatalf("Validate() error %T is not joined", err)
+				}
+				for _, err := range joined.Unwrap() {
+					got = append(got, err.Error())
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.wantErrs) {
+				t.Errorf("Validate() errors = %q, want %q", got, test.wantErrs)
+			}
+		})
+	}
+}
+
+// TestValidateNestedErrorsJoined checks that the nested configurations return joined errors, Validate unwraps them
+// to report every error on its own.
+func TestValidateNestedErrorsJoined(t *testing.T) {
+	cfg, err := readTestConfig(t, "moderation:\n  action: ban\nanswers:\n  mode: fancy\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, err := range map[string]error{"moderation": cfg.Moderation.Validate(), "answers": cfg.Answers.Validate()} {
+		if _, ok := err.(interface{ Unwrap() []error }); !ok {
+			t.Errorf("%s: Validate() error %T is not joined", name, err)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	cfg, err := readTestConfig(t, "discord:\n  token: token\nopenAI:\n  apiKey: key\nrateLimits:\n  gpt:\n    requests: 1\n    per: 90s\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	printed := cfg.String()
+	for _, want := range []string{"token: <redacted>", "apiKey: <redacted>", "per: 1m30s", "maxHeartbeatLatency: 10s"} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("printed configuration doesn't contain %q:\n%s", want, printed)
+		}
+	}
+}
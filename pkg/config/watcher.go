@@ -0,0 +1,94 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Editors usually write a file in several steps (truncate, write, rename),
+// so events are collapsed and the reload happens once the file settles down.
+const watcherDebounce = 500 * time.Millisecond
+
+// Watcher calls the given function every time the configuration file changes on disk
+// or the process receives SIGHUP.
+type Watcher struct {
+	file     string
+	onChange func()
+
+	watcher *fsnotify.Watcher
+	signals chan os.Signal
+	done    chan struct{}
+}
+
+// NewWatcher starts watching the configuration file and listening for SIGHUP.
+// The directory of the file is watched instead of the file itself, so the watch survives
+// editors and tools that replace the file by renaming a new one over it.
+func NewWatcher(file string, onChange func()) (*Watcher, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := fsWatcher.Add(filepath.Dir(file)); err != nil {
+		fsWatcher.Close()
+		return nil, err
+	}
+
+	w := &Watcher{
+		file:     filepath.Clean(file),
+		onChange: onChange,
+		watcher:  fsWatcher,
+		signals:  make(chan os.Signal, 1),
+		done:     make(chan struct{}),
+	}
+	signal.Notify(w.signals, syscall.SIGHUP)
+
+	go w.run()
+	return w, nil
+}
+
+// run dispatches file system events and signals until the watcher is closed.
+// onChange is always called from this goroutine, so reloads never run concurrently.
+func (w *Watcher) run() {
+	debounce := time.NewTimer(watcherDebounce)
+	debounce.Stop()
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != w.file || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			debounce.Reset(watcherDebounce)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Config watcher error", "error", err)
+		case <-w.signals:
+			slog.Info("Received SIGHUP, reloading configuration")
+			w.onChange()
+		case <-debounce.C:
+			slog.Info("Configuration file changed, reloading", "file", w.file)
+			w.onChange()
+		case <-w.done:
+			debounce.Stop()
+			return
+		}
+	}
+}
+
+// Close stops watching the configuration file and listening for SIGHUP.
+func (w *Watcher) Close() error {
+	signal.Stop(w.signals)
+	close(w.done)
+	return w.watcher.Close()
+}
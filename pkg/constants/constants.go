@@ -1,5 +1,7 @@
 package constants
 
+import "time"
+
 // Package constants provides constant values used throughout the project.
 
 // Version represents the current version of the project.
@@ -8,6 +10,12 @@ const Version = "0.4.7"
 // DiscordThreadsCacheSize represents the maximum number of threads to cache in memory.
 const DiscordThreadsCacheSize = 64
 
+// DiscordIgnoredChannelsCacheSize represents the maximum number of ignored channels to cache in memory.
+const DiscordIgnoredChannelsCacheSize = 4096
+
+// DiscordIgnoredChannelsCacheTTL represents how long a channel stays in the ignored channels cache.
+const DiscordIgnoredChannelsCacheTTL = 6 * time.Hour
+
 // OpenAIBlackIconURL represents the URL of the black OpenAI icon.
 const OpenAIBlackIconURL = "https://ph-files.imgix.net/b739ac93-2899-4cc1-a893-40ea8afde77e.png"
 
@@ -0,0 +1,134 @@
+package discordtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+// Gateway opcodes used by the fake gateway
+const (
+	opDispatch     = 0
+	opHeartbeat    = 1
+	opIdentify     = 2
+	opHello        = 10
+	opHeartbeatAck = 11
+)
+
+// heartbeatInterval is sent with Hello, in milliseconds. It is long enough that no test has to wait for a heartbeat.
+const heartbeatInterval = 45000
+
+// payload is a gateway message.
+type payload struct {
+	Op       int         `json:"op"`
+	Data     interface{} `json:"d"`
+	Sequence int64       `json:"s,omitempty"`
+	Type     string      `json:"t,omitempty"`
+}
+
+// gatewayConn is a session connected to the fake gateway.
+type gatewayConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (c *gatewayConn) send(p payload) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteJSON(p)
+}
+
+func (c *gatewayConn) close() {
+	c.conn.Close()
+}
+
+// serveGateway accepts a session: it says hello, waits for it to identify, sends READY and then answers
+// its heartbeats until it disconnects. Resuming is not supported, the sessions are never supposed to reconnect.
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &gatewayConn{conn: conn}
+	defer c.close()
+
+	if err := c.send(payload{Op: opHello, Data: map[string]int{"heartbeat_interval": heartbeatInterval}}); err != nil {
+		return
+	}
+
+	var identify struct {
+		Op int `json:"op"`
+	}
+	if err := conn.ReadJSON(&identify); err != nil || identify.Op != opIdentify {
+		s.t.Errorf("discordtest: expected the session to identify, got op %d: %v", identify.Op, err)
+		return
+	}
+
+	ready := &discord.Ready{
+		Version:   10,
+		SessionID: "session-" + s.NewID(),
+		User:      s.User,
+		Guilds:    []*discord.Guild{},
+	}
+	// the events are dispatched with the lock held, so all of them are sent after READY
+	s.mu.Lock()
+	s.conns = append(s.conns, c)
+	err = c.send(payload{Op: opDispatch, Type: "READY", Sequence: atomic.AddInt64(&s.sequence, 1), Data: ready})
+	s.mu.Unlock()
+	defer s.removeConn(c)
+	if err != nil {
+		return
+	}
+
+	for {
+		var p struct {
+			Op int `json:"op"`
+		}
+		if err := conn.ReadJSON(&p); err != nil {
+			return
+		}
+		if p.Op == opHeartbeat {
+			c.send(payload{Op: opHeartbeatAck})
+		}
+	}
+}
+
+func (s *Server) removeConn(c *gatewayConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, conn := range s.conns {
+		if conn == c {
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// Dispatch sends an event to all the connected sessions, e.g. Dispatch("MESSAGE_CREATE", m).
+// The data is sent as JSON, like the real gateway does.
+func (s *Server) Dispatch(eventType string, data interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dispatch(eventType, data)
+}
+
+// dispatch sends an event, the caller holds the lock. The events caused by a REST request are sent before
+// the response, so they reach the sessions before any event the test dispatches afterwards.
+func (s *Server) dispatch(eventType string, data interface{}) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		s.t.Errorf("discordtest: encoding the %s event: %v", eventType, err)
+		return
+	}
+
+	for _, c := range s.conns {
+		p := payload{Op: opDispatch, Type: eventType, Sequence: atomic.AddInt64(&s.sequence, 1), Data: json.RawMessage(raw)}
+		if err := c.send(p); err != nil {
+			s.t.Errorf("discordtest: sending the %s event: %v", eventType, err)
+		}
+	}
+}
@@ -0,0 +1,634 @@
+package discordtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// messageData is the part of a message create or edit request the server looks at. Components are ignored,
+// decoding them needs the concrete component types.
+type messageData struct {
+	Content          *string                   `json:"content"`
+	Embeds           *[]*discord.MessageEmbed  `json:"embeds"`
+	Flags            discord.MessageFlags      `json:"flags"`
+	MessageReference *discord.MessageReference `json:"message_reference"`
+	// Title and CustomID are set on modals
+	Title    string `json:"title"`
+	CustomID string `json:"custom_id"`
+
+	files []*discord.File
+}
+
+// interactionCallback is the body of an interaction response.
+type interactionCallback struct {
+	Type discord.InteractionResponseType `json:"type"`
+	Data *messageData                    `json:"data"`
+}
+
+// File returns the file attached to the message with the given name, or nil if there is none.
+func (s *Server) File(messageID string, name string) *discord.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.files[messageID] {
+		if f.Name == name {
+			return copyFile(f)
+		}
+	}
+	return nil
+}
+
+// Files returns the files attached to the message, in the order they were uploaded.
+func (s *Server) Files(messageID string) []*discord.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []*discord.File
+	for _, f := range s.files[messageID] {
+		files = append(files, copyFile(f))
+	}
+	return files
+}
+
+// copyFile returns a copy of a stored file with its own reader, so the content can be read any number of times.
+func copyFile(f *discord.File) *discord.File {
+	content := f.Reader.(*bytes.Reader)
+	return &discord.File{Name: f.Name, ContentType: f.ContentType, Reader: io.NewSectionReader(content, 0, content.Size())}
+}
+
+// serveREST handles a REST request, path is relative to the API root.
+func (s *Server) serveREST(w http.ResponseWriter, r *http.Request, path string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: path, Body: body})
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	route := func(method string, pattern string) bool {
+		if r.Method != method {
+			return false
+		}
+		segments := strings.Split(pattern, "/")
+		if len(segments) != len(parts) {
+			return false
+		}
+		for i, segment := range segments {
+			if segment != "*" && segment != parts[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch {
+	case route(http.MethodGet, "gateway"), route(http.MethodGet, "gateway/bot"):
+		writeJSON(w, http.StatusOK, map[string]interface{}{"url": s.websocketURL(), "shards": 1})
+	case route(http.MethodGet, "users/@me"):
+		writeJSON(w, http.StatusOK, s.User)
+	case route(http.MethodPost, "users/@me/channels"):
+		s.createDM(w, body)
+
+	case route(http.MethodPost, "interactions/*/*/callback"):
+		s.interactionCallback(w, r, body, parts[2])
+	case route(http.MethodGet, "webhooks/*/*/messages/@original"):
+		s.getMessageByID(w, s.originalID(parts[2]))
+	case route(http.MethodPatch, "webhooks/*/*/messages/@original"):
+		s.editWebhookMessage(w, r, body, parts[2], s.originalID(parts[2]))
+	case route(http.MethodDelete, "webhooks/*/*/messages/@original"):
+		s.deleteOriginal(w, parts[2])
+	case route(http.MethodPost, "webhooks/*/*"):
+		s.followup(w, r, body, parts[2])
+	case route(http.MethodGet, "webhooks/*/*/messages/*"):
+		s.getMessageByID(w, parts[4])
+	case route(http.MethodPatch, "webhooks/*/*/messages/*"):
+		s.editWebhookMessage(w, r, body, parts[2], parts[4])
+	case route(http.MethodDelete, "webhooks/*/*/messages/*"):
+		s.deleteMessageByID(w, parts[4])
+
+	case route(http.MethodGet, "channels/*"):
+		s.getChannel(w, parts[1])
+	case route(http.MethodPatch, "channels/*"):
+		s.editChannel(w, body, parts[1])
+	case route(http.MethodGet, "channels/*/messages"):
+		s.getMessages(w, r, parts[1])
+	case route(http.MethodPost, "channels/*/messages"):
+		s.createMessage(w, r, body, parts[1])
+	case route(http.MethodGet, "channels/*/messages/*"):
+		s.getMessage(w, parts[1], parts[3])
+	case route(http.MethodPatch, "channels/*/messages/*"):
+		s.editMessage(w, r, body, parts[1], parts[3])
+	case route(http.MethodDelete, "channels/*/messages/*"):
+		s.deleteMessage(w, parts[1], parts[3])
+	case route(http.MethodPost, "channels/*/messages/*/threads"):
+		s.startThread(w, body, parts[1], parts[3])
+	case route(http.MethodPut, "channels/*/messages/*/reactions/*/@me"):
+		s.react(w, parts[1], parts[3], parts[5], false)
+	case route(http.MethodDelete, "channels/*/messages/*/reactions/*/@me"),
+		route(http.MethodDelete, "channels/*/messages/*/reactions/*"):
+		s.react(w, parts[1], parts[3], parts[5], true)
+	case route(http.MethodPost, "channels/*/typing"), route(http.MethodPut, "channels/*/thread-members/*"):
+		w.WriteHeader(http.StatusNoContent)
+
+	case route(http.MethodGet, "applications/*/commands"), route(http.MethodGet, "applications/*/guilds/*/commands"):
+		writeJSON(w, http.StatusOK, []interface{}{})
+	case route(http.MethodPut, "applications/*/commands"), route(http.MethodPut, "applications/*/guilds/*/commands"):
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+
+	default:
+		writeError(w, http.StatusNotFound, "404: Not Found")
+	}
+}
+
+// decodeBody decodes the JSON body of a request into v. Requests with files are sent as multipart, with the JSON
+// in the payload_json field next to the files, which are returned.
+func decodeBody(r *http.Request, body []byte, v interface{}) ([]*discord.File, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, json.Unmarshal(body, v)
+	}
+
+	var files []*discord.File
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "payload_json" {
+			if err := json.Unmarshal(data, v); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		files = append(files, &discord.File{
+			Name:        part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+			Reader:      bytes.NewReader(data),
+		})
+	}
+}
+
+// decodeMessage decodes a message create or edit request.
+func decodeMessage(r *http.Request, body []byte) (*messageData, error) {
+	data := &messageData{}
+	files, err := decodeBody(r, body, data)
+	data.files = files
+	return data, err
+}
+
+// newMessage creates a message of the bot from the request data. The caller holds the lock.
+func (s *Server) newMessage(channelID string, data *messageData) *discord.Message {
+	m := &discord.Message{
+		ChannelID: channelID,
+		Author:    s.User,
+		Flags:     data.Flags,
+		Embeds:    []*discord.MessageEmbed{},
+	}
+	if data.Content != nil {
+		m.Content = *data.Content
+	}
+	if data.Embeds != nil {
+		m.Embeds = *data.Embeds
+	}
+	if data.MessageReference != nil {
+		m.Type = discord.MessageTypeReply
+		m.MessageReference = data.MessageReference
+		m.ReferencedMessage = s.message(data.MessageReference.ChannelID, data.MessageReference.MessageID)
+	}
+	s.addMessage(m)
+	s.attachFiles(m, data.files)
+	return m
+}
+
+// attachFiles stores the uploaded files and lists them as the attachments of the message. The caller holds the lock.
+func (s *Server) attachFiles(m *discord.Message, files []*discord.File) {
+	for _, f := range files {
+		s.files[m.ID] = append(s.files[m.ID], f)
+		m.Attachments = append(m.Attachments, &discord.MessageAttachment{
+			ID:          s.newID(),
+			Filename:    f.Name,
+			ContentType: f.ContentType,
+			Size:        int(f.Reader.(*bytes.Reader).Size()),
+		})
+	}
+}
+
+// applyEdit applies an edit to a message of the bot and records it. The caller holds the lock.
+func (s *Server) applyEdit(m *discord.Message, data *messageData) {
+	if data.Content != nil {
+		m.Content = *data.Content
+	}
+	if data.Embeds != nil {
+		m.Embeds = *data.Embeds
+	}
+	m.Flags &^= discord.MessageFlagsLoading
+	s.attachFiles(m, data.files)
+	now := time.Now().UTC()
+	m.EditedTimestamp = &now
+	s.edits = append(s.edits, Edit{ChannelID: m.ChannelID, MessageID: m.ID, Content: m.Content, Embeds: m.Embeds})
+}
+
+// findMessage looks a message up by its ID in all the channels. The caller holds the lock.
+func (s *Server) findMessage(messageID string) *discord.Message {
+	for _, messages := range s.messages {
+		for _, m := range messages {
+			if m.ID == messageID {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// originalID returns the ID of the original response of the interaction with the token. The caller holds the lock.
+func (s *Server) originalID(token string) string {
+	if m := s.originals[token]; m != nil {
+		return m.ID
+	}
+	return ""
+}
+
+func (s *Server) interactionCallback(w http.ResponseWriter, r *http.Request, body []byte, token string) {
+	i, ok := s.interactions[token]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown interaction")
+		return
+	}
+	if _, responded := s.responses[token]; responded {
+		writeError(w, http.StatusBadRequest, "Interaction has already been acknowledged.")
+		return
+	}
+
+	data := &messageData{}
+	callback := interactionCallback{Data: data}
+	files, err := decodeBody(r, body, &callback)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	data.files = files
+
+	response := &discord.InteractionResponse{Type: callback.Type, Data: &discord.InteractionResponseData{
+		Flags:    data.Flags,
+		Title:    data.Title,
+		CustomID: data.CustomID,
+	}}
+	if data.Content != nil {
+		response.Data.Content = *data.Content
+	}
+	if data.Embeds != nil {
+		response.Data.Embeds = *data.Embeds
+	}
+	s.responses[token] = append(s.responses[token], response)
+
+	switch callback.Type {
+	case discord.InteractionResponseChannelMessageWithSource, discord.InteractionResponseDeferredChannelMessageWithSource:
+		m := s.newMessage(i.ChannelID, data)
+		m.WebhookID = i.AppID
+		m.Interaction = &discord.MessageInteraction{ID: i.ID, Type: i.Type, User: interactionUser(i)}
+		if i.Type == discord.InteractionApplicationCommand {
+			m.Interaction.Name = i.ApplicationCommandData().Name
+		}
+		if callback.Type == discord.InteractionResponseDeferredChannelMessageWithSource {
+			// "the bot is thinking" until the response is edited or the first followup is sent
+			m.Flags |= discord.MessageFlagsLoading
+		}
+		s.originals[token] = m
+	case discord.InteractionResponseUpdateMessage, discord.InteractionResponseDeferredMessageUpdate:
+		if i.Message != nil {
+			if m := s.message(i.ChannelID, i.Message.ID); m != nil && callback.Type == discord.InteractionResponseUpdateMessage {
+				s.applyEdit(m, data)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// interactionUser returns the user who invoked the interaction, in a guild or in DMs.
+func interactionUser(i *discord.Interaction) *discord.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+func (s *Server) followup(w http.ResponseWriter, r *http.Request, body []byte, token string) {
+	i, ok := s.interactions[token]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown Webhook")
+		return
+	}
+	data, err := decodeMessage(r, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// like on Discord, the first followup after a deferred response replaces the loading message,
+	// and it keeps the visibility of the deferred response, the flags of the followup are ignored
+	if original := s.originals[token]; original != nil && original.Flags&discord.MessageFlagsLoading != 0 {
+		original.Flags &^= discord.MessageFlagsLoading
+		s.applyEdit(original, data)
+		s.followups[token] = append(s.followups[token], original)
+		writeJSON(w, http.StatusOK, original)
+		return
+	}
+
+	m := s.newMessage(i.ChannelID, data)
+	m.WebhookID = i.AppID
+	m.Interaction = &discord.MessageInteraction{ID: i.ID, Type: i.Type, User: interactionUser(i)}
+	s.followups[token] = append(s.followups[token], m)
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (s *Server) editWebhookMessage(w http.ResponseWriter, r *http.Request, body []byte, token string, messageID string) {
+	if _, ok := s.interactions[token]; !ok {
+		writeError(w, http.StatusNotFound, "Unknown Webhook")
+		return
+	}
+	m := s.findMessage(messageID)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "Unknown Message")
+		return
+	}
+	data, err := decodeMessage(r, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.applyEdit(m, data)
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (s *Server) getMessageByID(w http.ResponseWriter, messageID string) {
+	m := s.findMessage(messageID)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "Unknown Message")
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// deleteOriginal deletes the original response, the next followup is a message of its own then.
+func (s *Server) deleteOriginal(w http.ResponseWriter, token string) {
+	original := s.originals[token]
+	if original == nil {
+		writeError(w, http.StatusNotFound, "Unknown Message")
+		return
+	}
+	delete(s.originals, token)
+	s.deleteMessage(w, original.ChannelID, original.ID)
+}
+
+func (s *Server) deleteMessageByID(w http.ResponseWriter, messageID string) {
+	m := s.findMessage(messageID)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "Unknown Message")
+		return
+	}
+	s.deleteMessage(w, m.ChannelID, m.ID)
+}
+
+func (s *Server) getChannel(w http.ResponseWriter, channelID string) {
+	ch, ok := s.channels[channelID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown Channel")
+		return
+	}
+	writeJSON(w, http.StatusOK, ch)
+}
+
+func (s *Server) editChannel(w http.ResponseWriter, body []byte, channelID string) {
+	ch, ok := s.channels[channelID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown Channel")
+		return
+	}
+	var edit discord.ChannelEdit
+	if err := json.Unmarshal(body, &edit); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if edit.Name != "" {
+		ch.Name = edit.Name
+	}
+	if edit.Topic != "" {
+		ch.Topic = edit.Topic
+	}
+	if edit.Locked != nil || edit.Archived != nil {
+		if ch.ThreadMetadata == nil {
+			ch.ThreadMetadata = &discord.ThreadMetadata{}
+		}
+		if edit.Locked != nil {
+			ch.ThreadMetadata.Locked = *edit.Locked
+		}
+		if edit.Archived != nil {
+			ch.ThreadMetadata.Archived = *edit.Archived
+		}
+	}
+
+	writeJSON(w, http.StatusOK, ch)
+	event := "CHANNEL_UPDATE"
+	if ch.IsThread() {
+		event = "THREAD_UPDATE"
+	}
+	s.dispatch(event, ch)
+}
+
+func (s *Server) getMessages(w http.ResponseWriter, r *http.Request, channelID string) {
+	if _, ok := s.channels[channelID]; !ok {
+		writeError(w, http.StatusNotFound, "Unknown Channel")
+		return
+	}
+	query := r.URL.Query()
+	limit := 50
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+	before, _ := strconv.ParseUint(query.Get("before"), 10, 64)
+	after, _ := strconv.ParseUint(query.Get("after"), 10, 64)
+
+	// newest first, like Discord
+	messages := make([]*discord.Message, 0, limit)
+	all := append([]*discord.Message(nil), s.messages[channelID]...)
+	sort.Slice(all, func(i, j int) bool { return snowflake(all[i].ID) > snowflake(all[j].ID) })
+	for _, m := range all {
+		id := snowflake(m.ID)
+		if (before != 0 && id >= before) || (after != 0 && id <= after) {
+			continue
+		}
+		messages = append(messages, m)
+		if len(messages) == limit {
+			break
+		}
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+func snowflake(id string) uint64 {
+	n, _ := strconv.ParseUint(id, 10, 64)
+	return n
+}
+
+func (s *Server) createMessage(w http.ResponseWriter, r *http.Request, body []byte, channelID string) {
+	if _, ok := s.channels[channelID]; !ok {
+		writeError(w, http.StatusNotFound, "Unknown Channel")
+		return
+	}
+	data, err := decodeMessage(r, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.newMessage(channelID, data))
+}
+
+func (s *Server) getMessage(w http.ResponseWriter, channelID string, messageID string) {
+	m := s.message(channelID, messageID)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "Unknown Message")
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (s *Server) editMessage(w http.ResponseWriter, r *http.Request, body []byte, channelID string, messageID string) {
+	m := s.message(channelID, messageID)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "Unknown Message")
+		return
+	}
+	data, err := decodeMessage(r, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.applyEdit(m, data)
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (s *Server) deleteMessage(w http.ResponseWriter, channelID string, messageID string) {
+	messages := s.messages[channelID]
+	for i, m := range messages {
+		if m.ID == messageID {
+			s.messages[channelID] = append(messages[:i:i], messages[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "Unknown Message")
+}
+
+func (s *Server) startThread(w http.ResponseWriter, body []byte, channelID string, messageID string) {
+	parent, ok := s.channels[channelID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown Channel")
+		return
+	}
+	m := s.message(channelID, messageID)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "Unknown Message")
+		return
+	}
+	var start discord.ThreadStart
+	if err := json.Unmarshal(body, &start); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// like on Discord, a thread started from a message has the ID of the message
+	thread := &discord.Channel{
+		ID:             m.ID,
+		GuildID:        parent.GuildID,
+		ParentID:       parent.ID,
+		OwnerID:        s.User.ID,
+		Name:           start.Name,
+		Type:           discord.ChannelTypeGuildPublicThread,
+		ThreadMetadata: &discord.ThreadMetadata{AutoArchiveDuration: start.AutoArchiveDuration},
+	}
+	s.channels[thread.ID] = thread
+	s.threads = append(s.threads, thread)
+	m.Thread = thread
+
+	writeJSON(w, http.StatusCreated, thread)
+	s.dispatch("THREAD_CREATE", thread)
+}
+
+func (s *Server) react(w http.ResponseWriter, channelID string, messageID string, emoji string, removed bool) {
+	m := s.message(channelID, messageID)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "Unknown Message")
+		return
+	}
+	// the reactions are kept on the message too, so the bot sees them when it reads the messages back
+	m.Reactions = withReaction(m.Reactions, emoji, removed)
+	s.reactions = append(s.reactions, Reaction{ChannelID: channelID, MessageID: messageID, Emoji: emoji, Removed: removed})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// withReaction returns the reactions of a message after the bot added the emoji, or removed it.
+func withReaction(reactions []*discord.MessageReactions, emoji string, removed bool) []*discord.MessageReactions {
+	var updated []*discord.MessageReactions
+	found := false
+	for _, r := range reactions {
+		if r.Emoji != nil && r.Emoji.Name == emoji {
+			found = true
+			if removed {
+				continue
+			}
+			if !r.Me {
+				r = &discord.MessageReactions{Count: r.Count + 1, Me: true, Emoji: r.Emoji}
+			}
+		}
+		updated = append(updated, r)
+	}
+	if !found && !removed {
+		updated = append(updated, &discord.MessageReactions{Count: 1, Me: true, Emoji: &discord.Emoji{Name: emoji}})
+	}
+	return updated
+}
+
+func (s *Server) createDM(w http.ResponseWriter, body []byte) {
+	var req struct {
+		RecipientID string `json:"recipient_id"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, ch := range s.channels {
+		if ch.Type == discord.ChannelTypeDM && len(ch.Recipients) == 1 && ch.Recipients[0].ID == req.RecipientID {
+			writeJSON(w, http.StatusOK, ch)
+			return
+		}
+	}
+	ch := &discord.Channel{
+		ID:         s.newID(),
+		Type:       discord.ChannelTypeDM,
+		Recipients: []*discord.User{{ID: req.RecipientID}},
+	}
+	s.channels[ch.ID] = ch
+	writeJSON(w, http.StatusOK, ch)
+}
@@ -0,0 +1,426 @@
+// Package discordtest provides an in-process fake of the Discord REST API and gateway for end-to-end tests.
+//
+// A Server keeps channels, messages and interactions in memory. Sessions created with Server.Session send all their
+// REST requests to it and connect to its gateway, through which the test injects events like InteractionCreate
+// and MessageCreate. Everything the bot does (messages sent and edited, threads created, reactions, interaction
+// responses) is recorded and can be checked afterwards. The events are handled asynchronously, like with the real
+// gateway, so tests wait for the outcome with WaitFor.
+//
+// The endpoint variables of discordgo are derived from each other when the package is initialized, so overriding
+// them doesn't redirect anything. Instead, the HTTP client of the session rewrites the host of every request.
+package discordtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	discord "github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+// apiPrefix is the path all REST endpoints of the Discord API share
+var apiPrefix = "/api/v" + discord.APIVersion + "/"
+
+// gatewayPath is the path of the gateway websocket
+const gatewayPath = "/gateway"
+
+// Request is a REST request the fake server received.
+type Request struct {
+	Method string
+	// Path relative to the API root, e.g. "channels/123/messages"
+	Path string
+	Body []byte
+}
+
+// Edit is a message edit made by the bot.
+type Edit struct {
+	ChannelID string
+	MessageID string
+	Content   string
+	Embeds    []*discord.MessageEmbed
+}
+
+// Reaction is a reaction the bot added to or removed from a message.
+type Reaction struct {
+	ChannelID string
+	MessageID string
+	Emoji     string
+	Removed   bool
+}
+
+// Server is the fake Discord API.
+type Server struct {
+	// User is the bot user, sent with the READY event
+	User *discord.User
+	// ApplicationID of the bot
+	ApplicationID string
+
+	t      testing.TB
+	server *httptest.Server
+
+	mu           sync.Mutex
+	nextID       uint64
+	channels     map[string]*discord.Channel
+	messages     map[string][]*discord.Message // keyed by channel ID, in the order they were created
+	interactions map[string]*discord.Interaction
+	originals    map[string]*discord.Message   // original interaction responses, keyed by interaction token
+	followups    map[string][]*discord.Message // followup messages, keyed by interaction token
+	files        map[string][]*discord.File    // uploaded files, keyed by message ID
+	responses    map[string][]*discord.InteractionResponse
+	requests     []Request
+	edits        []Edit
+	threads      []*discord.Channel
+	reactions    []Reaction
+	conns        []*gatewayConn
+	sequence     int64
+}
+
+// NewServer starts a fake Discord API, it is closed when the test finishes.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		t:            t,
+		nextID:       1100000000000000000,
+		channels:     make(map[string]*discord.Channel),
+		messages:     make(map[string][]*discord.Message),
+		interactions: make(map[string]*discord.Interaction),
+		originals:    make(map[string]*discord.Message),
+		followups:    make(map[string][]*discord.Message),
+		files:        make(map[string][]*discord.File),
+		responses:    make(map[string][]*discord.InteractionResponse),
+	}
+	s.User = &discord.User{ID: s.NewID(), Username: "bot", Discriminator: "0001", Bot: true}
+	s.ApplicationID = s.User.ID
+
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close disconnects the gateway connections and stops the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+	s.server.Close()
+}
+
+// NewID returns a new unique snowflake.
+func (s *Server) NewID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newID()
+}
+
+func (s *Server) newID() string {
+	s.nextID++
+	return strconv.FormatUint(s.nextID, 10)
+}
+
+// Session returns a session connected to the fake gateway, with all its REST requests sent to the fake server.
+// The session is closed when the test finishes. Handlers can be added before or after it is returned,
+// the READY event has been handled by then.
+func (s *Server) Session() *discord.Session {
+	session, err := discord.New("Bot test-token")
+	if err != nil {
+		s.t.Fatalf("discordtest: creating the session: %v", err)
+	}
+	session.Client = &http.Client{Transport: &rewriteTransport{target: s.server.URL}, Timeout: 10 * time.Second}
+	session.ShouldReconnectOnError = false
+	if err := session.Open(); err != nil {
+		s.t.Fatalf("discordtest: opening the session: %v", err)
+	}
+	s.t.Cleanup(func() { session.Close() })
+	return session
+}
+
+// rewriteTransport sends every request to the fake server, whatever host it was meant for.
+type rewriteTransport struct {
+	target string
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, err := req.URL.Parse(t.target)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+	req.Host = target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// AddGuild adds the guild with its channels and threads and sends GUILD_CREATE, so the state of the sessions knows them.
+func (s *Server) AddGuild(guild *discord.Guild) {
+	s.mu.Lock()
+	for _, ch := range append(append([]*discord.Channel(nil), guild.Channels...), guild.Threads...) {
+		ch.GuildID = guild.ID
+		s.channels[ch.ID] = copyChannel(ch)
+	}
+	s.mu.Unlock()
+
+	s.Dispatch("GUILD_CREATE", guild)
+}
+
+// AddChannel adds a channel or thread and sends CHANNEL_CREATE or THREAD_CREATE.
+func (s *Server) AddChannel(ch *discord.Channel) {
+	s.mu.Lock()
+	s.channels[ch.ID] = copyChannel(ch)
+	s.mu.Unlock()
+
+	if ch.IsThread() {
+		s.Dispatch("THREAD_CREATE", ch)
+	} else {
+		s.Dispatch("CHANNEL_CREATE", ch)
+	}
+}
+
+// AddMessage stores a message in its channel without sending an event, e.g. to seed the history of a thread.
+// The ID and the timestamp are set if they are empty.
+func (s *Server) AddMessage(m *discord.Message) *discord.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m = copyMessage(m)
+	s.addMessage(m)
+	return copyMessage(m)
+}
+
+func (s *Server) addMessage(m *discord.Message) {
+	if m.ID == "" {
+		m.ID = s.newID()
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now().UTC()
+	}
+	if ch, ok := s.channels[m.ChannelID]; ok && m.GuildID == "" {
+		m.GuildID = ch.GuildID
+	}
+	s.messages[m.ChannelID] = append(s.messages[m.ChannelID], m)
+}
+
+// SendMessage stores the message and sends MESSAGE_CREATE, as if a user posted it.
+func (s *Server) SendMessage(m *discord.Message) *discord.Message {
+	m = s.AddMessage(m)
+	s.Dispatch("MESSAGE_CREATE", m)
+	return m
+}
+
+// EditMessage changes the content of a stored message and sends MESSAGE_UPDATE, as if its author edited it.
+// It returns nil if there is no such message.
+func (s *Server) EditMessage(channelID string, messageID string, content string) *discord.Message {
+	s.mu.Lock()
+	m := s.message(channelID, messageID)
+	if m == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	m.Content = content
+	now := time.Now().UTC()
+	m.EditedTimestamp = &now
+	m = copyMessage(m)
+	s.mu.Unlock()
+
+	s.Dispatch("MESSAGE_UPDATE", m)
+	return m
+}
+
+// Interact sends INTERACTION_CREATE for the interaction, as if a user invoked a command. The ID, the token
+// and the application ID are set if they are empty.
+func (s *Server) Interact(i *discord.Interaction) *discord.Interaction {
+	s.mu.Lock()
+	if i.ID == "" {
+		i.ID = s.newID()
+	}
+	if i.Token == "" {
+		i.Token = "token-" + i.ID
+	}
+	if i.AppID == "" {
+		i.AppID = s.ApplicationID
+	}
+	s.interactions[i.Token] = i
+	s.mu.Unlock()
+
+	s.Dispatch("INTERACTION_CREATE", i)
+	return i
+}
+
+// Messages returns the messages of the channel, in the order they were created, with the edits applied.
+func (s *Server) Messages(channelID string) []*discord.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]*discord.Message, 0, len(s.messages[channelID]))
+	for _, m := range s.messages[channelID] {
+		messages = append(messages, copyMessage(m))
+	}
+	return messages
+}
+
+// Message returns a message by its ID, or nil if there is none.
+func (s *Server) Message(channelID string, messageID string) *discord.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyMessage(s.message(channelID, messageID))
+}
+
+func (s *Server) message(channelID string, messageID string) *discord.Message {
+	for _, m := range s.messages[channelID] {
+		if m.ID == messageID {
+			return m
+		}
+	}
+	return nil
+}
+
+// Channel returns a channel or thread by its ID, or nil if there is none.
+func (s *Server) Channel(channelID string) *discord.Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyChannel(s.channels[channelID])
+}
+
+// DMChannel returns the direct message channel the bot opened with the user, or nil if there is none.
+func (s *Server) DMChannel(userID string) *discord.Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.channels {
+		if ch.Type == discord.ChannelTypeDM && len(ch.Recipients) == 1 && ch.Recipients[0].ID == userID {
+			return copyChannel(ch)
+		}
+	}
+	return nil
+}
+
+// Threads returns the threads created by the bot, in the order they were created.
+func (s *Server) Threads() []*discord.Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	threads := make([]*discord.Channel, 0, len(s.threads))
+	for _, ch := range s.threads {
+		threads = append(threads, copyChannel(ch))
+	}
+	return threads
+}
+
+// Edits returns the message edits made by the bot, in the order they were made.
+func (s *Server) Edits() []Edit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Edit(nil), s.edits...)
+}
+
+// Reactions returns the reactions added and removed by the bot, in the order they were made.
+func (s *Server) Reactions() []Reaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Reaction(nil), s.reactions...)
+}
+
+// InteractionResponses returns the responses to the interaction, in the order they were sent.
+func (s *Server) InteractionResponses(i *discord.Interaction) []*discord.InteractionResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*discord.InteractionResponse(nil), s.responses[i.Token]...)
+}
+
+// Original returns the original response message of the interaction, or nil if there is none yet.
+func (s *Server) Original(i *discord.Interaction) *discord.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyMessage(s.originals[i.Token])
+}
+
+// Followups returns the followup messages of the interaction, in the order they were sent.
+func (s *Server) Followups(i *discord.Interaction) []*discord.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	followups := make([]*discord.Message, 0, len(s.followups[i.Token]))
+	for _, m := range s.followups[i.Token] {
+		followups = append(followups, copyMessage(m))
+	}
+	return followups
+}
+
+// copyMessage returns a copy of a stored message, which the bot may edit while the test looks at it.
+// The edits replace the fields, so a shallow copy is enough.
+func copyMessage(m *discord.Message) *discord.Message {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	return &c
+}
+
+// copyChannel returns a copy of a stored channel, which the bot may edit while the test looks at it.
+func copyChannel(ch *discord.Channel) *discord.Channel {
+	if ch == nil {
+		return nil
+	}
+	c := *ch
+	if ch.ThreadMetadata != nil {
+		metadata := *ch.ThreadMetadata
+		c.ThreadMetadata = &metadata
+	}
+	return &c
+}
+
+// Requests returns all the REST requests the server received.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// WaitFor waits until cond returns true, failing the test if it doesn't within a few seconds.
+func (s *Server) WaitFor(what string, cond func() bool) {
+	s.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			s.t.Fatalf("discordtest: timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// writeError writes a Discord API error.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{"code": 0, "message": message})
+}
+
+// serveHTTP routes the gateway connections and the REST requests.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, gatewayPath) {
+		s.serveGateway(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		writeError(w, http.StatusNotFound, "404: Not Found")
+		return
+	}
+	s.serveREST(w, r, strings.TrimPrefix(r.URL.Path, apiPrefix))
+}
+
+// websocketURL is the URL of the gateway, as returned by GET /gateway.
+func (s *Server) websocketURL() string {
+	return "ws" + strings.TrimPrefix(s.server.URL, "http") + gatewayPath
+}
+
+var upgrader = websocket.Upgrader{}
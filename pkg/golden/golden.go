@@ -0,0 +1,47 @@
+// Package golden compares test output with golden files kept in the testdata directory of the package under test.
+// Running the tests with -update rewrites the golden files with the current output instead, review the diff before committing it.
+package golden
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+// Assert compares got with the content of testdata/<name>.golden.
+func Assert(t testing.TB, name string, got []byte) {
+	t.Helper()
+	file := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("reading the golden file (run with -update to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (run with -update to accept it)\ngot:\n%s\nwant:\n%s", file, got, want)
+	}
+}
+
+// AssertJSON compares v, encoded as indented JSON, with the content of testdata/<name>.golden.
+func AssertJSON(t testing.TB, name string, v interface{}) {
+	t.Helper()
+	got, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, name, append(got, '\n'))
+}
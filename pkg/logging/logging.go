@@ -0,0 +1,106 @@
+// Package logging sets up the structured, leveled logger of the bot and provides helpers to keep user content,
+// like prompts and contexts, out of the logs unless debug logging is enabled.
+//
+// The same things are always logged under the same keys: guild_id, channel_id, thread_id, user_id, interaction_id,
+// message_id, command, correlation_id, model and error.
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Formats of the log output
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config holds the logging settings.
+type Config struct {
+	// Level is the minimum level logged: debug, info, warn or error. Prompts and other user content
+	// are only logged on the debug level.
+	Level string `yaml:"level"`
+	// Format of the output, text or json
+	Format string `yaml:"format"`
+}
+
+// Validate checks the level and the format.
+func (c Config) Validate() error {
+	if _, err := parseLevel(c.Level); err != nil {
+		return err
+	}
+	switch c.Format {
+	case "", FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, expected %s or %s", c.Format, FormatText, FormatJSON)
+}
+
+// level is shared by all handlers, so it can be changed when the configuration is reloaded
+var level = new(slog.LevelVar)
+
+// Setup replaces the default logger (which the log package writes to as well) with one configured by cfg.
+func Setup(cfg Config) error {
+	if err := SetLevel(cfg.Level); err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if cfg.Format == FormatJSON {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// SetLevel changes the minimum level logged. An empty level means info.
+func SetLevel(name string) error {
+	l, err := parseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+func parseLevel(name string) (slog.Level, error) {
+	var l slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+		return l, fmt.Errorf("unknown level %q, expected debug, info, warn or error", name)
+	}
+	return l, nil
+}
+
+// Debug reports whether debug logging is enabled.
+func Debug() bool {
+	return level.Level() <= slog.LevelDebug
+}
+
+// Content returns an attribute holding user content, like a prompt. The content itself is only logged
+// when debug logging is enabled, otherwise just its length.
+func Content(key string, content string) slog.Attr {
+	if Debug() {
+		return slog.String(key, content)
+	}
+	return slog.String(key, fmt.Sprintf("<redacted, %d characters>", len([]rune(content))))
+}
+
+// NewCorrelationID returns a random ID tying together the log lines of a single request.
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,68 @@
+package markdown
+
+import "strings"
+
+// CodeBlock is a fenced code block of a text.
+type CodeBlock struct {
+	// Start and End are the byte offsets of the block in the text, from the start of the opening fence line
+	// to the end of the closing fence line, including its newline
+	Start, End int
+	// Language is the first word of the info string, e.g. "go" for ```go
+	Language string
+	// Code is what is between the fences
+	Code string
+	// Lines is the number of lines of the code
+	Lines int
+}
+
+// CodeBlocks returns the fenced code blocks of the text, in order. A code block that is not closed, e.g. because
+// the answer of the model was cut off, goes on to the end of the text.
+func CodeBlocks(text string) []CodeBlock {
+	var blocks []CodeBlock
+	var open *fence
+	var block CodeBlock
+	var code strings.Builder
+	offset := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		start := offset
+		offset += len(line)
+		if open == nil {
+			if f := openingFence(line); f != nil {
+				open = f
+				block = CodeBlock{Start: start, Language: strings.ToLower(firstWord(f.info))}
+				code.Reset()
+			}
+			continue
+		}
+		if isClosingFence(line, open) {
+			block.End = offset
+			blocks = append(blocks, block.finish(code.String()))
+			open = nil
+			continue
+		}
+		code.WriteString(line)
+	}
+	if open != nil {
+		block.End = len(text)
+		blocks = append(blocks, block.finish(code.String()))
+	}
+	return blocks
+}
+
+// finish sets the code of the block and counts its lines.
+func (b CodeBlock) finish(code string) CodeBlock {
+	b.Code = code
+	b.Lines = strings.Count(code, "\n")
+	if code != "" && !strings.HasSuffix(code, "\n") {
+		b.Lines++
+	}
+	return b
+}
+
+// firstWord returns the text up to the first whitespace.
+func firstWord(s string) string {
+	if fields := strings.Fields(s); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
@@ -0,0 +1,305 @@
+// Package markdown splits Markdown answers of the model into Discord messages without breaking how they render,
+// and finds the code blocks in them.
+package markdown
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Ranks of the places a message can be split at, higher ones are preferred
+const (
+	rankNone = iota
+	rankWord
+	rankLine
+	rankParagraph
+)
+
+// Length returns the length of the text in the units Discord limits messages by, which are characters (Unicode code points),
+// not bytes. An emoji or a CJK character counts as one.
+func Length(text string) int {
+	return utf8.RuneCountInString(text)
+}
+
+// fence is an open fenced code block.
+type fence struct {
+	// marker is the opening fence, e.g. ``` or ~~~~
+	marker string
+	// info is the info string after the opening fence, e.g. "go"
+	info string
+}
+
+// reopen is the line that opens the code block again at the start of the next message.
+func (f *fence) reopen() string {
+	if f == nil {
+		return ""
+	}
+	return f.marker + f.info + "\n"
+}
+
+// close is the line that closes the code block at the end of a message, afterNewline tells whether the message already ends with a newline.
+func (f *fence) close(afterNewline bool) string {
+	if f == nil {
+		return ""
+	}
+	if afterNewline {
+		return f.marker
+	}
+	return "\n" + f.marker
+}
+
+// overhead is the most the code block adds to a message when it is split inside of it.
+func (f *fence) overhead() int {
+	return Length(f.reopen()) + Length(f.close(false))
+}
+
+// piece is a part of the text that is never split any further: a line, or a word or a part of a word of a line too long to fit in a message.
+type piece struct {
+	text   string
+	length int
+	// open is the code block that is open after the piece, it is closed and reopened when the text is split after the piece
+	open *fence
+	// rank tells how good a place to split at the end of the piece is
+	rank int
+}
+
+// chunk is a message, the prefix and suffix reopen and close a code block split between messages.
+type chunk struct {
+	prefix string
+	body   string
+	suffix string
+}
+
+func (c chunk) String() string {
+	return c.prefix + c.body + c.suffix
+}
+
+// Split splits the text into messages of at most limit characters (see Length).
+//
+// Whitespace, including newlines and indentation, is kept as it is. The text is split at paragraphs (blank lines) if possible,
+// else at line ends, else between words, and only words longer than a message are split in the middle. A message never
+// ends inside of a fenced code block: the block is closed at the end of the message and opened again, with the same fence
+// and language tag, at the start of the next one, so every message renders on its own. Messages with only whitespace are
+// left out, as Discord does not send them, but there is always at least one message.
+func Split(text string, limit int) []string {
+	if Length(text) <= limit {
+		return []string{text}
+	}
+
+	chunks := split(text, limit)
+	var messages []string
+	for _, c := range chunks {
+		if strings.TrimSpace(c.body) == "" {
+			continue
+		}
+		messages = append(messages, c.String())
+	}
+	if len(messages) == 0 {
+		return []string{chunks[0].String()}
+	}
+	return messages
+}
+
+// split packs the pieces of the text into chunks, the bodies of the chunks add up to the text.
+func split(text string, limit int) []chunk {
+	pieces := parse(text, limit)
+
+	var chunks []chunk
+	var open *fence
+	for i := 0; i < len(pieces); {
+		prefix := open.reopen()
+		length := Length(prefix)
+
+		// add pieces as long as they fit, every end of a piece is a place the chunk can end at
+		type cut struct {
+			end    int
+			length int
+			rank   int
+		}
+		var cuts []cut
+		j := i
+		for ; j < len(pieces); j++ {
+			p := pieces[j]
+			suffix := Length(p.open.close(strings.HasSuffix(p.text, "\n")))
+			if length+p.length+suffix > limit {
+				break
+			}
+			length += p.length
+			cuts = append(cuts, cut{end: j + 1, length: length + suffix, rank: p.rank})
+		}
+
+		end := j
+		if j < len(pieces) {
+			end = cuts[len(cuts)-1].end
+			// take the best place to split at that still fills at least half of the message,
+			// or the last one that is not in the middle of a word
+			found := false
+			for rank := rankParagraph; rank > rankNone && !found; rank-- {
+				for k := len(cuts) - 1; k >= 0 && cuts[k].length >= limit/2; k-- {
+					if cuts[k].rank >= rank {
+						end, found = cuts[k].end, true
+						break
+					}
+				}
+			}
+			for k := len(cuts) - 1; k >= 0 && !found; k-- {
+				if cuts[k].rank > rankNone {
+					end, found = cuts[k].end, true
+				}
+			}
+		}
+
+		var body strings.Builder
+		for _, p := range pieces[i:end] {
+			body.WriteString(p.text)
+		}
+		last := pieces[end-1]
+		chunks = append(chunks, chunk{
+			prefix: prefix,
+			body:   body.String(),
+			suffix: last.open.close(strings.HasSuffix(last.text, "\n")),
+		})
+		open = last.open
+		i = end
+	}
+	return chunks
+}
+
+// parse splits the text into lines, and lines too long to fit in a message into words and parts of words,
+// and finds out which code block is open after each of them.
+func parse(text string, limit int) []piece {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var pieces []piece
+	var open *fence
+	for n, line := range lines {
+		before := open
+		rank := rankLine
+		if !strings.HasSuffix(line, "\n") {
+			rank = rankNone
+		} else if strings.TrimSpace(line) == "" {
+			rank = rankParagraph
+		}
+
+		if open == nil {
+			if f := openingFence(line); f != nil && f.overhead() <= limit/4 {
+				open = f
+				// an empty code block is of no use at the end of a message
+				rank = rankNone
+			}
+		} else if isClosingFence(line, open) {
+			open = nil
+		}
+		if open != nil && n+1 < len(lines) && isClosingFence(lines[n+1], open) {
+			// neither at the start of the next one
+			rank = rankNone
+		}
+
+		// a line only has to be split if it does not fit in a message, with the code block it is in
+		max := limit
+		if before != nil {
+			max -= before.overhead()
+		} else if open != nil {
+			max -= Length(open.close(false))
+		}
+		if length := Length(line); length <= max {
+			pieces = append(pieces, piece{text: line, length: length, open: open, rank: rank})
+			continue
+		}
+		parts := splitLine(line, max)
+		for k, part := range parts {
+			p := piece{text: part, length: Length(part), open: before, rank: rankNone}
+			if strings.HasSuffix(part, " ") || strings.HasSuffix(part, "\t") {
+				p.rank = rankWord
+			}
+			if k == len(parts)-1 {
+				p.open, p.rank = open, rank
+			}
+			pieces = append(pieces, p)
+		}
+	}
+	return pieces
+}
+
+// splitLine splits a line into words, keeping the whitespace after each word with it, and words longer than max into parts of max characters.
+func splitLine(line string, max int) []string {
+	var parts []string
+	start := 0
+	for i, r := range line {
+		if i > start && (r != ' ' && r != '\t') {
+			if prev, _ := utf8.DecodeLastRuneInString(line[:i]); prev == ' ' || prev == '\t' {
+				parts = append(parts, line[start:i])
+				start = i
+			}
+		}
+	}
+	parts = append(parts, line[start:])
+
+	var fitting []string
+	for _, part := range parts {
+		start, n := 0, 0
+		for i := range part {
+			if n == max {
+				fitting = append(fitting, part[start:i])
+				start, n = i, 0
+			}
+			n++
+		}
+		fitting = append(fitting, part[start:])
+	}
+	return fitting
+}
+
+// openingFence returns the code block the line opens, if it is an opening code fence:
+// up to three spaces, at least three backticks or tildes and an optional info string.
+func openingFence(line string) *fence {
+	trimmed, ok := trimIndent(line)
+	if !ok {
+		return nil
+	}
+	marker := fenceMarker(trimmed)
+	if marker == "" {
+		return nil
+	}
+	info := strings.TrimSpace(trimmed[len(marker):])
+	if marker[0] == '`' && strings.Contains(info, "`") {
+		// backticks in the info string make it inline code
+		return nil
+	}
+	return &fence{marker: marker, info: info}
+}
+
+// isClosingFence tells whether the line closes the code block: a fence of the same character,
+// at least as long as the opening one, with nothing but whitespace after it.
+func isClosingFence(line string, f *fence) bool {
+	trimmed, ok := trimIndent(line)
+	if !ok {
+		return false
+	}
+	marker := fenceMarker(trimmed)
+	return marker != "" && marker[0] == f.marker[0] && len(marker) >= len(f.marker) && strings.TrimSpace(trimmed[len(marker):]) == ""
+}
+
+// trimIndent removes up to three spaces of indentation, more make the line an indented code block.
+func trimIndent(line string) (string, bool) {
+	trimmed := strings.TrimLeft(line, " ")
+	return trimmed, len(line)-len(trimmed) <= 3
+}
+
+// fenceMarker returns the run of at least three backticks or tildes the line starts with.
+func fenceMarker(line string) string {
+	if line == "" || (line[0] != '`' && line[0] != '~') {
+		return ""
+	}
+	n := 0
+	for n < len(line) && line[n] == line[0] {
+		n++
+	}
+	if n < 3 {
+		return ""
+	}
+	return line[:n]
+}
@@ -0,0 +1,98 @@
+package markdown
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/golden"
+)
+
+func TestSplit(t *testing.T) {
+	// small limits keep the inputs readable, the splitting works the same with 2000
+	tests := []struct {
+		name  string
+		limit int
+	}{
+		{name: "paragraphs", limit: 200},
+		{name: "code_block", limit: 150},
+		{name: "tilde_fence", limit: 120},
+		{name: "indentation", limit: 100},
+		{name: "long_word", limit: 200},
+		{name: "unicode", limit: 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input, err := os.ReadFile(filepath.Join("testdata", test.name+".md"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got strings.Builder
+			for i, message := range Split(string(input), test.limit) {
+				if Length(message) > test.limit {
+					t.Errorf("message %d is %d characters long, the limit is %d", i+1, Length(message), test.limit)
+				}
+				fmt.Fprintf(&got, "----- message %d (%d characters) -----\n%s\n", i+1, Length(message), message)
+			}
+			golden.Assert(t, "split_"+test.name, []byte(got.String()))
+		})
+	}
+}
+
+func TestSplitShortMessage(t *testing.T) {
+	message := "  short\n\n```go\nfmt.Println()\n"
+	if got := Split(message, 2000); len(got) != 1 || got[0] != message {
+		t.Errorf("Split(%q) = %q, want the message as it is", message, got)
+	}
+}
+
+func FuzzSplit(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.md"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		input, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(input), 100)
+	}
+	f.Add("```\n```\n```\n", 8)
+	f.Add("~~~ "+strings.Repeat(" ", 300)+"\ncode\n~~~\n", 50)
+
+	f.Fuzz(func(t *testing.T, text string, limit int) {
+		if limit < 1 || limit > 4000 {
+			t.Skip()
+		}
+
+		chunks := split(text, limit)
+		var bodies strings.Builder
+		for i, c := range chunks {
+			if Length(c.String()) > limit {
+				t.Fatalf("chunk %d is %d characters long, the limit is %d: %q", i, Length(c.String()), limit, c.String())
+			}
+			if c.body == "" {
+				t.Fatalf("chunk %d is empty", i)
+			}
+			bodies.WriteString(c.body)
+		}
+		if bodies.String() != text {
+			t.Fatalf("chunks add up to %q, want %q", bodies.String(), text)
+		}
+
+		messages := Split(text, limit)
+		if len(messages) == 0 {
+			t.Fatal("no messages")
+		}
+		for i, message := range messages {
+			if Length(message) > limit {
+				t.Fatalf("message %d is %d characters long, the limit is %d", i, Length(message), limit)
+			}
+		}
+	})
+}
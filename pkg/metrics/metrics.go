@@ -0,0 +1,171 @@
+// Package metrics holds the Prometheus metrics of the bot. They are registered with the default registry
+// and served on /metrics by the admin server, when it is enabled.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sashabaranov/go-openai"
+)
+
+// namespace prefixes the names of all the metrics
+const namespace = "discord_bot"
+
+// Names of the caches, used as the cache label
+const (
+	CacheMessages        = "messages"
+	CacheIgnoredChannels = "ignored_channels"
+)
+
+// Names of the OpenAI endpoints, used as the endpoint label
+const (
+	EndpointChatCompletion = "chat_completion"
+	EndpointCompletion     = "completion"
+	EndpointImage          = "image"
+	EndpointModeration     = "moderation"
+)
+
+var (
+	// Interactions counts the slash command invocations, by the full command name (e.g. "chat gpt")
+	Interactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interactions_total",
+		Help:      "Slash command invocations, by command.",
+	}, []string{"command"})
+
+	// Messages counts the thread messages that made it to a message handler, by command
+	Messages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "message_handler_invocations_total",
+		Help:      "Thread messages handled, by command.",
+	}, []string{"command"})
+
+	// OpenAIRequestDuration is the latency of the OpenAI requests, by endpoint and model
+	OpenAIRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "openai_request_duration_seconds",
+		Help:      "Latency of the OpenAI requests, by endpoint and model.",
+		Buckets:   []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 60, 120},
+	}, []string{"endpoint", "model"})
+
+	// OpenAIRequestErrors counts the failed OpenAI requests, by endpoint and model
+	OpenAIRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "openai_request_errors_total",
+		Help:      "Failed OpenAI requests, by endpoint and model.",
+	}, []string{"endpoint", "model"})
+
+	// OpenAITokens counts the tokens used, by model and type (prompt or completion)
+	OpenAITokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "openai_tokens_total",
+		Help:      "Tokens used, by model and type (prompt or completion).",
+	}, []string{"model", "type"})
+
+	// ImageGenerations counts the generated images, by size
+	ImageGenerations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "image_generations_total",
+		Help:      "Generated images, by size.",
+	}, []string{"size"})
+
+	// CacheLookups counts the cache lookups, by cache and result (hit or miss)
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Cache lookups, by cache and result (hit or miss).",
+	}, []string{"cache", "result"})
+
+	// DiscordAPIErrors counts the failed Discord REST requests, by method and status code
+	// (0 when no response was received)
+	DiscordAPIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "discord_api_errors_total",
+		Help:      "Failed Discord REST requests, by method and status code (0 when no response was received).",
+	}, []string{"method", "code"})
+
+	// ThreadLockFailures counts the threads that could not be locked or unlocked, by action (lock or unlock)
+	ThreadLockFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "thread_lock_failures_total",
+		Help:      "Threads that could not be locked or unlocked, by action.",
+	}, []string{"action"})
+)
+
+// lastOpenAIRequest is the outcome of the latest OpenAI request, for the readiness check
+var lastOpenAIRequest struct {
+	sync.RWMutex
+	at  time.Time
+	err error
+}
+
+// ObserveOpenAIRequest records the latency of an OpenAI request started at start, and counts it as failed if err is not nil.
+func ObserveOpenAIRequest(endpoint string, model string, start time.Time, err error) {
+	OpenAIRequestDuration.WithLabelValues(endpoint, model).Observe(time.Since(start).Seconds())
+	if err != nil {
+		OpenAIRequestErrors.WithLabelValues(endpoint, model).Inc()
+	}
+
+	lastOpenAIRequest.Lock()
+	lastOpenAIRequest.at, lastOpenAIRequest.err = time.Now(), err
+	lastOpenAIRequest.Unlock()
+}
+
+// LastOpenAIRequest returns when the latest OpenAI request finished and its error, at is zero if there was no request yet.
+func LastOpenAIRequest() (at time.Time, err error) {
+	lastOpenAIRequest.RLock()
+	defer lastOpenAIRequest.RUnlock()
+	return lastOpenAIRequest.at, lastOpenAIRequest.err
+}
+
+// AddOpenAITokens records the tokens used by an OpenAI request.
+func AddOpenAITokens(model string, usage openai.Usage) {
+	OpenAITokens.WithLabelValues(model, "prompt").Add(float64(usage.PromptTokens))
+	OpenAITokens.WithLabelValues(model, "completion").Add(float64(usage.CompletionTokens))
+}
+
+// CacheLookup records a lookup in the cache.
+func CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	CacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+// ThreadLockFailed records a failed attempt to lock or unlock a thread.
+func ThreadLockFailed(locked bool) {
+	action := "unlock"
+	if locked {
+		action = "lock"
+	}
+	ThreadLockFailures.WithLabelValues(action).Inc()
+}
+
+// DiscordTransport wraps the transport of the Discord REST client, counting the requests that fail
+// or get a 4xx/5xx response. A nil transport wraps http.DefaultTransport.
+func DiscordTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			DiscordAPIErrors.WithLabelValues(req.Method, "0").Inc()
+		} else if resp.StatusCode >= http.StatusBadRequest {
+			DiscordAPIErrors.WithLabelValues(req.Method, strconv.Itoa(resp.StatusCode)).Inc()
+		}
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
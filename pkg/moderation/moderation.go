@@ -0,0 +1,227 @@
+// Package moderation checks user input and model output against the OpenAI Moderation API and decides,
+// based on the policy of the guild, whether flagged content is blocked, let through with a warning or only logged.
+package moderation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/audit"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/metrics"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/session"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/tracing"
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Action is what happens with flagged content.
+type Action string
+
+const (
+	// ActionBlock stops flagged content from reaching the model or the channel
+	ActionBlock Action = "block"
+	// ActionWarn lets flagged content through, but warns the user
+	ActionWarn Action = "warn"
+	// ActionLog lets flagged content through and only reports it to the moderation log channel
+	ActionLog Action = "log"
+)
+
+// Categories are the moderation categories thresholds can be set for.
+var Categories = []string{"hate", "hate/threatening", "self-harm", "sexual", "sexual/minors", "violence", "violence/graphic"}
+
+// Policy decides what is flagged and what happens with it.
+type Policy struct {
+	// Action taken on flagged content, block by default
+	Action Action `yaml:"action"`
+	// Thresholds flag a category once its score reaches the threshold (0 to 1). Categories without
+	// a threshold are flagged when the Moderation API flags them.
+	Thresholds map[string]float64 `yaml:"thresholds"`
+	// LogChannel is the ID of the channel flagged content is reported to, nothing is reported when empty
+	LogChannel string `yaml:"logChannel"`
+}
+
+// Config holds the default policy and the policies of single guilds, which replace the default one.
+type Config struct {
+	Policy `yaml:",inline"`
+	Guilds map[string]Policy `yaml:"guilds"`
+}
+
+// PolicyFor returns the policy of the guild.
+func (c Config) PolicyFor(guildID string) Policy {
+	policy, ok := c.Guilds[guildID]
+	if !ok {
+		policy = c.Policy
+	}
+	if policy.Action == "" {
+		policy.Action = ActionBlock
+	}
+	return policy
+}
+
+// Validate checks the policies for unknown actions and categories and thresholds out of range.
+func (c Config) Validate() error {
+	errs := c.Policy.validate("")
+	for guild, policy := range c.Guilds {
+		errs = append(errs, policy.validate("guilds."+guild+".")...)
+	}
+	return errors.Join(errs...)
+}
+
+func (p Policy) validate(prefix string) (errs []error) {
+	switch p.Action {
+	case "", ActionBlock, ActionWarn, ActionLog:
+	default:
+		errs = append(errs, fmt.Errorf("%saction %q is unknown, expected %s, %s or %s", prefix, p.Action, ActionBlock, ActionWarn, ActionLog))
+	}
+	for category, threshold := range p.Thresholds {
+		if !isCategory(category) {
+			errs = append(errs, fmt.Errorf("%sthresholds contains unknown category %q", prefix, category))
+		} else if threshold < 0 || threshold > 1 {
+			errs = append(errs, fmt.Errorf("%sthresholds.%s is %g, must be between 0 and 1", prefix, category, threshold))
+		}
+	}
+	return errs
+}
+
+func isCategory(category string) bool {
+	for _, c := range Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Result is the outcome of a moderation check.
+type Result struct {
+	// Flagged is true if any category was flagged
+	Flagged bool
+	// Categories that were flagged, with their scores
+	Categories map[string]float32
+	// Action to take, as set in the policy of the guild
+	Action Action
+	// LogChannel flagged content should be reported to
+	LogChannel string
+}
+
+// FlaggedCategories returns the names of the flagged categories, sorted.
+func (r *Result) FlaggedCategories() []string {
+	categories := make([]string, 0, len(r.Categories))
+	for category := range r.Categories {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// Service moderates content with the OpenAI Moderation API.
+type Service struct {
+	client   *openai.Client
+	config   Config
+	auditLog *audit.Logger
+}
+
+// New creates a moderation service with the given policies. Flagged content and failed checks are recorded in the audit log.
+func New(client *openai.Client, config Config, auditLog *audit.Logger) *Service {
+	return &Service{client: client, config: config, auditLog: auditLog}
+}
+
+// Moderate checks the content of the item with the policy of its guild. Flagged content is reported to the moderation
+// log channel, and flagged content as well as failed checks are recorded in the audit log.
+func (s *Service) Moderate(ctx context.Context, sender session.MessageSender, item Item) (*Result, error) {
+	result, err := s.Check(ctx, item.GuildID, item.Content)
+	if err != nil {
+		s.auditLog.Emit(audit.Event{
+			Type:      audit.EventModerationFailed,
+			GuildID:   item.GuildID,
+			ChannelID: item.ChannelID,
+			UserID:    item.UserID,
+			Details:   map[string]string{"source": item.Source, "error": err.Error()},
+		})
+		return nil, err
+	}
+	if !result.Flagged {
+		return result, nil
+	}
+
+	item.Result = result
+	report(sender, item)
+	s.auditLog.Emit(audit.Event{
+		Type:      audit.EventModerationFlagged,
+		GuildID:   item.GuildID,
+		ChannelID: item.ChannelID,
+		UserID:    item.UserID,
+		Details: map[string]string{
+			"source":     item.Source,
+			"categories": strings.Join(result.FlaggedCategories(), ", "),
+			"action":     string(result.Action),
+		},
+	})
+	return result, nil
+}
+
+// Check moderates the input with the policy of the guild. Empty input is never flagged.
+func (s *Service) Check(ctx context.Context, guildID string, input string) (result *Result, err error) {
+	policy := s.config.PolicyFor(guildID)
+	result = &Result{Action: policy.Action, LogChannel: policy.LogChannel}
+	if input == "" {
+		return result, nil
+	}
+
+	ctx, span := tracing.Start(ctx, "openai.moderation")
+	defer func() {
+		if result != nil {
+			span.SetAttributes(attribute.Bool("moderation.flagged", result.Flagged))
+		}
+		tracing.End(span, err)
+	}()
+
+	start := time.Now()
+	resp, err := s.client.Moderations(ctx, openai.ModerationRequest{
+		Input: input,
+	})
+	metrics.ObserveOpenAIRequest(metrics.EndpointModeration, openai.ModerationTextLatest, start, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Results) == 0 {
+		return nil, fmt.Errorf("moderation API returned no results")
+	}
+
+	moderation := resp.Results[0]
+	flags := map[string]bool{
+		"hate":             moderation.Categories.Hate,
+		"hate/threatening": moderation.Categories.HateThreatening,
+		"self-harm":        moderation.Categories.SelfHarm,
+		"sexual":           moderation.Categories.Sexual,
+		"sexual/minors":    moderation.Categories.SexualMinors,
+		"violence":         moderation.Categories.Violence,
+		"violence/graphic": moderation.Categories.ViolenceGraphic,
+	}
+	scores := map[string]float32{
+		"hate":             moderation.CategoryScores.Hate,
+		"hate/threatening": moderation.CategoryScores.HateThreatening,
+		"self-harm":        moderation.CategoryScores.SelfHarm,
+		"sexual":           moderation.CategoryScores.Sexual,
+		"sexual/minors":    moderation.CategoryScores.SexualMinors,
+		"violence":         moderation.CategoryScores.Violence,
+		"violence/graphic": moderation.CategoryScores.ViolenceGraphic,
+	}
+
+	result.Categories = make(map[string]float32)
+	for _, category := range Categories {
+		flagged := flags[category]
+		if threshold, ok := policy.Thresholds[category]; ok {
+			flagged = float64(scores[category]) >= threshold
+		}
+		if flagged {
+			result.Categories[category] = scores[category]
+		}
+	}
+	result.Flagged = len(result.Categories) > 0
+	return result, nil
+}
@@ -0,0 +1,90 @@
+package moderation
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/session"
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// Sources of moderated content, shown in the reports
+const (
+	SourcePrompt        = "Prompt"
+	SourceContext       = "Context"
+	SourceContextFile   = "Context file"
+	SourceThreadMessage = "Thread message"
+	SourceOutput        = "Model output"
+	SourceImagePrompt   = "Image prompt"
+	SourceImport        = "Imported conversation"
+)
+
+// reportContentMaxLength is the limit of an embed field value
+const reportContentMaxLength = 1024
+
+// Item is flagged content reported to the moderation log channel.
+type Item struct {
+	GuildID   string
+	ChannelID string
+	// UserID of the user who sent the content, or asked for the model output
+	UserID string
+	// Source of the content, one of the Source constants
+	Source  string
+	Content string
+	// Result of the check, set when the item is reported
+	Result *Result
+}
+
+// report sends the flagged item to the moderation log channel of the guild, if there is one.
+func report(s session.MessageSender, item Item) {
+	if item.Result == nil || !item.Result.Flagged || item.Result.LogChannel == "" {
+		return
+	}
+
+	categories := make([]string, 0, len(item.Result.Categories))
+	for _, category := range item.Result.FlaggedCategories() {
+		categories = append(categories, fmt.Sprintf("%s (%.2f)", category, item.Result.Categories[category]))
+	}
+	content := item.Content
+	if runes := []rune(content); len(runes) > reportContentMaxLength {
+		content = string(runes[:reportContentMaxLength-3]) + "..."
+	}
+	color := 0xffa500
+	if item.Result.Action == ActionBlock {
+		color = 0xff0000
+	}
+
+	_, err := s.ChannelMessageSendComplex(item.Result.LogChannel, &discord.MessageSend{Embeds: []*discord.MessageEmbed{{
+		Title: "🚩 " + item.Source + " flagged",
+		Color: color,
+		Fields: []*discord.MessageEmbedField{
+			{Name: "User", Value: "<@" + item.UserID + ">", Inline: true},
+			{Name: "Channel", Value: "<#" + item.ChannelID + ">", Inline: true},
+			{Name: "Action", Value: string(item.Result.Action), Inline: true},
+			{Name: "Categories", Value: strings.Join(categories, ", ")},
+			{Name: "Content", Value: content},
+		},
+	}}})
+	if err != nil {
+		slog.Error("Failed to report flagged content to the moderation log channel", "guild_id", item.GuildID, "channel_id", item.ChannelID, "error", err)
+	}
+}
+
+// BlockedEmbed tells the user the content was blocked.
+func BlockedEmbed(source string) *discord.MessageEmbed {
+	return &discord.MessageEmbed{
+		Title:       "❌ Error",
+		Description: fmt.Sprintf("%s contains text that violates OpenAI's usage policies and is not allowed by their safety system", source),
+		Color:       0xff0000,
+	}
+}
+
+// WarningEmbed warns the user that the content was flagged, but let through.
+func WarningEmbed(source string) *discord.MessageEmbed {
+	return &discord.MessageEmbed{
+		Title:       "⚠️ Warning",
+		Description: fmt.Sprintf("%s was flagged as possibly violating OpenAI's usage policies", source),
+		Color:       0xffa500,
+	}
+}
@@ -0,0 +1,205 @@
+package openaitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// FlaggedMarker makes the default moderation flag the input for violence, so flagged content can be
+// tried out when running the bot against the fake API.
+const FlaggedMarker = "[flagged]"
+
+// embeddingDimensions is the length of the vectors of the default embeddings
+const embeddingDimensions = 8
+
+// Error is a response with an OpenAI API error, e.g. Error(http.StatusTooManyRequests, "rate_limit_exceeded", "Rate limit reached").
+func Error(status int, errType string, message string) Response {
+	return Response{
+		Status: status,
+		Body:   openai.ErrorResponse{Error: &openai.APIError{Type: errType, Message: message}},
+	}
+}
+
+// Disconnect is a response that closes the connection without answering.
+func Disconnect() Response {
+	return Response{Disconnect: true}
+}
+
+// ChatCompletion is a chat completion answering with the content.
+func ChatCompletion(content string, usage openai.Usage) Response {
+	return Response{Body: openai.ChatCompletionResponse{
+		ID:      "chatcmpl-fake",
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content},
+			FinishReason: openai.FinishReasonStop,
+		}},
+		Usage: usage,
+	}}
+}
+
+// Completion is a legacy completion answering with the text.
+func Completion(text string, usage openai.Usage) Response {
+	return Response{Body: openai.CompletionResponse{
+		ID:      "cmpl-fake",
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Choices: []openai.CompletionChoice{{Text: text, FinishReason: string(openai.FinishReasonStop)}},
+		Usage:   usage,
+	}}
+}
+
+// Images is an image generation with an image per URL.
+func Images(urls ...string) Response {
+	data := make([]openai.ImageResponseDataInner, 0, len(urls))
+	for _, url := range urls {
+		data = append(data, openai.ImageResponseDataInner{URL: url})
+	}
+	return Response{Body: openai.ImageResponse{Created: time.Now().Unix(), Data: data}}
+}
+
+// Moderation is a moderation result flagging the categories (e.g. "violence") with the given score,
+// it is flagged if there are any.
+func Moderation(score float32, categories ...string) Response {
+	flags := make(map[string]bool)
+	scores := make(map[string]float32)
+	for _, category := range categories {
+		flags[category] = true
+		scores[category] = score
+	}
+	return Response{Body: map[string]interface{}{
+		"id":    "modr-fake",
+		"model": openai.ModerationTextLatest,
+		"results": []map[string]interface{}{{
+			"flagged":         len(categories) > 0,
+			"categories":      flags,
+			"category_scores": scores,
+		}},
+	}}
+}
+
+// Embeddings is an embeddings response with a vector per input.
+func Embeddings(vectors ...[]float32) Response {
+	data := make([]openai.Embedding, 0, len(vectors))
+	for i, vector := range vectors {
+		data = append(data, openai.Embedding{Object: "embedding", Embedding: vector, Index: i})
+	}
+	return Response{Body: openai.EmbeddingResponse{Object: "list", Data: data, Model: openai.AdaEmbeddingV2}}
+}
+
+// countWords stands in for the tokenizer, the default responses count the tokens as words.
+func countWords(text string) int {
+	return len(strings.Fields(text))
+}
+
+// defaultChatCompletion echoes the last message.
+func defaultChatCompletion(req Request) Response {
+	var chatReq openai.ChatCompletionRequest
+	if err := req.Decode(&chatReq); err != nil || len(chatReq.Messages) == 0 {
+		return Error(http.StatusBadRequest, "invalid_request_error", "messages must not be empty")
+	}
+
+	var promptTokens int
+	for _, m := range chatReq.Messages {
+		promptTokens += countWords(m.Content)
+	}
+	content := "You said: " + chatReq.Messages[len(chatReq.Messages)-1].Content
+	resp := ChatCompletion(content, usage(promptTokens, countWords(content)))
+	completion := resp.Body.(openai.ChatCompletionResponse)
+	completion.Model = chatReq.Model
+	resp.Body = completion
+	return resp
+}
+
+// defaultCompletion answers with the first words of the prompt, which makes a fine thread title.
+func defaultCompletion(req Request) Response {
+	var completionReq struct {
+		Model  string `json:"model"`
+		Prompt string `json:"prompt"`
+	}
+	if err := req.Decode(&completionReq); err != nil {
+		return Error(http.StatusBadRequest, "invalid_request_error", err.Error())
+	}
+
+	words := strings.Fields(completionReq.Prompt)
+	if len(words) > 5 {
+		words = words[:5]
+	}
+	text := strings.Join(words, " ")
+	resp := Completion(text, usage(countWords(completionReq.Prompt), len(words)))
+	completion := resp.Body.(openai.CompletionResponse)
+	completion.Model = completionReq.Model
+	resp.Body = completion
+	return resp
+}
+
+// defaultImages generates as many placeholder images as requested.
+func defaultImages(req Request) Response {
+	var imageReq openai.ImageRequest
+	if err := req.Decode(&imageReq); err != nil {
+		return Error(http.StatusBadRequest, "invalid_request_error", err.Error())
+	}
+	n := imageReq.N
+	if n == 0 {
+		n = 1
+	}
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("https://images.openaitest.invalid/%d.png", i+1)
+	}
+	return Images(urls...)
+}
+
+// defaultModeration flags input containing FlaggedMarker for violence, nothing else.
+func defaultModeration(req Request) Response {
+	var moderationReq openai.ModerationRequest
+	if err := req.Decode(&moderationReq); err != nil {
+		return Error(http.StatusBadRequest, "invalid_request_error", err.Error())
+	}
+	if strings.Contains(moderationReq.Input, FlaggedMarker) {
+		return Moderation(0.99, "violence")
+	}
+	return Moderation(0)
+}
+
+// defaultEmbeddings derives a vector from the hash of each input, so the same input always gets the same vector.
+func defaultEmbeddings(req Request) Response {
+	var embeddingReq struct {
+		Input json.RawMessage `json:"input"`
+	}
+	if err := req.Decode(&embeddingReq); err != nil {
+		return Error(http.StatusBadRequest, "invalid_request_error", err.Error())
+	}
+	var inputs []string
+	if err := json.Unmarshal(embeddingReq.Input, &inputs); err != nil {
+		var input string
+		if err := json.Unmarshal(embeddingReq.Input, &input); err != nil {
+			return Error(http.StatusBadRequest, "invalid_request_error", "input must be a string or an array of strings")
+		}
+		inputs = []string{input}
+	}
+
+	vectors := make([][]float32, 0, len(inputs))
+	for _, input := range inputs {
+		h := fnv.New64a()
+		h.Write([]byte(input))
+		seed := h.Sum64()
+		vector := make([]float32, embeddingDimensions)
+		for i := range vector {
+			vector[i] = float32((seed>>(i*8))&0xff)/127.5 - 1
+		}
+		vectors = append(vectors, vector)
+	}
+	return Embeddings(vectors...)
+}
+
+func usage(prompt int, completion int) openai.Usage {
+	return openai.Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion}
+}
@@ -0,0 +1,270 @@
+// Package openaitest provides a fake of the OpenAI API for tests and for running the bot locally without an API key.
+//
+// The server answers chat completions (streamed or not), legacy completions, image generations, moderations and
+// embeddings with deterministic default responses. Tests script the responses they need with Respond (consumed in
+// order) or HandleFunc, inject errors, dropped connections and latency, and check the requests the bot made.
+package openaitest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Endpoints of the fake API, relative to its base URL
+const (
+	EndpointChatCompletions = "/chat/completions"
+	EndpointCompletions     = "/completions"
+	EndpointImages          = "/images/generations"
+	EndpointModerations     = "/moderations"
+	EndpointEmbeddings      = "/embeddings"
+)
+
+// basePath is the path the API is served under, like https://api.openai.com/v1
+const basePath = "/v1"
+
+// Request is a request the fake server received.
+type Request struct {
+	// Endpoint the request was made to, e.g. EndpointChatCompletions
+	Endpoint string
+	Header   http.Header
+	Body     []byte
+}
+
+// Decode decodes the JSON body of the request, e.g. into an openai.ChatCompletionRequest.
+func (r Request) Decode(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// Response is a scripted response of the fake server.
+type Response struct {
+	// Status of the response, 200 OK when zero
+	Status int
+	// Body is encoded as JSON
+	Body interface{}
+	// Chunks are the content deltas of a streamed chat completion. When empty, the content of a
+	// ChatCompletionResponse body is streamed word by word.
+	Chunks []string
+	// Delay is waited before responding, on top of the latency of the server
+	Delay time.Duration
+	// Disconnect closes the connection without responding
+	Disconnect bool
+}
+
+// Handler computes the response to a request.
+type Handler func(req Request) Response
+
+// Server is the fake OpenAI API.
+type Server struct {
+	// URL is the base URL of the API, to be used as the BaseURL of the client. It is only set by NewServer.
+	URL string
+
+	mu       sync.Mutex
+	latency  time.Duration
+	queued   map[string][]Response
+	handlers map[string]Handler
+	requests []Request
+}
+
+// New creates a fake API with the default responses, to be served with its ServeHTTP method.
+// Tests use NewServer instead.
+func New() *Server {
+	return &Server{
+		queued: make(map[string][]Response),
+		handlers: map[string]Handler{
+			EndpointChatCompletions: defaultChatCompletion,
+			EndpointCompletions:     defaultCompletion,
+			EndpointImages:          defaultImages,
+			EndpointModerations:     defaultModeration,
+			EndpointEmbeddings:      defaultEmbeddings,
+		},
+	}
+}
+
+// NewServer starts a fake API, it is closed when the test finishes.
+func NewServer(t testing.TB) *Server {
+	s := New()
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	s.URL = server.URL + basePath
+	return s
+}
+
+// Client returns an OpenAI client talking to the server started with NewServer.
+func (s *Server) Client() *openai.Client {
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = s.URL
+	return openai.NewClientWithConfig(config)
+}
+
+// Respond queues responses for the endpoint. They are used one per request, in order, before the handler
+// of the endpoint takes over again.
+func (s *Server) Respond(endpoint string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued[endpoint] = append(s.queued[endpoint], responses...)
+}
+
+// HandleFunc replaces the handler of the endpoint, which answers the requests no response is queued for.
+func (s *Server) HandleFunc(endpoint string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[endpoint] = handler
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Requests returns the requests made to the endpoint, or to all endpoints if it is empty, in the order they were received.
+func (s *Server) Requests(endpoint string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var requests []Request
+	for _, req := range s.requests {
+		if endpoint == "" || req.Endpoint == endpoint {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+// ChatCompletionRequests returns the decoded chat completion requests, in the order they were received.
+func (s *Server) ChatCompletionRequests() []openai.ChatCompletionRequest {
+	var requests []openai.ChatCompletionRequest
+	for _, req := range s.Requests(EndpointChatCompletions) {
+		var chatReq openai.ChatCompletionRequest
+		req.Decode(&chatReq)
+		requests = append(requests, chatReq)
+	}
+	return requests
+}
+
+// ServeHTTP answers a request with the next queued response of its endpoint or with the handler of the endpoint.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	endpoint := strings.TrimPrefix(r.URL.Path, basePath)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, Error(http.StatusBadRequest, "invalid_request_error", err.Error()))
+		return
+	}
+	req := Request{Endpoint: endpoint, Header: r.Header.Clone(), Body: body}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	latency := s.latency
+	var resp Response
+	if queued := s.queued[endpoint]; len(queued) > 0 {
+		resp, s.queued[endpoint] = queued[0], queued[1:]
+	} else if handler, ok := s.handlers[endpoint]; ok {
+		s.mu.Unlock()
+		resp = handler(req)
+		s.mu.Lock()
+	} else {
+		resp = Error(http.StatusNotFound, "invalid_request_error", "Unknown endpoint "+r.Method+" "+r.URL.Path)
+	}
+	s.mu.Unlock()
+
+	if delay := latency + resp.Delay; delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if resp.Disconnect {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	var stream struct {
+		Stream bool `json:"stream"`
+	}
+	json.Unmarshal(body, &stream)
+	if endpoint == EndpointChatCompletions && stream.Stream && (resp.Status == 0 || resp.Status == http.StatusOK) {
+		writeStream(w, resp)
+		return
+	}
+	writeResponse(w, resp)
+}
+
+// writeResponse writes the response as JSON.
+func writeResponse(w http.ResponseWriter, resp Response) {
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp.Body)
+}
+
+// writeStream writes a chat completion as server-sent events, one chunk per content delta.
+func writeStream(w http.ResponseWriter, resp Response) {
+	chunks := resp.Chunks
+	model := ""
+	if completion, ok := resp.Body.(openai.ChatCompletionResponse); ok {
+		model = completion.Model
+		if len(chunks) == 0 && len(completion.Choices) > 0 {
+			chunks = splitWords(completion.Choices[0].Message.Content)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	send := func(delta openai.ChatCompletionStreamChoiceDelta, finishReason openai.FinishReason) {
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(openai.ChatCompletionStreamResponse{
+			ID:      "chatcmpl-fake",
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   model,
+			Choices: []openai.ChatCompletionStreamChoice{{Delta: delta, FinishReason: finishReason}},
+		})
+		w.Write([]byte("data: " + strings.TrimSpace(buf.String()) + "\n\n"))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	send(openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant}, "")
+	for _, chunk := range chunks {
+		send(openai.ChatCompletionStreamChoiceDelta{Content: chunk}, "")
+	}
+	send(openai.ChatCompletionStreamChoiceDelta{}, openai.FinishReasonStop)
+	w.Write([]byte("data: [DONE]\n\n"))
+}
+
+// splitWords splits the text in chunks of one word each, keeping the whitespace, so the chunks add up to the text.
+func splitWords(text string) []string {
+	var chunks []string
+	start := 0
+	for i := 1; i < len(text); i++ {
+		if text[i] == ' ' && text[i-1] != ' ' {
+			chunks = append(chunks, text[start:i])
+			start = i
+		}
+	}
+	if start < len(text) {
+		chunks = append(chunks, text[start:])
+	}
+	return chunks
+}
@@ -0,0 +1,136 @@
+package openaitest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/openaitest"
+	"github.com/sashabaranov/go-openai"
+)
+
+func chatRequest(content string) openai.ChatCompletionRequest {
+	return openai.ChatCompletionRequest{
+		Model:    openai.GPT3Dot5Turbo,
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: content}},
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	server := openaitest.NewServer(t)
+	server.Respond(openaitest.EndpointChatCompletions, openaitest.Response{Chunks: []string{"Hello", " there", "!"}})
+
+	stream, err := server.Client().CreateChatCompletionStream(context.Background(), chatRequest("Hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	var content strings.Builder
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content.WriteString(resp.Choices[0].Delta.Content)
+	}
+	if content.String() != "Hello there!" {
+		t.Errorf("streamed content = %q, want %q", content.String(), "Hello there!")
+	}
+
+	// the default handler is streamed word by word
+	stream, err = server.Client().CreateChatCompletionStream(context.Background(), chatRequest("How are you?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	content.Reset()
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content.WriteString(resp.Choices[0].Delta.Content)
+	}
+	if content.String() != "You said: How are you?" {
+		t.Errorf("streamed content = %q, want the echo", content.String())
+	}
+}
+
+func TestRespondErrors(t *testing.T) {
+	server := openaitest.NewServer(t)
+	server.Respond(openaitest.EndpointChatCompletions,
+		openaitest.Error(http.StatusTooManyRequests, "rate_limit_exceeded", "Rate limit reached"),
+		openaitest.Disconnect(),
+	)
+	client := server.Client()
+
+	_, err := client.CreateChatCompletion(context.Background(), chatRequest("Hi"))
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusTooManyRequests || apiErr.Type != "rate_limit_exceeded" {
+		t.Errorf("got error %v, want the rate limit error", err)
+	}
+
+	if _, err := client.CreateChatCompletion(context.Background(), chatRequest("Hi")); err == nil {
+		t.Error("got no error, want the dropped connection")
+	}
+
+	// the queue is empty, the default handler answers again
+	resp, err := client.CreateChatCompletion(context.Background(), chatRequest("Hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Choices[0].Message.Content != "You said: Hi" {
+		t.Errorf("answer = %q, want the echo", resp.Choices[0].Message.Content)
+	}
+	if requests := server.ChatCompletionRequests(); len(requests) != 3 {
+		t.Errorf("got %d recorded requests, want 3", len(requests))
+	}
+}
+
+func TestLatency(t *testing.T) {
+	server := openaitest.NewServer(t)
+	server.SetLatency(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := server.Client().CreateChatCompletion(ctx, chatRequest("Hi")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want the deadline to be exceeded", err)
+	}
+}
+
+func TestModerationAndEmbeddings(t *testing.T) {
+	server := openaitest.NewServer(t)
+	client := server.Client()
+
+	moderation, err := client.Moderations(context.Background(), openai.ModerationRequest{Input: "a fight " + openaitest.FlaggedMarker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := moderation.Results[0]; !result.Flagged || !result.Categories.Violence {
+		t.Errorf("moderation result = %+v, want flagged for violence", result)
+	}
+
+	request := openai.EmbeddingRequest{Input: []string{"a", "b", "a"}, Model: openai.AdaEmbeddingV2}
+	embeddings, err := client.CreateEmbeddings(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors := embeddings.Data
+	if len(vectors) != 3 || len(vectors[0].Embedding) == 0 {
+		t.Fatalf("got %d embeddings, want 3", len(vectors))
+	}
+	if vectors[0].Embedding[0] != vectors[2].Embedding[0] || vectors[0].Embedding[0] == vectors[1].Embedding[0] {
+		t.Errorf("embeddings are not derived from the input: %v", vectors)
+	}
+}
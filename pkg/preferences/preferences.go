@@ -0,0 +1,84 @@
+// Package preferences keeps the settings users choose for themselves, like the mode answers are posted in.
+package preferences
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/render"
+)
+
+// Preferences are the settings of a user, settings that are not set fall back to the configuration of the guild.
+type Preferences struct {
+	// RenderMode is the mode the answers for the user are posted in
+	RenderMode render.Mode `json:"renderMode,omitempty"`
+}
+
+// Store holds the preferences of all users, keyed by user ID. It is safe for concurrent use.
+type Store struct {
+	mu    sync.RWMutex
+	file  string
+	users map[string]Preferences
+}
+
+// Open loads the preferences from the given file. A missing file means no preferences, it is created on the first change.
+func Open(file string) (*Store, error) {
+	s := &Store{file: file, users: make(map[string]Preferences)}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	return s, nil
+}
+
+// Get returns the preferences of the user, the zero value if the user did not choose any.
+func (s *Store) Get(userID string) Preferences {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.users[userID]
+}
+
+// Set replaces the preferences of the user, users without any settings are removed from the file.
+func (s *Store) Set(userID string, preferences Preferences) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if preferences == (Preferences{}) {
+		delete(s.users, userID)
+	} else {
+		s.users[userID] = preferences
+	}
+	return s.saveLocked()
+}
+
+// saveLocked writes the preferences to a temporary file and renames it over the store file, so a crash
+// never leaves a half written file behind. The caller must hold s.mu.
+func (s *Store) saveLocked() error {
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), filepath.Base(s.file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
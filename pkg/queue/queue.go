@@ -0,0 +1,262 @@
+// Package queue provides a bounded job queue with a fixed number of workers, used to run OpenAI requests
+// outside of the discordgo event goroutines and to keep the number of concurrent requests under control.
+package queue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrQueueFull is returned when a job is submitted to a queue that has no room left.
+var ErrQueueFull = errors.New("the request queue is full, please try again later")
+
+// ErrClosed is returned when a job is submitted to a closed queue.
+var ErrClosed = errors.New("the request queue is closed")
+
+// Priority decides the order jobs are taken from the queue in. Jobs with a higher priority go first,
+// jobs with the same priority are taken in the order they were submitted.
+type Priority int
+
+const (
+	// PriorityLow is used for replies in threads
+	PriorityLow Priority = iota
+	// PriorityHigh is used for slash commands, where Discord expects an answer within 15 minutes
+	PriorityHigh
+)
+
+// Job is a unit of work run by the queue.
+type Job struct {
+	// Priority of the job
+	Priority Priority
+	// Model the job talks to, jobs for models with a concurrency limit wait until a slot frees up
+	Model string
+	// Key groups jobs that are cancelled together with Cancel, e.g. the ID of the thread the job answers in
+	Key string
+	// Run does the actual work, ctx is cancelled if the job gets cancelled
+	Run func(ctx context.Context)
+	// Queued, if set, is called when the job can't start right away, with its position in the queue (starting at 1)
+	Queued func(position int)
+
+	seq     uint64
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started chan struct{}
+	done    chan struct{}
+}
+
+// Pool runs the submitted jobs on a fixed number of workers.
+type Pool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	size        int
+	modelLimits map[string]int
+	running     map[string]int // model -> jobs running
+	idle        int
+	seq         uint64
+	closed      bool
+
+	queue  []*Job
+	active map[*Job]struct{}
+	wg     sync.WaitGroup
+}
+
+// New starts a pool with the given number of workers. At most size jobs wait in the queue (0 means no limit)
+// and at most modelLimits[model] jobs for a model run at the same time (models that are not listed have no limit).
+func New(workers int, size int, modelLimits map[string]int) *Pool {
+	p := &Pool{
+		size:        size,
+		modelLimits: modelLimits,
+		running:     make(map[string]int),
+		active:      make(map[*Job]struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Do submits the job and blocks until it is finished. It returns ctx.Err() (or context.Canceled, if the job
+// was cancelled with Cancel) when the job was dropped before it could start, ErrQueueFull when the queue has no room left,
+// and ErrClosed when the pool is closed.
+func (p *Pool) Do(ctx context.Context, job *Job) error {
+	job.ctx, job.cancel = context.WithCancel(ctx)
+	defer job.cancel()
+	job.started = make(chan struct{})
+	job.done = make(chan struct{})
+
+	position, err := p.submit(job)
+	if err != nil {
+		return err
+	}
+	if position > 0 && job.Queued != nil {
+		job.Queued(position)
+	}
+
+	select {
+	case <-job.started:
+		<-job.done
+		return nil
+	case <-job.ctx.Done():
+	}
+
+	// the job was cancelled while waiting, drop it unless a worker picked it up in the meantime
+	p.mu.Lock()
+	removed := p.remove(job)
+	p.mu.Unlock()
+	if !removed {
+		<-job.done
+		return nil
+	}
+	return job.ctx.Err()
+}
+
+// submit adds the job to the queue and returns its position, or 0 if a worker is free to pick it up right away.
+func (p *Pool) submit(job *Job) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, ErrClosed
+	}
+	if p.size > 0 && len(p.queue) >= p.size {
+		return 0, ErrQueueFull
+	}
+
+	p.seq++
+	job.seq = p.seq
+	p.queue = append(p.queue, job)
+	sort.SliceStable(p.queue, func(i, j int) bool {
+		if p.queue[i].Priority != p.queue[j].Priority {
+			return p.queue[i].Priority > p.queue[j].Priority
+		}
+		return p.queue[i].seq < p.queue[j].seq
+	})
+	p.cond.Signal()
+
+	position := 0
+	if p.idle == 0 || !p.hasCapacity(job.Model) {
+		for i, queued := range p.queue {
+			if queued == job {
+				position = i + 1
+				break
+			}
+		}
+	}
+	return position, nil
+}
+
+// Cancel cancels all the queued and running jobs submitted with the given key.
+func (p *Pool) Cancel(key string) {
+	if key == "" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, job := range p.queue {
+		if job.Key == key {
+			job.cancel()
+		}
+	}
+	for job := range p.active {
+		if job.Key == key {
+			job.cancel()
+		}
+	}
+}
+
+// Len returns the number of jobs waiting in the queue.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// Close stops the workers once the running jobs finish. Jobs still waiting in the queue are cancelled.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	for _, job := range p.queue {
+		job.cancel()
+	}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// worker takes jobs from the queue and runs them until the pool is closed.
+func (p *Pool) worker() {
+	defer p.wg.Done()
+
+	for {
+		job := p.next()
+		if job == nil {
+			return
+		}
+
+		close(job.started)
+		job.Run(job.ctx)
+		close(job.done)
+
+		p.mu.Lock()
+		p.running[job.Model]--
+		delete(p.active, job)
+		// a model slot was freed, wake up the workers waiting for it
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+// next blocks until there is a job that can run and takes it from the queue. It returns nil once the pool is closed.
+func (p *Pool) next() *Job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.closed {
+			return nil
+		}
+		for i, job := range p.queue {
+			if job.ctx.Err() != nil {
+				// the job was cancelled, Do takes it out of the queue
+				continue
+			}
+			if !p.hasCapacity(job.Model) {
+				continue
+			}
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			p.running[job.Model]++
+			p.active[job] = struct{}{}
+			return job
+		}
+
+		p.idle++
+		p.cond.Wait()
+		p.idle--
+	}
+}
+
+// hasCapacity reports whether another job for the model can run. The caller must hold p.mu.
+func (p *Pool) hasCapacity(model string) bool {
+	limit, ok := p.modelLimits[model]
+	return !ok || p.running[model] < limit
+}
+
+// remove drops the job from the queue and reports whether it was still there. The caller must hold p.mu.
+func (p *Pool) remove(job *Job) bool {
+	for i, queued := range p.queue {
+		if queued == job {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,311 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blocker is a job that runs until it is released.
+type blocker struct {
+	started  chan struct{}
+	released chan struct{}
+}
+
+func newBlocker() *blocker {
+	return &blocker{started: make(chan struct{}), released: make(chan struct{})}
+}
+
+func (b *blocker) run(ctx context.Context) {
+	close(b.started)
+	<-b.released
+}
+
+// start submits a job that keeps a worker busy until it is released, and waits until it runs.
+func (b *blocker) start(t *testing.T, p *Pool, model string) <-chan error {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() { errs <- p.Do(context.Background(), &Job{Model: model, Run: b.run}) }()
+	select {
+	case <-b.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocking job didn't start")
+	}
+	return errs
+}
+
+// waitForLen waits until n jobs wait in the queue.
+func waitForLen(t *testing.T, p *Pool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d jobs in the queue, want %d", p.Len(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForIdle waits until n workers wait for jobs.
+func waitForIdle(t *testing.T, p *Pool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		idle := p.idle
+		p.mu.Unlock()
+		if idle == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d workers are idle, want %d", idle, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// result is what a submitted job reports back.
+type result struct {
+	position int
+	err      error
+}
+
+// submit submits a job in the background, the job is queued when submit returns. The names of the jobs that ran are sent to ran.
+func submit(t *testing.T, p *Pool, job *Job, name string, ran chan<- string) <-chan result {
+	t.Helper()
+	queued := p.Len()
+	results := make(chan result, 1)
+	position := 0
+	job.Queued = func(p int) { position = p }
+	if job.Run == nil {
+		job.Run = func(ctx context.Context) { ran <- name }
+	}
+	go func() {
+		err := p.Do(context.Background(), job)
+		results <- result{position: position, err: err}
+	}()
+	waitForLen(t, p, queued+1)
+	return results
+}
+
+func TestPriorityOrder(t *testing.T) {
+	p := New(1, 0, nil)
+	defer p.Close()
+	b := newBlocker()
+	b.start(t, p, "")
+
+	ran := make(chan string, 3)
+	low1 := submit(t, p, &Job{Priority: PriorityLow}, "low 1", ran)
+	low2 := submit(t, p, &Job{Priority: PriorityLow}, "low 2", ran)
+	high := submit(t, p, &Job{Priority: PriorityHigh}, "high", ran)
+	close(b.released)
+
+	var order []string
+	for i := 0; i < 3; i++ {
+		order = append(order, <-ran)
+	}
+	if fmt.Sprint(order) != fmt.Sprint([]string{"high", "low 1", "low 2"}) {
+		t.Errorf("jobs ran in the order %q, want the high priority one first", order)
+	}
+
+	// the positions are the ones at the time the jobs were submitted
+	for name, want := range map[string]struct {
+		results  <-chan result
+		position int
+	}{"low 1": {low1, 1}, "low 2": {low2, 2}, "high": {high, 1}} {
+		if r := <-want.results; r.err != nil || r.position != want.position {
+			t.Errorf("%s: position %d, error %v, want position %d", name, r.position, r.err, want.position)
+		}
+	}
+}
+
+func TestModelLimit(t *testing.T) {
+	p := New(2, 0, map[string]int{"gpt-4": 1})
+	defer p.Close()
+	b := newBlocker()
+	b.start(t, p, "gpt-4")
+
+	// the second worker is free, but not for the limited model
+	ran := make(chan string, 2)
+	limited := submit(t, p, &Job{Model: "gpt-4"}, "gpt-4", ran)
+	if err := p.Do(context.Background(), &Job{Model: "gpt-3.5-turbo", Run: func(ctx context.Context) { ran <- "gpt-3.5-turbo" }}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-ran; got != "gpt-3.5-turbo" {
+		t.Errorf("%s ran first, want the model without a limit to pass the waiting job", got)
+	}
+	if p.Len() != 1 {
+		t.Errorf("%d jobs in the queue, want the gpt-4 job to wait", p.Len())
+	}
+
+	close(b.released)
+	if got := <-ran; got != "gpt-4" {
+		t.Errorf("%s ran, want the gpt-4 job once the slot is free", got)
+	}
+	if r := <-limited; r.err != nil || r.position != 1 {
+		t.Errorf("gpt-4 job: position %d, error %v, want position 1", r.position, r.err)
+	}
+}
+
+func TestRunsRightAway(t *testing.T) {
+	p := New(1, 0, nil)
+	defer p.Close()
+	waitForIdle(t, p, 1)
+
+	queued := false
+	ran := false
+	err := p.Do(context.Background(), &Job{Run: func(ctx context.Context) { ran = true }, Queued: func(int) { queued = true }})
+	if err != nil || !ran || queued {
+		t.Errorf("Do() = %v, ran %v, queued %v, want the job to run without waiting", err, ran, queued)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	p := New(1, 1, nil)
+	defer p.Close()
+	b := newBlocker()
+	b.start(t, p, "")
+
+	ran := make(chan string, 1)
+	waiting := submit(t, p, &Job{}, "waiting", ran)
+	if err := p.Do(context.Background(), &Job{Run: func(ctx context.Context) { t.Error("the job didn't fit in the queue, but ran") }}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Do() = %v, want ErrQueueFull", err)
+	}
+
+	close(b.released)
+	if r := <-waiting; r.err != nil {
+		t.Errorf("the waiting job failed: %v", r.err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	p := New(1, 0, nil)
+	defer p.Close()
+
+	// a running job has its context cancelled
+	running := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.Do(context.Background(), &Job{Key: "thread", Run: func(ctx context.Context) {
+			close(running)
+			<-ctx.Done()
+		}})
+	}()
+	<-running
+
+	// a queued job is dropped without running
+	ran := make(chan string, 2)
+	queued := submit(t, p, &Job{Key: "thread"}, "queued", ran)
+	other := submit(t, p, &Job{Key: "other thread"}, "other", ran)
+
+	p.Cancel("thread")
+	if err := <-errs; err != nil {
+		t.Errorf("the running job returned %v, want nil once it finished", err)
+	}
+	if r := <-queued; !errors.Is(r.err, context.Canceled) {
+		t.Errorf("the queued job returned %v, want context.Canceled", r.err)
+	}
+	if r := <-other; r.err != nil {
+		t.Errorf("the job with another key returned %v, want it to run", r.err)
+	}
+	if got := <-ran; got != "other" {
+		t.Errorf("%s ran, want only the job with another key", got)
+	}
+}
+
+func TestDoCancelledWhileQueued(t *testing.T) {
+	p := New(1, 0, nil)
+	defer p.Close()
+	b := newBlocker()
+	b.start(t, p, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.Do(ctx, &Job{Run: func(ctx context.Context) { t.Error("the cancelled job ran") }})
+	}()
+	waitForLen(t, p, 1)
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() = %v, want context.Canceled", err)
+	}
+	if p.Len() != 0 {
+		t.Errorf("%d jobs in the queue, want the cancelled one to be removed", p.Len())
+	}
+	close(b.released)
+}
+
+func TestClose(t *testing.T) {
+	p := New(1, 0, nil)
+	b := newBlocker()
+	running := b.start(t, p, "")
+
+	ran := make(chan string, 1)
+	queued := submit(t, p, &Job{}, "queued", ran)
+
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	if r := <-queued; !errors.Is(r.err, context.Canceled) {
+		t.Errorf("the queued job returned %v, want context.Canceled", r.err)
+	}
+
+	// Close waits for the running job
+	select {
+	case <-closed:
+		t.Error("Close returned while a job was running")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(b.released)
+	<-closed
+	if err := <-running; err != nil {
+		t.Errorf("the running job returned %v", err)
+	}
+
+	if err := p.Do(context.Background(), &Job{Run: func(ctx context.Context) { t.Error("a job ran after Close") }}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Do() after Close = %v, want ErrClosed", err)
+	}
+	select {
+	case name := <-ran:
+		t.Errorf("%s ran after Close", name)
+	default:
+	}
+}
+
+// TestConcurrentSubmit runs many jobs from many goroutines, for the race detector.
+func TestConcurrentSubmit(t *testing.T) {
+	p := New(4, 0, map[string]int{"gpt-4": 2})
+	defer p.Close()
+
+	var mu sync.Mutex
+	count := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			model := "gpt-3.5-turbo"
+			if i%2 == 0 {
+				model = "gpt-4"
+			}
+			err := p.Do(context.Background(), &Job{Priority: Priority(i % 2), Model: model, Run: func(ctx context.Context) {
+				mu.Lock()
+				count++
+				mu.Unlock()
+			}})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if count != 50 {
+		t.Errorf("%d jobs ran, want 50", count)
+	}
+}
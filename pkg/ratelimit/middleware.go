@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/audit"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/bot"
+	discord "github.com/bwmarrin/discordgo"
+)
+
+const rateLimitEmbedColor = 0xffa500
+
+// Middleware returns a command middleware that lets a user through at most as often as the rule allows.
+// Throttled users get an ephemeral embed telling them when to retry, so it must run before the interaction is responded to.
+// Throttled requests are recorded in the audit log.
+func Middleware(l *Limiter, name string, rule Rule, auditLog *audit.Logger) bot.Handler {
+	return bot.HandlerFunc(func(ctx *bot.Context) {
+		member := ctx.Interaction.Member
+		if member == nil || member.User == nil {
+			// only guild interactions are limited
+			ctx.Next()
+			return
+		}
+
+		key := Key{Rule: name, GuildID: ctx.Interaction.GuildID, Channel: ctx.Interaction.ChannelID, UserID: member.User.ID}
+		if ok, retryAfter := l.Allow(key, rule, member.Roles); !ok {
+			ctx.Logger.Info("User is rate limited", "limit", name, "retry_after", retryAfter)
+			auditLog.Emit(budgetExceededEvent(key, retryAfter))
+			ctx.Respond(&discord.InteractionResponse{
+				Type: discord.InteractionResponseChannelMessageWithSource,
+				Data: &discord.InteractionResponseData{
+					Flags:  discord.MessageFlagsEphemeral,
+					Embeds: []*discord.MessageEmbed{rateLimitEmbed(retryAfter)},
+				},
+			})
+			return
+		}
+
+		ctx.Next()
+	})
+}
+
+// MessageMiddleware returns a message middleware that lets a user's messages through at most as often as the rule allows.
+// Throttled messages get a reply telling the user when to retry and are recorded in the audit log.
+func MessageMiddleware(l *Limiter, name string, rule Rule, auditLog *audit.Logger) bot.MessageHandler {
+	return bot.MessageHandlerFunc(func(ctx *bot.MessageContext) {
+		if ctx.Message.Author == nil || ctx.Message.GuildID == "" {
+			// only guild messages are limited
+			ctx.Next()
+			return
+		}
+
+		var roles []string
+		if ctx.Message.Member != nil {
+			roles = ctx.Message.Member.Roles
+		}
+
+		key := Key{Rule: name, GuildID: ctx.Message.GuildID, Channel: ctx.Message.ChannelID, UserID: ctx.Message.Author.ID}
+		if ok, retryAfter := l.Allow(key, rule, roles); !ok {
+			ctx.Logger.Info("User is rate limited", "limit", name, "retry_after", retryAfter)
+			auditLog.Emit(budgetExceededEvent(key, retryAfter))
+			ctx.EmbedReply(rateLimitEmbed(retryAfter))
+			return
+		}
+
+		ctx.Next()
+	})
+}
+
+// budgetExceededEvent returns the audit event of a throttled request.
+func budgetExceededEvent(key Key, retryAfter time.Duration) audit.Event {
+	return audit.Event{
+		Type:      audit.EventBudgetExceeded,
+		GuildID:   key.GuildID,
+		ChannelID: key.Channel,
+		UserID:    key.UserID,
+		Details: map[string]string{
+			"limit":      key.Rule,
+			"retryAfter": retryAfter.Round(time.Second).String(),
+		},
+	}
+}
+
+// rateLimitEmbed tells the user to slow down.
+func rateLimitEmbed(retryAfter time.Duration) *discord.MessageEmbed {
+	return &discord.MessageEmbed{
+		Title:       "⏳ Slow down",
+		Description: fmt.Sprintf("You are sending requests too fast, retry in %ds", int(math.Ceil(retryAfter.Seconds()))),
+		Color:       rateLimitEmbedColor,
+	}
+}
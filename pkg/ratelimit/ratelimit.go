@@ -0,0 +1,151 @@
+// Package ratelimit throttles how often users can invoke commands and talk to the bot in threads.
+// Every user gets a token bucket per rule (and guild, and optionally channel), refilled at a constant rate.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit allows Requests requests per period of time. The whole budget can be used at once (it is the bucket size).
+type Limit struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+}
+
+// rate returns the number of tokens added to the bucket per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// Rule is the limit applied to a command or to thread messages.
+type Rule struct {
+	Limit `yaml:",inline"`
+	// PerChannel keeps a separate bucket per channel, instead of one per guild
+	PerChannel bool `yaml:"perChannel"`
+	// Roles overrides the limit for members with the given role IDs. If a member has several of the roles,
+	// the most generous limit applies.
+	Roles map[string]Limit `yaml:"roles"`
+}
+
+// Validate checks the rule for values that make no sense.
+func (r Rule) Validate() error {
+	if err := r.Limit.validate(); err != nil {
+		return err
+	}
+	for role, limit := range r.Roles {
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("role %s: %w", role, err)
+		}
+	}
+	return nil
+}
+
+func (l Limit) validate() error {
+	if l.Requests < 1 {
+		return fmt.Errorf("requests is %d, must be at least 1", l.Requests)
+	}
+	if l.Per <= 0 {
+		return fmt.Errorf("per is %v, must be positive", l.Per)
+	}
+	return nil
+}
+
+// limitFor returns the limit of the rule for a member with the given roles.
+func (r Rule) limitFor(roles []string) Limit {
+	limit := r.Limit
+	for _, role := range roles {
+		if roleLimit, ok := r.Roles[role]; ok && roleLimit.rate() > limit.rate() {
+			limit = roleLimit
+		}
+	}
+	return limit
+}
+
+// Key identifies whose bucket a request is taken from.
+type Key struct {
+	Rule    string
+	GuildID string
+	Channel string
+	UserID  string
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// Limiter holds the token buckets of all users. It is safe for concurrent use.
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[Key]*bucket
+	sweep   time.Time
+
+	now func() time.Time
+}
+
+// tokenEpsilon is the rounding error tolerated when checking whether a bucket holds a whole token.
+const tokenEpsilon = 1e-9
+
+// sweepInterval is how often buckets that refilled completely are dropped, to keep memory bounded.
+const sweepInterval = 10 * time.Minute
+
+// NewLimiter creates a new limiter without any buckets.
+func NewLimiter() *Limiter {
+	return &Limiter{
+		buckets: make(map[Key]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of the given key. The bucket is created full on first use.
+// When the bucket is empty, it returns false and how long until a token becomes available.
+func (l *Limiter) Allow(key Key, rule Rule, roles []string) (ok bool, retryAfter time.Duration) {
+	if !rule.PerChannel {
+		key.Channel = ""
+	}
+	limit := rule.limitFor(roles)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweepLocked(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(limit.Requests), updated: now, limit: limit}
+		l.buckets[key] = b
+	}
+
+	// refill the bucket for the time passed since the last request
+	b.limit = limit
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+now.Sub(b.updated).Seconds()*limit.rate())
+	b.updated = now
+
+	// the refills of several requests add up to rounding errors, a user who waited for retryAfter must get through
+	if b.tokens >= 1-tokenEpsilon {
+		b.tokens = math.Max(0, b.tokens-1)
+		return true, 0
+	}
+
+	missing := 1 - b.tokens
+	return false, time.Duration(missing / limit.rate() * float64(time.Second))
+}
+
+// sweepLocked drops the buckets that are full again, they behave exactly like new ones. The caller must hold l.mu.
+func (l *Limiter) sweepLocked(now time.Time) {
+	if now.Sub(l.sweep) < sweepInterval {
+		return
+	}
+	l.sweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*b.limit.rate() >= float64(b.limit.Requests) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns a limiter whose clock only moves when the returned function is called.
+func newTestLimiter() (l *Limiter, advance func(time.Duration)) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	l = NewLimiter()
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLimiterAllow(t *testing.T) {
+	user := Key{Rule: "chat", GuildID: "guild", Channel: "channel", UserID: "user"}
+	otherChannel := user
+	otherChannel.Channel = "other-channel"
+	otherUser := user
+	otherUser.UserID = "other-user"
+
+	type request struct {
+		// advance moves the clock before the request
+		advance time.Duration
+		key     Key
+		roles   []string
+
+		wantOK         bool
+		wantRetryAfter time.Duration
+	}
+	tests := []struct {
+		name     string
+		rule     Rule
+		requests []request
+	}{
+		{
+			name: "refill",
+			rule: Rule{Limit: Limit{Requests: 2, Per: 10 * time.Second}},
+			requests: []request{
+				{key: user, wantOK: true},
+				{key: user, wantOK: true},
+				{key: user, wantRetryAfter: 5 * time.Second},
+				// one token is added every 5s
+				{advance: 5 * time.Second, key: user, wantOK: true},
+				{key: user, wantRetryAfter: 5 * time.Second},
+				// the bucket never holds more than the whole budget
+				{advance: time.Minute, key: user, wantOK: true},
+				{key: user, wantOK: true},
+				{key: user, wantRetryAfter: 5 * time.Second},
+			},
+		},
+		{
+			name: "partial refill",
+			rule: Rule{Limit: Limit{Requests: 1, Per: 3 * time.Second}},
+			requests: []request{
+				{key: user, wantOK: true},
+				{advance: time.Second, key: user, wantRetryAfter: 2 * time.Second},
+				{advance: 1500 * time.Millisecond, key: user, wantRetryAfter: 500 * time.Millisecond},
+				{advance: 500 * time.Millisecond, key: user, wantOK: true},
+			},
+		},
+		{
+			name: "users",
+			rule: Rule{Limit: Limit{Requests: 1, Per: time.Minute}},
+			requests: []request{
+				{key: user, wantOK: true},
+				{key: user, wantRetryAfter: time.Minute},
+				{key: otherUser, wantOK: true},
+			},
+		},
+		{
+			name: "per guild",
+			rule: Rule{Limit: Limit{Requests: 1, Per: time.Minute}},
+			requests: []request{
+				{key: user, wantOK: true},
+				{key: otherChannel, wantRetryAfter: time.Minute},
+			},
+		},
+		{
+			name: "per channel",
+			rule: Rule{Limit: Limit{Requests: 1, Per: time.Minute}, PerChannel: true},
+			requests: []request{
+				{key: user, wantOK: true},
+				{key: user, wantRetryAfter: time.Minute},
+				{key: otherChannel, wantOK: true},
+				{key: otherChannel, wantRetryAfter: time.Minute},
+			},
+		},
+		{
+			name: "most generous role",
+			rule: Rule{
+				Limit: Limit{Requests: 1, Per: time.Minute},
+				Roles: map[string]Limit{
+					"supporter": {Requests: 2, Per: time.Minute},
+					"moderator": {Requests: 3, Per: time.Minute},
+				},
+			},
+			requests: []request{
+				{key: user, roles: []string{"supporter", "moderator"}, wantOK: true},
+				{key: user, roles: []string{"supporter", "moderator"}, wantOK: true},
+				{key: user, roles: []string{"supporter", "moderator"}, wantOK: true},
+				{key: user, roles: []string{"supporter", "moderator"}, wantRetryAfter: 20 * time.Second},
+			},
+		},
+		{
+			name: "stricter role",
+			rule: Rule{
+				Limit: Limit{Requests: 1, Per: time.Minute},
+				Roles: map[string]Limit{"newcomer": {Requests: 1, Per: time.Hour}},
+			},
+			requests: []request{
+				// a role override never makes the limit stricter than the default one
+				{key: user, roles: []string{"newcomer", "unknown"}, wantOK: true},
+				{key: user, roles: []string{"newcomer", "unknown"}, wantRetryAfter: time.Minute},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, advance := newTestLimiter()
+			for n, r := range test.requests {
+				advance(r.advance)
+				ok, retryAfter := l.Allow(r.key, test.rule, r.roles)
+				if ok != r.wantOK || retryAfter != r.wantRetryAfter {
+					t.Errorf("request %d: Allow() = %t, %v, want %t, %v", n, ok, retryAfter, r.wantOK, r.wantRetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	fast := Rule{Limit: Limit{Requests: 1, Per: time.Minute}}
+	slow := Rule{Limit: Limit{Requests: 1, Per: time.Hour}}
+	refilled := Key{Rule: "fast", GuildID: "guild", UserID: "user"}
+	empty := Key{Rule: "slow", GuildID: "guild", UserID: "user"}
+	next := Key{Rule: "fast", GuildID: "guild", UserID: "other-user"}
+
+	tests := []struct {
+		name string
+		// advance moves the clock before the request that triggers the sweep
+		advance time.Duration
+		want    []Key
+	}{
+		{
+			name:    "before the interval",
+			advance: sweepInterval - time.Second,
+			want:    []Key{refilled, empty, next},
+		},
+		{
+			name:    "after the interval",
+			advance: sweepInterval,
+			// only the buckets that are full again are dropped
+			want: []Key{empty, next},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, advance := newTestLimiter()
+			l.Allow(refilled, fast, nil)
+			l.Allow(empty, slow, nil)
+
+			advance(test.advance)
+			l.Allow(next, fast, nil)
+
+			if len(l.buckets) != len(test.want) {
+				t.Errorf("%d buckets, want %d", len(l.buckets), len(test.want))
+			}
+			for _, key := range test.want {
+				if _, ok := l.buckets[key]; !ok {
+					t.Errorf("bucket %+v was dropped", key)
+				}
+			}
+		})
+	}
+}
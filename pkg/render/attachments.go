@@ -0,0 +1,204 @@
+package render
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/markdown"
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// maxFiles is the number of files Discord allows in a message, further code blocks stay inline.
+const maxFiles = 10
+
+// File is a code block attached to an answer.
+type File struct {
+	Name    string
+	Content string
+}
+
+// fileNames are the names of the attached files keyed by the language of the code block, languages not listed here
+// are attached as snippet.txt.
+var fileNames = map[string]string{
+	"go":         "main.go",
+	"golang":     "main.go",
+	"python":     "script.py",
+	"py":         "script.py",
+	"javascript": "script.js",
+	"js":         "script.js",
+	"jsx":        "component.jsx",
+	"typescript": "script.ts",
+	"ts":         "script.ts",
+	"tsx":        "component.tsx",
+	"rust":       "main.rs",
+	"rs":         "main.rs",
+	"java":       "Main.java",
+	"kotlin":     "Main.kt",
+	"kt":         "Main.kt",
+	"c":          "main.c",
+	"cpp":        "main.cpp",
+	"c++":        "main.cpp",
+	"csharp":     "Program.cs",
+	"cs":         "Program.cs",
+	"c#":         "Program.cs",
+	"ruby":       "script.rb",
+	"rb":         "script.rb",
+	"php":        "index.php",
+	"swift":      "main.swift",
+	"bash":       "script.sh",
+	"sh":         "script.sh",
+	"shell":      "script.sh",
+	"zsh":        "script.sh",
+	"powershell": "script.ps1",
+	"ps1":        "script.ps1",
+	"sql":        "query.sql",
+	"html":       "index.html",
+	"css":        "style.css",
+	"json":       "data.json",
+	"yaml":       "config.yaml",
+	"yml":        "config.yaml",
+	"toml":       "config.toml",
+	"xml":        "data.xml",
+	"dockerfile": "Dockerfile",
+	"makefile":   "Makefile",
+	"markdown":   "README.md",
+	"md":         "README.md",
+}
+
+// languages is the language a file name is restored with, the longest of the languages attached under the name,
+// e.g. golang for main.go. Ties go to the first in alphabetical order.
+var languages = func() map[string]string {
+	languages := make(map[string]string)
+	for language, name := range fileNames {
+		current, ok := languages[name]
+		if !ok || len(language) > len(current) || (len(language) == len(current) && language < current) {
+			languages[name] = language
+		}
+	}
+	return languages
+}()
+
+// FileName returns the name a code block of the language is attached as, e.g. main.go for go.
+func FileName(language string) string {
+	if name, ok := fileNames[strings.ToLower(language)]; ok {
+		return name
+	}
+	return "snippet.txt"
+}
+
+// Attach replaces the code blocks of the answer that are too long to be posted inline by short references and returns them
+// as files. Code blocks of at least MinLines lines are attached, and if the answer is still longer than MaxLength, the largest
+// of the remaining ones are attached until it fits. Names taken by an earlier file get a number, e.g. main_2.go.
+func Attach(answer string, attachments Attachments) (string, []File) {
+	if attachments.Disabled {
+		return answer, nil
+	}
+
+	blocks := markdown.CodeBlocks(answer)
+	attached := make([]bool, len(blocks))
+	count := 0
+	for i, block := range blocks {
+		if block.Lines >= attachments.MinLines && block.Code != "" && count < maxFiles {
+			attached[i] = true
+			count++
+		}
+	}
+
+	text, files := replaceBlocks(answer, blocks, attached)
+	for markdown.Length(text) > attachments.MaxLength && count < maxFiles {
+		largest := -1
+		for i, block := range blocks {
+			if !attached[i] && block.Code != "" && (largest < 0 || markdown.Length(block.Code) > markdown.Length(blocks[largest].Code)) {
+				largest = i
+			}
+		}
+		if largest < 0 {
+			break
+		}
+		attached[largest] = true
+		count++
+		text, files = replaceBlocks(answer, blocks, attached)
+	}
+	return text, files
+}
+
+// replaceBlocks replaces the attached code blocks of the answer by references to the files.
+func replaceBlocks(answer string, blocks []markdown.CodeBlock, attached []bool) (string, []File) {
+	var text strings.Builder
+	var files []File
+	taken := make(map[string]int)
+	last := 0
+	for i, block := range blocks {
+		if !attached[i] {
+			continue
+		}
+		name := FileName(block.Language)
+		taken[name]++
+		if n := taken[name]; n > 1 {
+			ext := path.Ext(name)
+			name = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), n, ext)
+		}
+		files = append(files, File{Name: name, Content: block.Code})
+
+		text.WriteString(answer[last:block.Start])
+		text.WriteString(reference(name, block.Lines))
+		if strings.HasSuffix(answer[block.Start:block.End], "\n") {
+			text.WriteString("\n")
+		}
+		last = block.End
+	}
+	text.WriteString(answer[last:])
+	return text.String(), files
+}
+
+// reference is what an attached code block is replaced by in the answer.
+func reference(name string, lines int) string {
+	if lines == 1 {
+		return fmt.Sprintf("📎 `%s` (1 line)", name)
+	}
+	return fmt.Sprintf("📎 `%s` (%d lines)", name, lines)
+}
+
+// Restore puts the attached files back in place of their references in the answer, so an answer read back from Discord
+// holds the code the model wrote. References to files that are not given are left as they are.
+func Restore(text string, files []File) string {
+	for _, f := range files {
+		lines := strings.Count(f.Content, "\n")
+		code := f.Content
+		if code != "" && !strings.HasSuffix(code, "\n") {
+			lines++
+			code += "\n"
+		}
+		// the fence must be longer than any fence inside the code
+		fence := "```"
+		for strings.Contains(code, fence) {
+			fence += "`"
+		}
+		text = strings.Replace(text, reference(f.Name, lines), fence+fileLanguage(f.Name)+"\n"+code+fence, 1)
+	}
+	return text
+}
+
+// fileLanguage returns the language of a file attached by Attach, numbered names like main_2.go included.
+func fileLanguage(name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if i := strings.LastIndex(base, "_"); i >= 0 && i+1 < len(base) && strings.Trim(base[i+1:], "0123456789") == "" {
+		base = base[:i]
+	}
+	return languages[base+ext]
+}
+
+// DiscordFiles returns the files to send with a message.
+func DiscordFiles(files []File) []*discord.File {
+	var discordFiles []*discord.File
+	for _, f := range files {
+		discordFiles = append(discordFiles, &discord.File{
+			Name:        f.Name,
+			ContentType: "text/plain; charset=utf-8",
+			Reader:      strings.NewReader(f.Content),
+		})
+	}
+	return discordFiles
+}
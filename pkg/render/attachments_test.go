@@ -0,0 +1,141 @@
+package render
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/golden"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/markdown"
+)
+
+func TestAttach(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		attachments Attachments
+	}{
+		{name: "long_block", input: "long_block", attachments: Attachments{MinLines: 10, MaxLength: 4000}},
+		{name: "disabled", input: "long_block", attachments: Attachments{Disabled: true, MinLines: 10, MaxLength: 4000}},
+		{name: "same_language", input: "same_language", attachments: Attachments{MinLines: 5, MaxLength: 4000}},
+		{name: "max_length", input: "max_length", attachments: Attachments{MinLines: 100, MaxLength: 150}},
+		{name: "unclosed", input: "unclosed", attachments: Attachments{MinLines: 5, MaxLength: 4000}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input, err := os.ReadFile(filepath.Join("testdata", test.input+".md"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			text, files := Attach(string(input), test.attachments)
+			var got strings.Builder
+			fmt.Fprintf(&got, "----- answer -----\n%s\n", text)
+			for _, f := range files {
+				fmt.Fprintf(&got, "----- %s -----\n%s\n", f.Name, f.Content)
+			}
+			golden.Assert(t, "attach_"+test.name, []byte(got.String()))
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		files []File
+		want  string
+	}{
+		{
+			name:  "block",
+			text:  "Here it is:\n📎 `main.go` (2 lines)\nRun it.",
+			files: []File{{Name: "main.go", Content: "package main\nfunc main() {}\n"}},
+			want:  "Here it is:\n```golang\npackage main\nfunc main() {}\n```\nRun it.",
+		},
+		{
+			name:  "numbered",
+			text:  "📎 `script.py` (1 line)\n📎 `script_2.py` (1 line)",
+			files: []File{{Name: "script.py", Content: "print(1)\n"}, {Name: "script_2.py", Content: "print(2)\n"}},
+			want:  "```python\nprint(1)\n```\n```python\nprint(2)\n```",
+		},
+		{
+			name:  "unclosed",
+			text:  "📎 `snippet.txt` (2 lines)",
+			files: []File{{Name: "snippet.txt", Content: "first\nsecond"}},
+			want:  "```\nfirst\nsecond\n```",
+		},
+		{
+			name:  "fence in code",
+			text:  "📎 `README.md` (3 lines)",
+			files: []File{{Name: "README.md", Content: "```sh\nmake\n```\n"}},
+			want:  "````markdown\n```sh\nmake\n```\n````",
+		},
+		{
+			name: "missing file",
+			text: "📎 `main.go` (2 lines)",
+			want: "📎 `main.go` (2 lines)",
+		},
+		{
+			// the file is not the one the reference was made for
+			name:  "other lines",
+			text:  "📎 `main.go` (2 lines)",
+			files: []File{{Name: "main.go", Content: "package main\n"}},
+			want:  "📎 `main.go` (2 lines)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Restore(test.text, test.files); got != test.want {
+				t.Errorf("Restore() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// TestAttachRestore checks that restoring the attached files gives back the code of the answer.
+func TestAttachRestore(t *testing.T) {
+	for _, input := range []string{"long_block", "same_language", "max_length", "unclosed"} {
+		t.Run(input, func(t *testing.T) {
+			answer, err := os.ReadFile(filepath.Join("testdata", input+".md"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			text, files := Attach(string(answer), Attachments{MinLines: 5, MaxLength: 150})
+			restored := Restore(text, files)
+			if got, want := codeOf(restored), codeOf(string(answer)); got != want {
+				t.Errorf("restored code = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// codeOf returns the code of all the code blocks of the text.
+func codeOf(text string) string {
+	var code []string
+	for _, block := range markdown.CodeBlocks(text) {
+		code = append(code, block.Code)
+	}
+	return strings.Join(code, "\n---\n")
+}
+
+func TestPolicyFor(t *testing.T) {
+	config := Config{
+		Policy: Policy{Attachments: Attachments{MinLines: 50}},
+		Guilds: map[string]Policy{"1": {Attachments: Attachments{Disabled: true}}},
+	}
+
+	if got := config.PolicyFor("2").Mode; got != ModeHybrid {
+		t.Errorf("default policy mode = %q, want %q", got, ModeHybrid)
+	}
+	if got := config.PolicyFor("2").Attachments; got != (Attachments{MinLines: 50, MaxLength: defaultMaxLength}) {
+		t.Errorf("default policy attachments = %+v", got)
+	}
+	if got := config.PolicyFor("1").Attachments; got != (Attachments{Disabled: true, MinLines: defaultMinLines, MaxLength: defaultMaxLength}) {
+		t.Errorf("guild policy attachments = %+v", got)
+	}
+}
@@ -0,0 +1,108 @@
+// Package render prepares the answers of the model for Discord, e.g. by attaching long code blocks as files,
+// and holds the policies that decide how they are posted.
+package render
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Default values of the policy settings that are not set
+const (
+	defaultMinLines  = 30
+	defaultMaxLength = 4000
+)
+
+// Mode is how an answer is posted.
+type Mode string
+
+// Modes answers can be posted in
+const (
+	// ModePlain posts the answer and the usage as text only
+	ModePlain Mode = "plain"
+	// ModeEmbed posts the answer in embeds colored by the model, with the usage in the footer of the last one
+	ModeEmbed Mode = "embed"
+	// ModeHybrid posts the answer as text, with the usage in an embed below it
+	ModeHybrid Mode = "hybrid"
+)
+
+// Modes are all the modes, in the order they are offered to users.
+var Modes = []Mode{ModeHybrid, ModeEmbed, ModePlain}
+
+// IsMode tells whether the mode is one of Modes.
+func IsMode(mode Mode) bool {
+	for _, m := range Modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy decides how answers are posted.
+type Policy struct {
+	// Mode answers are posted in unless users choose another one, hybrid by default
+	Mode Mode `yaml:"mode"`
+	// Attachments decides which code blocks are attached as files
+	Attachments Attachments `yaml:"attachments"`
+	// RegenerateOnEdit answers the last message of a thread again when its author edits it, by default the edit only
+	// changes the conversation the next answers are based on
+	RegenerateOnEdit bool `yaml:"regenerateOnEdit"`
+}
+
+// Attachments decides which code blocks of an answer are attached as files instead of being posted inline.
+type Attachments struct {
+	// Disabled keeps all code blocks inline, however long they are
+	Disabled bool `yaml:"disabled"`
+	// MinLines is the number of lines from which a code block is attached, 30 by default
+	MinLines int `yaml:"minLines"`
+	// MaxLength is the length (in characters) up to which an answer is posted inline, the largest code blocks of longer
+	// answers are attached until the rest fits, 4000 by default
+	MaxLength int `yaml:"maxLength"`
+}
+
+// Config holds the default policy and the policies of single guilds, which replace the default one.
+type Config struct {
+	Policy `yaml:",inline"`
+	Guilds map[string]Policy `yaml:"guilds"`
+}
+
+// PolicyFor returns the policy of the guild.
+func (c Config) PolicyFor(guildID string) Policy {
+	policy, ok := c.Guilds[guildID]
+	if !ok {
+		policy = c.Policy
+	}
+	if policy.Mode == "" {
+		policy.Mode = ModeHybrid
+	}
+	if policy.Attachments.MinLines == 0 {
+		policy.Attachments.MinLines = defaultMinLines
+	}
+	if policy.Attachments.MaxLength == 0 {
+		policy.Attachments.MaxLength = defaultMaxLength
+	}
+	return policy
+}
+
+// Validate checks the policies for unknown modes and settings out of range.
+func (c Config) Validate() error {
+	errs := c.Policy.validate("")
+	for guild, policy := range c.Guilds {
+		errs = append(errs, policy.validate("guilds."+guild+".")...)
+	}
+	return errors.Join(errs...)
+}
+
+func (p Policy) validate(prefix string) (errs []error) {
+	if p.Mode != "" && !IsMode(p.Mode) {
+		errs = append(errs, fmt.Errorf("%smode %q is unknown, expected %s, %s or %s", prefix, p.Mode, ModeHybrid, ModeEmbed, ModePlain))
+	}
+	if p.Attachments.MinLines < 0 {
+		errs = append(errs, fmt.Errorf("%sattachments.minLines is %d, must not be negative", prefix, p.Attachments.MinLines))
+	}
+	if p.Attachments.MaxLength < 0 {
+		errs = append(errs, fmt.Errorf("%sattachments.maxLength is %d, must not be negative", prefix, p.Attachments.MaxLength))
+	}
+	return errs
+}
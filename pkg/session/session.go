@@ -0,0 +1,90 @@
+// Package session hides the Discord session behind narrow interfaces, one per kind of work the handlers do with it:
+// sending messages, managing threads, responding to interactions and reading the state cache.
+// The handlers only depend on the interfaces, so they run against the real discordgo session in the bot and
+// against the in-memory fake of the sessiontest package in unit tests.
+package session
+
+import (
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// MessageSender sends, reads, edits and reacts to channel messages, including the direct messages to users.
+type MessageSender interface {
+	ChannelMessageSendComplex(channelID string, data *discord.MessageSend, options ...discord.RequestOption) (*discord.Message, error)
+	ChannelMessageEditComplex(m *discord.MessageEdit, options ...discord.RequestOption) (*discord.Message, error)
+	ChannelMessageDelete(channelID string, messageID string, options ...discord.RequestOption) error
+	ChannelMessage(channelID string, messageID string, options ...discord.RequestOption) (*discord.Message, error)
+	ChannelMessages(channelID string, limit int, beforeID string, afterID string, aroundID string, options ...discord.RequestOption) ([]*discord.Message, error)
+	MessageReactionAdd(channelID string, messageID string, emojiID string, options ...discord.RequestOption) error
+	MessageReactionsRemoveEmoji(channelID string, messageID string, emojiID string, options ...discord.RequestOption) error
+	ChannelTyping(channelID string, options ...discord.RequestOption) error
+	UserChannelCreate(recipientID string, options ...discord.RequestOption) (*discord.Channel, error)
+}
+
+// ThreadManager starts threads from messages and edits channels and threads, e.g. to rename or lock them.
+type ThreadManager interface {
+	MessageThreadStartComplex(channelID string, messageID string, data *discord.ThreadStart, options ...discord.RequestOption) (*discord.Channel, error)
+	ChannelEditComplex(channelID string, data *discord.ChannelEdit, options ...discord.RequestOption) (*discord.Channel, error)
+	ThreadMemberAdd(threadID string, memberID string, options ...discord.RequestOption) error
+}
+
+// InteractionResponder responds to interactions and sends their followup messages.
+type InteractionResponder interface {
+	InteractionRespond(interaction *discord.Interaction, resp *discord.InteractionResponse, options ...discord.RequestOption) error
+	InteractionResponse(interaction *discord.Interaction, options ...discord.RequestOption) (*discord.Message, error)
+	InteractionResponseEdit(interaction *discord.Interaction, newresp *discord.WebhookEdit, options ...discord.RequestOption) (*discord.Message, error)
+	InteractionResponseDelete(interaction *discord.Interaction, options ...discord.RequestOption) error
+	FollowupMessageCreate(interaction *discord.Interaction, wait bool, data *discord.WebhookParams, options ...discord.RequestOption) (*discord.Message, error)
+	FollowupMessageEdit(interaction *discord.Interaction, messageID string, data *discord.WebhookEdit, options ...discord.RequestOption) (*discord.Message, error)
+}
+
+// StateReader reads the state cache the gateway keeps up to date, without making requests.
+type StateReader interface {
+	// CurrentUser is the user of the bot
+	CurrentUser() *discord.User
+	// CachedChannel returns a channel or thread of a guild the bot is in
+	CachedChannel(channelID string) (*discord.Channel, error)
+	// MessagePermissions returns the permissions the author of the message has in its channel
+	MessagePermissions(m *discord.Message) (int64, error)
+}
+
+// Session is everything the handlers do with Discord.
+type Session interface {
+	MessageSender
+	ThreadManager
+	InteractionResponder
+	StateReader
+}
+
+// discordSession is the real discordgo session, the state cache is read from its State.
+type discordSession struct {
+	*discord.Session
+}
+
+// New wraps the discordgo session, so it can be passed to the handlers.
+func New(s *discord.Session) Session {
+	return discordSession{s}
+}
+
+// CurrentUser returns the user of the bot from the ready event.
+func (s discordSession) CurrentUser() *discord.User {
+	return s.State.User
+}
+
+// CachedChannel returns a copy of the channel from the state cache. The state overwrites its channels in place when
+// Discord updates them, so handlers reading the cached channel itself would race with the gateway.
+func (s discordSession) CachedChannel(channelID string) (*discord.Channel, error) {
+	ch, err := s.State.Channel(channelID)
+	if err != nil {
+		return nil, err
+	}
+	s.State.RLock()
+	defer s.State.RUnlock()
+	c := *ch
+	return &c, nil
+}
+
+// MessagePermissions computes the permissions of the author of the message from the state cache.
+func (s discordSession) MessagePermissions(m *discord.Message) (int64, error) {
+	return s.State.MessagePermissions(m)
+}
@@ -0,0 +1,695 @@
+// Package sessiontest provides an in-memory fake of session.Session for unit tests of handlers.
+//
+// Unlike the discordtest package, which serves the Discord API over HTTP and the gateway to a real discordgo
+// session, the fake answers the calls directly and keeps the messages, threads, reactions and interaction
+// responses in memory, so a handler can be called with a bot.Context or bot.MessageContext and its effects
+// checked right after it returns. Failures are injected per method with Fail.
+package sessiontest
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/session"
+	discord "github.com/bwmarrin/discordgo"
+)
+
+// firstID is the first snowflake handed out, high enough to look like a real one
+const firstID = 1100000000000000000
+
+// Reaction is a reaction added to or removed from a message.
+type Reaction struct {
+	ChannelID string
+	MessageID string
+	Emoji     string
+	Removed   bool
+}
+
+// Session is the fake session. Its zero value is not usable, create it with New.
+type Session struct {
+	// User is the user of the bot
+	User *discord.User
+
+	mu          sync.Mutex
+	nextID      uint64
+	channels    map[string]*discord.Channel
+	messages    map[string][]*discord.Message
+	reactions   []Reaction
+	typing      []string
+	members     map[string][]string
+	permissions map[string]int64
+	responses   map[string][]*discord.InteractionResponse
+	originals   map[string]*discord.Message
+	followups   map[string][]*discord.Message
+	files       map[string][]*discord.File
+	failures    map[string]error
+}
+
+var _ session.Session = (*Session)(nil)
+
+// New creates an empty fake session, the bot is logged in as the user "bot".
+func New() *Session {
+	s := &Session{
+		nextID:      firstID,
+		channels:    make(map[string]*discord.Channel),
+		messages:    make(map[string][]*discord.Message),
+		members:     make(map[string][]string),
+		permissions: make(map[string]int64),
+		responses:   make(map[string][]*discord.InteractionResponse),
+		originals:   make(map[string]*discord.Message),
+		followups:   make(map[string][]*discord.Message),
+		files:       make(map[string][]*discord.File),
+		failures:    make(map[string]error),
+	}
+	s.User = &discord.User{ID: s.NewID(), Username: "bot", Bot: true}
+	return s
+}
+
+// NewID returns a new snowflake.
+func (s *Session) NewID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newID()
+}
+
+func (s *Session) newID() string {
+	s.nextID++
+	return strconv.FormatUint(s.nextID, 10)
+}
+
+// Fail makes every call of the method (e.g. "ChannelMessageSendComplex") fail with err, a nil err makes it succeed again.
+func (s *Session) Fail(method string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.failures, method)
+		return
+	}
+	s.failures[method] = err
+}
+
+// AddChannel adds a channel or thread to the state cache.
+func (s *Session) AddChannel(ch *discord.Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[ch.ID] = copyChannel(ch)
+}
+
+// AddMessage adds a message to its channel, its ID is set if empty. It returns a copy of the added message.
+func (s *Session) AddMessage(m *discord.Message) *discord.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m = copyMessage(m)
+	if m.ID == "" {
+		m.ID = s.newID()
+	}
+	s.messages[m.ChannelID] = append(s.messages[m.ChannelID], m)
+	return copyMessage(m)
+}
+
+// SetPermissions sets the permissions of the user in all channels.
+func (s *Session) SetPermissions(userID string, permissions int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.permissions[userID] = permissions
+}
+
+// Channel returns a copy of the channel, or nil if there is none.
+func (s *Session) Channel(channelID string) *discord.Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ch, ok := s.channels[channelID]; ok {
+		return copyChannel(ch)
+	}
+	return nil
+}
+
+// Messages returns copies of the messages of the channel, oldest first.
+func (s *Session) Messages(channelID string) []*discord.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]*discord.Message, 0, len(s.messages[channelID]))
+	for _, m := range s.messages[channelID] {
+		messages = append(messages, copyMessage(m))
+	}
+	return messages
+}
+
+// Reactions returns the reactions added and removed, in order.
+func (s *Session) Reactions() []Reaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Reaction(nil), s.reactions...)
+}
+
+// Typing returns the channels the bot was typing in, once per call.
+func (s *Session) Typing() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.typing...)
+}
+
+// ThreadMembers returns the users added to the thread.
+func (s *Session) ThreadMembers(threadID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.members[threadID]...)
+}
+
+// Files returns the files sent with the message, in order.
+func (s *Session) Files(messageID string) []*discord.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*discord.File(nil), s.files[messageID]...)
+}
+
+// InteractionResponses returns the responses to the interaction, in order.
+func (s *Session) InteractionResponses(i *discord.Interaction) []*discord.InteractionResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*discord.InteractionResponse(nil), s.responses[i.ID]...)
+}
+
+// Original returns a copy of the original response message of the interaction, or nil if there is none.
+func (s *Session) Original(i *discord.Interaction) *discord.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.originals[i.ID]; m != nil {
+		return copyMessage(m)
+	}
+	return nil
+}
+
+// Followups returns copies of the followup messages of the interaction, in order.
+func (s *Session) Followups(i *discord.Interaction) []*discord.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]*discord.Message, 0, len(s.followups[i.ID]))
+	for _, m := range s.followups[i.ID] {
+		messages = append(messages, copyMessage(m))
+	}
+	return messages
+}
+
+// CurrentUser returns the user of the bot.
+func (s *Session) CurrentUser() *discord.User {
+	return s.User
+}
+
+// CachedChannel returns a copy of the channel, like the state cache does.
+func (s *Session) CachedChannel(channelID string) (*discord.Channel, error) {
+	if ch := s.Channel(channelID); ch != nil {
+		return ch, nil
+	}
+	return nil, discord.ErrStateNotFound
+}
+
+// MessagePermissions returns the permissions set for the author with SetPermissions.
+func (s *Session) MessagePermissions(m *discord.Message) (int64, error) {
+	if m.Author == nil {
+		return 0, discord.ErrStateNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.permissions[m.Author.ID], nil
+}
+
+// ChannelMessageSendComplex adds a message of the bot to the channel.
+func (s *Session) ChannelMessageSendComplex(channelID string, data *discord.MessageSend, options ...discord.RequestOption) (*discord.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("ChannelMessageSendComplex"); err != nil {
+		return nil, err
+	}
+	m := s.newMessage(channelID, data.Content, data.Embeds)
+	s.attachFiles(m, data.Files)
+	if data.Reference != nil {
+		m.Type = discord.MessageTypeReply
+		m.MessageReference = data.Reference
+		m.ReferencedMessage = s.findMessage(data.Reference.MessageID)
+	}
+	s.messages[channelID] = append(s.messages[channelID], m)
+	return copyMessage(m), nil
+}
+
+// ChannelMessageEditComplex edits the content and embeds of a message, nil ones are left as they are, and attaches the files.
+func (s *Session) ChannelMessageEditComplex(edit *discord.MessageEdit, options ...discord.RequestOption) (*discord.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("ChannelMessageEditComplex"); err != nil {
+		return nil, err
+	}
+	m := s.channelMessage(edit.Channel, edit.ID)
+	if m == nil {
+		return nil, notFound(discord.ErrCodeUnknownMessage, "Unknown Message")
+	}
+	applyEdit(m, edit.Content, edit.Embeds)
+	s.attachFiles(m, edit.Files)
+	return copyMessage(m), nil
+}
+
+// ChannelMessageDelete removes the message from its channel.
+func (s *Session) ChannelMessageDelete(channelID string, messageID string, options ...discord.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("ChannelMessageDelete"); err != nil {
+		return err
+	}
+	messages := s.messages[channelID]
+	for i, m := range messages {
+		if m.ID == messageID {
+			s.messages[channelID] = append(messages[:i:i], messages[i+1:]...)
+			return nil
+		}
+	}
+	return notFound(discord.ErrCodeUnknownMessage, "Unknown Message")
+}
+
+// ChannelMessage returns a copy of the message.
+func (s *Session) ChannelMessage(channelID string, messageID string, options ...discord.RequestOption) (*discord.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("ChannelMessage"); err != nil {
+		return nil, err
+	}
+	if m := s.channelMessage(channelID, messageID); m != nil {
+		return copyMessage(m), nil
+	}
+	return nil, notFound(discord.ErrCodeUnknownMessage, "Unknown Message")
+}
+
+// ChannelMessages returns up to limit messages of the channel, newest first, like the API does.
+// Messages around a message are not supported.
+func (s *Session) ChannelMessages(channelID string, limit int, beforeID string, afterID string, aroundID string, options ...discord.RequestOption) ([]*discord.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("ChannelMessages"); err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+
+	var messages []*discord.Message
+	for _, m := range s.messages[channelID] {
+		if beforeID != "" && snowflake(m.ID) >= snowflake(beforeID) {
+			continue
+		}
+		if afterID != "" && snowflake(m.ID) <= snowflake(afterID) {
+			continue
+		}
+		messages = append(messages, copyMessage(m))
+	}
+	sort.Slice(messages, func(i, j int) bool { return snowflake(messages[i].ID) > snowflake(messages[j].ID) })
+	if afterID != "" && len(messages) > limit {
+		// after pages from the oldest message on
+		messages = messages[len(messages)-limit:]
+	}
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+// MessageReactionAdd records the reaction.
+func (s *Session) MessageReactionAdd(channelID string, messageID string, emojiID string, options ...discord.RequestOption) error {
+	return s.react("MessageReactionAdd", channelID, messageID, emojiID, false)
+}
+
+// MessageReactionsRemoveEmoji records the removal of the reaction.
+func (s *Session) MessageReactionsRemoveEmoji(channelID string, messageID string, emojiID string, options ...discord.RequestOption) error {
+	return s.react("MessageReactionsRemoveEmoji", channelID, messageID, emojiID, true)
+}
+
+func (s *Session) react(method string, channelID string, messageID string, emojiID string, removed bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure(method); err != nil {
+		return err
+	}
+	for _, m := range s.messages[channelID] {
+		if m.ID == messageID {
+			// the reactions are kept on the message too, so the bot sees them when it reads the messages back
+			m.Reactions = withReaction(m.Reactions, emojiID, removed)
+		}
+	}
+	s.reactions = append(s.reactions, Reaction{ChannelID: channelID, MessageID: messageID, Emoji: emojiID, Removed: removed})
+	return nil
+}
+
+// withReaction returns the reactions of a message after the bot added the emoji, or removed it.
+func withReaction(reactions []*discord.MessageReactions, emoji string, removed bool) []*discord.MessageReactions {
+	var updated []*discord.MessageReactions
+	found := false
+	for _, r := range reactions {
+		if r.Emoji != nil && r.Emoji.Name == emoji {
+			found = true
+			if removed {
+				continue
+			}
+			if !r.Me {
+				r = &discord.MessageReactions{Count: r.Count + 1, Me: true, Emoji: r.Emoji}
+			}
+		}
+		updated = append(updated, r)
+	}
+	if !found && !removed {
+		updated = append(updated, &discord.MessageReactions{Count: 1, Me: true, Emoji: &discord.Emoji{Name: emoji}})
+	}
+	return updated
+}
+
+// ChannelTyping records that the bot is typing in the channel.
+func (s *Session) ChannelTyping(channelID string, options ...discord.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("ChannelTyping"); err != nil {
+		return err
+	}
+	s.typing = append(s.typing, channelID)
+	return nil
+}
+
+// UserChannelCreate returns the direct message channel with the user, it is created on the first call.
+func (s *Session) UserChannelCreate(recipientID string, options ...discord.RequestOption) (*discord.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("UserChannelCreate"); err != nil {
+		return nil, err
+	}
+	for _, ch := range s.channels {
+		if ch.Type == discord.ChannelTypeDM && len(ch.Recipients) == 1 && ch.Recipients[0].ID == recipientID {
+			return copyChannel(ch), nil
+		}
+	}
+	ch := &discord.Channel{
+		ID:         s.newID(),
+		Type:       discord.ChannelTypeDM,
+		Recipients: []*discord.User{{ID: recipientID}},
+	}
+	s.channels[ch.ID] = ch
+	return copyChannel(ch), nil
+}
+
+// MessageThreadStartComplex starts a public thread from the message, the thread gets the ID of the message like on Discord.
+func (s *Session) MessageThreadStartComplex(channelID string, messageID string, data *discord.ThreadStart, options ...discord.RequestOption) (*discord.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("MessageThreadStartComplex"); err != nil {
+		return nil, err
+	}
+	parent, ok := s.channels[channelID]
+	if !ok {
+		return nil, notFound(discord.ErrCodeUnknownChannel, "Unknown Channel")
+	}
+	if s.channelMessage(channelID, messageID) == nil {
+		return nil, notFound(discord.ErrCodeUnknownMessage, "Unknown Message")
+	}
+
+	thread := &discord.Channel{
+		ID:       messageID,
+		GuildID:  parent.GuildID,
+		ParentID: channelID,
+		Name:     data.Name,
+		Type:     discord.ChannelTypeGuildPublicThread,
+		OwnerID:  s.User.ID,
+		ThreadMetadata: &discord.ThreadMetadata{
+			AutoArchiveDuration: data.AutoArchiveDuration,
+		},
+	}
+	s.channels[thread.ID] = thread
+	return copyChannel(thread), nil
+}
+
+// ChannelEditComplex edits the name, topic and the locked and archived flags of the channel.
+func (s *Session) ChannelEditComplex(channelID string, data *discord.ChannelEdit, options ...discord.RequestOption) (*discord.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("ChannelEditComplex"); err != nil {
+		return nil, err
+	}
+	ch, ok := s.channels[channelID]
+	if !ok {
+		return nil, notFound(discord.ErrCodeUnknownChannel, "Unknown Channel")
+	}
+	if data.Name != "" {
+		ch.Name = data.Name
+	}
+	if data.Topic != "" {
+		ch.Topic = data.Topic
+	}
+	if data.Locked != nil || data.Archived != nil {
+		if ch.ThreadMetadata == nil {
+			ch.ThreadMetadata = &discord.ThreadMetadata{}
+		}
+		if data.Locked != nil {
+			ch.ThreadMetadata.Locked = *data.Locked
+		}
+		if data.Archived != nil {
+			ch.ThreadMetadata.Archived = *data.Archived
+		}
+	}
+	return copyChannel(ch), nil
+}
+
+// ThreadMemberAdd adds the user to the thread.
+func (s *Session) ThreadMemberAdd(threadID string, memberID string, options ...discord.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("ThreadMemberAdd"); err != nil {
+		return err
+	}
+	s.members[threadID] = append(s.members[threadID], memberID)
+	return nil
+}
+
+// InteractionRespond records the response. Responses with a message, including deferred ones, become the
+// original response of the interaction, a deferred one is loading until it is edited or followed up.
+func (s *Session) InteractionRespond(i *discord.Interaction, resp *discord.InteractionResponse, options ...discord.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("InteractionRespond"); err != nil {
+		return err
+	}
+	s.responses[i.ID] = append(s.responses[i.ID], resp)
+
+	switch resp.Type {
+	case discord.InteractionResponseChannelMessageWithSource, discord.InteractionResponseDeferredChannelMessageWithSource:
+		m := s.newMessage(i.ChannelID, "", nil)
+		m.Interaction = &discord.MessageInteraction{ID: i.ID, Type: i.Type}
+		if resp.Data != nil {
+			m.Content = resp.Data.Content
+			m.Embeds = resp.Data.Embeds
+			m.Flags = resp.Data.Flags
+		}
+		if resp.Type == discord.InteractionResponseDeferredChannelMessageWithSource {
+			m.Flags |= discord.MessageFlagsLoading
+		}
+		s.originals[i.ID] = m
+		if m.Flags&discord.MessageFlagsEphemeral == 0 {
+			s.messages[i.ChannelID] = append(s.messages[i.ChannelID], m)
+		}
+	}
+	return nil
+}
+
+// InteractionResponse returns a copy of the original response message.
+func (s *Session) InteractionResponse(i *discord.Interaction, options ...discord.RequestOption) (*discord.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("InteractionResponse"); err != nil {
+		return nil, err
+	}
+	if m := s.originals[i.ID]; m != nil {
+		return copyMessage(m), nil
+	}
+	return nil, notFound(discord.ErrCodeUnknownMessage, "Unknown Message")
+}
+
+// InteractionResponseEdit edits the original response message.
+func (s *Session) InteractionResponseEdit(i *discord.Interaction, edit *discord.WebhookEdit, options ...discord.RequestOption) (*discord.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("InteractionResponseEdit"); err != nil {
+		return nil, err
+	}
+	m := s.originals[i.ID]
+	if m == nil {
+		return nil, notFound(discord.ErrCodeUnknownMessage, "Unknown Message")
+	}
+	s.applyWebhookEdit(m, edit)
+	return copyMessage(m), nil
+}
+
+// InteractionResponseDelete deletes the original response message, the next followup is a message of its own then.
+func (s *Session) InteractionResponseDelete(i *discord.Interaction, options ...discord.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("InteractionResponseDelete"); err != nil {
+		return err
+	}
+	m := s.originals[i.ID]
+	if m == nil {
+		return notFound(discord.ErrCodeUnknownMessage, "Unknown Message")
+	}
+	delete(s.originals, i.ID)
+	messages := s.messages[m.ChannelID]
+	for j, message := range messages {
+		if message == m {
+			s.messages[m.ChannelID] = append(messages[:j:j], messages[j+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// FollowupMessageCreate adds a followup message. The first followup of a deferred response replaces the
+// loading original response and keeps its visibility, like on Discord, which ignores the flags of that followup.
+func (s *Session) FollowupMessageCreate(i *discord.Interaction, wait bool, data *discord.WebhookParams, options ...discord.RequestOption) (*discord.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("FollowupMessageCreate"); err != nil {
+		return nil, err
+	}
+
+	var m *discord.Message
+	if original := s.originals[i.ID]; original != nil && original.Flags&discord.MessageFlagsLoading != 0 {
+		m = original
+		applyEdit(m, &data.Content, data.Embeds)
+		m.Flags &^= discord.MessageFlagsLoading
+	} else {
+		m = s.newMessage(i.ChannelID, data.Content, data.Embeds)
+		m.Flags = data.Flags
+		if m.Flags&discord.MessageFlagsEphemeral == 0 {
+			s.messages[i.ChannelID] = append(s.messages[i.ChannelID], m)
+		}
+	}
+	s.attachFiles(m, data.Files)
+	s.followups[i.ID] = append(s.followups[i.ID], m)
+	return copyMessage(m), nil
+}
+
+// FollowupMessageEdit edits a followup message.
+func (s *Session) FollowupMessageEdit(i *discord.Interaction, messageID string, edit *discord.WebhookEdit, options ...discord.RequestOption) (*discord.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failure("FollowupMessageEdit"); err != nil {
+		return nil, err
+	}
+	for _, m := range s.followups[i.ID] {
+		if m.ID == messageID {
+			s.applyWebhookEdit(m, edit)
+			return copyMessage(m), nil
+		}
+	}
+	return nil, notFound(discord.ErrCodeUnknownMessage, "Unknown Message")
+}
+
+// failure returns the error injected for the method. The caller holds the lock.
+func (s *Session) failure(method string) error {
+	return s.failures[method]
+}
+
+// newMessage creates a message of the bot. The caller holds the lock.
+func (s *Session) newMessage(channelID string, content string, embeds []*discord.MessageEmbed) *discord.Message {
+	m := &discord.Message{
+		ID:        s.newID(),
+		ChannelID: channelID,
+		Content:   content,
+		Embeds:    embeds,
+		Author:    s.User,
+		Timestamp: time.Now().UTC(),
+		Type:      discord.MessageTypeDefault,
+	}
+	if ch, ok := s.channels[channelID]; ok {
+		m.GuildID = ch.GuildID
+	}
+	return m
+}
+
+// channelMessage looks the message up in the channel. The caller holds the lock.
+func (s *Session) channelMessage(channelID string, messageID string) *discord.Message {
+	for _, m := range s.messages[channelID] {
+		if m.ID == messageID {
+			return m
+		}
+	}
+	return nil
+}
+
+// findMessage looks a message up by its ID in all the channels. The caller holds the lock.
+func (s *Session) findMessage(messageID string) *discord.Message {
+	for channelID := range s.messages {
+		if m := s.channelMessage(channelID, messageID); m != nil {
+			return copyMessage(m)
+		}
+	}
+	return nil
+}
+
+// applyEdit sets the content and embeds that are not nil and ends the loading state of a deferred response.
+func applyEdit(m *discord.Message, content *string, embeds []*discord.MessageEmbed) {
+	if content != nil {
+		m.Content = *content
+	}
+	if embeds != nil {
+		m.Embeds = embeds
+	}
+	m.Flags &^= discord.MessageFlagsLoading
+	now := time.Now().UTC()
+	m.EditedTimestamp = &now
+}
+
+// applyWebhookEdit applies an edit of an interaction response or followup. The caller holds the lock.
+func (s *Session) applyWebhookEdit(m *discord.Message, edit *discord.WebhookEdit) {
+	var embeds []*discord.MessageEmbed
+	if edit.Embeds != nil {
+		embeds = *edit.Embeds
+	}
+	applyEdit(m, edit.Content, embeds)
+	s.attachFiles(m, edit.Files)
+}
+
+// attachFiles keeps the files sent with the message and lists them as its attachments. The caller holds the lock.
+func (s *Session) attachFiles(m *discord.Message, files []*discord.File) {
+	for _, f := range files {
+		s.files[m.ID] = append(s.files[m.ID], f)
+		m.Attachments = append(m.Attachments, &discord.MessageAttachment{
+			ID:          s.newID(),
+			Filename:    f.Name,
+			ContentType: f.ContentType,
+		})
+	}
+}
+
+// notFound is the error the API returns for unknown messages and channels.
+func notFound(code int, message string) error {
+	return &discord.RESTError{
+		Response: &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found"},
+		Message:  &discord.APIErrorMessage{Code: code, Message: message},
+	}
+}
+
+func snowflake(id string) uint64 {
+	n, _ := strconv.ParseUint(id, 10, 64)
+	return n
+}
+
+func copyMessage(m *discord.Message) *discord.Message {
+	c := *m
+	c.Embeds = append([]*discord.MessageEmbed(nil), m.Embeds...)
+	c.Attachments = append([]*discord.MessageAttachment(nil), m.Attachments...)
+	return &c
+}
+
+func copyChannel(ch *discord.Channel) *discord.Channel {
+	c := *ch
+	if ch.ThreadMetadata != nil {
+		metadata := *ch.ThreadMetadata
+		c.ThreadMetadata = &metadata
+	}
+	return &c
+}
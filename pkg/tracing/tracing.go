@@ -0,0 +1,139 @@
+// Package tracing sets up the optional OpenTelemetry tracing of the bot. Every interaction and thread message
+// gets a root span, with child spans for the handlers, the Discord REST calls and the OpenAI requests, which
+// are exported to an OTLP/HTTP collector. Without a collector configured, all the spans are no-ops.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans of the bot
+const instrumentationName = "github.com/akhilsharma90/go-openai-bot-discord"
+
+// defaultServiceName is the service name the spans are exported with
+const defaultServiceName = "go-openai-bot-discord"
+
+// Config holds the tracing settings.
+type Config struct {
+	// Endpoint of the OTLP/HTTP collector, e.g. "localhost:4318". Tracing is disabled when empty.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends the spans over plain HTTP instead of HTTPS
+	Insecure bool `yaml:"insecure"`
+	// Headers are sent with every export request, e.g. the API key of a hosted collector
+	Headers map[string]string `yaml:"headers"`
+	// ServiceName the spans are exported with, go-openai-bot-discord by default
+	ServiceName string `yaml:"serviceName"`
+	// SampleRatio is the share of the interactions and messages that are traced, between 0 and 1
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// Validate checks the sample ratio.
+func (c Config) Validate() error {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("sampleRatio is %g, must be between 0 and 1", c.SampleRatio)
+	}
+	return nil
+}
+
+// Setup starts exporting the spans to the collector configured in cfg. The returned function flushes the
+// remaining spans and stops the exporter, it must be called on shutdown. If no endpoint is configured,
+// nothing is set up and the spans stay no-ops.
+func Setup(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Start starts a span as a child of the span in ctx, if there is one.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on the span, if it is not nil, and ends the span.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the trace the span in ctx belongs to, or an empty string if it is not traced.
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsSampled() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// Transport wraps the transport of the Discord REST client, adding a span for every request made with
+// a traced context (see discordgo.WithContext). Requests without a span in their context are not traced,
+// so background calls don't show up as traces of their own. A nil transport wraps http.DefaultTransport.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if !trace.SpanContextFromContext(req.Context()).IsValid() {
+			return next.RoundTrip(req)
+		}
+
+		ctx, span := Start(req.Context(), "discord "+req.Method,
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLPath(req.URL.Path),
+		)
+		resp, err := next.RoundTrip(req.WithContext(ctx))
+		if err == nil {
+			span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+			if resp.StatusCode >= http.StatusBadRequest {
+				span.SetStatus(codes.Error, resp.Status)
+			}
+		}
+		End(span, err)
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -1,43 +1,75 @@
 package utils
 
 import (
-	"log"
+	"log/slog"
+	"sync"
 
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/metrics"
+	"github.com/akhilsharma90/go-openai-bot-discord/pkg/session"
 	discord "github.com/bwmarrin/discordgo"
 )
 
+// lockedThreads holds the IDs of the threads locked by the bot, so they can be unlocked on shutdown
+var lockedThreads = struct {
+	sync.Mutex
+	ids map[string]struct{}
+}{ids: make(map[string]struct{})}
+
 // ToggleThreadLock locks or unlocks a Discord thread, based on the 'locked' parameter.
 // If the thread is already locked/unlocked, the function does nothing.
-// The function takes a discord.Session pointer, a string representing a channel ID, and a bool representing whether the thread should be locked or unlocked as arguments.
-// The function calls the ChannelEditComplex function on the session to edit the channel and set the Locked field to the locked parameter.
+// The function takes a session.ThreadManager, a string representing a channel ID, and a bool representing whether the thread should be locked or unlocked as arguments.
+// The function calls the ChannelEditComplex function on the thread manager to edit the channel and set the Locked field to the locked parameter.
 // If an error occurs during the editing process, the function logs an error message with the channel ID and the error.
-func ToggleDiscordThreadLock(s *discord.Session, channelID string, locked bool) {
+func ToggleDiscordThreadLock(s session.ThreadManager, channelID string, locked bool) {
 	_, err := s.ChannelEditComplex(channelID, &discord.ChannelEdit{
 		Locked: &locked,
 	})
 	if err != nil {
-		log.Printf("[CHID: %s] Failed to lock/unlock Thread with the error: %v\n", channelID, err)
+		slog.Error("Failed to lock/unlock thread", "thread_id", channelID, "locked", locked, "error", err)
+		metrics.ThreadLockFailed(locked)
+		return
+	}
+
+	lockedThreads.Lock()
+	defer lockedThreads.Unlock()
+	if locked {
+		lockedThreads.ids[channelID] = struct{}{}
+	} else {
+		delete(lockedThreads.ids, channelID)
+	}
+}
+
+// UnlockDiscordThreads unlocks all the threads that were locked by ToggleDiscordThreadLock and are still locked.
+// It is used on shutdown, so no thread stays locked forever when the bot stops in the middle of generating an answer.
+func UnlockDiscordThreads(s session.ThreadManager) {
+	lockedThreads.Lock()
+	ids := make([]string, 0, len(lockedThreads.ids))
+	for id := range lockedThreads.ids {
+		ids = append(ids, id)
+	}
+	lockedThreads.Unlock()
+
+	for _, id := range ids {
+		ToggleDiscordThreadLock(s, id, false)
 	}
 }
 
 // Sends a message to a specified Discord channel, either as a reply to another message if a message reference is provided or as a standalone message if the message reference is nil
-// The function takes a discord.Session pointer, a string representing a channel ID, a string representing the message content, and a *discord.MessageReference pointer representing
-// the message reference as arguments. If the message reference is not nil, the function calls the ChannelMessageSendReply function on the session to send the message as a reply to
-// the referenced message. If the message reference is nil, the function calls the ChannelMessageSend function on the session to send the message as a standalone message.
+// The function takes a session.MessageSender, a string representing a channel ID, a string representing the message content, and a *discord.MessageReference pointer representing
+// the message reference as arguments. The function calls the ChannelMessageSendComplex function on the sender, with the message reference set when the message is a reply,
+// so a nil message reference sends the message as a standalone message.
 // The function returns a *discord.Message pointer and an error.
-func DiscordChannelMessageSend(s *discord.Session, channelID string, content string, messageReference *discord.MessageReference) (m *discord.Message, err error) {
-	if messageReference != nil {
-		m, err = s.ChannelMessageSendReply(channelID, content, messageReference)
-	} else {
-		m, err = s.ChannelMessageSend(channelID, content)
-	}
-	return
+func DiscordChannelMessageSend(s session.MessageSender, channelID string, content string, messageReference *discord.MessageReference) (m *discord.Message, err error) {
+	return s.ChannelMessageSendComplex(channelID, &discord.MessageSend{
+		Content:   content,
+		Reference: messageReference,
+	})
 }
 
-//The DiscordChannelMessageEdit function is used to edit a message in a specified Discord channel. The function takes a discord.Session pointer, a string representing a message ID,
+//The DiscordChannelMessageEdit function is used to edit a message in a specified Discord channel. The function takes a session.MessageSender, a string representing a message ID,
 // a string representing a channel ID, a *string representing the message content, and a slice of *discord.MessageEmbed pointers representing the message embeds as arguments.
 
-func DiscordChannelMessageEdit(s *discord.Session, messageID string, channelID string, content *string, embeds []*discord.MessageEmbed) error {
+func DiscordChannelMessageEdit(s session.MessageSender, messageID string, channelID string, content *string, embeds []*discord.MessageEmbed) error {
 	_, err := s.ChannelMessageEditComplex( // The function calls the ChannelMessageEditComplex
 		&discord.MessageEdit{ // function on the session to edit the message
 			Content: content,   // and set the Content